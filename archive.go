@@ -0,0 +1,175 @@
+package boom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Type tags of archive entries. Tags are part of the archive format, so they
+// must not be changed or reused.
+const (
+	archiveBuckets     = 1
+	archiveBloom       = 2
+	archivePartitioned = 3
+	archiveScalable    = 4
+	archiveStable      = 5
+	archiveInverse     = 6
+	archiveCounting    = 7
+	archiveDeletable   = 8
+	archiveSparse      = 9
+)
+
+// WriteArchive writes the named filters to a single archive so they can be
+// stored in one file. Every entry holds the name, a tag identifying the type
+// of the filter, and the binary representation written by its WriteTo, so
+// entries are decoded independently and ReadArchive restores each filter with
+// its original type. Entries are written in name order. It returns an error
+// without writing anything if a filter's type isn't supported, i.e. it can't
+// be read back.
+func WriteArchive(w io.Writer, filters map[string]Serializable) error {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Every type is checked up front, so that an unsupported filter doesn't
+	// leave a truncated archive behind.
+	tags := make([]byte, len(names))
+	for i, name := range names {
+		tag, err := archiveTag(filters[name])
+		if err != nil {
+			return err
+		}
+		tags[i] = tag
+	}
+
+	e := newEncoder(w)
+	e.header()
+	e.uvarint(uint64(len(names)))
+
+	var buf bytes.Buffer
+	for i, name := range names {
+		f, tag := filters[name], tags[i]
+		buf.Reset()
+		if _, err := f.WriteTo(&buf); err != nil {
+			return err
+		}
+
+		e.uvarint(uint64(len(name)))
+		e.write([]byte(name))
+		e.byte(tag)
+		e.uvarint(uint64(buf.Len()))
+		e.write(buf.Bytes())
+	}
+	return e.err
+}
+
+// ReadArchive reads the named filters from an archive written by
+// WriteArchive. Each filter has the type it was written with, so callers can
+// use a type assertion or switch to recover it.
+func ReadArchive(r io.Reader) (map[string]Serializable, error) {
+	d, _, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, errors.New("invalid format header")
+	}
+
+	// Every entry takes at least 3 bytes.
+	n := d.length(3)
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	filters := make(map[string]Serializable)
+	for i := uint64(0); i < n; i++ {
+		name := string(d.bytes(d.length(1)))
+		tag := d.byte()
+		blob := d.bytes(d.length(1))
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		if _, ok := filters[name]; ok {
+			return nil, fmt.Errorf("duplicate archive entry %q", name)
+		}
+
+		f, err := newArchiveEntry(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		read, err := f.ReadFrom(bytes.NewReader(blob))
+		if err != nil {
+			return nil, fmt.Errorf("archive entry %q: %w", name, err)
+		}
+		if read != int64(len(blob)) {
+			return nil, fmt.Errorf("archive entry %q: trailing data", name)
+		}
+		filters[name] = f
+	}
+	return filters, nil
+}
+
+// archiveEntry is implemented by every type which can be read from an
+// archive.
+type archiveEntry interface {
+	Serializable
+	io.ReaderFrom
+}
+
+// archiveTag returns the type tag of the filter.
+func archiveTag(f Serializable) (byte, error) {
+	switch f.(type) {
+	case *Buckets:
+		return archiveBuckets, nil
+	case *BloomFilter:
+		return archiveBloom, nil
+	case *PartitionedBloomFilter:
+		return archivePartitioned, nil
+	case *ScalableBloomFilter:
+		return archiveScalable, nil
+	case *StableBloomFilter:
+		return archiveStable, nil
+	case *InverseBloomFilter:
+		return archiveInverse, nil
+	case *CountingBloomFilter:
+		return archiveCounting, nil
+	case *DeletableBloomFilter:
+		return archiveDeletable, nil
+	case *SparsePartitionedBloomFilter:
+		return archiveSparse, nil
+	}
+	return 0, fmt.Errorf("unsupported archive entry type %T", f)
+}
+
+// newArchiveEntry returns a new instance of the type with the given tag to
+// read an entry into.
+func newArchiveEntry(tag byte) (archiveEntry, error) {
+	switch tag {
+	case archiveBuckets:
+		return NewBuckets(1, 1), nil
+	case archiveBloom:
+		return NewBloomFilter(1, 0.5), nil
+	case archivePartitioned:
+		return NewPartitionedBloomFilter(1, 0.5), nil
+	case archiveScalable:
+		return NewScalableBloomFilter(1, 0.5, 0.8), nil
+	case archiveStable:
+		return NewDefaultStableBloomFilter(1, 0.5), nil
+	case archiveInverse:
+		return NewInverseBloomFilter(1), nil
+	case archiveCounting:
+		return NewDefaultCountingBloomFilter(1, 0.5), nil
+	case archiveDeletable:
+		return NewDeletableBloomFilter(1, 1, 0.5), nil
+	case archiveSparse:
+		return NewSparsePartitionedBloomFilter(1, 0.5), nil
+	}
+	return nil, fmt.Errorf("unknown archive entry type %d", tag)
+}
@@ -0,0 +1,116 @@
+package boom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that an archive of mixed filter types round trips with every filter
+// restored to its original type and members.
+func TestArchiveRoundTrip(t *testing.T) {
+	filters := map[string]Serializable{
+		"bloom":       NewBloomFilter(100, 0.01),
+		"partitioned": NewPartitionedBloomFilter(100, 0.01),
+		"scalable":    NewScalableBloomFilter(10, 0.01, 0.8),
+		"stable":      NewDefaultStableBloomFilter(10000, 0.01),
+		"inverse":     NewInverseBloomFilter(100),
+		"counting":    NewDefaultCountingBloomFilter(100, 0.01),
+		"deletable":   NewDeletableBloomFilter(100, 10, 0.01),
+		"sparse":      NewSparsePartitionedBloomFilter(100, 0.01),
+	}
+	for _, f := range filters {
+		for i := 0; i < 50; i++ {
+			f.(Filter).Add([]byte(strconv.Itoa(i)))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, filters); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := ReadArchive(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != len(filters) {
+		t.Errorf("Expected %d filters, got %d", len(filters), len(decoded))
+	}
+
+	for name, f := range filters {
+		d, ok := decoded[name]
+		if !ok {
+			t.Errorf("Expected %s to be in the archive", name)
+			continue
+		}
+
+		want, _ := archiveTag(f)
+		if tag, _ := archiveTag(d); tag != want {
+			t.Errorf("Expected %s to be a %T, got %T", name, f, d)
+		}
+
+		// Stable and Inverse Bloom Filters evict elements, so membership
+		// is compared to the original.
+		for i := 0; i < 100; i++ {
+			data := []byte(strconv.Itoa(i))
+			if d.(Filter).Test(data) != f.(Filter).Test(data) {
+				t.Errorf("Expected %d to have the same membership in %s", i, name)
+			}
+		}
+	}
+
+	if _, ok := decoded["scalable"].(*ScalableBloomFilter); !ok {
+		t.Errorf("Expected a ScalableBloomFilter, got %T", decoded["scalable"])
+	}
+}
+
+// Ensures that unsupported types and corrupted archives return errors.
+func TestArchiveErrors(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteArchive(&buf, map[string]Serializable{
+		"concurrent": NewConcurrentScalableBloomFilter(10, 0.01, 0.8),
+	})
+	if err == nil {
+		t.Error("Expected error")
+	}
+
+	// Nothing is written if any entry is unsupported, even one sorting after
+	// supported entries.
+	err = WriteArchive(&buf, map[string]Serializable{
+		"a": NewBloomFilter(100, 0.01),
+		"z": NewConcurrentScalableBloomFilter(10, 0.01, 0.8),
+	})
+	if err == nil {
+		t.Error("Expected error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing written, got %d bytes", buf.Len())
+	}
+
+	buf.Reset()
+	if err := WriteArchive(&buf, map[string]Serializable{
+		"bloom": NewBloomFilter(100, 0.01),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if _, err := ReadArchive(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("Expected error")
+	}
+
+	// Corrupt the type tag, which follows the entry count, name length and
+	// name.
+	corrupted := append([]byte(nil), data...)
+	corrupted[headerSize+2+len("bloom")] = 0xff
+	if _, err := ReadArchive(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected error")
+	}
+
+	empty, err := ReadArchive(bytes.NewReader(nil))
+	if err == nil {
+		t.Errorf("Expected error, got %v", empty)
+	}
+}
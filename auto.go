@@ -0,0 +1,97 @@
+package boom
+
+// AutoThreshold is the number of items below which NewAutoFilter stores the
+// items exactly instead of using a Bloom filter. A Go map costs roughly 50
+// bytes per short key, against about 10 bits per item for a Bloom filter at a
+// 1% false-positive rate, so the exact representation only pays off for tiny
+// sets, where its memory is negligible anyway and its lack of false positives
+// is a strict improvement.
+const AutoThreshold = 256
+
+// AutoFilter is a Filter which stores its items exactly in a map while there
+// are at most AutoThreshold of them, and therefore has no false positives, and
+// transparently switches to a Scalable Bloom Filter with the configured
+// false-positive rate once there are more.
+type AutoFilter struct {
+	set    map[string]struct{}  // items, while exact
+	filter *ScalableBloomFilter // filter, once there are too many items
+	fpRate float64              // target false-positive rate once inexact
+}
+
+// NewAutoFilter creates a Filter for n items with the specified target
+// false-positive rate. If n is below AutoThreshold, it returns an AutoFilter,
+// which has no false positives until more than AutoThreshold items are added.
+// Otherwise it returns a BloomFilter optimized for n items.
+func NewAutoFilter(n uint, fpRate float64) Filter {
+	if n >= AutoThreshold {
+		return NewBloomFilter(n, fpRate)
+	}
+	return &AutoFilter{set: make(map[string]struct{}, n), fpRate: fpRate}
+}
+
+// Exact returns true if the items are still stored exactly, meaning there are
+// no false positives.
+func (a *AutoFilter) Exact() bool {
+	return a.filter == nil
+}
+
+// Count returns the number of items added to the filter. While exact, this is
+// the number of distinct items.
+func (a *AutoFilter) Count() uint {
+	if a.filter != nil {
+		return a.filter.Count()
+	}
+	return uint(len(a.set))
+}
+
+// Test will test for membership of the data and returns true if it is a
+// member, false if not. While exact, there are no false positives.
+func (a *AutoFilter) Test(data []byte) bool {
+	if a.filter != nil {
+		return a.filter.Test(data)
+	}
+	_, ok := a.set[string(data)]
+	return ok
+}
+
+// Add will add the data to the filter, switching to a Scalable Bloom Filter if
+// there are now more than AutoThreshold items. It returns the filter to allow
+// for chaining.
+func (a *AutoFilter) Add(data []byte) Filter {
+	a.TestAndAdd(data)
+	return a
+}
+
+// TestAndAdd is equivalent to calling Test followed by Add. It returns true if
+// the data is a member, false if not.
+func (a *AutoFilter) TestAndAdd(data []byte) bool {
+	if a.filter != nil {
+		return a.filter.TestAndAdd(data)
+	}
+
+	if _, ok := a.set[string(data)]; ok {
+		return true
+	}
+	a.set[string(data)] = struct{}{}
+	if len(a.set) > AutoThreshold {
+		a.switchToFilter()
+	}
+	return false
+}
+
+// switchToFilter moves the items into a Scalable Bloom Filter.
+func (a *AutoFilter) switchToFilter() {
+	a.filter = NewScalableBloomFilter(2*AutoThreshold, a.fpRate, 0.8)
+	for data := range a.set {
+		a.filter.Add([]byte(data))
+	}
+	a.set = nil
+}
+
+// Reset restores the filter to its original, exact state. It returns the
+// filter to allow for chaining.
+func (a *AutoFilter) Reset() *AutoFilter {
+	a.set = make(map[string]struct{})
+	a.filter = nil
+	return a
+}
@@ -0,0 +1,81 @@
+package boom
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Ensures that NewAutoFilter returns an exact filter below the threshold and
+// a Bloom filter above it.
+func TestNewAutoFilter(t *testing.T) {
+	if _, ok := NewAutoFilter(AutoThreshold-1, 0.01).(*AutoFilter); !ok {
+		t.Error("Expected an AutoFilter")
+	}
+
+	if _, ok := NewAutoFilter(AutoThreshold, 0.01).(*BloomFilter); !ok {
+		t.Error("Expected a BloomFilter")
+	}
+}
+
+// Ensures that an AutoFilter has no false positives while exact and switches
+// to a Bloom filter, keeping its members, above the threshold.
+func TestAutoFilterSwitch(t *testing.T) {
+	f := NewAutoFilter(10, 0.5).(*AutoFilter)
+
+	// `a` isn't in the filter.
+	if f.TestAndAdd([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if f.Add([]byte(`b`)) != f {
+		t.Error("Returned AutoFilter should be the same instance")
+	}
+
+	if !f.TestAndAdd([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	for i := 0; i < AutoThreshold-2; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if !f.Exact() {
+		t.Error("Expected filter to be exact")
+	}
+
+	if count := f.Count(); count != AutoThreshold {
+		t.Errorf("Expected %d, got %d", AutoThreshold, count)
+	}
+
+	// Despite the high false-positive rate, there are no false positives.
+	for i := 0; i < 10000; i++ {
+		if f.Test([]byte("x" + strconv.Itoa(i))) {
+			t.Errorf("Expected x%d not to be a member", i)
+		}
+	}
+
+	f.Add([]byte(`c`))
+	if f.Exact() {
+		t.Error("Expected filter not to be exact")
+	}
+
+	for i := 0; i < AutoThreshold-2; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	for _, data := range []string{`a`, `b`, `c`} {
+		if !f.Test([]byte(data)) {
+			t.Errorf("Expected %s to be a member", data)
+		}
+	}
+
+	if f.Reset() != f {
+		t.Error("Returned AutoFilter should be the same instance")
+	}
+
+	if !f.Exact() || f.Test([]byte(`a`)) {
+		t.Error("Expected an empty exact filter")
+	}
+}
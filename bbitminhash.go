@@ -0,0 +1,143 @@
+package boom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// BBitMinHash estimates the Jaccard similarity of sets using b-bit minwise
+// hashing as described by Li and König in b-Bit Minwise Hashing:
+//
+// https://arxiv.org/abs/0910.3349
+//
+// Each set is reduced to a signature of k minimum hash values like MinHash,
+// but only the lowest b bits of each are kept, which shrinks a signature of
+// 64-bit values by a factor of 64/b. This is useful for storing signatures of
+// many sets. Two b-bit values also match by chance with probability 2^-b when
+// the full values differ, so the similarity estimate is corrected for these
+// collisions. This assumes the sets are small relative to the hash space,
+// which holds for 64-bit hashes. Smaller b needs a larger k for the same
+// accuracy, but b = 1 still takes far less space for a given accuracy than
+// keeping full values. Signatures are only comparable if they were computed
+// with the same parameters.
+type BBitMinHash struct {
+	k    int    // number of minimum hash values in a signature
+	b    uint   // number of bits kept of each value
+	seed uint64 // seed the hash functions are derived from
+}
+
+// BBitSignature is the signature of a set computed by BBitMinHash.
+type BBitSignature struct {
+	k    int      // number of values
+	b    uint     // bits per value
+	bits []uint64 // packed values, nil for an empty set
+}
+
+// NewBBitMinHash creates a new BBitMinHash which computes signatures of k
+// minimum hash values, keeping the lowest b bits of each, with hash functions
+// derived from the given seed. b is limited to between 1 and 64, where 64
+// keeps the full values.
+func NewBBitMinHash(k int, b uint, seed uint64) *BBitMinHash {
+	if b < 1 {
+		b = 1
+	}
+	if b > 64 {
+		b = 64
+	}
+	return &BBitMinHash{k: k, b: b, seed: seed}
+}
+
+// Signature returns the signature of the set of elements. Duplicate elements
+// don't affect it.
+func (m *BBitMinHash) Signature(set []string) BBitSignature {
+	signature := BBitSignature{k: m.k, b: m.b}
+	if len(set) == 0 {
+		return signature
+	}
+
+	mins := make([]uint64, m.k)
+	for i := range mins {
+		mins[i] = math.MaxUint64
+	}
+	for _, element := range set {
+		h := fnv.New64a()
+		h.Write([]byte(element))
+		base := mix64(h.Sum64() ^ m.seed)
+		for i := range mins {
+			if v := mix64(base + generationSeed(i+1)); v < mins[i] {
+				mins[i] = v
+			}
+		}
+	}
+
+	signature.bits = make([]uint64, (uint(m.k)*m.b+63)/64)
+	for i, v := range mins {
+		signature.set(i, v)
+	}
+	return signature
+}
+
+// Size returns the size of the signature's values in bytes.
+func (s BBitSignature) Size() int {
+	return len(s.bits) * 8
+}
+
+// Similarity returns the estimated Jaccard similarity of the sets the
+// signatures were computed from, between 0 and 1, corrected for values which
+// match by chance. It returns 0 if either set is empty or the signatures were
+// computed with different parameters.
+func (s BBitSignature) Similarity(other BBitSignature) float64 {
+	if s.bits == nil || other.bits == nil || s.k != other.k || s.b != other.b {
+		return 0
+	}
+
+	matches := 0
+	for i := 0; i < s.k; i++ {
+		if s.get(i) == other.get(i) {
+			matches++
+		}
+	}
+
+	var (
+		p      = float64(matches) / float64(s.k)
+		chance = math.Pow(2, -float64(s.b))
+		r      = (p - chance) / (1 - chance)
+	)
+	return math.Max(0, math.Min(1, r))
+}
+
+// mask returns the mask of the lowest b bits.
+func (s BBitSignature) mask() uint64 {
+	if s.b == 64 {
+		return math.MaxUint64
+	}
+	return 1<<s.b - 1
+}
+
+// set stores the lowest b bits of v as the value at index i.
+func (s BBitSignature) set(i int, v uint64) {
+	var (
+		pos    = uint(i) * s.b
+		word   = pos / 64
+		offset = pos % 64
+	)
+	v &= s.mask()
+	s.bits[word] |= v << offset
+	if offset+s.b > 64 {
+		s.bits[word+1] |= v >> (64 - offset)
+	}
+}
+
+// get returns the value at index i.
+func (s BBitSignature) get(i int) uint64 {
+	var (
+		pos    = uint(i) * s.b
+		word   = pos / 64
+		offset = pos % 64
+		v      = s.bits[word] >> offset
+	)
+	if offset+s.b > 64 {
+		v |= s.bits[word+1] << (64 - offset)
+	}
+	return v & s.mask()
+}
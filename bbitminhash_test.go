@@ -0,0 +1,90 @@
+package boom
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// Ensures that the corrected b-bit similarity tracks the estimate from full
+// 64-bit values and the exact similarity, while shrinking the signature.
+func TestBBitMinHash(t *testing.T) {
+	var set1, set2 []string
+	for i := 0; i < 1000; i++ {
+		set1 = append(set1, strconv.Itoa(i))
+	}
+	for i := 500; i < 1500; i++ {
+		set2 = append(set2, strconv.Itoa(i))
+	}
+
+	// The exact similarity is 500/1500.
+	var (
+		full     = NewBBitMinHash(2048, 64, 1)
+		fullSim  = full.Signature(set1).Similarity(full.Signature(set2))
+		fullSize = full.Signature(set1).Size()
+	)
+	if math.Abs(fullSim-1.0/3) > 0.05 {
+		t.Errorf("Expected about 0.333, got %f", fullSim)
+	}
+
+	for _, b := range []uint{1, 2, 3, 4, 8} {
+		var (
+			m    = NewBBitMinHash(2048, b, 1)
+			sig1 = m.Signature(set1)
+			sig2 = m.Signature(set2)
+		)
+		if s := sig1.Similarity(sig1); s != 1 {
+			t.Errorf("Expected 1 for b=%d, got %f", b, s)
+		}
+
+		if s := sig1.Similarity(sig2); math.Abs(s-fullSim) > 0.08 {
+			t.Errorf("Expected about %f for b=%d, got %f", fullSim, b, s)
+		}
+
+		if size := sig1.Size(); size != fullSize*int(b)/64 {
+			t.Errorf("Expected %d bytes for b=%d, got %d", fullSize*int(b)/64, b, size)
+		}
+	}
+
+	// Values are the lowest bits of the full values.
+	var (
+		m    = NewBBitMinHash(100, 3, 1)
+		sig  = m.Signature(set1)
+		base = full.Signature(set1)
+	)
+	for i := 0; i < 100; i++ {
+		if sig.get(i) != base.get(i)&7 {
+			t.Errorf("Expected %d at %d, got %d", base.get(i)&7, i, sig.get(i))
+		}
+	}
+
+	var disjoint []string
+	for i := 2000; i < 3000; i++ {
+		disjoint = append(disjoint, strconv.Itoa(i))
+	}
+	if s := full.Signature(set1).Similarity(full.Signature(disjoint)); s != 0 {
+		t.Errorf("Expected 0, got %f", s)
+	}
+
+	if s := full.Signature(set1).Similarity(full.Signature(nil)); s != 0 {
+		t.Errorf("Expected 0, got %f", s)
+	}
+
+	if s := full.Signature(set1).Similarity(m.Signature(set1)); s != 0 {
+		t.Errorf("Expected 0, got %f", s)
+	}
+}
+
+func BenchmarkBBitMinHashSignature(b *testing.B) {
+	b.StopTimer()
+	m := NewBBitMinHash(128, 1, 1)
+	set := make([]string, 500)
+	for i := range set {
+		set[i] = strconv.Itoa(i)
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		m.Signature(set)
+	}
+}
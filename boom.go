@@ -37,13 +37,32 @@ into a bag of words.
 package boom
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash"
+	"io"
 	"math"
 )
 
 const fillRatio = 0.5
 
+// MaxDecodeSize is the maximum number of bytes ReadFrom will allocate for any
+// single length declared in a binary representation, and for all of the data
+// of a structure in the compact format together, since sparse data takes far
+// less space in the stream than in memory. Larger lengths are rejected with an
+// error instead of being allocated, which protects against corrupt or
+// malicious input. Raise it to load larger structures.
+var MaxDecodeSize uint64 = 1 << 30
+
+const (
+	// decodeChunkSize is the length above which readBytes reads in chunks.
+	decodeChunkSize = 1 << 20
+
+	// ptrSize is the size of a pointer in bytes.
+	ptrSize = 4 << (^uintptr(0) >> 63)
+)
+
 // Filter is a probabilistic data structure which is used to test the
 // membership of an element in a set.
 type Filter interface {
@@ -60,6 +79,62 @@ type Filter interface {
 	TestAndAdd([]byte) bool
 }
 
+// Countable is a probabilistic data structure which tracks the number of items
+// added to it.
+type Countable interface {
+	// Count returns the number of items added.
+	Count() uint
+}
+
+// Compile-time assertions that the filters implement the common interfaces.
+var (
+	_ Filter = (*AutoFilter)(nil)
+	_ Filter = (*BloomFilter)(nil)
+	_ Filter = (*ConcurrentScalableBloomFilter)(nil)
+	_ Filter = (*CountingBloomFilter)(nil)
+	_ Filter = (*DeletableBloomFilter)(nil)
+	_ Filter = (*InverseBloomFilter)(nil)
+	_ Filter = (*PartitionedBloomFilter)(nil)
+	_ Filter = (*ScalableBloomFilter)(nil)
+	_ Filter = (*SparsePartitionedBloomFilter)(nil)
+	_ Filter = (*StableBloomFilter)(nil)
+
+	_ Countable = (*AutoFilter)(nil)
+	_ Countable = (*BloomFilter)(nil)
+	_ Countable = (*ConcurrentScalableBloomFilter)(nil)
+	_ Countable = (*CountingBloomFilter)(nil)
+	_ Countable = (*CuckooFilter)(nil)
+	_ Countable = (*DeletableBloomFilter)(nil)
+	_ Countable = (*PartitionedBloomFilter)(nil)
+	_ Countable = (*ScalableBloomFilter)(nil)
+	_ Countable = (*SparsePartitionedBloomFilter)(nil)
+
+	_ ReadOnlyFilter = (*BloomFilter)(nil)
+	_ ReadOnlyFilter = (*PartitionedBloomFilter)(nil)
+	_ ReadOnlyFilter = (*ReadOnlyView)(nil)
+	_ ReadOnlyFilter = (*ScalableBloomFilter)(nil)
+
+	_ Serializable = (*BloomFilter)(nil)
+	_ Serializable = (*ConcurrentScalableBloomFilter)(nil)
+	_ Serializable = (*CountMinSketch)(nil)
+	_ Serializable = (*CountingBloomFilter)(nil)
+	_ Serializable = (*DeletableBloomFilter)(nil)
+	_ Serializable = (*InverseBloomFilter)(nil)
+	_ Serializable = (*PartitionedBloomFilter)(nil)
+	_ Serializable = (*ScalableBloomFilter)(nil)
+	_ Serializable = (*SparsePartitionedBloomFilter)(nil)
+	_ Serializable = (*StableBloomFilter)(nil)
+)
+
+// HashConsumer is a probabilistic data structure which can be updated with
+// precomputed base hashes, so that a FilterSet can hash each element once for
+// several structures.
+type HashConsumer interface {
+	// AddWithHashes adds the element with the given base hashes, which are
+	// the lower and upper 32-bit halves of its 64-bit hash.
+	AddWithHashes(h1, h2 uint64)
+}
+
 // OptimalM calculates the optimal Bloom filter size, m, based on the number of
 // items and the desired rate of false positives.
 func OptimalM(n uint, fpRate float64) uint {
@@ -67,6 +142,41 @@ func OptimalM(n uint, fpRate float64) uint {
 		math.Log(1-fillRatio)) / math.Abs(math.Log(fpRate)))))
 }
 
+// BitsForCount returns the number of bits a Bloom filter needs to hold n items
+// at the desired rate of false positives. It's the same as OptimalM and
+// matches the sizing used by the constructors.
+func BitsForCount(n uint, fpRate float64) uint {
+	return OptimalM(n, fpRate)
+}
+
+// CountForBits returns the largest number of items a Bloom filter with the
+// given number of bits can hold at the desired rate of false positives. It's
+// the inverse of BitsForCount, so BitsForCount(CountForBits(bits, fpRate),
+// fpRate) never exceeds bits. It returns 0 if the rate isn't between 0 and 1
+// exclusive.
+func CountForBits(bits uint, fpRate float64) uint {
+	if !(fpRate > 0 && fpRate < 1) {
+		return 0
+	}
+
+	estimate := float64(bits) * (math.Log(fillRatio) * math.Log(1-fillRatio)) /
+		math.Abs(math.Log(fpRate))
+	n := ^uint(0)
+	if estimate < float64(n) {
+		n = uint(estimate)
+	}
+
+	// Correct for floating-point rounding in either direction, which is off
+	// by at most a few items.
+	for n > 0 && OptimalM(n, fpRate) > bits {
+		n--
+	}
+	for i := 0; i < 64 && n < ^uint(0) && OptimalM(n+1, fpRate) <= bits; i++ {
+		n++
+	}
+	return n
+}
+
 // OptimalK calculates the optimal number of hash functions to use for a Bloom
 // filter based on the desired rate of false positives.
 func OptimalK(fpRate float64) uint {
@@ -81,3 +191,127 @@ func hashKernel(data []byte, hash hash.Hash64) (uint32, uint32) {
 	hash.Reset()
 	return binary.BigEndian.Uint32(sum[4:8]), binary.BigEndian.Uint32(sum[0:4])
 }
+
+// Hash128 returns a base hash function for SetHashFunc which splits the sum of
+// a hash function of at least 128 bits, such as FNV-1 128-bit, into two
+// independent 64-bit halves. By default, the base hashes are the 32-bit
+// halves of a 64-bit hash, so the indices they derive can't address more than
+// about 2^32 bits per hash function without bias. This matters for filters
+// with partitions or arrays near or above 2^32 bits, i.e. around half a
+// billion items or more; for smaller filters a 64-bit hash is cheaper and just
+// as good. Each half is finalized with mix64, since simple hashes such as FNV
+// don't spread short inputs over their high bits. The hash function is
+// stateful, so the returned function isn't safe for concurrent use. It panics
+// if h produces fewer than 16 bytes.
+func Hash128(h hash.Hash) func([]byte) (uint64, uint64) {
+	if h.Size() < 16 {
+		panic("boom: Hash128 requires a hash of at least 128 bits")
+	}
+
+	sum := make([]byte, 0, h.Size())
+	return func(data []byte) (uint64, uint64) {
+		h.Write(data)
+		sum = h.Sum(sum[:0])
+		h.Reset()
+		return mix64(binary.BigEndian.Uint64(sum[8:16])), mix64(binary.BigEndian.Uint64(sum[0:8]))
+	}
+}
+
+// HashScratch holds a hash function and a digest buffer which are reused across
+// calls to TestInto, so that testing doesn't allocate. Callers allocate one
+// with NewHashScratch and reuse it for as many calls as they like. A
+// HashScratch is stateful, so it must not be shared by goroutines which may
+// use it at the same time; give each goroutine its own.
+type HashScratch struct {
+	hash hash.Hash64 // hash function
+	sum  []byte      // digest buffer
+}
+
+// NewHashScratch creates a new HashScratch using the given hash function. For
+// TestInto to be consistent with Test, it must be a separate instance of the
+// same hash function the filter uses, which is FNV-1 64-bit unless SetHash was
+// called.
+func NewHashScratch(h hash.Hash64) *HashScratch {
+	return &HashScratch{hash: h, sum: make([]byte, 0, h.Size())}
+}
+
+// hashKernel is like the hashKernel function but writes the digest to the
+// scratch buffer instead of allocating it.
+func (s *HashScratch) hashKernel(data []byte) (uint32, uint32) {
+	s.hash.Write(data)
+	s.sum = s.hash.Sum(s.sum[:0])
+	s.hash.Reset()
+	return binary.BigEndian.Uint32(s.sum[4:8]), binary.BigEndian.Uint32(s.sum[0:4])
+}
+
+// Prehashed holds the hashes of an element computed by Prehash, so that an
+// element can be hashed in one stage of a pipeline and added or tested in
+// another, or hashed once and tested against several filters which use the
+// same hash function. The hashing scheme is opaque and versioned: a Prehashed
+// must come from Prehash, and the zero value isn't valid.
+type Prehashed struct {
+	lower, upper uint64 // base hashes
+	scheme       uint8  // hashing scheme, 0 if not created by Prehash
+}
+
+// prehashScheme is the hashing scheme of the Prehashed values created by this
+// version of the package: the two base hashes the filters derive partition
+// indices from.
+const prehashScheme = 1
+
+// newPrehashed returns a Prehashed holding the given base hashes.
+func newPrehashed(lower, upper uint64) Prehashed {
+	return Prehashed{lower: lower, upper: upper, scheme: prehashScheme}
+}
+
+// hashes returns the base hashes. It panics if the Prehashed wasn't created by
+// Prehash.
+func (p Prehashed) hashes() (uint64, uint64) {
+	if p.scheme != prehashScheme {
+		panic("boom: Prehashed wasn't created by Prehash")
+	}
+	return p.lower, p.upper
+}
+
+// mix64 is the 64-bit finalizer from MurmurHash3. It thoroughly mixes the bits
+// of the input so that related inputs produce unrelated outputs.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// checkDecodeSize returns an error if n elements of the given size in bytes
+// exceed MaxDecodeSize.
+func checkDecodeSize(n, size uint64) error {
+	if size != 0 && n > MaxDecodeSize/size {
+		return fmt.Errorf("declared length %d exceeds MaxDecodeSize", n)
+	}
+	return nil
+}
+
+// readBytes reads n bytes from the stream. Large lengths are read in chunks so
+// that a stream which is shorter than it claims fails before the declared
+// length is allocated.
+func readBytes(stream io.Reader, n uint64) ([]byte, error) {
+	if err := checkDecodeSize(n, 1); err != nil {
+		return nil, err
+	}
+
+	if n <= decodeChunkSize {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(stream, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, stream, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
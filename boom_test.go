@@ -0,0 +1,250 @@
+package boom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// readerFrom is implemented by every structure with a binary representation.
+type readerFrom interface {
+	WriteTo(io.Writer) (int64, error)
+	ReadFrom(io.Reader) (int64, error)
+}
+
+// decoders returns a new instance of every structure with a binary
+// representation, indexed by the kind used in FuzzReadFrom.
+func decoders() []readerFrom {
+	return []readerFrom{
+		NewBuckets(100, 4),
+		NewBloomFilter(100, 0.01),
+		NewPartitionedBloomFilter(100, 0.01),
+		NewScalableBloomFilter(10, 0.01, 0.8),
+		NewStableBloomFilter(100, 3, 0.01),
+		NewInverseBloomFilter(10),
+		NewDefaultCountingBloomFilter(100, 0.01),
+		NewDeletableBloomFilter(100, 10, 0.01),
+		NewSparsePartitionedBloomFilter(100, 0.01),
+		NewCountMinSketch(0.1, 0.1),
+	}
+}
+
+// Ensures that every filter behaves correctly through the Filter interface
+// and reports its count through the Countable interface.
+func TestFilterInterface(t *testing.T) {
+	filters := []Filter{
+		NewBloomFilter(100, 0.01),
+		NewConcurrentScalableBloomFilter(10, 0.01, 0.8),
+		NewDefaultCountingBloomFilter(100, 0.01),
+		NewDeletableBloomFilter(100, 10, 0.01),
+		NewInverseBloomFilter(100),
+		NewPartitionedBloomFilter(100, 0.01),
+		NewScalableBloomFilter(10, 0.01, 0.8),
+		NewSparsePartitionedBloomFilter(100, 0.01),
+		NewDefaultStableBloomFilter(1000, 0.01),
+	}
+
+	for _, f := range filters {
+		if f.Test([]byte(`a`)) {
+			t.Errorf("%T: `a` should not be a member", f)
+		}
+
+		if f.Add([]byte(`a`)) != f {
+			t.Errorf("%T: Returned filter should be the same instance", f)
+		}
+
+		if !f.Test([]byte(`a`)) {
+			t.Errorf("%T: `a` should be a member", f)
+		}
+
+		if f.TestAndAdd([]byte(`b`)) {
+			t.Errorf("%T: `b` should not be a member", f)
+		}
+
+		if !f.TestAndAdd([]byte(`b`)) {
+			t.Errorf("%T: `b` should be a member", f)
+		}
+
+		if c, ok := f.(Countable); ok && c.Count() != 3 {
+			t.Errorf("%T: Expected 3, got %d", f, c.Count())
+		}
+
+		if _, ok := f.(Serializable); !ok {
+			t.Errorf("%T: Expected filter to be serializable", f)
+		}
+	}
+}
+
+// Ensures that MayContain and DefinitelyNotContains follow the guarantee of
+// filters without false negatives: added data may be contained, and only
+// data which was never added is definitely not contained.
+func TestMayContain(t *testing.T) {
+	filters := []interface {
+		Filter
+		MayContain([]byte) bool
+		DefinitelyNotContains([]byte) bool
+	}{
+		NewBloomFilter(50, 0.3),
+		NewPartitionedBloomFilter(50, 0.3),
+		NewScalableBloomFilter(50, 0.3, 0.8),
+	}
+
+	for _, f := range filters {
+		for i := 0; i < 200; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+
+		for i := 0; i < 200; i++ {
+			data := []byte(strconv.Itoa(i))
+			if !f.MayContain(data) || f.DefinitelyNotContains(data) {
+				t.Errorf("%T: Expected %d to be possibly contained", f, i)
+			}
+		}
+
+		// Data which was never added can still be a false positive.
+		positives := 0
+		for i := 1000; i < 3000; i++ {
+			data := []byte(strconv.Itoa(i))
+			if f.MayContain(data) == f.DefinitelyNotContains(data) {
+				t.Errorf("%T: Expected DefinitelyNotContains to negate MayContain for %d", f, i)
+			}
+			if f.MayContain(data) != f.Test(data) {
+				t.Errorf("%T: Expected MayContain to match Test for %d", f, i)
+			}
+			if f.MayContain(data) {
+				positives++
+			}
+		}
+		if positives == 0 {
+			t.Errorf("%T: Expected false positives", f)
+		}
+	}
+}
+
+// Ensures that BitsForCount matches the constructors' sizing and that
+// CountForBits is its inverse.
+func TestBitsForCount(t *testing.T) {
+	if bits := BitsForCount(1000, 0.01); bits != NewBloomFilter(1000, 0.01).Capacity() {
+		t.Errorf("Expected %d, got %d", NewBloomFilter(1000, 0.01).Capacity(), bits)
+	}
+
+	for _, fpRate := range []float64{0.1, 0.01, 0.001} {
+		for _, bits := range []uint{0, 1, 100, 9586, 1 << 23} {
+			n := CountForBits(bits, fpRate)
+			if BitsForCount(n, fpRate) > bits {
+				t.Errorf("Expected at most %d bits for %d items, got %d", bits, n, BitsForCount(n, fpRate))
+			}
+			if BitsForCount(n+1, fpRate) <= bits {
+				t.Errorf("Expected %d items to need more than %d bits", n+1, bits)
+			}
+		}
+	}
+
+	if n := CountForBits(BitsForCount(1000, 0.01), 0.01); n != 1000 {
+		t.Errorf("Expected 1000, got %d", n)
+	}
+
+	// Rates out of range hold no items.
+	for _, fpRate := range []float64{0, 1, -0.1, 1.5, math.NaN()} {
+		if n := CountForBits(1000, fpRate); n != 0 {
+			t.Errorf("Expected 0 for %v, got %d", fpRate, n)
+		}
+	}
+}
+
+// Ensures that ReadFrom returns an error instead of allocating lengths which
+// exceed MaxDecodeSize.
+func TestReadFromMaxDecodeSize(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{1, 1})
+	binary.Write(&buf, binary.BigEndian, uint64(8))
+	binary.Write(&buf, binary.BigEndian, uint64(1<<62))
+	if _, err := NewBuckets(8, 1).ReadFrom(&buf); err == nil {
+		t.Error("Expected error")
+	}
+
+	buf.Reset()
+	for _, x := range []float64{0.8, 0.01, 0.5} {
+		binary.Write(&buf, binary.BigEndian, x)
+	}
+	for _, x := range []uint64{10, 1, 1 << 62} {
+		binary.Write(&buf, binary.BigEndian, x)
+	}
+	if _, err := NewScalableBloomFilter(10, 0.01, 0.8).ReadFrom(&buf); err == nil {
+		t.Error("Expected error")
+	}
+
+	// A declared length within MaxDecodeSize but beyond the end of the stream
+	// must fail as well.
+	buf.Reset()
+	buf.Write([]byte{1, 1})
+	binary.Write(&buf, binary.BigEndian, uint64(8<<24))
+	binary.Write(&buf, binary.BigEndian, uint64(1<<24))
+	if _, err := NewBuckets(8, 1).ReadFrom(&buf); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that MaxDecodeSize bounds the total data allocated for sparse
+// buckets, which take far less space in the stream than in memory.
+func TestReadFromMaxDecodeSizeSparse(t *testing.T) {
+	defer func(max uint64) { MaxDecodeSize = max }(MaxDecodeSize)
+
+	// Each empty partition of 1 MiB is encoded in a few bytes.
+	var buf bytes.Buffer
+	if _, err := NewPartitionedBloomFilterFixedMemory(8<<23, 8).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 200 {
+		t.Fatalf("Expected at most 200 bytes, got %d", buf.Len())
+	}
+
+	// Every partition fits, but not all of them together.
+	MaxDecodeSize = 4 << 20
+	if _, err := NewPartitionedBloomFilter(10, 0.1).ReadFrom(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("Expected error")
+	}
+
+	MaxDecodeSize = 8 << 20
+	if _, err := NewPartitionedBloomFilter(10, 0.1).ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Error(err)
+	}
+}
+
+func FuzzReadFrom(f *testing.F) {
+	for kind, d := range decoders() {
+		if filter, ok := d.(Filter); ok {
+			for i := 0; i < 20; i++ {
+				filter.Add([]byte(strconv.Itoa(i)))
+			}
+		}
+		var buf bytes.Buffer
+		if _, err := d.WriteTo(&buf); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(uint8(kind), buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte) {
+		defer func(max uint64) { MaxDecodeSize = max }(MaxDecodeSize)
+		MaxDecodeSize = 1 << 20
+
+		d := decoders()
+		decoded := d[int(kind)%len(d)]
+		if _, err := decoded.ReadFrom(bytes.NewReader(data)); err != nil {
+			return
+		}
+
+		// Whatever decodes successfully must be usable.
+		if filter, ok := decoded.(Filter); ok {
+			filter.Test([]byte("a"))
+			filter.Add([]byte("a"))
+			if !filter.Test([]byte("a")) {
+				t.Error("Expected a to be a member")
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+/*
+Package boomprom exports metrics of Boom Filters to Prometheus. It's a separate
+package so that the Prometheus client is only a dependency of programs which
+use it.
+*/
+package boomprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tylertreat/BoomFilters"
+)
+
+const subsystem = "scalable_bloom_filter"
+
+// collector is a prometheus.Collector which reads the metrics of a Scalable
+// Bloom Filter at scrape time.
+type collector struct {
+	filter   *boom.ScalableBloomFilter
+	capacity *prometheus.Desc
+	count    *prometheus.Desc
+	fill     *prometheus.Desc
+	filters  *prometheus.Desc
+	fpRate   *prometheus.Desc
+}
+
+// NewCollector returns a prometheus.Collector which exposes gauges for the
+// capacity, count, fill ratio, number of filters and estimated false-positive
+// rate of the Scalable Bloom Filter, with names in the given namespace. Values
+// are read from the filter whenever metrics are collected, and the fill ratio
+// and false-positive rate take time proportional to the filter size to
+// compute. Since a ScalableBloomFilter isn't safe for concurrent use, the
+// caller must ensure it isn't modified while metrics are being collected.
+func NewCollector(f *boom.ScalableBloomFilter, namespace string) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, nil, nil)
+	}
+
+	return &collector{
+		filter:   f,
+		capacity: desc("capacity", "Sum of the capacities of the filters in bits."),
+		count:    desc("count", "Estimated number of items added to the filter."),
+		fill:     desc("fill_ratio", "Average ratio of set bits across the filters."),
+		filters:  desc("filters", "Number of filters in the series."),
+		fpRate:   desc("estimated_false_positive_rate", "False-positive rate implied by the ratio of set bits."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.capacity
+	ch <- c.count
+	ch <- c.fill
+	ch <- c.filters
+	ch <- c.fpRate
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+
+	gauge(c.capacity, float64(c.filter.Capacity()))
+	gauge(c.count, float64(c.filter.Count()))
+	gauge(c.fill, c.filter.FillRatio())
+	gauge(c.filters, float64(len(c.filter.Filters())))
+	gauge(c.fpRate, c.filter.EstimatedFalsePositiveRate())
+}
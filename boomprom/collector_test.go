@@ -0,0 +1,72 @@
+package boomprom
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tylertreat/BoomFilters"
+)
+
+// collect returns the values of the gauges collected from c.
+func collect(t *testing.T, c prometheus.Collector) []float64 {
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+
+	var values []float64
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, m.GetGauge().GetValue())
+	}
+	return values
+}
+
+// Ensures that the collector describes every gauge and reads the filter's
+// values at collection time.
+func TestCollector(t *testing.T) {
+	f := boom.NewScalableBloomFilter(10, 0.01, 0.8)
+	c := NewCollector(f, "test")
+
+	descs := make(chan *prometheus.Desc, 10)
+	c.Describe(descs)
+	close(descs)
+	if n := len(descs); n != 5 {
+		t.Errorf("Expected 5 descriptions, got %d", n)
+	}
+
+	values := collect(t, c)
+	if len(values) != 5 {
+		t.Fatalf("Expected 5 metrics, got %d", len(values))
+	}
+
+	if values[1] != 0 || values[2] != 0 || values[3] != 1 || values[4] != 0 {
+		t.Errorf("Expected an empty filter, got %v", values)
+	}
+
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	values = collect(t, c)
+	expected := []float64{
+		float64(f.Capacity()),
+		float64(f.Count()),
+		f.FillRatio(),
+		float64(len(f.Filters())),
+		f.EstimatedFalsePositiveRate(),
+	}
+	for i, value := range values {
+		if value != expected[i] {
+			t.Errorf("Expected %f, got %f", expected[i], value)
+		}
+	}
+
+	if values[3] < 2 {
+		t.Errorf("Expected the filter to have grown, got %f filters", values[3])
+	}
+}
@@ -3,7 +3,11 @@ package boom
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
 )
 
 // Buckets is a fast, space-efficient array of buckets where each bucket can
@@ -75,6 +79,67 @@ func (b *Buckets) Reset() *Buckets {
 	return b
 }
 
+// popCount returns the number of set bits across all buckets. For 1-bit
+// buckets, this is the number of non-zero buckets. The data is counted a word
+// at a time, which is considerably faster than summing individual buckets for
+// large filters. Unused trailing bits are never set, so they don't affect the
+// result.
+func (b *Buckets) popCount() uint {
+	var (
+		count = 0
+		i     = 0
+	)
+	for ; i+8 <= len(b.data); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(b.data[i:]))
+	}
+	for ; i < len(b.data); i++ {
+		count += bits.OnesCount8(b.data[i])
+	}
+	return uint(count)
+}
+
+// unionPopCount returns the number of bits set in either these Buckets or the
+// other Buckets, which must have the same size.
+func (b *Buckets) unionPopCount(other *Buckets) uint {
+	var (
+		count = 0
+		i     = 0
+	)
+	for ; i+8 <= len(b.data); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(b.data[i:]) |
+			binary.LittleEndian.Uint64(other.data[i:]))
+	}
+	for ; i < len(b.data); i++ {
+		count += bits.OnesCount8(b.data[i] | other.data[i])
+	}
+	return uint(count)
+}
+
+// differencePopCount returns the number of bits set in these Buckets but not
+// in the other Buckets, which must have the same size.
+func (b *Buckets) differencePopCount(other *Buckets) uint {
+	var (
+		count = 0
+		i     = 0
+	)
+	for ; i+8 <= len(b.data); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(b.data[i:]) &^
+			binary.LittleEndian.Uint64(other.data[i:]))
+	}
+	for ; i < len(b.data); i++ {
+		count += bits.OnesCount8(b.data[i] &^ other.data[i])
+	}
+	return uint(count)
+}
+
+// union sets every bit which is set in the other Buckets, which must have the
+// same size.
+func (b *Buckets) union(other *Buckets) {
+	for i := range b.data {
+		b.data[i] |= other.data[i]
+	}
+}
+
 // getBits returns the bits at the specified offset and length.
 func (b *Buckets) getBits(offset, length uint) uint32 {
 	byteIndex := offset / 8
@@ -102,36 +167,218 @@ func (b *Buckets) setBits(offset, length, bits uint32) {
 	b.data[byteIndex] = byte(uint32(b.data[byteIndex]) | ((bits & bitMask) << byteOffset))
 }
 
+// clone returns a copy of the Buckets.
+func (b *Buckets) clone() *Buckets {
+	clone := *b
+	clone.data = make([]byte, len(b.data))
+	copy(clone.data, b.data)
+	return &clone
+}
+
+// bigEndian reports whether the native byte order is big endian, which
+// determines where a byte sits within a 32-bit word.
+var bigEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+// alignData moves the data into storage backed by 32-bit words, which is
+// required before using getBitAtomic and setBitAtomic. Go only guarantees byte
+// alignment for byte slices, and atomic operations need whole aligned words.
+func (b *Buckets) alignData() {
+	if len(b.data) == 0 {
+		return
+	}
+	words := make([]uint32, (len(b.data)+3)/4)
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), len(b.data))
+	copy(data, b.data)
+	b.data = data
+}
+
+// word returns the 32-bit word containing the bit at the specified offset and
+// the position of that bit within the word. The data must have been aligned
+// with alignData.
+func (b *Buckets) word(offset uint) (*uint32, uint) {
+	byteIndex := offset / 8
+	shift := (byteIndex%4)*8 + offset%8
+	if bigEndian {
+		shift = (3-byteIndex%4)*8 + offset%8
+	}
+	ptr := unsafe.Add(unsafe.Pointer(unsafe.SliceData(b.data)), byteIndex&^3)
+	return (*uint32)(ptr), shift
+}
+
+// getBitAtomic atomically returns the value of a 1-bit bucket. It's safe to
+// call concurrently with setBitAtomic.
+func (b *Buckets) getBitAtomic(bucket uint) bool {
+	word, shift := b.word(bucket)
+	return atomic.LoadUint32(word)&(1<<shift) != 0
+}
+
+// setBitAtomic atomically sets a 1-bit bucket. It's safe to call concurrently
+// with getBitAtomic and other calls to setBitAtomic.
+func (b *Buckets) setBitAtomic(bucket uint) {
+	word, shift := b.word(bucket)
+	for {
+		old := atomic.LoadUint32(word)
+		if old&(1<<shift) != 0 || atomic.CompareAndSwapUint32(word, old, old|1<<shift) {
+			return
+		}
+	}
+}
+
 // WriteTo writes a binary representation of Buckets to an i/o stream.
 // It returns the number of bytes written.
 func (b *Buckets) WriteTo(stream io.Writer) (int64, error) {
-	err := binary.Write(stream, binary.BigEndian, b.bucketSize)
-	if err != nil {
-		return 0, err
+	e := newEncoder(stream)
+	e.header()
+	b.encode(e)
+	return e.n, e.err
+}
+
+// encode writes the Buckets without a format header. The data is written
+// sparsely, as the gap from the previous non-zero byte and the value of every
+// non-zero byte, if that is smaller than writing it densely.
+func (b *Buckets) encode(e *encoder) {
+	e.byte(b.bucketSize)
+	e.byte(b.max)
+	e.uvarint(uint64(b.count))
+	e.uvarint(uint64(len(b.data)))
+
+	var (
+		sparseSize = 0
+		nonZero    = 0
+		prev       = -1
+	)
+	for i, x := range b.data {
+		if x != 0 {
+			sparseSize += uvarintSize(uint64(i-prev-1)) + 1
+			nonZero++
+			prev = i
+		}
 	}
-	err = binary.Write(stream, binary.BigEndian, b.max)
-	if err != nil {
-		return 0, err
+	sparseSize += uvarintSize(uint64(nonZero))
+
+	if sparseSize >= len(b.data) {
+		e.byte(denseBuckets)
+		e.write(b.data)
+		return
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(b.count))
-	if err != nil {
-		return 0, err
+
+	e.byte(sparseBuckets)
+	e.uvarint(uint64(nonZero))
+	prev = -1
+	for i, x := range b.data {
+		if x != 0 {
+			e.uvarint(uint64(i - prev - 1))
+			e.byte(x)
+			prev = i
+		}
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(len(b.data)))
+}
+
+// ReadFrom reads a binary representation of Buckets (such as might
+// have been written by WriteTo()) from an i/o stream. It returns the number
+// of bytes read. Both the compact format and the original fixed-width format
+// can be read.
+func (b *Buckets) ReadFrom(stream io.Reader) (int64, error) {
+	d, legacy, err := readHeader(stream)
 	if err != nil {
 		return 0, err
 	}
-	err = binary.Write(stream, binary.BigEndian, b.data)
-	if err != nil {
-		return 0, err
+	if d == nil {
+		return b.readLegacy(legacy)
 	}
-	return int64(len(b.data) + 2*binary.Size(uint8(0)) + 2*binary.Size(uint64(0))), err
+
+	b.decode(d)
+	return d.n, d.err
 }
 
-// ReadFrom reads a binary representation of Buckets (such as might
-// have been written by WriteTo()) from an i/o stream. It returns the number
-// of bytes read.
-func (b *Buckets) ReadFrom(stream io.Reader) (int64, error) {
+// decode reads Buckets written by encode. The Buckets are only modified if
+// decoding succeeds.
+func (b *Buckets) decode(d *decoder) {
+	var (
+		bucketSize = d.byte()
+		max        = d.byte()
+		count      = d.uvarint()
+		size       = d.length(1)
+		data       []byte
+	)
+	if d.err == nil {
+		d.err = checkBuckets(bucketSize, max, count, size)
+	}
+
+	switch mode := d.byte(); {
+	case d.err != nil:
+		return
+	case mode == denseBuckets:
+		data = d.bytes(size)
+	case mode == sparseBuckets:
+		nonZero := d.uvarint()
+		if nonZero > size {
+			d.err = errors.New("invalid sparse buckets")
+			return
+		}
+		// The non-zero bytes are read before the data is allocated, so a
+		// stream which is shorter than it claims fails first. Their number
+		// is bounded by the length of the stream rather than the size.
+		var (
+			indexes []uint64
+			values  []byte
+			i       = uint64(0)
+		)
+		for n := uint64(0); n < nonZero && d.err == nil; n++ {
+			i += d.uvarint()
+			if i >= size {
+				d.err = errors.New("invalid sparse buckets")
+				return
+			}
+			indexes = append(indexes, i)
+			values = append(values, d.byte())
+			i++
+		}
+
+		d.reserve(size)
+		if d.err != nil {
+			return
+		}
+		data = make([]byte, size)
+		for n, index := range indexes {
+			data[index] = values[n]
+		}
+	default:
+		d.err = errors.New("invalid buckets encoding")
+	}
+
+	if d.err != nil {
+		return
+	}
+	b.bucketSize = bucketSize
+	b.max = max
+	b.count = uint(count)
+	b.data = data
+}
+
+// checkBuckets returns an error if the bucket size, maximum bucket value,
+// number of buckets and data size in bytes declared by a binary representation
+// of Buckets aren't consistent with each other, as they are for Buckets created
+// by NewBuckets, since accessing inconsistent Buckets would panic.
+func checkBuckets(bucketSize, max uint8, count, size uint64) error {
+	if bucketSize < 1 || bucketSize > 8 {
+		return errors.New("bucket size must be between 1 and 8")
+	}
+	if uint(max) != 1<<bucketSize-1 {
+		return errors.New("maximum bucket value must match bucket size")
+	}
+	if count > uint64(^uint(0))/8 || (count*uint64(bucketSize)+7)/8 != size {
+		return errors.New("data size must match number of buckets")
+	}
+	return nil
+}
+
+// readLegacy reads the original fixed-width binary representation of Buckets
+// from an i/o stream. It returns the number of bytes read.
+func (b *Buckets) readLegacy(stream io.Reader) (int64, error) {
 	var bucketSize, max uint8
 	var count, len uint64
 	err := binary.Read(stream, binary.BigEndian, &bucketSize)
@@ -150,8 +397,10 @@ func (b *Buckets) ReadFrom(stream io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	data := make([]byte, len)
-	err = binary.Read(stream, binary.BigEndian, &data)
+	if err := checkBuckets(bucketSize, max, count, len); err != nil {
+		return 0, err
+	}
+	data, err := readBytes(stream, len)
 	if err != nil {
 		return 0, err
 	}
@@ -3,6 +3,8 @@ package boom
 import (
 	"bytes"
 	"encoding/gob"
+	"math/bits"
+	"math/rand"
 	"testing"
 
 	"github.com/d4l3k/messagediff"
@@ -102,6 +104,61 @@ func TestBucketsGob(t *testing.T) {
 	}
 }
 
+// Ensures that popCount returns the same number of set bits as counting each
+// bucket individually.
+func TestBucketsPopCount(t *testing.T) {
+	for _, size := range []uint8{1, 3, 8} {
+		for _, count := range []uint{0, 1, 7, 64, 65, 1000, 4099} {
+			b := NewBuckets(count, size)
+			for i := uint(0); i < count; i++ {
+				if rand.Intn(3) == 0 {
+					b.Set(i, uint8(rand.Intn(int(b.MaxBucketValue())+1)))
+				}
+			}
+
+			expected := uint(0)
+			for i := uint(0); i < count; i++ {
+				expected += uint(bits.OnesCount32(b.Get(i)))
+			}
+
+			if actual := b.popCount(); actual != expected {
+				t.Errorf("Expected %d set bits for %d %d-bit buckets, got %d",
+					expected, count, size, actual)
+			}
+		}
+	}
+}
+
+// Ensures that getBitAtomic and setBitAtomic are consistent with Get and Set
+// once the data is aligned.
+func TestBucketsAtomicBits(t *testing.T) {
+	b := NewBuckets(101, 1)
+	for i := uint(0); i < 101; i += 3 {
+		b.Set(i, 1)
+	}
+	b.alignData()
+
+	for i := uint(0); i < 101; i++ {
+		if b.getBitAtomic(i) != (b.Get(i) == 1) {
+			t.Errorf("Expected bucket %d to be %d", i, b.Get(i))
+		}
+	}
+
+	for i := uint(0); i < 101; i += 5 {
+		b.setBitAtomic(i)
+	}
+
+	for i := uint(0); i < 101; i++ {
+		expected := uint32(0)
+		if i%3 == 0 || i%5 == 0 {
+			expected = 1
+		}
+		if x := b.Get(i); x != expected {
+			t.Errorf("Expected %d for bucket %d, got %d", expected, i, x)
+		}
+	}
+}
+
 func BenchmarkBucketsIncrement(b *testing.B) {
 	buckets := NewBuckets(10000, 10)
 	for n := 0; n < b.N; n++ {
@@ -127,3 +184,34 @@ func BenchmarkBucketsGet(b *testing.B) {
 		buckets.Get(uint(n) % 10000)
 	}
 }
+
+func BenchmarkBucketsPopCount(b *testing.B) {
+	b.StopTimer()
+	buckets := NewBuckets(1<<25, 1)
+	for n := uint(0); n < buckets.Count(); n += 3 {
+		buckets.Set(n, 1)
+	}
+	b.SetBytes(int64(len(buckets.data)))
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		buckets.popCount()
+	}
+}
+
+func BenchmarkBucketsPopCountBytewise(b *testing.B) {
+	b.StopTimer()
+	buckets := NewBuckets(1<<25, 1)
+	for n := uint(0); n < buckets.Count(); n += 3 {
+		buckets.Set(n, 1)
+	}
+	b.SetBytes(int64(len(buckets.data)))
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		count := 0
+		for _, d := range buckets.data {
+			count += bits.OnesCount8(d)
+		}
+	}
+}
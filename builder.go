@@ -0,0 +1,46 @@
+package boom
+
+import "sync"
+
+// Builder constructs a Scalable Bloom Filter from many concurrent producers
+// without shared locking. Each producer adds to its own shard, a Scalable
+// Bloom Filter with the builder's parameters, and Build merges the shards into
+// the final filter by OR-ing their bits. Since every generation of the result
+// holds that generation's elements from every shard, the false-positive rate
+// of the result grows with the number of shards, as with UnionScalable.
+type Builder struct {
+	mu     sync.Mutex             // guards shards
+	hint   uint                   // size hint of each shard
+	fpRate float64                // target false-positive rate of each shard
+	r      float64                // tightening ratio of each shard
+	shards []*ScalableBloomFilter // shards handed out by Shard
+}
+
+// NewBuilder creates a new Builder whose shards are Scalable Bloom Filters with
+// the specified size hint, target false-positive rate and tightening ratio.
+func NewBuilder(hint uint, fpRate, r float64) *Builder {
+	return &Builder{hint: hint, fpRate: fpRate, r: r}
+}
+
+// Shard returns a new shard for a producer. A shard isn't safe for concurrent
+// use, so each producer goroutine should have its own. It's safe to call
+// concurrently.
+func (b *Builder) Shard() *ScalableBloomFilter {
+	shard := NewScalableBloomFilter(b.hint, b.fpRate, b.r)
+	b.mu.Lock()
+	b.shards = append(b.shards, shard)
+	b.mu.Unlock()
+	return shard
+}
+
+// Build merges the shards into a new Scalable Bloom Filter containing every
+// element added to them. It must only be called once every producer is done
+// with its shard, and the shards shouldn't be used afterwards.
+func (b *Builder) Build() (*ScalableBloomFilter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.shards) == 0 {
+		return NewScalableBloomFilter(b.hint, b.fpRate, b.r), nil
+	}
+	return UnionScalable(b.shards...)
+}
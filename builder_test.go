@@ -0,0 +1,99 @@
+package boom
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Ensures that Build merges the elements added concurrently to every shard.
+func TestBuilder(t *testing.T) {
+	var (
+		b  = NewBuilder(1000, 0.01, 0.8)
+		wg sync.WaitGroup
+	)
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			shard := b.Shard()
+			for i := p * 1000; i < (p+1)*1000; i++ {
+				shard.Add([]byte(strconv.Itoa(i)))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	f, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if count := f.Count(); count != 8000 {
+		t.Errorf("Expected 8000, got %d", count)
+	}
+}
+
+// Ensures that Build returns an empty filter if no shards were created.
+func TestBuilderEmpty(t *testing.T) {
+	f, err := NewBuilder(1000, 0.01, 0.8).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Count() != 0 || f.Test([]byte(`a`)) {
+		t.Error("Expected an empty filter")
+	}
+}
+
+func BenchmarkBuilderParallel(b *testing.B) {
+	b.StopTimer()
+	builder := NewBuilder(100000, 0.01, 0.8)
+	b.StartTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			shard = builder.Shard()
+			data  = make([]byte, 0, 20)
+			i     = 0
+		)
+		for pb.Next() {
+			data = strconv.AppendInt(data[:0], int64(i), 10)
+			shard.Add(data)
+			i++
+		}
+	})
+
+	if _, err := builder.Build(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkMutexScalableBloomParallel(b *testing.B) {
+	b.StopTimer()
+	var (
+		f  = NewScalableBloomFilter(100000, 0.01, 0.8)
+		mu sync.Mutex
+	)
+	b.StartTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			data = make([]byte, 0, 20)
+			i    = 0
+		)
+		for pb.Next() {
+			data = strconv.AppendInt(data[:0], int64(i), 10)
+			mu.Lock()
+			f.Add(data)
+			mu.Unlock()
+			i++
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package boom
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Serializable is a structure with a binary representation which can be
+// written to a stream.
+type Serializable interface {
+	io.WriterTo
+}
+
+// StartPeriodicCheckpoint starts a goroutine which writes the binary
+// representation of f to the file at path every interval, so that a crashed
+// process can recover a filter which is at most one interval stale. The file
+// is replaced atomically by writing a temporary file in the same directory and
+// renaming it, so it always holds a complete checkpoint. A checkpoint is
+// skipped if the previous one is still being written.
+//
+// The returned stop function stops the goroutine, waits for a checkpoint in
+// progress, and writes a final checkpoint before it returns. It must be called
+// once. Since f is written from another goroutine, its WriteTo must be safe to
+// call concurrently with the program's use of it, as is the case for a
+// ConcurrentScalableBloomFilter. A checkpoint which fails leaves the previous
+// checkpoint in place, and periodic ones are retried at the next interval. Use
+// StartPeriodicCheckpointWithErrorHandler to find out about failures.
+func StartPeriodicCheckpoint(f Serializable, path string, interval time.Duration) (stop func()) {
+	return StartPeriodicCheckpointWithErrorHandler(f, path, interval, nil)
+}
+
+// StartPeriodicCheckpointWithErrorHandler is like StartPeriodicCheckpoint but
+// calls onError with the error of every checkpoint which fails, including the
+// final one, which is reported before stop returns. onError is called from
+// the checkpointing goroutine, or from stop for the final checkpoint, and
+// never concurrently with itself. A nil onError ignores failures.
+func StartPeriodicCheckpointWithErrorHandler(f Serializable, path string, interval time.Duration, onError func(error)) (stop func()) {
+	var (
+		ticker  = time.NewTicker(interval)
+		done    = make(chan struct{})
+		wg      sync.WaitGroup
+		running atomic.Bool
+	)
+
+	write := func() {
+		if err := writeCheckpoint(f, path); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+
+	checkpoint := func() {
+		defer wg.Done()
+		defer running.Store(false)
+		write()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				if running.CompareAndSwap(false, true) {
+					wg.Add(1)
+					go checkpoint()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		wg.Wait()
+		write()
+	}
+}
+
+// writeCheckpoint atomically replaces the file at path with the binary
+// representation of f.
+func writeCheckpoint(f Serializable, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if _, err := f.WriteTo(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
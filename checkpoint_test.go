@@ -0,0 +1,142 @@
+package boom
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowWriter is a Serializable which blocks in WriteTo and tracks the number
+// of concurrent calls.
+type slowWriter struct {
+	active, maxActive, calls int32
+}
+
+func (s *slowWriter) WriteTo(stream io.Writer) (int64, error) {
+	n := atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+	atomic.AddInt32(&s.calls, 1)
+	for {
+		max := atomic.LoadInt32(&s.maxActive)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxActive, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return 0, nil
+}
+
+// Ensures that checkpoints are written periodically and on stop, and that the
+// checkpoint can be read back.
+func TestStartPeriodicCheckpoint(t *testing.T) {
+	var (
+		f    = NewConcurrentScalableBloomFilter(10, 0.01, 0.8)
+		path = filepath.Join(t.TempDir(), "filter.bin")
+		stop = StartPeriodicCheckpoint(f, path, time.Millisecond)
+	)
+
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a checkpoint")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	f.Add([]byte(`a`))
+	stop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := NewScalableBloomFilter(10, 0.01, 0.8)
+	if _, err := decoded.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The final checkpoint includes everything added before stop.
+	for i := 0; i < 100; i++ {
+		if !decoded.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if !decoded.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	// Temporary files are cleaned up.
+	matches, err := filepath.Glob(path + ".tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("Expected no temporary files, got %v", matches)
+	}
+}
+
+// Ensures that failed checkpoints, including the final one, are reported to
+// the error handler.
+func TestStartPeriodicCheckpointError(t *testing.T) {
+	var (
+		path     = filepath.Join(t.TempDir(), "missing", "filter.bin")
+		failures int32
+		stop     = StartPeriodicCheckpointWithErrorHandler(&slowWriter{}, path, time.Millisecond, func(err error) {
+			if err == nil {
+				t.Error("Expected error")
+			}
+			atomic.AddInt32(&failures, 1)
+		})
+	)
+
+	time.Sleep(10 * time.Millisecond)
+	periodic := atomic.LoadInt32(&failures)
+	stop()
+
+	if n := atomic.LoadInt32(&failures); n <= periodic {
+		t.Errorf("Expected more than %d failures, got %d", periodic, n)
+	}
+
+	// Without an error handler, failures are ignored.
+	StartPeriodicCheckpoint(&slowWriter{}, path, time.Millisecond)()
+}
+
+// Ensures that a checkpoint is skipped while the previous one is still
+// running.
+func TestStartPeriodicCheckpointOverlap(t *testing.T) {
+	var (
+		w    = &slowWriter{}
+		path = filepath.Join(t.TempDir(), "filter.bin")
+		stop = StartPeriodicCheckpoint(w, path, time.Millisecond)
+	)
+
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	if max := atomic.LoadInt32(&w.maxActive); max != 1 {
+		t.Errorf("Expected 1 concurrent checkpoint, got %d", max)
+	}
+
+	// Far fewer checkpoints than ticks are written, plus the final one.
+	if calls := atomic.LoadInt32(&w.calls); calls < 2 || calls > 10 {
+		t.Errorf("Expected between 2 and 10 checkpoints, got %d", calls)
+	}
+
+	if active := atomic.LoadInt32(&w.active); active != 0 {
+		t.Errorf("Expected no checkpoint after stop, got %d", active)
+	}
+}
@@ -3,6 +3,7 @@ package boom
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"hash"
 	"hash/fnv"
 	"io"
@@ -53,11 +54,13 @@ func (b *BloomFilter) EstimatedFillRatio() float64 {
 
 // FillRatio returns the ratio of set bits.
 func (b *BloomFilter) FillRatio() float64 {
-	sum := uint32(0)
-	for i := uint(0); i < b.buckets.Count(); i++ {
-		sum += b.buckets.Get(i)
-	}
-	return float64(sum) / float64(b.m)
+	return float64(b.buckets.popCount()) / float64(b.m)
+}
+
+// ReadOnly returns a view of the Bloom filter which can't be used to modify
+// it.
+func (b *BloomFilter) ReadOnly() ReadOnlyFilter {
+	return &ReadOnlyView{filter: b}
 }
 
 // Test will test for membership of the data and returns true if it is a
@@ -77,6 +80,18 @@ func (b *BloomFilter) Test(data []byte) bool {
 	return true
 }
 
+// MayContain is equivalent to Test, named for its guarantee: true means the
+// data may have been added, since it can be a false positive.
+func (b *BloomFilter) MayContain(data []byte) bool {
+	return b.Test(data)
+}
+
+// DefinitelyNotContains is the negation of Test. Since there are no false
+// negatives, true means the data was definitely never added.
+func (b *BloomFilter) DefinitelyNotContains(data []byte) bool {
+	return !b.Test(data)
+}
+
 // Add will add the data to the Bloom filter. It returns the filter to allow
 // for chaining.
 func (b *BloomFilter) Add(data []byte) Filter {
@@ -91,6 +106,51 @@ func (b *BloomFilter) Add(data []byte) Filter {
 	return b
 }
 
+// AddWithHashes adds the element with the given base hashes to the filter,
+// skipping hashing. For the result to be consistent with Test and Add, the
+// hashes must be the lower and upper 32-bit halves of the hash.Hash64 sum.
+func (b *BloomFilter) AddWithHashes(h1, h2 uint64) {
+	for i := uint(0); i < b.k; i++ {
+		b.buckets.Set((uint(h1)+uint(h2)*i)%b.m, 1)
+	}
+	b.count++
+}
+
+// AddScoped will add the data to the Bloom filter on behalf of a tenant, so
+// that it's tested with TestScoped and the same tenant ID. The tenant ID is
+// mixed into the hash, so identical data of different tenants maps to
+// different bits and one tenant's elements don't make the same data a member
+// for another tenant. This decorrelates tenants without isolating them: they
+// share the bits and the capacity, so every tenant's elements raise the
+// false-positive rate of all the others, and a tenant can still craft data
+// which tests positive for another. It returns the filter to allow for
+// chaining.
+func (b *BloomFilter) AddScoped(tenantID uint64, data []byte) Filter {
+	b.AddWithHashes(b.scopedHashes(tenantID, data))
+	return b
+}
+
+// TestScoped will test for membership of the data added by the tenant with
+// AddScoped and returns true if it is a member, false if not.
+func (b *BloomFilter) TestScoped(tenantID uint64, data []byte) bool {
+	h1, h2 := b.scopedHashes(tenantID, data)
+	for i := uint(0); i < b.k; i++ {
+		if b.buckets.Get((uint(h1)+uint(h2)*i)%b.m) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scopedHashes returns the base hashes of the data mixed with the tenant ID.
+func (b *BloomFilter) scopedHashes(tenantID uint64, data []byte) (uint64, uint64) {
+	var (
+		lower, upper = hashKernel(data, b.hash)
+		scope        = mix64(tenantID ^ 0x9e3779b97f4a7c15)
+	)
+	return mix64(uint64(lower) ^ scope), mix64(uint64(upper) ^ scope)
+}
+
 // TestAndAdd is equivalent to calling Test followed by Add. It returns true if
 // the data is a member, false if not.
 func (b *BloomFilter) TestAndAdd(data []byte) bool {
@@ -126,31 +186,55 @@ func (b *BloomFilter) SetHash(h hash.Hash64) {
 // WriteTo writes a binary representation of the BloomFilter to an i/o stream.
 // It returns the number of bytes written.
 func (b *BloomFilter) WriteTo(stream io.Writer) (int64, error) {
-	err := binary.Write(stream, binary.BigEndian, uint64(b.count))
-	if err != nil {
-		return 0, err
-	}
-	err = binary.Write(stream, binary.BigEndian, uint64(b.m))
+	e := newEncoder(stream)
+	e.header()
+	e.uvarint(uint64(b.count))
+	e.uvarint(uint64(b.m))
+	e.uvarint(uint64(b.k))
+	b.buckets.encode(e)
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of BloomFilter (such as might
+// have been written by WriteTo()) from an i/o stream. It returns the number
+// of bytes read. Both the compact format and the original fixed-width format
+// can be read.
+func (b *BloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	d, legacy, err := readHeader(stream)
 	if err != nil {
 		return 0, err
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(b.k))
-	if err != nil {
-		return 0, err
+	if d == nil {
+		return b.readLegacy(legacy)
 	}
 
-	writtenSize, err := b.buckets.WriteTo(stream)
-	if err != nil {
-		return 0, err
+	var (
+		count   = d.uvarint()
+		m       = d.uvarint()
+		k       = d.uvarint()
+		buckets Buckets
+	)
+	buckets.decode(d)
+	if d.err == nil && (m == 0 || uint64(buckets.Count()) != m) {
+		d.err = errors.New("number of buckets must match filter size")
+	}
+	if d.err == nil && k > m {
+		d.err = errors.New("number of hash functions must not exceed filter size")
+	}
+	if d.err != nil {
+		return 0, d.err
 	}
 
-	return writtenSize + int64(3*binary.Size(uint64(0))), err
+	b.count = uint(count)
+	b.m = uint(m)
+	b.k = uint(k)
+	b.buckets = &buckets
+	return d.n, nil
 }
 
-// ReadFrom reads a binary representation of BloomFilter (such as might
-// have been written by WriteTo()) from an i/o stream. It returns the number
-// of bytes read.
-func (b *BloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+// readLegacy reads the original fixed-width binary representation of
+// BloomFilter from an i/o stream. It returns the number of bytes read.
+func (b *BloomFilter) readLegacy(stream io.Reader) (int64, error) {
 	var count, m, k uint64
 	var buckets Buckets
 
@@ -167,10 +251,16 @@ func (b *BloomFilter) ReadFrom(stream io.Reader) (int64, error) {
 		return 0, err
 	}
 
-	readSize, err := buckets.ReadFrom(stream)
+	readSize, err := buckets.readLegacy(stream)
 	if err != nil {
 		return 0, err
 	}
+	if m == 0 || uint64(buckets.Count()) != m {
+		return 0, errors.New("number of buckets must match filter size")
+	}
+	if k > m {
+		return 0, errors.New("number of hash functions must not exceed filter size")
+	}
 
 	b.count = uint(count)
 	b.m = uint(m)
@@ -134,6 +134,38 @@ func TestBloomReset(t *testing.T) {
 	}
 }
 
+// Ensures that identical data added by one tenant with AddScoped is rarely a
+// member for another tenant, unlike data added without scoping.
+func TestBloomScoped(t *testing.T) {
+	f := NewBloomFilter(2000, 0.01)
+	for i := 0; i < 1000; i++ {
+		if f.AddScoped(1, []byte(strconv.Itoa(i))) != f {
+			t.Error("Returned BloomFilter should be the same instance")
+		}
+	}
+
+	if count := f.Count(); count != 1000 {
+		t.Errorf("Expected 1000, got %d", count)
+	}
+
+	crossTenant := 0
+	for i := 0; i < 1000; i++ {
+		data := []byte(strconv.Itoa(i))
+		if !f.TestScoped(1, data) {
+			t.Errorf("Expected %d to be a member for tenant 1", i)
+		}
+		if f.TestScoped(2, data) {
+			crossTenant++
+		}
+	}
+
+	// Without scoping, every element of one tenant would be a member for the
+	// others.
+	if crossTenant > 20 {
+		t.Errorf("Expected at most 20 cross-tenant positives, got %d", crossTenant)
+	}
+}
+
 // Ensures that BloomFilter can be serialized and deserialized without errors.
 func TestBloomFilter_EncodeDecode(t *testing.T) {
 	f := NewBloomFilter(1000, 0.1)
@@ -0,0 +1,259 @@
+package boom
+
+import (
+	"errors"
+	"hash"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcurrentScalableBloomFilter is a Scalable Bloom Filter which is safe for
+// concurrent use. Writers are serialized by a mutex, while Test is lock-free:
+// the series of Bloom filters is published as an immutable snapshot which is
+// replaced, rather than modified, whenever a filter is added, and bits are
+// read and set atomically. A Test which runs during growth therefore sees
+// either the series before or after the new filter was added, never a slice
+// which is being appended to.
+type ConcurrentScalableBloomFilter struct {
+	mu       sync.Mutex                                // serializes writers
+	sbf      *ScalableBloomFilter                      // guarded by mu
+	filters  atomic.Pointer[[]*PartitionedBloomFilter] // snapshot of sbf.filters
+	hashes   sync.Pool                                 // hash functions for concurrent callers
+	hashFunc func([]byte) (uint64, uint64)             // base hash function, if set
+	frozen   int                                       // number of frozen filters, guarded by mu
+}
+
+// NewConcurrentScalableBloomFilter creates a new Scalable Bloom Filter which is
+// safe for concurrent use with the specified target false-positive rate and
+// tightening ratio.
+func NewConcurrentScalableBloomFilter(hint uint, fpRate, r float64) *ConcurrentScalableBloomFilter {
+	c := &ConcurrentScalableBloomFilter{sbf: NewScalableBloomFilter(hint, fpRate, r)}
+	c.hashes.New = func() interface{} { return fnv.New64() }
+	c.sbf.filters[0].alignData()
+	c.publish()
+	return c
+}
+
+// Capacity returns the current Scalable Bloom Filter capacity, which is the
+// sum of the capacities for the contained series of Bloom filters.
+func (c *ConcurrentScalableBloomFilter) Capacity() uint {
+	capacity := uint(0)
+	for _, bf := range *c.filters.Load() {
+		capacity += bf.Capacity()
+	}
+	return capacity
+}
+
+// K returns the number of hash functions used in the initial Bloom filter.
+func (c *ConcurrentScalableBloomFilter) K() uint {
+	return (*c.filters.Load())[0].K()
+}
+
+// Count returns the number of items added to the Scalable Bloom Filter.
+func (c *ConcurrentScalableBloomFilter) Count() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sbf.Count()
+}
+
+// Test will test for membership of the data and returns true if it is a
+// member, false if not. This is a probabilistic test, meaning there is a
+// non-zero probability of false positives but a zero probability of false
+// negatives. It doesn't block, even while the filter is growing.
+func (c *ConcurrentScalableBloomFilter) Test(data []byte) bool {
+	lower, upper := c.baseHashes(data)
+	for _, bf := range *c.filters.Load() {
+		if bf.testHashesAtomic(lower, upper) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add will add the data to the Bloom filter. It returns the filter to allow
+// for chaining.
+func (c *ConcurrentScalableBloomFilter) Add(data []byte) Filter {
+	lower, upper := c.baseHashes(data)
+	c.mu.Lock()
+	c.activeFilter().addHashesAtomic(lower, upper)
+	c.mu.Unlock()
+	return c
+}
+
+// TestAndAdd is equivalent to calling Test followed by Add. It returns true if
+// the data is a member, false if not. The test and add are atomic with respect
+// to other writers.
+func (c *ConcurrentScalableBloomFilter) TestAndAdd(data []byte) bool {
+	lower, upper := c.baseHashes(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	member := false
+	for _, bf := range *c.filters.Load() {
+		if bf.testHashesAtomic(lower, upper) {
+			member = true
+			break
+		}
+	}
+	c.activeFilter().addHashesAtomic(lower, upper)
+	return member
+}
+
+// Reset restores the Scalable Bloom Filter to its original state. The series
+// of filters is replaced by a fresh one rather than cleared in place, and the
+// new snapshot is published atomically, so a concurrent Test sees either the
+// complete state before the reset or the empty state after it. It returns the
+// filter to allow for chaining.
+func (c *ConcurrentScalableBloomFilter) Reset() *ConcurrentScalableBloomFilter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sbf.Reset()
+	c.sbf.filters[0].alignData()
+	c.publish()
+	c.frozen = 0
+	return c
+}
+
+// Freeze makes the current series of filters immutable and starts a new
+// active filter which elements are added to from then on, so that the frozen
+// filters can be written with WriteFrozenTo while Add proceeds. Test checks
+// both the frozen and active filters. The new filter is added even if the
+// previous one isn't full, so each Freeze costs the memory of another
+// generation of the series, which is the size of the last filter times the
+// growth factor, while the remaining capacity of the previous filter goes
+// unused. Every filter also compounds the false-positive rate, so freezing
+// should be limited to about once per checkpoint. It returns the filter to
+// allow for chaining.
+func (c *ConcurrentScalableBloomFilter) Freeze() *ConcurrentScalableBloomFilter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sbf.addFilter()
+	c.sbf.filters[len(c.sbf.filters)-1].alignData()
+	c.publish()
+	c.frozen = len(c.sbf.filters) - 1
+	return c
+}
+
+// WriteFrozenTo writes a binary representation of the filters frozen by the
+// last Freeze to an i/o stream in the same format as
+// ScalableBloomFilter.WriteTo, so it can be read with
+// ScalableBloomFilter.ReadFrom. Since frozen filters are never modified, they
+// are written without being copied or blocking Add. Elements added since the
+// last Freeze are not included. It returns the number of bytes written, or an
+// error if no filters are frozen.
+func (c *ConcurrentScalableBloomFilter) WriteFrozenTo(stream io.Writer) (int64, error) {
+	c.mu.Lock()
+	if c.frozen == 0 {
+		c.mu.Unlock()
+		return 0, errors.New("no filters are frozen")
+	}
+	snapshot := *c.sbf
+	snapshot.filters = c.sbf.filters[:c.frozen:c.frozen]
+	c.mu.Unlock()
+
+	return snapshot.WriteTo(stream)
+}
+
+// WriteToConsistent writes a binary representation of the filter to an i/o
+// stream in the same format as ScalableBloomFilter.WriteTo, so it can be read
+// with ScalableBloomFilter.ReadFrom. The filter is snapshotted by copying its
+// bits under the writer lock, which blocks Add only for the duration of the
+// copy rather than the write. Filters frozen by Freeze aren't copied, since
+// they're no longer modified. The result reflects the filter at the point in
+// time of the snapshot: elements added while the snapshot is being written
+// are not included. It returns the number of bytes written.
+func (c *ConcurrentScalableBloomFilter) WriteToConsistent(stream io.Writer) (int64, error) {
+	c.mu.Lock()
+	snapshot := *c.sbf
+	snapshot.filters = make([]*PartitionedBloomFilter, len(c.sbf.filters))
+	for i, bf := range c.sbf.filters {
+		if i < c.frozen {
+			snapshot.filters[i] = bf
+		} else {
+			snapshot.filters[i] = bf.clone()
+		}
+	}
+	c.mu.Unlock()
+
+	return snapshot.WriteTo(stream)
+}
+
+// WriteTo is equivalent to WriteToConsistent. It makes the filter a
+// Serializable, so it can be checkpointed with StartPeriodicCheckpoint.
+func (c *ConcurrentScalableBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	return c.WriteToConsistent(stream)
+}
+
+// ReloadFrom replaces the filter with one decoded from a binary representation
+// in the format written by WriteToConsistent or ScalableBloomFilter.WriteTo,
+// so that a running service can swap in new reference data. The stream is
+// decoded before the writer lock is taken, and the new series of filters is
+// published atomically, so Test never blocks and a concurrent Test sees either
+// the complete old filter or the complete new one. The filter's hash functions
+// are kept, and any frozen filters are dropped. It returns an error if the
+// stream can't be decoded, in which case the filter is unchanged.
+func (c *ConcurrentScalableBloomFilter) ReloadFrom(stream io.Reader) error {
+	sbf := &ScalableBloomFilter{}
+	if _, err := sbf.ReadFrom(stream); err != nil {
+		return err
+	}
+	for _, bf := range sbf.filters {
+		bf.alignData()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sbf = sbf
+	c.publish()
+	c.frozen = 0
+	return nil
+}
+
+// SetHashFactory sets a function which creates the hashing functions used in
+// the filter. Since a hash.Hash64 is stateful, concurrent callers each use
+// their own, which are created on demand and reused. It must be set before the
+// filter is used.
+func (c *ConcurrentScalableBloomFilter) SetHashFactory(factory func() hash.Hash64) {
+	c.hashes.New = func() interface{} { return factory() }
+}
+
+// SetHashFunc sets a function which produces the two base hashes used to
+// derive the k partition indices. The function must be safe for concurrent
+// use. When set, it overrides the hash functions created by the factory set
+// with SetHashFactory. It must be set before the filter is used.
+func (c *ConcurrentScalableBloomFilter) SetHashFunc(fn func(data []byte) (uint64, uint64)) {
+	c.hashFunc = fn
+}
+
+// baseHashes returns the base hash values of the data.
+func (c *ConcurrentScalableBloomFilter) baseHashes(data []byte) (uint64, uint64) {
+	if c.hashFunc != nil {
+		return c.hashFunc(data)
+	}
+	h := c.hashes.Get().(hash.Hash64)
+	lower, upper := hashKernel(data, h)
+	c.hashes.Put(h)
+	return uint64(lower), uint64(upper)
+}
+
+// activeFilter returns the filter new elements are added to, publishing a new
+// snapshot if a filter was added. The caller must hold mu.
+func (c *ConcurrentScalableBloomFilter) activeFilter() *PartitionedBloomFilter {
+	n := len(c.sbf.filters)
+	bf := c.sbf.activeFilter()
+	if len(c.sbf.filters) != n {
+		bf.alignData()
+		c.publish()
+	}
+	return bf
+}
+
+// publish replaces the snapshot read by Test with a copy of the current series
+// of filters. The caller must hold mu, except during construction.
+func (c *ConcurrentScalableBloomFilter) publish() {
+	filters := make([]*PartitionedBloomFilter, len(c.sbf.filters))
+	copy(filters, c.sbf.filters)
+	c.filters.Store(&filters)
+}
@@ -0,0 +1,399 @@
+package boom
+
+import (
+	"bytes"
+	"hash"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Ensures that Test, Add and TestAndAdd behave like the ScalableBloomFilter
+// equivalents.
+func TestConcurrentScalableBloomTestAndAdd(t *testing.T) {
+	f := NewConcurrentScalableBloomFilter(1000, 0.01, 0.8)
+
+	// `a` isn't in the filter.
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if f.Add([]byte(`a`)) != f {
+		t.Error("Returned ConcurrentScalableBloomFilter should be the same instance")
+	}
+
+	// `a` is now in the filter.
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	// `b` isn't in the filter.
+	if f.TestAndAdd([]byte(`b`)) {
+		t.Error("`b` should not be a member")
+	}
+
+	// `b` is now in the filter.
+	if !f.TestAndAdd([]byte(`b`)) {
+		t.Error("`b` should be a member")
+	}
+
+	for i := 0; i < 10000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if count := f.Count(); count != 10003 {
+		t.Errorf("Expected 10003, got %d", count)
+	}
+
+	if len(*f.filters.Load()) == 1 {
+		t.Error("Expected filter to grow")
+	}
+
+	for i := 0; i < 10000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that Test never misses an element which was added before it started,
+// even while concurrent Adds are growing the filter.
+func TestConcurrentScalableBloomGrowthStress(t *testing.T) {
+	f := NewConcurrentScalableBloomFilter(100, 0.01, 0.8)
+	f.SetHashFactory(func() hash.Hash64 { return fnv.New64a() })
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(`seed` + strconv.Itoa(i)))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				f.Add([]byte(strconv.Itoa(w*5000 + i)))
+			}
+		}(w)
+	}
+
+	errs := make(chan string, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				for i := 0; i < 100; i++ {
+					if !f.Test([]byte(`seed` + strconv.Itoa(i))) {
+						errs <- `seed` + strconv.Itoa(i)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for data := range errs {
+		t.Errorf("Expected %s to be a member", data)
+	}
+
+	if len(*f.filters.Load()) < 10 {
+		t.Errorf("Expected at least 10 filters, got %d", len(*f.filters.Load()))
+	}
+
+	for i := 0; i < 20000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that Reset can be interleaved with concurrent Tests, which see either
+// the state before or after a reset, and that it empties the filter.
+func TestConcurrentScalableBloomResetStress(t *testing.T) {
+	f := NewConcurrentScalableBloomFilter(10, 0.01, 0.8)
+	f.SetHashFactory(func() hash.Hash64 { return fnv.New64a() })
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < 100; i++ {
+					f.Test([]byte(strconv.Itoa(i)))
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < 200; n++ {
+		if f.Reset() != f {
+			t.Error("Returned ConcurrentScalableBloomFilter should be the same instance")
+		}
+		for i := 0; i < 100; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	f.Reset()
+	if count := f.Count(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+
+	if filters := len(*f.filters.Load()); filters != 1 {
+		t.Errorf("Expected 1 filter, got %d", filters)
+	}
+
+	for i := 0; i < 100; i++ {
+		if f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d not to be a member", i)
+		}
+	}
+}
+
+// Ensures that WriteToConsistent writes a snapshot which can be read by a
+// ScalableBloomFilter, even while elements are being added concurrently.
+func TestConcurrentScalableBloomWriteToConsistent(t *testing.T) {
+	f := NewConcurrentScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1000; i < 5000; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+	}()
+
+	var buf bytes.Buffer
+	n, err := f.WriteToConsistent(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if n != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes written, got %d", buf.Len(), n)
+	}
+
+	s := NewScalableBloomFilter(10, 0.1, 0.8)
+	if _, err := s.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !s.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that WriteFrozenTo writes the filters frozen by Freeze while
+// elements are being added to the active filter, and that Test checks both.
+func TestConcurrentScalableBloomFreeze(t *testing.T) {
+	f := NewConcurrentScalableBloomFilter(100, 0.01, 0.8)
+	if _, err := f.WriteFrozenTo(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error")
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	frozen := f.Count()
+
+	if f.Freeze() != f {
+		t.Error("Returned ConcurrentScalableBloomFilter should be the same instance")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1000; i < 5000; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+	}()
+
+	var buf bytes.Buffer
+	n, err := f.WriteFrozenTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if n != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes written, got %d", buf.Len(), n)
+	}
+
+	s := NewScalableBloomFilter(10, 0.1, 0.8)
+	if _, err := s.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the elements added before Freeze are written.
+	if count := s.Count(); count != frozen {
+		t.Errorf("Expected %d, got %d", frozen, count)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !s.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// WriteToConsistent includes the active filters.
+	buf.Reset()
+	if _, err := f.WriteToConsistent(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if count := s.Count(); count != 5000 {
+		t.Errorf("Expected 5000, got %d", count)
+	}
+
+	f.Reset()
+	if _, err := f.WriteFrozenTo(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that ReloadFrom swaps in a decoded filter while Test and Add run
+// concurrently, and that a concurrent Test never sees a partial filter.
+func TestConcurrentScalableBloomReloadFrom(t *testing.T) {
+	var (
+		small = NewScalableBloomFilter(100, 0.01, 0.8)
+		large = NewScalableBloomFilter(100, 0.01, 0.8)
+	)
+	for i := 0; i < 1000; i++ {
+		small.Add([]byte(strconv.Itoa(i)))
+		large.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 1000; i < 2000; i++ {
+		large.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var smallData, largeData bytes.Buffer
+	if _, err := small.WriteTo(&smallData); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := large.WriteTo(&largeData); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewConcurrentScalableBloomFilter(100, 0.01, 0.8)
+	if err := f.ReloadFrom(bytes.NewReader(smallData.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Both filters contain the first 1000 elements.
+				if e := strconv.Itoa(i % 1000); !f.Test([]byte(e)) {
+					t.Errorf("Expected %s to be a member", e)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			f.Add([]byte(`added` + strconv.Itoa(i)))
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		data := smallData.Bytes()
+		if i%2 == 0 {
+			data = largeData.Bytes()
+		}
+		if err := f.ReloadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if err := f.ReloadFrom(bytes.NewReader(largeData.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if count := f.Count(); count != 2000 {
+		t.Errorf("Expected 2000, got %d", count)
+	}
+	for i := 0; i < 2000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// A stream which can't be decoded leaves the filter unchanged.
+	if err := f.ReloadFrom(bytes.NewReader([]byte(`garbage`))); err == nil {
+		t.Error("Expected error")
+	}
+	if count := f.Count(); count != 2000 {
+		t.Errorf("Expected 2000, got %d", count)
+	}
+}
+
+func BenchmarkConcurrentScalableBloomTestParallel(b *testing.B) {
+	b.StopTimer()
+	f := NewConcurrentScalableBloomFilter(1000, 0.01, 0.8)
+	for i := 0; i < 10000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	b.StartTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			f.Test([]byte(strconv.Itoa(i % 10000)))
+			i++
+		}
+	})
+}
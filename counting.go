@@ -1,8 +1,14 @@
 package boom
 
 import (
+	"bytes"
+	"container/heap"
+	"errors"
 	"hash"
 	"hash/fnv"
+	"io"
+	"math"
+	"sort"
 )
 
 // CountingBloomFilter implements a Counting Bloom Filter as described by Fan,
@@ -22,14 +28,41 @@ import (
 // and removed from the data set. Since they use n-bit buckets, CBFs use
 // roughly n-times more memory than traditional Bloom filters.
 type CountingBloomFilter struct {
-	buckets     *Buckets    // filter data
-	hash        hash.Hash64 // hash function (kernel for all k functions)
-	m           uint        // number of buckets
-	k           uint        // number of hash functions
-	count       uint        // number of items in the filter
-	indexBuffer []uint      // buffer used to cache indices
+	buckets     *Buckets       // filter data
+	hash        hash.Hash64    // hash function (kernel for all k functions)
+	m           uint           // number of buckets
+	k           uint           // number of hash functions
+	count       uint           // number of items in the filter
+	indexBuffer []uint         // buffer used to cache indices
+	overflow    OverflowPolicy // behavior when a bucket would overflow
+	top         *elementHeap   // candidate hot keys, if tracked
+	topN        uint           // maximum number of candidate hot keys
 }
 
+// OverflowPolicy determines what a CountingBloomFilter does when adding an
+// element would increment a bucket beyond its maximum value.
+type OverflowPolicy int
+
+const (
+	// OverflowSaturate clamps the bucket to its maximum value. This is the
+	// default. A saturated bucket is no longer decremented accurately, so
+	// removals can cause false negatives.
+	OverflowSaturate OverflowPolicy = iota
+
+	// OverflowError makes TryAdd return ErrCounterOverflow without adding the
+	// element. Add can't return an error, so it saturates instead.
+	OverflowError
+
+	// OverflowWiden doubles the bucket size, up to 8 bits, copying the
+	// values, before adding the element. Once buckets are 8 bits, they
+	// saturate.
+	OverflowWiden
+)
+
+// ErrCounterOverflow is returned by CountingBloomFilter.TryAdd when adding an
+// element would overflow a bucket under the OverflowError policy.
+var ErrCounterOverflow = errors.New("counter overflow")
+
 // NewCountingBloomFilter creates a new Counting Bloom Filter optimized to
 // store n items with a specified target false-positive rate and bucket size.
 // If you don't know how many bits to use for buckets, use
@@ -90,16 +123,47 @@ func (c *CountingBloomFilter) Test(data []byte) bool {
 // for chaining.
 func (c *CountingBloomFilter) Add(data []byte) Filter {
 	lower, upper := hashKernel(data, c.hash)
+	c.addHashes(uint(lower), uint(upper), 1, false)
+	c.trackTop(data)
+	return c
+}
 
-	// Set the K bits.
-	for i := uint(0); i < c.k; i++ {
-		c.buckets.Increment((uint(lower)+uint(upper)*i)%c.m, 1)
+// AddN adds the data to the Bloom filter with multiplicity n, incrementing
+// each of its K buckets by n in one call, which is equivalent to but much
+// faster than calling Add n times, e.g. for ingesting pre-aggregated counts.
+// The count of the filter grows by n. Buckets saturate at the maximum bucket
+// value, unless the policy is OverflowWiden, in which case the bucket size is
+// doubled, up to 8 bits, until the increments fit. It returns the filter to
+// allow for chaining.
+func (c *CountingBloomFilter) AddN(data []byte, n uint) Filter {
+	if n == 0 {
+		return c
 	}
-
-	c.count++
+	lower, upper := hashKernel(data, c.hash)
+	c.addHashes(uint(lower), uint(upper), n, false)
+	c.trackTop(data)
 	return c
 }
 
+// TryAdd will add the data to the Bloom filter, applying the overflow policy
+// if a bucket would overflow. It returns ErrCounterOverflow without adding the
+// data if the policy is OverflowError and a bucket would overflow.
+func (c *CountingBloomFilter) TryAdd(data []byte) error {
+	lower, upper := hashKernel(data, c.hash)
+	if err := c.addHashes(uint(lower), uint(upper), 1, true); err != nil {
+		return err
+	}
+	c.trackTop(data)
+	return nil
+}
+
+// AddWithHashes adds the element with the given base hashes to the filter,
+// skipping hashing. For the result to be consistent with Test and Add, the
+// hashes must be the lower and upper 32-bit halves of the hash.Hash64 sum.
+func (c *CountingBloomFilter) AddWithHashes(h1, h2 uint64) {
+	c.addHashes(uint(h1), uint(h2), 1, false)
+}
+
 // TestAndAdd is equivalent to calling Test followed by Add. It returns true if
 // the data is a member, false if not.
 func (c *CountingBloomFilter) TestAndAdd(data []byte) bool {
@@ -108,36 +172,140 @@ func (c *CountingBloomFilter) TestAndAdd(data []byte) bool {
 
 	// If any of the K bits are not set, then it's not a member.
 	for i := uint(0); i < c.k; i++ {
-		idx := (uint(lower) + uint(upper)*i) % c.m
-		if c.buckets.Get(idx) == 0 {
+		if c.buckets.Get((uint(lower)+uint(upper)*i)%c.m) == 0 {
 			member = false
 		}
-		c.buckets.Increment(idx, 1)
 	}
 
-	c.count++
+	c.addHashes(uint(lower), uint(upper), 1, false)
+	c.trackTop(data)
 	return member
 }
 
+// addHashes increments the K buckets of the element with the given base
+// hashes by n. If a bucket would overflow, the overflow policy is applied. If
+// strict is true and the policy is OverflowError, ErrCounterOverflow is
+// returned and nothing is incremented, otherwise buckets saturate.
+func (c *CountingBloomFilter) addHashes(lower, upper, n uint, strict bool) error {
+	for i := uint(0); i < c.k; i++ {
+		c.indexBuffer[i] = (lower + upper*i) % c.m
+	}
+
+	if c.overflow != OverflowSaturate && c.overflows(n) {
+		switch {
+		case c.overflow == OverflowWiden:
+			for c.buckets.bucketSize < 8 && c.overflows(n) {
+				c.widen()
+			}
+		case strict:
+			return ErrCounterOverflow
+		}
+	}
+
+	// No bucket holds more than 8 bits, so larger increments saturate the
+	// same way.
+	delta := int32(math.MaxUint8)
+	if n < math.MaxUint8 {
+		delta = int32(n)
+	}
+	for _, idx := range c.indexBuffer {
+		c.buckets.Increment(idx, delta)
+	}
+
+	c.count += n
+	return nil
+}
+
+// overflows returns true if incrementing the buckets in the index buffer by n
+// would take one beyond the maximum bucket value. A bucket can occur more than
+// once in the index buffer, in which case it's incremented once per
+// occurrence.
+func (c *CountingBloomFilter) overflows(n uint) bool {
+	max := uint(c.buckets.MaxBucketValue())
+	for i, idx := range c.indexBuffer {
+		increments := uint(0)
+		for _, other := range c.indexBuffer[i:] {
+			if other == idx {
+				increments++
+			}
+		}
+		if n > max || uint(c.buckets.Get(idx))+increments*n > max {
+			return true
+		}
+	}
+	return false
+}
+
+// underflows returns true if decrementing the buckets in the index buffer
+// would take one below zero. Like in overflows, a bucket which occurs more than
+// once is decremented once per occurrence.
+func (c *CountingBloomFilter) underflows() bool {
+	for i, idx := range c.indexBuffer {
+		decrements := uint32(0)
+		for _, other := range c.indexBuffer[i:] {
+			if other == idx {
+				decrements++
+			}
+		}
+		if c.buckets.Get(idx) < decrements {
+			return true
+		}
+	}
+	return false
+}
+
+// widen doubles the bucket size, up to 8 bits, keeping the bucket values.
+func (c *CountingBloomFilter) widen() {
+	size := c.buckets.bucketSize * 2
+	if size > 8 {
+		size = 8
+	}
+	if size == c.buckets.bucketSize {
+		return
+	}
+
+	buckets := NewBuckets(c.m, size)
+	for i := uint(0); i < c.m; i++ {
+		buckets.Set(i, uint8(c.buckets.Get(i)))
+	}
+	c.buckets = buckets
+}
+
+// SetOverflowPolicy sets what happens when adding an element would increment
+// a bucket beyond its maximum value. The default is OverflowSaturate. The
+// policy is not included in the binary representation. It returns the filter
+// to allow for chaining.
+func (c *CountingBloomFilter) SetOverflowPolicy(policy OverflowPolicy) *CountingBloomFilter {
+	c.overflow = policy
+	return c
+}
+
+// BucketSize returns the number of bits allocated per bucket, which can grow
+// under the OverflowWiden policy.
+func (c *CountingBloomFilter) BucketSize() uint8 {
+	return c.buckets.bucketSize
+}
+
 // TestAndRemove will test for membership of the data and remove it from the
-// filter if it exists. Returns true if the data was a member, false if not.
+// filter if it exists, decrementing its K buckets in the same pass. Returns
+// true if the data was a member, false if not. A bucket which occurs more than
+// once among the data's K buckets was incremented once per occurrence by Add,
+// so the data is only a member if every bucket is at least its number of
+// occurrences. Otherwise it's a false positive, and removing it would
+// decrement the buckets of other elements.
 func (c *CountingBloomFilter) TestAndRemove(data []byte) bool {
 	lower, upper := hashKernel(data, c.hash)
-	member := true
-
-	// Set the K bits.
 	for i := uint(0); i < c.k; i++ {
 		c.indexBuffer[i] = (uint(lower) + uint(upper)*i) % c.m
-		if c.buckets.Get(c.indexBuffer[i]) == 0 {
-			member = false
-		}
 	}
 
+	member := !c.underflows()
 	if member {
 		for _, idx := range c.indexBuffer {
 			c.buckets.Increment(idx, -1)
 		}
 		c.count--
+		c.trackTop(data)
 	}
 
 	return member
@@ -148,11 +316,165 @@ func (c *CountingBloomFilter) TestAndRemove(data []byte) bool {
 func (c *CountingBloomFilter) Reset() *CountingBloomFilter {
 	c.buckets.Reset()
 	c.count = 0
+	if c.top != nil {
+		c.TrackTopN(c.topN)
+	}
+	return c
+}
+
+// TrackTopN enables tracking up to n candidate hot keys, the keys with the
+// highest counts, from this point on so that they can be retrieved with TopN.
+// The filter itself can't enumerate its keys, so the candidates are kept in a
+// min-heap which is updated on every Add and TestAndRemove: a key becomes a
+// candidate if the heap has room or its count exceeds the smallest candidate's,
+// which it then displaces. This is an approximation. A key which was
+// displaced only becomes a candidate again once it's added with a higher count
+// than the smallest candidate. Counts are the minimum of the key's buckets, so
+// they can overestimate due to collisions and saturate at the maximum bucket
+// value, so wider buckets or the OverflowWiden policy are recommended. The
+// candidates are not included in the binary representation. It returns the
+// filter to allow for chaining.
+func (c *CountingBloomFilter) TrackTopN(n uint) *CountingBloomFilter {
+	top := make(elementHeap, 0, n)
+	c.top = &top
+	c.topN = n
 	return c
 }
 
+// TopN returns up to n of the candidate hot keys tracked since TrackTopN was
+// called with their counts, from highest to lowest count. It returns nil if
+// hot keys aren't tracked or n isn't positive.
+func (c *CountingBloomFilter) TopN(n int) []struct {
+	Data  []byte
+	Count uint
+} {
+	if c.top == nil || n <= 0 {
+		return nil
+	}
+
+	elements := make([]struct {
+		Data  []byte
+		Count uint
+	}, len(*c.top))
+	for i, element := range *c.top {
+		elements[i].Data = element.Data
+		elements[i].Count = uint(element.Freq)
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		return elements[i].Count > elements[j].Count
+	})
+	if n < len(elements) {
+		elements = elements[:n]
+	}
+	return elements
+}
+
+// trackTop updates the candidate hot keys with the current count of the data,
+// whose bucket indices are in the index buffer.
+func (c *CountingBloomFilter) trackTop(data []byte) {
+	if c.top == nil || c.topN == 0 {
+		return
+	}
+
+	freq := uint64(c.buckets.Get(c.indexBuffer[0]))
+	for _, idx := range c.indexBuffer[1:] {
+		if count := uint64(c.buckets.Get(idx)); count < freq {
+			freq = count
+		}
+	}
+
+	for i, element := range *c.top {
+		if bytes.Equal(element.Data, data) {
+			if freq == 0 {
+				heap.Remove(c.top, i)
+			} else {
+				element.Freq = freq
+				heap.Fix(c.top, i)
+			}
+			return
+		}
+	}
+
+	switch {
+	case freq == 0:
+		return
+	case uint(c.top.Len()) < c.topN:
+	case freq > (*c.top)[0].Freq:
+		heap.Pop(c.top)
+	default:
+		return
+	}
+	heap.Push(c.top, &Element{Data: append([]byte(nil), data...), Freq: freq})
+}
+
 // SetHash sets the hashing function used in the filter.
 // For the effect on false positive rates see: https://github.com/tylertreat/BoomFilters/pull/1
 func (c *CountingBloomFilter) SetHash(h hash.Hash64) {
 	c.hash = h
 }
+
+// WriteTo writes a binary representation of the CountingBloomFilter to an i/o
+// stream. Buckets which are mostly zero, as in a sparsely populated filter,
+// are written compactly. It returns the number of bytes written.
+func (c *CountingBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	e := newEncoder(stream)
+	e.header()
+	e.uvarint(uint64(c.m))
+	e.uvarint(uint64(c.k))
+	e.uvarint(uint64(c.count))
+	c.buckets.encode(e)
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of CountingBloomFilter (such as
+// might have been written by WriteTo()) from an i/o stream. It returns the
+// number of bytes read.
+func (c *CountingBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	d, _, err := readHeader(stream)
+	if err != nil {
+		return 0, err
+	}
+	if d == nil {
+		return 0, errors.New("invalid format header")
+	}
+
+	var (
+		m       = d.uvarint()
+		k       = d.length(ptrSize)
+		count   = d.uvarint()
+		buckets Buckets
+	)
+	buckets.decode(d)
+	if d.err == nil && (m == 0 || uint64(buckets.Count()) != m) {
+		d.err = errors.New("number of buckets must match filter size")
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	c.m = uint(m)
+	c.k = uint(k)
+	c.count = uint(count)
+	c.buckets = &buckets
+	c.indexBuffer = make([]uint, k)
+	return d.n, nil
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (c *CountingBloomFilter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := c.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder interface.
+func (c *CountingBloomFilter) GobDecode(data []byte) error {
+	buf := bytes.NewBuffer(data)
+	_, err := c.ReadFrom(buf)
+
+	return err
+}
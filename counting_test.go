@@ -1,6 +1,8 @@
 package boom
 
 import (
+	"bytes"
+	"encoding/binary"
 	"strconv"
 	"testing"
 )
@@ -114,6 +116,81 @@ func TestCountingTestAndRemove(t *testing.T) {
 	}
 }
 
+// constantHash is a hash.Hash64 whose sum is always the same, so every bucket
+// index derived from it is the lower half of the sum modulo m.
+type constantHash uint64
+
+func (h constantHash) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (h constantHash) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+func (h constantHash) Sum64() uint64  { return uint64(h) }
+func (h constantHash) Reset()         {}
+func (h constantHash) Size() int      { return 8 }
+func (h constantHash) BlockSize() int { return 1 }
+
+// Ensures that TestAndRemove removes an element whose buckets are exactly 1
+// and treats an element as a member only if every bucket is at least its
+// number of occurrences among the element's buckets.
+func TestCountingTestAndRemoveBoundary(t *testing.T) {
+	f := NewDefaultCountingBloomFilter(100, 0.01)
+	f.Add([]byte(`a`))
+	f.Add([]byte(`a`))
+
+	for i := 0; i < 2; i++ {
+		if !f.TestAndRemove([]byte(`a`)) {
+			t.Errorf("Expected `a` to be a member after %d removals", i)
+		}
+	}
+
+	if f.TestAndRemove([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if count := f.Count(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+
+	for i := uint(0); i < f.m; i++ {
+		if b := f.buckets.Get(i); b != 0 {
+			t.Errorf("Expected bucket %d to be 0, got %d", i, b)
+		}
+	}
+
+	// With an upper hash of zero, all K buckets are the same, so Add
+	// increments it K times.
+	f.SetHash(constantHash(5))
+	f.Add([]byte(`a`))
+	if b := f.buckets.Get(5); b != uint32(f.k) {
+		t.Errorf("Expected %d, got %d", f.k, b)
+	}
+
+	// A bucket of 1 was incremented by another element, not `a`.
+	f.buckets.Set(5, 1)
+	if f.TestAndRemove([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if b := f.buckets.Get(5); b != 1 {
+		t.Errorf("Expected 1, got %d", b)
+	}
+
+	f.buckets.Set(5, uint8(f.k))
+	if !f.TestAndRemove([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	if b := f.buckets.Get(5); b != 0 {
+		t.Errorf("Expected 0, got %d", b)
+	}
+}
+
 // Ensures that Reset sets every bit to zero and the count is zero.
 func TestCountingReset(t *testing.T) {
 	f := NewDefaultCountingBloomFilter(100, 0.1)
@@ -136,6 +213,230 @@ func TestCountingReset(t *testing.T) {
 	}
 }
 
+// Ensures that buckets saturate at the overflow boundary by default.
+func TestCountingOverflowSaturate(t *testing.T) {
+	f := NewCountingBloomFilter(100, 2, 0.01)
+	for i := 0; i < 5; i++ {
+		if err := f.TryAdd([]byte(`a`)); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+
+	if size := f.BucketSize(); size != 2 {
+		t.Errorf("Expected 2, got %d", size)
+	}
+
+	// The buckets saturated at 3, so the fourth removal fails.
+	for i := 0; i < 3; i++ {
+		if !f.TestAndRemove([]byte(`a`)) {
+			t.Error("`a` should be a member")
+		}
+	}
+	if f.TestAndRemove([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+}
+
+// Ensures that TryAdd returns an error at the overflow boundary without
+// adding the data under the OverflowError policy.
+func TestCountingOverflowError(t *testing.T) {
+	f := NewCountingBloomFilter(100, 2, 0.01)
+	if f.SetOverflowPolicy(OverflowError) != f {
+		t.Error("Returned CountingBloomFilter should be the same instance")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := f.TryAdd([]byte(`a`)); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+
+	if err := f.TryAdd([]byte(`a`)); err != ErrCounterOverflow {
+		t.Errorf("Expected ErrCounterOverflow, got %v", err)
+	}
+
+	if count := f.Count(); count != 3 {
+		t.Errorf("Expected 3, got %d", count)
+	}
+
+	// Add can't return the error, so it saturates.
+	f.Add([]byte(`a`))
+	if count := f.Count(); count != 4 {
+		t.Errorf("Expected 4, got %d", count)
+	}
+
+	if err := f.TryAdd([]byte(`b`)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+// Ensures that buckets are widened at the overflow boundary, keeping their
+// values, under the OverflowWiden policy.
+func TestCountingOverflowWiden(t *testing.T) {
+	f := NewCountingBloomFilter(100, 2, 0.01).SetOverflowPolicy(OverflowWiden)
+	f.Add([]byte(`b`))
+	for i := 0; i < 3; i++ {
+		f.Add([]byte(`a`))
+	}
+
+	if size := f.BucketSize(); size != 2 {
+		t.Errorf("Expected 2, got %d", size)
+	}
+
+	if err := f.TryAdd([]byte(`a`)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if size := f.BucketSize(); size != 4 {
+		t.Errorf("Expected 4, got %d", size)
+	}
+
+	// Every addition is counted, so `a` can be removed four times.
+	for i := 0; i < 4; i++ {
+		if !f.TestAndRemove([]byte(`a`)) {
+			t.Error("`a` should be a member")
+		}
+	}
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if !f.Test([]byte(`b`)) {
+		t.Error("`b` should be a member")
+	}
+
+	// Buckets are widened to at most 8 bits and saturate afterwards.
+	for i := 0; i < 300; i++ {
+		f.Add([]byte(`c`))
+	}
+	if size := f.BucketSize(); size != 8 {
+		t.Errorf("Expected 8, got %d", size)
+	}
+}
+
+// Ensures that AddN is equivalent to adding the data n times and saturates
+// the buckets for large n.
+func TestCountingAddN(t *testing.T) {
+	var (
+		f = NewCountingBloomFilter(100, 4, 0.01)
+		g = NewCountingBloomFilter(100, 4, 0.01)
+	)
+	if f.AddN([]byte(`a`), 5) != f {
+		t.Error("Returned CountingBloomFilter should be the same instance")
+	}
+	for i := 0; i < 5; i++ {
+		g.Add([]byte(`a`))
+	}
+
+	if count := f.Count(); count != 5 {
+		t.Errorf("Expected 5, got %d", count)
+	}
+
+	if !bytes.Equal(f.buckets.data, g.buckets.data) {
+		t.Error("Expected the same buckets as adding 5 times")
+	}
+
+	f.AddN([]byte(`b`), 0)
+	if f.Test([]byte(`b`)) {
+		t.Error("`b` should not be a member")
+	}
+
+	// The buckets saturate at 15.
+	f = NewCountingBloomFilter(100, 4, 0.01)
+	f.AddN([]byte(`a`), 1<<30)
+	if count := f.Count(); count != 1<<30 {
+		t.Errorf("Expected %d, got %d", 1<<30, count)
+	}
+	for i := 0; i < 15; i++ {
+		if !f.TestAndRemove([]byte(`a`)) {
+			t.Error("`a` should be a member")
+		}
+	}
+	if f.TestAndRemove([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	// Buckets are widened until the increments fit.
+	f = NewCountingBloomFilter(100, 2, 0.01).SetOverflowPolicy(OverflowWiden)
+	f.AddN([]byte(`a`), 100)
+	if size := f.BucketSize(); size != 8 {
+		t.Errorf("Expected 8, got %d", size)
+	}
+	for i := 0; i < 100; i++ {
+		if !f.TestAndRemove([]byte(`a`)) {
+			t.Error("`a` should be a member")
+		}
+	}
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+}
+
+// Ensures that TopN returns the hot keys of a skewed stream from highest to
+// lowest count and follows removals.
+func TestCountingTopN(t *testing.T) {
+	f := NewCountingBloomFilter(5000, 8, 0.01)
+	if f.TopN(5) != nil {
+		t.Error("Expected nil without tracking")
+	}
+
+	if f.TrackTopN(10) != f {
+		t.Error("Returned CountingBloomFilter should be the same instance")
+	}
+
+	// hot0 to hot4 are added 100, 90, ..., 60 times, interleaved with 2000
+	// cold keys which are added once.
+	cold := 0
+	for round := 0; round < 100; round++ {
+		for i := 0; i < 5; i++ {
+			if round < 100-10*i {
+				f.Add([]byte("hot" + strconv.Itoa(i)))
+			}
+		}
+		for j := 0; j < 20; j++ {
+			f.Add([]byte(strconv.Itoa(cold)))
+			cold++
+		}
+	}
+
+	top := f.TopN(5)
+	if len(top) != 5 {
+		t.Fatalf("Expected 5 elements, got %d", len(top))
+	}
+
+	for i, element := range top {
+		if data := "hot" + strconv.Itoa(i); string(element.Data) != data {
+			t.Errorf("Expected %s, got %s", data, element.Data)
+		}
+		if count := uint(100 - 10*i); element.Count < count || element.Count > count+2 {
+			t.Errorf("Expected about %d, got %d", count, element.Count)
+		}
+	}
+
+	if l := len(f.TopN(100)); l != 10 {
+		t.Errorf("Expected 10 elements, got %d", l)
+	}
+
+	for _, n := range []int{0, -1} {
+		if top := f.TopN(n); top != nil {
+			t.Errorf("Expected nil for %d, got %v", n, top)
+		}
+	}
+
+	// Removing hot0 lowers its count below hot1's.
+	for i := 0; i < 20; i++ {
+		f.TestAndRemove([]byte(`hot0`))
+	}
+	if data := string(f.TopN(1)[0].Data); data != "hot1" {
+		t.Errorf("Expected hot1, got %s", data)
+	}
+
+	f.Reset()
+	if l := len(f.TopN(5)); l != 0 {
+		t.Errorf("Expected 0 elements, got %d", l)
+	}
+}
+
 func BenchmarkCountingAdd(b *testing.B) {
 	b.StopTimer()
 	f := NewDefaultCountingBloomFilter(100000, 0.1)
@@ -9,6 +9,9 @@ import (
 	"hash/fnv"
 	"io"
 	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 // CountMinSketch implements a Count-Min Sketch as described by Cormode and
@@ -30,14 +33,32 @@ import (
 // impractical. It may be possible for offline processing, but real-time
 // processing requires fast, space-efficient solutions like the CMS. For
 // approximating set cardinality, refer to the HyperLogLog.
+//
+// Add, Count and TotalCount are safe for concurrent use. Counters are updated
+// with atomic operations, and only hashing is serialized since the hash
+// function is shared. Other methods require external synchronization.
 type CountMinSketch struct {
+	// count is first so that it's 64-bit aligned for atomic access on 32-bit
+	// platforms.
+	count   uint64      // number of items added
 	matrix  [][]uint64  // count matrix
 	width   uint        // matrix width
 	depth   uint        // matrix depth
-	count   uint64      // number of items added
 	epsilon float64     // relative-accuracy factor
 	delta   float64     // relative-accuracy probability
 	hash    hash.Hash64 // hash function (kernel for all depth functions)
+	mu      sync.Mutex  // guards the hash function
+	seed    uint64      // seed mixed into the base hashes
+
+	minCount   uint64              // estimate at which candidates are tracked, 0 if disabled
+	candidates map[string]struct{} // candidate heavy hitters
+	cmu        sync.Mutex          // guards candidates
+}
+
+// HeavyHitter is an element whose estimated count exceeds a threshold.
+type HeavyHitter struct {
+	Data  []byte
+	Count uint64
 }
 
 // NewCountMinSketch creates a new Count-Min Sketch whose relative accuracy is
@@ -74,43 +95,157 @@ func (c *CountMinSketch) Delta() float64 {
 	return c.delta
 }
 
+// Width returns the number of counters in each row of the sketch.
+func (c *CountMinSketch) Width() uint {
+	return c.width
+}
+
+// Depth returns the number of rows, i.e. hash functions, of the sketch.
+func (c *CountMinSketch) Depth() uint {
+	return c.depth
+}
+
+// RecommendedResize returns the dimensions of a sketch whose relative
+// accuracy is within a factor of targetError with the same probability,
+// delta, as this one. A sketch can't be resized without losing accuracy, so
+// this is meant for sizing a sketch to rebuild from the data once the accuracy
+// target changes. The width only depends on the error factor and the depth on
+// delta, so the depth is unchanged.
+func (c *CountMinSketch) RecommendedResize(targetError float64) (width, depth uint) {
+	return uint(math.Ceil(math.E / targetError)), uint(math.Ceil(math.Log(1 / c.delta)))
+}
+
 // TotalCount returns the number of items added to the sketch.
 func (c *CountMinSketch) TotalCount() uint64 {
-	return c.count
+	return atomic.LoadUint64(&c.count)
 }
 
 // Add will add the data to the set. Returns the CountMinSketch to allow for
 // chaining.
 func (c *CountMinSketch) Add(data []byte) *CountMinSketch {
-	lower, upper := hashKernel(data, c.hash)
+	lower, upper := c.hashKernel(data)
 
 	// Increment count in each row.
 	for i := uint(0); i < c.depth; i++ {
-		c.matrix[i][(uint(lower)+uint(upper)*i)%c.width]++
+		atomic.AddUint64(&c.matrix[i][(uint(lower)+uint(upper)*i)%c.width], 1)
 	}
 
-	c.count++
+	atomic.AddUint64(&c.count, 1)
+
+	if c.minCount > 0 && c.estimate(lower, upper) >= c.minCount {
+		c.cmu.Lock()
+		c.candidates[string(data)] = struct{}{}
+		c.cmu.Unlock()
+	}
 	return c
 }
 
+// AddWithHashes increments the count for the item with the given base hashes,
+// skipping hashing. For the result to be consistent with Add and Count, the
+// hashes must be the lower and upper 32-bit halves of the hash.Hash64 sum.
+func (c *CountMinSketch) AddWithHashes(h1, h2 uint64) {
+	if c.seed != 0 {
+		lower, upper := c.seedHashes(uint32(h1), uint32(h2))
+		h1, h2 = uint64(lower), uint64(upper)
+	}
+	for i := uint(0); i < c.depth; i++ {
+		atomic.AddUint64(&c.matrix[i][(uint(h1)+uint(h2)*i)%c.width], 1)
+	}
+	atomic.AddUint64(&c.count, 1)
+}
+
 // Count returns the approximate count for the specified item, correct within
 // epsilon * total count with a probability of delta.
 func (c *CountMinSketch) Count(data []byte) uint64 {
-	var (
-		lower, upper = hashKernel(data, c.hash)
-		count        = uint64(math.MaxUint64)
-	)
+	return c.estimate(c.hashKernel(data))
+}
 
+// TrackHeavyHitters enables tracking the elements added from this point on
+// whose estimated count reaches minCount, so that HeavyHitters can enumerate
+// them, which a Count-Min Sketch alone can't do. Tracking costs a count
+// estimate on every Add and memory for every tracked element, of which there
+// are at most about TotalCount / minCount plus those overestimated into
+// reaching minCount. Elements added with AddWithHashes aren't tracked. It must
+// not be called concurrently with Add. It returns the CountMinSketch to allow
+// for chaining.
+func (c *CountMinSketch) TrackHeavyHitters(minCount uint64) *CountMinSketch {
+	if minCount == 0 {
+		minCount = 1
+	}
+	c.cmu.Lock()
+	c.minCount = minCount
+	if c.candidates == nil {
+		c.candidates = make(map[string]struct{})
+	}
+	c.cmu.Unlock()
+	return c
+}
+
+// HeavyHitters returns the tracked elements whose estimated count exceeds the
+// threshold, with their estimates, from highest to lowest count. This is an
+// approximation in both directions: since estimates are correct within
+// epsilon * total count with a probability of delta, an element may be
+// reported although its true count is up to that much below the threshold.
+// An element whose true count exceeds the threshold is always reported as long
+// as the threshold is at least the minCount given to TrackHeavyHitters and the
+// element was last added while tracking was enabled.
+// Returns nil if tracking isn't enabled.
+func (c *CountMinSketch) HeavyHitters(threshold uint64) []HeavyHitter {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+
+	var hitters []HeavyHitter
+	for data := range c.candidates {
+		if count := c.Count([]byte(data)); count > threshold {
+			hitters = append(hitters, HeavyHitter{Data: []byte(data), Count: count})
+		}
+	}
+
+	sort.Slice(hitters, func(i, j int) bool {
+		if hitters[i].Count != hitters[j].Count {
+			return hitters[i].Count > hitters[j].Count
+		}
+		return bytes.Compare(hitters[i].Data, hitters[j].Data) < 0
+	})
+	return hitters
+}
+
+// estimate returns the approximate count for the item with the given base
+// hashes.
+func (c *CountMinSketch) estimate(lower, upper uint32) uint64 {
+	count := uint64(math.MaxUint64)
 	for i := uint(0); i < c.depth; i++ {
-		count = uint64(math.Min(float64(count),
-			float64(c.matrix[i][(uint(lower)+uint(upper)*i)%c.width])))
+		if n := atomic.LoadUint64(&c.matrix[i][(uint(lower)+uint(upper)*i)%c.width]); n < count {
+			count = n
+		}
 	}
 
 	return count
 }
 
-// Merge combines this CountMinSketch with another. Returns an error if the
-// matrix width and depth are not equal.
+// hashKernel returns the base hash values of the data. The hash function is
+// stateful, so concurrent callers take turns using it.
+func (c *CountMinSketch) hashKernel(data []byte) (uint32, uint32) {
+	c.mu.Lock()
+	lower, upper := hashKernel(data, c.hash)
+	c.mu.Unlock()
+	return c.seedHashes(lower, upper)
+}
+
+// seedHashes mixes the seed into the base hashes, so that every row maps an
+// item to a different counter than an unseeded sketch or one with another
+// seed. The hashes are unchanged if the seed is zero.
+func (c *CountMinSketch) seedHashes(lower, upper uint32) (uint32, uint32) {
+	if c.seed == 0 {
+		return lower, upper
+	}
+	return uint32(mix64(uint64(lower) ^ c.seed)), uint32(mix64(uint64(upper) ^ c.seed))
+}
+
+// Merge combines this CountMinSketch with another. Both must use the same hash
+// function and seed, since counters are only comparable if every item maps to
+// the same counters in both. Returns an error if the matrix width and depth or
+// the seeds are not equal.
 func (c *CountMinSketch) Merge(other *CountMinSketch) error {
 	if c.depth != other.depth {
 		return errors.New("matrix depth must match")
@@ -120,6 +255,10 @@ func (c *CountMinSketch) Merge(other *CountMinSketch) error {
 		return errors.New("matrix width must match")
 	}
 
+	if c.seed != other.seed {
+		return errors.New("seed must match")
+	}
+
 	for i := uint(0); i < c.depth; i++ {
 		for j := uint(0); j < c.width; j++ {
 			c.matrix[i][j] += other.matrix[i][j]
@@ -127,9 +266,44 @@ func (c *CountMinSketch) Merge(other *CountMinSketch) error {
 	}
 
 	c.count += other.count
+
+	// Candidates of the other sketch may be heavy hitters of the merged one.
+	c.mergeCandidates(other)
 	return nil
 }
 
+// mergeCandidates adds the other sketch's heavy hitter candidates to this
+// sketch's if tracking is enabled. They're copied before this sketch's
+// candidates are locked, so that merging a sketch into itself, or two sketches
+// into each other at the same time, can't deadlock.
+func (c *CountMinSketch) mergeCandidates(other *CountMinSketch) {
+	if c.candidates != nil && other != c {
+		other.cmu.Lock()
+		candidates := make([]string, 0, len(other.candidates))
+		for data := range other.candidates {
+			candidates = append(candidates, data)
+		}
+		other.cmu.Unlock()
+
+		c.cmu.Lock()
+		for _, data := range candidates {
+			c.candidates[data] = struct{}{}
+		}
+		c.cmu.Unlock()
+	}
+}
+
+// decay multiplies every counter and the total count by the factor, rounding
+// down.
+func (c *CountMinSketch) decay(factor float64) {
+	for i := range c.matrix {
+		for j, n := range c.matrix[i] {
+			c.matrix[i][j] = uint64(float64(n) * factor)
+		}
+	}
+	c.count = uint64(float64(c.count) * factor)
+}
+
 // Reset restores the CountMinSketch to its original state. It returns itself
 // to allow for chaining.
 func (c *CountMinSketch) Reset() *CountMinSketch {
@@ -140,6 +314,11 @@ func (c *CountMinSketch) Reset() *CountMinSketch {
 
 	c.matrix = matrix
 	c.count = 0
+	c.cmu.Lock()
+	if c.candidates != nil {
+		c.candidates = make(map[string]struct{})
+	}
+	c.cmu.Unlock()
 	return c
 }
 
@@ -148,6 +327,108 @@ func (c *CountMinSketch) SetHash(h hash.Hash64) {
 	c.hash = h
 }
 
+// SetSeed sets the hash seed, which is mixed into the base hashes from which
+// every row's counter is derived, so that the counter mapping differs from an
+// unseeded CountMinSketch. CountMinSketches can only be merged if they use the
+// same seed. The seed is written by WriteTo, so a sketch read with ReadFrom
+// maps items to the same counters and can be merged with sketches of the same
+// lineage. A seed of zero disables seeding, which is the default. The
+// CountMinSketch should be empty when the seed is set.
+func (c *CountMinSketch) SetSeed(seed uint64) {
+	c.seed = seed
+}
+
+// Seed returns the hash seed.
+func (c *CountMinSketch) Seed() uint64 {
+	return c.seed
+}
+
+// WriteTo writes a binary representation of the CountMinSketch, including its
+// configuration and seed, to an i/o stream. Candidate heavy hitters aren't
+// included. It returns the number of bytes written.
+func (c *CountMinSketch) WriteTo(stream io.Writer) (int64, error) {
+	e := newEncoder(stream)
+	e.header()
+	e.float64(c.epsilon)
+	e.float64(c.delta)
+	e.uvarint(uint64(c.width))
+	e.uvarint(uint64(c.depth))
+	e.uint64(c.seed)
+	e.uvarint(atomic.LoadUint64(&c.count))
+	for _, row := range c.matrix {
+		for i := range row {
+			e.uvarint(atomic.LoadUint64(&row[i]))
+		}
+	}
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of CountMinSketch (such as might
+// have been written by WriteTo()) from an i/o stream, replacing the sketch's
+// configuration, seed and counters. Candidate heavy hitters are cleared. It
+// returns the number of bytes read.
+func (c *CountMinSketch) ReadFrom(stream io.Reader) (int64, error) {
+	d, _, err := readHeader(stream)
+	if err != nil {
+		return 0, err
+	}
+	if d == nil {
+		return 0, errors.New("invalid format header")
+	}
+
+	var (
+		epsilon = d.float64()
+		delta   = d.float64()
+		width   = d.length(8)
+		depth   uint64
+	)
+	if d.err == nil && width == 0 {
+		d.err = errors.New("matrix width must be positive")
+	}
+	if d.err == nil {
+		depth = d.length(8 * width)
+	}
+	var (
+		seed  = d.uint64()
+		count = d.uvarint()
+	)
+
+	// Every counter takes at least a byte, so rows are grown as counters are
+	// read rather than allocated up front, which bounds the memory allocated
+	// by the length of the stream instead of the declared dimensions.
+	var (
+		rowCap = width
+		matrix [][]uint64
+	)
+	if rowCap > decodeChunkSize/8 {
+		rowCap = decodeChunkSize / 8
+	}
+	for i := uint64(0); i < depth && d.err == nil; i++ {
+		row := make([]uint64, 0, rowCap)
+		for j := uint64(0); j < width && d.err == nil; j++ {
+			row = append(row, d.uvarint())
+		}
+		matrix = append(matrix, row)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	c.epsilon = epsilon
+	c.delta = delta
+	c.width = uint(width)
+	c.depth = uint(depth)
+	c.seed = seed
+	c.count = count
+	c.matrix = matrix
+	c.cmu.Lock()
+	if c.candidates != nil {
+		c.candidates = make(map[string]struct{})
+	}
+	c.cmu.Unlock()
+	return d.n, nil
+}
+
 // WriteDataTo writes a binary representation of the CMS data to
 // an io stream. It returns the number of bytes written and error
 func (c *CountMinSketch) WriteDataTo(stream io.Writer) (int, error) {
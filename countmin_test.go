@@ -2,8 +2,11 @@ package boom
 
 import (
 	"bytes"
+	"math/rand"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -20,6 +23,37 @@ func TestCMSTotalCount(t *testing.T) {
 	}
 }
 
+// Ensures that Width and Depth return the sketch dimensions and that
+// RecommendedResize returns the dimensions for a new error factor.
+func TestCMSRecommendedResize(t *testing.T) {
+	cms := NewCountMinSketch(0.01, 0.001)
+
+	if width := cms.Width(); width != 272 {
+		t.Errorf("Expected 272, got %d", width)
+	}
+
+	if depth := cms.Depth(); depth != 7 {
+		t.Errorf("Expected 7, got %d", depth)
+	}
+
+	// The current error factor recommends the current dimensions.
+	if width, depth := cms.RecommendedResize(0.01); width != 272 || depth != 7 {
+		t.Errorf("Expected 272x7, got %dx%d", width, depth)
+	}
+
+	// A ten times smaller error needs ten times the width, with the same
+	// depth.
+	width, depth := cms.RecommendedResize(0.001)
+	if width != 2719 || depth != 7 {
+		t.Errorf("Expected 2719x7, got %dx%d", width, depth)
+	}
+
+	rebuilt := NewCountMinSketch(0.001, cms.Delta())
+	if rebuilt.Width() != width || rebuilt.Depth() != depth {
+		t.Errorf("Expected %dx%d, got %dx%d", width, depth, rebuilt.Width(), rebuilt.Depth())
+	}
+}
+
 // Ensures that Add adds to the set and Count returns the correct
 // approximation.
 func TestCMSAddAndCount(t *testing.T) {
@@ -56,6 +90,37 @@ func TestCMSAddAndCount(t *testing.T) {
 	}
 }
 
+// Ensures that Add and Count are safe for concurrent use.
+func TestCMSConcurrentAddAndCount(t *testing.T) {
+	cms := NewCountMinSketch(0.001, 0.99)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				cms.Add([]byte(`a`))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				cms.Count([]byte(`a`))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := cms.Count([]byte(`a`)); count != 8000 {
+		t.Errorf("expected 8000, got %d", count)
+	}
+
+	if count := cms.TotalCount(); count != 8000 {
+		t.Errorf("expected 8000, got %d", count)
+	}
+}
+
 // Ensures that Merge combines the two sketches.
 func TestCMSMerge(t *testing.T) {
 	cms := NewCountMinSketch(0.001, 0.99)
@@ -117,6 +182,106 @@ func TestCMSReset(t *testing.T) {
 	}
 }
 
+// Ensures that HeavyHitters reports every element of a skewed stream whose
+// count exceeds the threshold, and only elements close to it.
+func TestCMSHeavyHitters(t *testing.T) {
+	cms := NewCountMinSketch(0.001, 0.01)
+	if hitters := cms.HeavyHitters(0); hitters != nil {
+		t.Errorf("expected nil, got %v", hitters)
+	}
+
+	var (
+		rng    = rand.New(rand.NewSource(1))
+		zipf   = rand.NewZipf(rng, 1.2, 1, 9999)
+		counts = make(map[string]uint64)
+		total  = uint64(100000)
+		// Elements must make up more than 1% of the stream.
+		threshold = total / 100
+	)
+
+	cms.TrackHeavyHitters(threshold)
+	for i := uint64(0); i < total; i++ {
+		data := strconv.FormatUint(zipf.Uint64(), 10)
+		counts[data]++
+		cms.Add([]byte(data))
+	}
+
+	hitters := cms.HeavyHitters(threshold)
+	reported := make(map[string]bool)
+	for i, hitter := range hitters {
+		reported[string(hitter.Data)] = true
+		actual := counts[string(hitter.Data)]
+		if hitter.Count < actual {
+			t.Errorf("expected at least %d, got %d", actual, hitter.Count)
+		}
+		if actual+uint64(cms.Epsilon()*float64(total)) < threshold {
+			t.Errorf("expected %s to be close to the threshold, got %d", hitter.Data, actual)
+		}
+		if i > 0 && hitters[i-1].Count < hitter.Count {
+			t.Error("expected heavy hitters in descending order")
+		}
+	}
+
+	expected := 0
+	for data, count := range counts {
+		if count > threshold {
+			expected++
+			if !reported[data] {
+				t.Errorf("expected %s with count %d to be reported", data, count)
+			}
+		}
+	}
+
+	if expected == 0 || len(hitters) > 2*expected {
+		t.Errorf("expected about %d heavy hitters, got %d", expected, len(hitters))
+	}
+
+	if n := len(cms.candidates); n > int(total/threshold)*2 {
+		t.Errorf("expected at most %d candidates, got %d", total/threshold*2, n)
+	}
+
+	cms.Reset()
+	if hitters := cms.HeavyHitters(0); len(hitters) != 0 {
+		t.Errorf("expected no heavy hitters, got %d", len(hitters))
+	}
+}
+
+// Ensures that merging tracking sketches into themselves or into each other
+// from two goroutines doesn't deadlock on the candidates.
+func TestCMSMergeTrackingNoDeadlock(t *testing.T) {
+	var (
+		a = NewCountMinSketch(0.001, 0.01).TrackHeavyHitters(1)
+		b = NewCountMinSketch(0.001, 0.01).TrackHeavyHitters(1)
+	)
+	a.Add([]byte(`a`))
+	b.Add([]byte(`b`))
+
+	if err := a.Merge(a); err != nil {
+		t.Fatal(err)
+	}
+	if count := a.Count([]byte(`a`)); count != 2 {
+		t.Errorf("expected 2, got %d", count)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			a.mergeCandidates(b)
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		b.mergeCandidates(a)
+	}
+	<-done
+
+	for _, cms := range []*CountMinSketch{a, b} {
+		if n := len(cms.candidates); n != 2 {
+			t.Errorf("expected 2 candidates, got %d", n)
+		}
+	}
+}
+
 // Test binary serialization
 func TestCMSSerialization(t *testing.T) {
 	freq := 73
@@ -166,6 +331,128 @@ func TestCMSSerialization(t *testing.T) {
 
 }
 
+// Ensures that WriteTo and ReadFrom preserve the configuration and seed, so
+// that a reloaded sketch counts items the same way and can be merged with a
+// sketch of the same lineage.
+func TestCMSWriteToReadFrom(t *testing.T) {
+	cms := NewCountMinSketch(0.01, 0.01)
+	cms.SetSeed(42)
+	for i := 0; i < 1000; i++ {
+		cms.Add([]byte(strconv.Itoa(i % 100)))
+	}
+
+	var buf bytes.Buffer
+	wn, err := cms.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wn != int64(buf.Len()) {
+		t.Errorf("Expected %d, got %d", buf.Len(), wn)
+	}
+
+	reloaded := NewCountMinSketch(0.1, 0.1)
+	rn, err := reloaded.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rn != wn {
+		t.Errorf("Expected %d, got %d", wn, rn)
+	}
+
+	if seed := reloaded.Seed(); seed != 42 {
+		t.Errorf("Expected 42, got %d", seed)
+	}
+
+	if reloaded.Epsilon() != 0.01 || reloaded.Delta() != 0.01 {
+		t.Errorf("Expected 0.01 and 0.01, got %f and %f", reloaded.Epsilon(), reloaded.Delta())
+	}
+
+	if count := reloaded.TotalCount(); count != 1000 {
+		t.Errorf("Expected 1000, got %d", count)
+	}
+
+	for i := 0; i < 100; i++ {
+		data := []byte(strconv.Itoa(i))
+		if count := reloaded.Count(data); count != cms.Count(data) {
+			t.Errorf("Expected %d, got %d", cms.Count(data), count)
+		}
+	}
+
+	// A sketch of the same lineage can be merged into the reloaded one.
+	other := NewCountMinSketch(0.01, 0.01)
+	other.SetSeed(42)
+	other.Add([]byte(`0`))
+	if err := reloaded.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := reloaded.Count([]byte(`0`)); count != cms.Count([]byte(`0`))+1 {
+		t.Errorf("Expected %d, got %d", cms.Count([]byte(`0`))+1, count)
+	}
+
+	if err := reloaded.Merge(NewCountMinSketch(0.01, 0.01)); err == nil {
+		t.Error("Expected error for a different seed")
+	}
+
+	if _, err := reloaded.ReadFrom(bytes.NewReader([]byte{1, 2, 3, 4})); err == nil {
+		t.Error("Expected error for an invalid header")
+	}
+}
+
+// Ensures that ReadFrom doesn't allocate the declared dimensions before the
+// counters are read, so a short stream declaring a huge matrix fails cheaply.
+func TestCMSReadFromTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	e := newEncoder(&buf)
+	e.header()
+	e.float64(0.001)
+	e.float64(0.99)
+	e.uvarint(1 << 27)
+	e.uvarint(1)
+	e.uint64(0)
+	e.uvarint(0)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := NewCountMinSketch(0.001, 0.99).ReadFrom(&buf); err == nil {
+		t.Error("Expected error")
+	}
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("Expected at most %d bytes allocated, got %d", 16<<20, allocated)
+	}
+}
+
+// Ensures that the seed changes the counters items map to.
+func TestCMSSeed(t *testing.T) {
+	var (
+		unseeded = NewCountMinSketch(0.01, 0.01)
+		seeded   = NewCountMinSketch(0.01, 0.01)
+	)
+	seeded.SetSeed(42)
+	unseeded.Add([]byte(`a`))
+	seeded.Add([]byte(`a`))
+
+	same := 0
+	for i := range unseeded.matrix {
+		for j := range unseeded.matrix[i] {
+			if unseeded.matrix[i][j] != 0 && seeded.matrix[i][j] != 0 {
+				same++
+			}
+		}
+	}
+	if same == len(unseeded.matrix) {
+		t.Error("Expected the seeded sketch to use different counters")
+	}
+
+	if count := seeded.Count([]byte(`a`)); count != 1 {
+		t.Errorf("Expected 1, got %d", count)
+	}
+}
+
 func BenchmarkCMSWriteDataTo(b *testing.B) {
 	b.StopTimer()
 	freq := 73
@@ -250,3 +537,12 @@ func BenchmarkCMSCount(b *testing.B) {
 		cms.Count(data[n])
 	}
 }
+
+func BenchmarkCMSAddParallel(b *testing.B) {
+	cms := NewCountMinSketch(0.001, 0.99)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cms.Add([]byte(`a`))
+		}
+	})
+}
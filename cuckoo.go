@@ -68,6 +68,10 @@ type CuckooFilter struct {
 	f       uint        // length of fingerprints (in bytes)
 	count   uint        // number of items in the filter
 	n       uint        // filter capacity
+
+	semiSorted bool     // whether buckets are semi-sorted
+	fpBits     uint     // length of semi-sorted fingerprints (in bits)
+	packed     *Buckets // semi-sorted bucket data
 }
 
 // NewCuckooFilter creates a new Cuckoo Bloom filter optimized to store n items
@@ -113,6 +117,10 @@ func (c *CuckooFilter) Count() uint {
 // member, false if not. This is a probabilistic test, meaning there is a
 // non-zero probability of false positives.
 func (c *CuckooFilter) Test(data []byte) bool {
+	if c.semiSorted {
+		return c.testSemiSorted(data)
+	}
+
 	i1, i2, f := c.components(data)
 
 	// If either bucket contains f, it's a member.
@@ -125,6 +133,10 @@ func (c *CuckooFilter) Test(data []byte) bool {
 // this, use Count and Capacity to check if the filter is full before adding an
 // item.
 func (c *CuckooFilter) Add(data []byte) error {
+	if c.semiSorted {
+		return c.addSemiSorted(c.semiSortedComponents(data))
+	}
+
 	return c.add(c.components(data))
 }
 
@@ -134,6 +146,10 @@ func (c *CuckooFilter) Add(data []byte) error {
 // item. This introduces a possibility for false negatives. To avoid this, use
 // Count and Capacity to check if the filter is full before adding an item.
 func (c *CuckooFilter) TestAndAdd(data []byte) (bool, error) {
+	if c.semiSorted {
+		return c.testAndAddSemiSorted(data)
+	}
+
 	i1, i2, f := c.components(data)
 
 	// If either bucket contains f, it's a member.
@@ -147,6 +163,10 @@ func (c *CuckooFilter) TestAndAdd(data []byte) (bool, error) {
 // TestAndRemove will test for membership of the data and remove it from the
 // filter if it exists. Returns true if the data was a member, false if not.
 func (c *CuckooFilter) TestAndRemove(data []byte) bool {
+	if c.semiSorted {
+		return c.testAndRemoveSemiSorted(data)
+	}
+
 	i1, i2, f := c.components(data)
 
 	// Try to remove from bucket[i1].
@@ -171,6 +191,12 @@ func (c *CuckooFilter) TestAndRemove(data []byte) bool {
 // Reset restores the Bloom filter to its original state. It returns the filter
 // to allow for chaining.
 func (c *CuckooFilter) Reset() *CuckooFilter {
+	if c.semiSorted {
+		c.packed.Reset()
+		c.count = 0
+		return c
+	}
+
 	buckets := make([]bucket, c.m)
 	for i := uint(0); i < c.m; i++ {
 		buckets[i] = make(bucket, c.b)
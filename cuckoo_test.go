@@ -147,6 +147,110 @@ func TestCuckooReset(t *testing.T) {
 	}
 }
 
+// Ensures that a semi-sorted Cuckoo Filter supports Test, Add, TestAndAdd and
+// TestAndRemove without false negatives.
+func TestSemiSortedCuckooTestAndAdd(t *testing.T) {
+	f := NewSemiSortedCuckooFilter(100, 0.1)
+
+	if !f.SemiSorted() {
+		t.Error("Expected filter to be semi-sorted")
+	}
+
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if f.Add([]byte(`a`)) != nil {
+		t.Error("error should be nil")
+	}
+
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	if member, err := f.TestAndAdd([]byte(`b`)); member {
+		t.Error("`b` should not be a member")
+	} else if err != nil {
+		t.Error("error should be nil")
+	}
+
+	if !f.TestAndRemove([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	// Fill most of the filter so items are relocated.
+	for i := 0; i < 3500; i++ {
+		if err := f.Add([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error adding %d: %v", i, err)
+		}
+	}
+
+	for i := 0; i < 3500; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	for i := 0; i < 3500; i += 2 {
+		if !f.TestAndRemove([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	for i := 1; i < 3500; i += 2 {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if count := f.Count(); count != 1751 {
+		t.Errorf("Expected 1751, got %d", count)
+	}
+
+	if f.Reset() != f {
+		t.Error("Returned CuckooFilter should be the same instance")
+	}
+
+	if f.Test([]byte(`b`)) {
+		t.Error("`b` should not be a member")
+	}
+}
+
+// Ensures that semi-sorting lowers the false-positive rate at the same memory.
+func TestSemiSortedCuckooFalsePositiveRate(t *testing.T) {
+	var (
+		f  = NewCuckooFilter(1000, 0.1)
+		ss = NewSemiSortedCuckooFilter(1000, 0.1)
+	)
+	for i := 0; i < 30000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		ss.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if bits := uint(len(ss.packed.data)) * 8; bits != f.m*f.b*f.f*8 {
+		t.Errorf("Expected %d bits, got %d", f.m*f.b*f.f*8, bits)
+	}
+
+	fps, ssFps := 0, 0
+	for i := 0; i < 100000; i++ {
+		data := []byte(strconv.Itoa(-i - 1))
+		if f.Test(data) {
+			fps++
+		}
+		if ss.Test(data) {
+			ssFps++
+		}
+	}
+
+	if float64(ssFps) > 0.75*float64(fps) {
+		t.Errorf("Expected fewer than %d false positives, got %d", int(0.75*float64(fps)), ssFps)
+	}
+}
+
 func BenchmarkCuckooAdd(b *testing.B) {
 	b.StopTimer()
 	f := NewCuckooFilter(uint(b.N), 0.1)
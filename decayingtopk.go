@@ -0,0 +1,77 @@
+package boom
+
+// DecayingTopK is a TopK whose frequencies decay, so that recent occurrences
+// dominate and elements which stop appearing fall out of the top-k. This is
+// useful for detecting trending elements. A decay multiplies every frequency
+// tracked by the underlying Count-Min Sketch and the top-k heap by a factor,
+// either every N additions as configured with SetDecay or whenever Decay is
+// called, e.g. on a timer.
+type DecayingTopK struct {
+	topk   *TopK   // underlying top-k
+	factor float64 // multiplier applied by each decay
+	everyN uint    // additions between decays, 0 if only on demand
+	adds   uint    // additions since the last decay
+}
+
+// NewDecayingTopK creates a new DecayingTopK backed by a Count-Min sketch
+// whose relative accuracy is within a factor of epsilon with probability
+// delta. It tracks the k-most frequent elements. Frequencies don't decay until
+// SetDecay is called.
+func NewDecayingTopK(epsilon, delta float64, k uint) *DecayingTopK {
+	return &DecayingTopK{topk: NewTopK(epsilon, delta, k), factor: 1}
+}
+
+// SetDecay sets the factor, between 0 exclusive and 1 inclusive, which
+// frequencies are multiplied by on each decay, and the number of additions
+// between decays. A factor outside that range is ignored, since it would wipe
+// out or inflate the frequencies, and the previous factor is kept. If everyN
+// is 0, frequencies only decay when Decay is called. It returns the
+// DecayingTopK to allow for chaining.
+func (d *DecayingTopK) SetDecay(factor float64, everyN uint) *DecayingTopK {
+	if factor > 0 && factor <= 1 {
+		d.factor = factor
+	}
+	d.everyN = everyN
+	d.adds = 0
+	return d
+}
+
+// Add will add the data to the Count-Min Sketch and update the top-k heap if
+// applicable, decaying frequencies afterwards if it's time to. Returns the
+// DecayingTopK to allow for chaining.
+func (d *DecayingTopK) Add(data []byte) *DecayingTopK {
+	d.topk.Add(data)
+	d.adds++
+	if d.everyN > 0 && d.adds >= d.everyN {
+		d.Decay()
+	}
+	return d
+}
+
+// Decay multiplies every frequency by the decay factor, rounding down. It
+// returns the DecayingTopK to allow for chaining.
+func (d *DecayingTopK) Decay() *DecayingTopK {
+	d.topk.cms.decay(d.factor)
+
+	// Scaling every frequency by the same factor keeps the heap ordered.
+	for _, element := range *d.topk.elements {
+		element.Freq = uint64(float64(element.Freq) * d.factor)
+	}
+
+	d.adds = 0
+	return d
+}
+
+// Elements returns the top-k elements from lowest to highest decayed
+// frequency.
+func (d *DecayingTopK) Elements() []*Element {
+	return d.topk.Elements()
+}
+
+// Reset restores the DecayingTopK to its original state, keeping the decay
+// settings. It returns itself to allow for chaining.
+func (d *DecayingTopK) Reset() *DecayingTopK {
+	d.topk.Reset()
+	d.adds = 0
+	return d
+}
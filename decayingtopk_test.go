@@ -0,0 +1,102 @@
+package boom
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// Ensures that Decay scales the frequencies of the elements.
+func TestDecayingTopKDecay(t *testing.T) {
+	topk := NewDecayingTopK(0.001, 0.99, 5)
+	for i := 0; i < 10; i++ {
+		topk.Add([]byte(`a`))
+	}
+
+	if topk.Decay() != topk {
+		t.Error("Returned DecayingTopK should be the same instance")
+	}
+
+	// Without SetDecay, the factor is 1.
+	if freq := topk.Elements()[0].Freq; freq != 10 {
+		t.Errorf("Expected 10, got %d", freq)
+	}
+
+	if topk.SetDecay(0.5, 0) != topk {
+		t.Error("Returned DecayingTopK should be the same instance")
+	}
+	topk.Decay()
+
+	if freq := topk.Elements()[0].Freq; freq != 5 {
+		t.Errorf("Expected 5, got %d", freq)
+	}
+
+	if count := topk.topk.cms.Count([]byte(`a`)); count != 5 {
+		t.Errorf("Expected 5, got %d", count)
+	}
+
+	// Factors outside (0, 1] are ignored.
+	for _, factor := range []float64{0, -0.5, 1.5, math.NaN(), math.Inf(1)} {
+		if topk.SetDecay(factor, 0).factor != 0.5 {
+			t.Errorf("Expected factor %f to be ignored, got %f", factor, topk.factor)
+		}
+	}
+
+	if topk.Reset() != topk {
+		t.Error("Returned DecayingTopK should be the same instance")
+	}
+
+	if l := len(topk.Elements()); l != 0 {
+		t.Errorf("Expected 0, got %d", l)
+	}
+}
+
+// Ensures that an element which was frequent early but stops appearing drops
+// out of the top-k after enough decays.
+func TestDecayingTopKTrending(t *testing.T) {
+	topk := NewDecayingTopK(0.001, 0.99, 3).SetDecay(0.5, 100)
+
+	// `old` dominates the first part of the stream.
+	for i := 0; i < 1000; i++ {
+		topk.Add([]byte(`old`))
+		if i%10 == 0 {
+			topk.Add([]byte(strconv.Itoa(i % 3)))
+		}
+	}
+
+	if !containsElement(topk.Elements(), `old`) {
+		t.Error("Expected `old` to be in the top-k")
+	}
+
+	// Afterwards, only other elements appear.
+	for i := 0; i < 3000; i++ {
+		topk.Add([]byte(strconv.Itoa(i % 5)))
+	}
+
+	if containsElement(topk.Elements(), `old`) {
+		t.Error("Expected `old` to have dropped out of the top-k")
+	}
+
+	// Without decay, `old` would still be the most frequent element.
+	plain := NewTopK(0.001, 0.99, 3)
+	for i := 0; i < 1000; i++ {
+		plain.Add([]byte(`old`))
+	}
+	for i := 0; i < 3000; i++ {
+		plain.Add([]byte(strconv.Itoa(i % 5)))
+	}
+
+	if !containsElement(plain.Elements(), `old`) {
+		t.Error("Expected `old` to be in the top-k without decay")
+	}
+}
+
+// containsElement indicates if the elements contain the data.
+func containsElement(elements []*Element, data string) bool {
+	for _, element := range elements {
+		if string(element.Data) == data {
+			return true
+		}
+	}
+	return false
+}
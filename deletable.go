@@ -1,8 +1,11 @@
 package boom
 
 import (
+	"bytes"
+	"errors"
 	"hash"
 	"hash/fnv"
+	"io"
 )
 
 // DeletableBloomFilter implements a Deletable Bloom Filter as described by
@@ -93,7 +96,7 @@ func (d *DeletableBloomFilter) Add(data []byte) Filter {
 		idx := (uint(lower) + uint(upper)*i) % d.m
 		if d.buckets.Get(idx) != 0 {
 			// Collision, set corresponding region bit.
-			d.collisions.Set(idx/d.regionSize, 1)
+			d.collisions.Set(d.region(idx), 1)
 		} else {
 			d.buckets.Set(idx, 1)
 		}
@@ -116,7 +119,7 @@ func (d *DeletableBloomFilter) TestAndAdd(data []byte) bool {
 			member = false
 		} else {
 			// Collision, set corresponding region bit.
-			d.collisions.Set(idx/d.regionSize, 1)
+			d.collisions.Set(d.region(idx), 1)
 		}
 		d.buckets.Set(idx, 1)
 	}
@@ -141,7 +144,7 @@ func (d *DeletableBloomFilter) TestAndRemove(data []byte) bool {
 
 	if member {
 		for _, idx := range d.indexBuffer {
-			if d.collisions.Get(idx/d.regionSize) == 0 {
+			if d.collisions.Get(d.region(idx)) == 0 {
 				// Clear only bits located in collision-free zones.
 				d.buckets.Set(idx, 0)
 			}
@@ -152,6 +155,49 @@ func (d *DeletableBloomFilter) TestAndRemove(data []byte) bool {
 	return member
 }
 
+// region returns the index of the collision region holding the bit. Since the
+// region size is rounded down, the bits past the last whole region belong to
+// the last region.
+func (d *DeletableBloomFilter) region(idx uint) uint {
+	if region := idx / d.regionSize; region < d.collisions.count {
+		return region
+	}
+	return d.collisions.count - 1
+}
+
+// Remove will remove the data from the filter if it's a member and can be
+// deleted without introducing false negatives. Only bits located in
+// collision-free regions are cleared, so an element can be deleted if at least
+// one of its bits lies in such a region. Returns true if the data was deleted,
+// false if it wasn't a member or all of its bits share regions with
+// collisions, in which case the filter is left unchanged.
+func (d *DeletableBloomFilter) Remove(data []byte) bool {
+	lower, upper := hashKernel(data, d.hash)
+	deletable := false
+
+	for i := uint(0); i < d.k; i++ {
+		d.indexBuffer[i] = (uint(lower) + uint(upper)*i) % d.m
+		if d.buckets.Get(d.indexBuffer[i]) == 0 {
+			return false
+		}
+		if d.collisions.Get(d.region(d.indexBuffer[i])) == 0 {
+			deletable = true
+		}
+	}
+
+	if !deletable {
+		return false
+	}
+
+	for _, idx := range d.indexBuffer {
+		if d.collisions.Get(d.region(idx)) == 0 {
+			d.buckets.Set(idx, 0)
+		}
+	}
+	d.count--
+	return true
+}
+
 // Reset restores the Bloom filter to its original state. It returns the filter
 // to allow for chaining.
 func (d *DeletableBloomFilter) Reset() *DeletableBloomFilter {
@@ -166,3 +212,78 @@ func (d *DeletableBloomFilter) Reset() *DeletableBloomFilter {
 func (d *DeletableBloomFilter) SetHash(h hash.Hash64) {
 	d.hash = h
 }
+
+// WriteTo writes a binary representation of the DeletableBloomFilter to an i/o
+// stream. It returns the number of bytes written.
+func (d *DeletableBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	e := newEncoder(stream)
+	e.header()
+	e.uvarint(uint64(d.m))
+	e.uvarint(uint64(d.k))
+	e.uvarint(uint64(d.regionSize))
+	e.uvarint(uint64(d.count))
+	d.buckets.encode(e)
+	d.collisions.encode(e)
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of DeletableBloomFilter (such as
+// might have been written by WriteTo()) from an i/o stream. It returns the
+// number of bytes read.
+func (d *DeletableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	dec, _, err := readHeader(stream)
+	if err != nil {
+		return 0, err
+	}
+	if dec == nil {
+		return 0, errors.New("invalid format header")
+	}
+
+	var (
+		m          = dec.uvarint()
+		k          = dec.length(ptrSize)
+		regionSize = dec.uvarint()
+		count      = dec.uvarint()
+		buckets    Buckets
+		collisions Buckets
+	)
+	buckets.decode(dec)
+	collisions.decode(dec)
+	if dec.err == nil && (m == 0 || uint64(buckets.Count()) != m) {
+		dec.err = errors.New("number of buckets must match filter size")
+	}
+	if dec.err == nil && (regionSize == 0 || collisions.Count() == 0) {
+		dec.err = errors.New("region size and number of regions must be positive")
+	}
+	if dec.err != nil {
+		return 0, dec.err
+	}
+
+	d.m = uint(m)
+	d.k = uint(k)
+	d.regionSize = uint(regionSize)
+	d.count = uint(count)
+	d.buckets = &buckets
+	d.collisions = &collisions
+	d.indexBuffer = make([]uint, k)
+	return dec.n, nil
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (d *DeletableBloomFilter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := d.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder interface.
+func (d *DeletableBloomFilter) GobDecode(data []byte) error {
+	buf := bytes.NewBuffer(data)
+	_, err := d.ReadFrom(buf)
+
+	return err
+}
@@ -1,6 +1,8 @@
 package boom
 
 import (
+	"bytes"
+	"encoding/gob"
 	"strconv"
 	"testing"
 )
@@ -114,6 +116,93 @@ func TestDeletableTestAndRemove(t *testing.T) {
 	}
 }
 
+// Ensures that Remove deletes elements in collision-free regions without
+// introducing false negatives for the remaining elements.
+func TestDeletableRemove(t *testing.T) {
+	d := NewDeletableBloomFilter(1000, 200, 0.01)
+
+	if d.Remove([]byte(`a`)) {
+		t.Error("`a` should not be removed")
+	}
+
+	for i := 0; i < 500; i++ {
+		d.Add([]byte(strconv.Itoa(i)))
+	}
+
+	removed := 0
+	for i := 0; i < 500; i += 2 {
+		if d.Remove([]byte(strconv.Itoa(i))) {
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		t.Error("Expected some elements to be removed")
+	}
+
+	if count := d.Count(); count != uint(500-removed) {
+		t.Errorf("Expected %d, got %d", 500-removed, count)
+	}
+
+	for i := 1; i < 500; i += 2 {
+		if !d.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that Remove leaves the filter unchanged when every bit of the
+// element lies in a region with collisions.
+func TestDeletableRemoveCollisions(t *testing.T) {
+	d := NewDeletableBloomFilter(100, 1, 0.1)
+	for i := 0; d.collisions.Get(0) == 0; i++ {
+		d.Add([]byte(strconv.Itoa(i)))
+	}
+	count := d.Count()
+
+	if d.Remove([]byte(`0`)) {
+		t.Error("`0` should not be removed")
+	}
+
+	if !d.Test([]byte(`0`)) {
+		t.Error("`0` should be a member")
+	}
+
+	if d.Count() != count {
+		t.Errorf("Expected %d, got %d", count, d.Count())
+	}
+}
+
+// Ensures that the bits past the last whole region belong to the last region
+// when the filter size isn't a multiple of r, so that they neither map past
+// the collision bits nor keep the filter from being decoded.
+func TestDeletableRegions(t *testing.T) {
+	d := NewDeletableBloomFilter(100, 7, 0.1)
+	if d.m%7 == 0 {
+		t.Fatalf("Expected a size which isn't a multiple of 7, got %d", d.m)
+	}
+
+	if region := d.region(7*d.regionSize - 1); region != 6 {
+		t.Errorf("Expected 6, got %d", region)
+	}
+
+	if region := d.region(d.m - 1); region != 6 {
+		t.Errorf("Expected 6, got %d", region)
+	}
+
+	for i := 0; i < 200; i++ {
+		d.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDeletableBloomFilter(10, 2, 0.1).ReadFrom(&buf); err != nil {
+		t.Error(err)
+	}
+}
+
 // Ensures that Reset sets every bit to zero and the count is zero.
 func TestDeletableReset(t *testing.T) {
 	d := NewDeletableBloomFilter(100, 10, 0.1)
@@ -170,6 +259,53 @@ func BenchmarkDeletableTest(b *testing.B) {
 	}
 }
 
+// Ensures that DeletableBloomFilter can be serialized and deserialized without
+// losing members or deletability.
+func TestDeletableGob(t *testing.T) {
+	f := NewDeletableBloomFilter(100, 10, 0.01)
+	for i := 0; i < 50; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := NewDeletableBloomFilter(10, 2, 0.1)
+	if err := gob.NewDecoder(&buf).Decode(f2); err != nil {
+		t.Fatal(err)
+	}
+
+	if f2.Capacity() != f.Capacity() || f2.K() != f.K() || f2.Count() != f.Count() {
+		t.Errorf("Expected %d, %d, %d, got %d, %d, %d",
+			f.Capacity(), f.K(), f.Count(), f2.Capacity(), f2.K(), f2.Count())
+	}
+
+	for i := 0; i < 50; i++ {
+		if !f2.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// Collision data is preserved, so removals behave the same.
+	for i := 0; i < 50; i++ {
+		data := []byte(strconv.Itoa(i))
+		if f.Remove(data) != f2.Remove(data) {
+			t.Errorf("Expected removal of %d to match", i)
+		}
+	}
+
+	// Corrupted data is rejected.
+	buf.Reset()
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.ReadFrom(bytes.NewReader(buf.Bytes()[:buf.Len()/2])); err == nil {
+		t.Error("Expected error")
+	}
+}
+
 func BenchmarkDeletableTestAndAdd(b *testing.B) {
 	b.StopTimer()
 	d := NewDeletableBloomFilter(100, 10, 0.1)
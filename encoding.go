@@ -0,0 +1,349 @@
+package boom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// formatMagic identifies the compact binary format written by WriteTo. It's
+// followed by a one-byte format version. Blobs in the original fixed-width
+// format never start with it, since their first byte is a bucket size of at
+// most 8, the high byte of an 8-byte length, or the sign and exponent of a
+// positive float64, so ReadFrom can tell the formats apart.
+var formatMagic = [3]byte{0xb0, 0x0f, 0x5e}
+
+const (
+	// formatVersion is the version of the compact binary format. Version 2
+	// added the index mapping of partitioned filters. Older versions can still
+	// be read.
+	formatVersion = 2
+
+	// headerSize is the size of the fixed-width format header in bytes.
+	headerSize = len(formatMagic) + 1
+
+	// littleEndianFlag is set in the version byte of the header if
+	// fixed-width values are little-endian rather than big-endian.
+	littleEndianFlag = 0x80
+)
+
+// Encodings of Buckets data.
+const (
+	denseBuckets  = 0 // every byte of the data
+	sparseBuckets = 1 // the index gap and value of every non-zero byte
+)
+
+// Mappings of base hashes to partition indices.
+const (
+	moduloIndex    = 0 // the combined hash modulo the partition size
+	fastRangeIndex = 1 // Lemire's fast range reduction of the mixed combined hash
+)
+
+// encoder writes the compact binary format. Integers are written as uvarints
+// unless stated otherwise. The first error is kept and makes every further
+// write a no-op.
+type encoder struct {
+	w     io.Writer
+	n     int64
+	err   error
+	buf   [binary.MaxVarintLen64]byte
+	order binary.ByteOrder
+}
+
+// newEncoder returns an encoder which writes to the stream. Fixed-width values
+// are big-endian unless the stream was wrapped by WriteToOrder.
+func newEncoder(stream io.Writer) *encoder {
+	if w, ok := stream.(*orderWriter); ok {
+		w.used = true
+		return &encoder{w: stream, order: w.order}
+	}
+	return &encoder{w: stream, order: binary.BigEndian}
+}
+
+// write writes raw bytes.
+func (e *encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	n, err := e.w.Write(p)
+	e.n += int64(n)
+	e.err = err
+}
+
+// header writes the format magic and version, flagged with the byte order.
+func (e *encoder) header() {
+	e.write(formatMagic[:])
+	if e.order == binary.LittleEndian {
+		e.byte(formatVersion | littleEndianFlag)
+	} else {
+		e.byte(formatVersion)
+	}
+}
+
+// byte writes a single byte.
+func (e *encoder) byte(x byte) {
+	e.buf[0] = x
+	e.write(e.buf[:1])
+}
+
+// uvarint writes a variable-length unsigned integer.
+func (e *encoder) uvarint(x uint64) {
+	e.write(e.buf[:binary.PutUvarint(e.buf[:], x)])
+}
+
+// uint64 writes a fixed-width unsigned integer, which is more compact than a
+// uvarint for values with high bits set, such as seeds.
+func (e *encoder) uint64(x uint64) {
+	e.order.PutUint64(e.buf[:], x)
+	e.write(e.buf[:8])
+}
+
+// float64 writes a fixed-width float.
+func (e *encoder) float64(x float64) {
+	e.uint64(math.Float64bits(x))
+}
+
+// decoder reads the compact binary format written by an encoder. The first
+// error is kept and makes every further read return zero values.
+type decoder struct {
+	r       io.Reader
+	n       int64
+	err     error
+	buf     [8]byte
+	version byte
+	order   binary.ByteOrder
+	alloc   uint64 // bytes allocated for decoded data so far
+}
+
+// read reads exactly len(p) bytes.
+func (d *decoder) read(p []byte) {
+	if d.err != nil {
+		return
+	}
+	n, err := io.ReadFull(d.r, p)
+	d.n += int64(n)
+	d.err = err
+}
+
+// ReadByte implements io.ByteReader so that uvarints can be read without
+// buffering beyond the end of the structure.
+func (d *decoder) ReadByte() (byte, error) {
+	d.read(d.buf[:1])
+	return d.buf[0], d.err
+}
+
+// byte reads a single byte.
+func (d *decoder) byte() byte {
+	x, _ := d.ReadByte()
+	if d.err != nil {
+		return 0
+	}
+	return x
+}
+
+// uvarint reads a variable-length unsigned integer.
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(d)
+	if err != nil {
+		d.err = err
+		return 0
+	}
+	return x
+}
+
+// length reads a uvarint length of elements of the given size in bytes and
+// checks it against MaxDecodeSize.
+func (d *decoder) length(size uint64) uint64 {
+	n := d.uvarint()
+	if d.err == nil {
+		d.err = checkDecodeSize(n, size)
+	}
+	if d.err != nil {
+		return 0
+	}
+	return n
+}
+
+// reserve charges n bytes which are about to be allocated for decoded data
+// against MaxDecodeSize, which bounds the total allocated while decoding a
+// structure rather than only each declared length. This matters for data
+// which is allocated beyond what the stream holds, such as sparse buckets.
+func (d *decoder) reserve(n uint64) {
+	if d.err != nil {
+		return
+	}
+	if n > MaxDecodeSize || d.alloc > MaxDecodeSize-n {
+		d.err = errors.New("decoded data exceeds MaxDecodeSize")
+		return
+	}
+	d.alloc += n
+}
+
+// bytes reads n raw bytes.
+func (d *decoder) bytes(n uint64) []byte {
+	d.reserve(n)
+	if d.err != nil {
+		return nil
+	}
+	data, err := readBytes(d.r, n)
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	d.n += int64(n)
+	return data
+}
+
+// uint64 reads a fixed-width unsigned integer.
+func (d *decoder) uint64() uint64 {
+	d.read(d.buf[:8])
+	if d.err != nil {
+		return 0
+	}
+	return d.order.Uint64(d.buf[:])
+}
+
+// float64 reads a fixed-width float.
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// indexMapping reads the index mapping of a partitioned filter. Versions of
+// the format before it was written only used the modulo mapping.
+func (d *decoder) indexMapping() byte {
+	if d.version < 2 {
+		return moduloIndex
+	}
+	mapping := d.byte()
+	if d.err == nil && mapping != moduloIndex && mapping != fastRangeIndex {
+		d.err = errors.New("invalid index mapping")
+		return 0
+	}
+	return mapping
+}
+
+// readHeader reads the format header from the stream. If the stream is in the
+// compact format, it returns a decoder positioned after the header, which
+// reads fixed-width values in the byte order recorded in the header.
+// Otherwise it returns nil and a reader which yields the stream from the
+// start, for decoding the original fixed-width format, which is big-endian. If
+// the stream was wrapped by ReadFromOrder, the byte order must match.
+func readHeader(stream io.Reader) (*decoder, io.Reader, error) {
+	var header [headerSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+
+	var (
+		compact = n == headerSize && bytes.Equal(header[:len(formatMagic)], formatMagic[:])
+		version = header[len(formatMagic)]
+		order   = binary.ByteOrder(binary.BigEndian)
+	)
+	if compact && version&littleEndianFlag != 0 {
+		order = binary.LittleEndian
+		version &^= littleEndianFlag
+	}
+
+	if r, ok := stream.(*orderReader); ok {
+		r.checked = true
+		if r.order != order {
+			return nil, nil, fmt.Errorf("expected %v byte order, got %v", r.order, order)
+		}
+	}
+
+	if !compact {
+		return nil, io.MultiReader(bytes.NewReader(header[:n]), stream), nil
+	}
+
+	if version == 0 || version > formatVersion {
+		return nil, nil, errors.New("unsupported format version")
+	}
+
+	return &decoder{r: stream, n: int64(headerSize), version: version, order: order}, nil, nil
+}
+
+// readUpstream returns a reader which yields the stream from the start for
+// decoding the fixed-width format, or an error if the stream starts with the
+// compact format header, which upstream never writes.
+func readUpstream(stream io.Reader) (io.Reader, error) {
+	d, legacy, err := readHeader(stream)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		return nil, errors.New("expected the upstream format, got the compact format")
+	}
+	return legacy, nil
+}
+
+// orderWriter is a stream wrapped by WriteToOrder to carry the byte order to
+// the encoder.
+type orderWriter struct {
+	io.Writer
+	order binary.ByteOrder
+	used  bool
+}
+
+// orderReader is a stream wrapped by ReadFromOrder to carry the expected byte
+// order to readHeader.
+type orderReader struct {
+	io.Reader
+	order   binary.ByteOrder
+	checked bool
+}
+
+// WriteToOrder writes the binary representation of f to the stream like
+// f.WriteTo, but with fixed-width values, such as seeds and floats, in the
+// given byte order, which must be binary.BigEndian or binary.LittleEndian.
+// WriteTo always writes big-endian, i.e. network byte order. The order is
+// recorded in the header, so ReadFrom detects it. Only the compact format, as
+// written by the filters which ReadArchive supports, can be written in either
+// order. It returns the number of bytes written, or an error if f doesn't
+// support the order, in which case nothing is written.
+func WriteToOrder(stream io.Writer, f Serializable, order binary.ByteOrder) (int64, error) {
+	if order != binary.BigEndian && order != binary.LittleEndian {
+		return 0, errors.New("byte order must be big-endian or little-endian")
+	}
+
+	var buf bytes.Buffer
+	w := &orderWriter{Writer: &buf, order: order}
+	if _, err := f.WriteTo(w); err != nil {
+		return 0, err
+	}
+	if !w.used && order != binary.BigEndian {
+		return 0, fmt.Errorf("%T only supports big-endian", f)
+	}
+
+	n, err := stream.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ReadFromOrder reads the binary representation of f from the stream like
+// f.ReadFrom, but returns an error unless it's in the given byte order, for
+// example to enforce the byte order mandated by the system which wrote it.
+// Since the order is recorded in the header, ReadFrom reads either order. It
+// returns the number of bytes read.
+func ReadFromOrder(stream io.Reader, f io.ReaderFrom, order binary.ByteOrder) (int64, error) {
+	r := &orderReader{Reader: stream, order: order}
+	n, err := f.ReadFrom(r)
+	if err == nil && !r.checked && order != binary.BigEndian {
+		return n, fmt.Errorf("%T only supports big-endian", f)
+	}
+	return n, err
+}
+
+// uvarintSize returns the number of bytes x takes as a uvarint.
+func uvarintSize(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,296 @@
+package boom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Ensures that WriteTo uses the compact format, that sparse buckets are
+// written much smaller than their data, and that ReadFrom restores the filter.
+func TestCompactEncodingRoundTrip(t *testing.T) {
+	f := NewDefaultCountingBloomFilter(10000, 0.01)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes written, got %d", buf.Len(), n)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), formatMagic[:]) {
+		t.Error("Expected format magic")
+	}
+
+	// The fixed-width format needs 8 bytes for each of the 3 fields and the
+	// bucket count and length, 2 for the bucket size and maximum value, and
+	// the data itself.
+	fixed := 5*8 + 2 + len(f.buckets.data)
+	if n*5 > int64(fixed) {
+		t.Errorf("Expected at most %d bytes, got %d", fixed/5, n)
+	}
+
+	decoded := NewDefaultCountingBloomFilter(10, 0.1)
+	m, err := decoded.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m != n {
+		t.Errorf("Expected %d bytes read, got %d", n, m)
+	}
+
+	if decoded.Capacity() != f.Capacity() {
+		t.Errorf("Expected capacity %d, got %d", f.Capacity(), decoded.Capacity())
+	}
+
+	if decoded.K() != f.K() {
+		t.Errorf("Expected %d hash functions, got %d", f.K(), decoded.K())
+	}
+
+	if decoded.Count() != 100 {
+		t.Errorf("Expected 100, got %d", decoded.Count())
+	}
+
+	if !bytes.Equal(decoded.buckets.data, f.buckets.data) {
+		t.Error("Expected decoded buckets to match")
+	}
+
+	for i := 0; i < 100; i++ {
+		if !decoded.TestAndRemove([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that dense buckets are written as-is and survive a round trip.
+func TestCompactEncodingDense(t *testing.T) {
+	b := NewBuckets(1000, 8)
+	for i := uint(0); i < 1000; i++ {
+		b.Set(i, uint8(i%255+1))
+	}
+
+	var buf bytes.Buffer
+	n, err := b.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n > int64(len(b.data)+16) {
+		t.Errorf("Expected at most %d bytes, got %d", len(b.data)+16, n)
+	}
+
+	decoded := NewBuckets(1, 1)
+	if _, err := decoded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint(0); i < 1000; i++ {
+		if decoded.Get(i) != b.Get(i) {
+			t.Errorf("Expected %d, got %d", b.Get(i), decoded.Get(i))
+		}
+	}
+}
+
+// Ensures that ReadFrom still decodes blobs written in the original
+// fixed-width format.
+func TestReadFromLegacyFormat(t *testing.T) {
+	tests := []struct {
+		file   string
+		filter interface {
+			readerFrom
+			Test([]byte) bool
+		}
+		items int
+	}{
+		{"testdata/legacy_classic.bin", NewBloomFilter(10, 0.1), 20},
+		{"testdata/legacy_scalable.bin", NewScalableBloomFilter(100, 0.01, 0.9), 50},
+		{"testdata/legacy_partitioned.bin", NewPartitionedBloomFilter(10, 0.1), 50},
+		{"testdata/legacy_stable.bin", NewStableBloomFilter(10, 1, 0.1), 20},
+	}
+
+	for _, test := range tests {
+		data, err := os.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := test.filter.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+
+		if n != int64(len(data)) {
+			t.Errorf("%s: Expected %d bytes read, got %d", test.file, len(data), n)
+		}
+
+		for i := 0; i < test.items; i++ {
+			if !test.filter.Test([]byte(strconv.Itoa(i))) {
+				t.Errorf("%s: Expected %d to be a member", test.file, i)
+			}
+		}
+
+		// Writing the decoded filter again produces the compact format.
+		var buf bytes.Buffer
+		if _, err := test.filter.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.Len() >= len(data) {
+			t.Errorf("%s: Expected fewer than %d bytes, got %d", test.file, len(data), buf.Len())
+		}
+	}
+}
+
+// Ensures that GobDecode still decodes filters gob-encoded in the original
+// fixed-width format.
+func TestGobDecodeLegacyFormat(t *testing.T) {
+	data, err := os.ReadFile("testdata/legacy_scalable.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s ScalableBloomFilter
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if !s.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	data, err = os.ReadFile("testdata/legacy_partitioned.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPartitionedBloomFilter(10, 0.1)
+	if err := p.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if !p.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that ReadFrom rejects unknown versions of the compact format.
+func TestReadFromUnsupportedVersion(t *testing.T) {
+	data := append(formatMagic[:], formatVersion+1)
+	if _, err := NewBloomFilter(10, 0.1).ReadFrom(bytes.NewReader(data)); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that WriteToOrder writes either byte order, that ReadFrom detects
+// it, and that ReadFromOrder enforces it.
+func TestWriteToOrderRoundTrip(t *testing.T) {
+	type filter interface {
+		readerFrom
+		Add([]byte) Filter
+		Test([]byte) bool
+	}
+	filters := []struct {
+		name string
+		new  func() filter
+	}{
+		{"classic", func() filter { return NewBloomFilter(100, 0.01) }},
+		{"scalable", func() filter { return NewScalableBloomFilter(10, 0.01, 0.8) }},
+		{"stable", func() filter { return NewStableBloomFilter(100, 3, 0.01) }},
+		{"counting", func() filter { return NewDefaultCountingBloomFilter(100, 0.01) }},
+	}
+
+	for _, test := range filters {
+		f := test.new()
+		for i := 0; i < 50; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+
+		var plain bytes.Buffer
+		if _, err := f.WriteTo(&plain); err != nil {
+			t.Fatal(err)
+		}
+
+		blobs := make(map[binary.ByteOrder][]byte)
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			var buf bytes.Buffer
+			n, err := WriteToOrder(&buf, f, order)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if n != int64(buf.Len()) {
+				t.Errorf("%s: Expected %d bytes written, got %d", test.name, buf.Len(), n)
+			}
+			blobs[order] = buf.Bytes()
+
+			// ReadFrom detects the order.
+			g := test.new()
+			if _, err := g.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			for i := 0; i < 50; i++ {
+				if data := []byte(strconv.Itoa(i)); g.Test(data) != f.Test(data) {
+					t.Errorf("%s: Expected the same membership of %d", test.name, i)
+				}
+			}
+
+			// The decoded filter is written the same way again.
+			var again bytes.Buffer
+			if _, err := g.WriteTo(&again); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again.Bytes(), plain.Bytes()) {
+				t.Errorf("%s: Expected the same blob after decoding %v", test.name, order)
+			}
+
+			if _, err := ReadFromOrder(bytes.NewReader(buf.Bytes()), test.new(), order); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		}
+
+		// WriteTo is big-endian. The scalable filter's rates and seeds are
+		// fixed-width, so its blobs differ in more than the header.
+		if !bytes.Equal(blobs[binary.BigEndian], plain.Bytes()) {
+			t.Errorf("%s: Expected WriteTo to be big-endian", test.name)
+		}
+		same := bytes.Equal(blobs[binary.BigEndian][headerSize:], blobs[binary.LittleEndian][headerSize:])
+		if test.name == "scalable" && same {
+			t.Errorf("%s: Expected the byte orders to differ", test.name)
+		}
+
+		if _, err := ReadFromOrder(bytes.NewReader(blobs[binary.LittleEndian]), test.new(), binary.BigEndian); err == nil {
+			t.Errorf("%s: Expected error", test.name)
+		}
+		if _, err := ReadFromOrder(bytes.NewReader(blobs[binary.BigEndian]), test.new(), binary.LittleEndian); err == nil {
+			t.Errorf("%s: Expected error", test.name)
+		}
+	}
+
+	// The original fixed-width format is only big-endian.
+	var buf bytes.Buffer
+	if _, err := WriteToOrder(&buf, NewInverseBloomFilter(10), binary.LittleEndian); err == nil {
+		t.Error("Expected error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing written, got %d bytes", buf.Len())
+	}
+	if _, err := WriteToOrder(&buf, NewInverseBloomFilter(10), binary.BigEndian); err != nil {
+		t.Error(err)
+	}
+	if _, err := ReadFromOrder(bytes.NewReader(buf.Bytes()), NewInverseBloomFilter(10), binary.LittleEndian); err == nil {
+		t.Error("Expected error")
+	}
+}
@@ -0,0 +1,47 @@
+package boom
+
+import (
+	"hash"
+	"hash/fnv"
+)
+
+// FilterSet feeds a stream of elements to several probabilistic data
+// structures, such as a Bloom filter, a Count-Min Sketch and a HyperLogLog,
+// while hashing each element only once. The base hashes are computed with a
+// single hash function and passed to every registered structure's
+// AddWithHashes.
+//
+// Bloom filters and Count-Min Sketches registered with a FilterSet stay
+// consistent with their own Test and Count methods as long as they use the
+// same hash function as the FilterSet, which is FNV-1 64-bit by default.
+type FilterSet struct {
+	hash      hash.Hash64    // hash function (kernel for all consumers)
+	consumers []HashConsumer // registered structures
+}
+
+// NewFilterSet creates a new FilterSet with no registered structures.
+func NewFilterSet() *FilterSet {
+	return &FilterSet{hash: fnv.New64()}
+}
+
+// Register adds a structure to the set. Elements added to the set afterwards
+// are added to it. It returns the set to allow for chaining.
+func (s *FilterSet) Register(f HashConsumer) *FilterSet {
+	s.consumers = append(s.consumers, f)
+	return s
+}
+
+// Add hashes the data once and adds it to every registered structure. It
+// returns the set to allow for chaining.
+func (s *FilterSet) Add(data []byte) *FilterSet {
+	lower, upper := hashKernel(data, s.hash)
+	for _, c := range s.consumers {
+		c.AddWithHashes(uint64(lower), uint64(upper))
+	}
+	return s
+}
+
+// SetHash sets the hashing function used to compute the base hashes.
+func (s *FilterSet) SetHash(h hash.Hash64) {
+	s.hash = h
+}
@@ -0,0 +1,77 @@
+package boom
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Ensures that Add feeds every registered structure with the same results as
+// adding the data to each of them directly.
+func TestFilterSetAdd(t *testing.T) {
+	var (
+		bf        = NewBloomFilter(1000, 0.01)
+		pbf       = NewPartitionedBloomFilter(1000, 0.01)
+		sbf       = NewScalableBloomFilter(100, 0.01, 0.8)
+		cbf       = NewDefaultCountingBloomFilter(1000, 0.01)
+		cms       = NewCountMinSketch(0.001, 0.99)
+		hll, _    = NewDefaultHyperLogLog(0.01)
+		set       = NewFilterSet()
+		consumers = []HashConsumer{bf, pbf, sbf, cbf, cms, hll}
+	)
+
+	for _, c := range consumers {
+		if set.Register(c) != set {
+			t.Error("Returned FilterSet should be the same instance")
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		if set.Add([]byte(strconv.Itoa(i))) != set {
+			t.Error("Returned FilterSet should be the same instance")
+		}
+	}
+	set.Add([]byte(`a`))
+
+	for i := 0; i < 1000; i++ {
+		data := []byte(strconv.Itoa(i))
+		for _, f := range []Filter{bf, pbf, sbf, cbf} {
+			if !f.Test(data) {
+				t.Errorf("Expected %d to be a member of %T", i, f)
+			}
+		}
+	}
+
+	if count := cms.Count([]byte(`a`)); count != 1 {
+		t.Errorf("expected 1, got %d", count)
+	}
+
+	if count := cms.TotalCount(); count != 1001 {
+		t.Errorf("expected 1001, got %d", count)
+	}
+
+	if count := hll.Count(); count < 950 || count > 1050 {
+		t.Errorf("expected about 1001, got %d", count)
+	}
+
+	if bf.Count() != 1001 || pbf.Count() != 1001 || sbf.Count() != 1001 || cbf.Count() != 1001 {
+		t.Error("Expected every filter to count 1001 items")
+	}
+}
+
+func BenchmarkFilterSetAdd(b *testing.B) {
+	b.StopTimer()
+	hll, _ := NewDefaultHyperLogLog(0.01)
+	set := NewFilterSet().
+		Register(NewScalableBloomFilter(100000, 0.01, 0.8)).
+		Register(NewCountMinSketch(0.001, 0.99)).
+		Register(hll)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		set.Add(data[n])
+	}
+}
@@ -29,6 +29,13 @@ import (
 
 var exp32 = math.Pow(2, 32)
 
+// hllFormatVersion is the version of the binary format written by
+// WriteDataTo, which follows the format magic. Version 1 added the seed. Data
+// written before then has no header and starts with the number of registers,
+// whose low byte is never the first byte of the magic since it's a power of
+// two, and is read with a seed of zero.
+const hllFormatVersion = 1
+
 // HyperLogLog implements the HyperLogLog cardinality estimation algorithm as
 // described by Flajolet, Fusy, Gandouet, and Meunier in HyperLogLog: the
 // analysis of a near-optimal cardinality estimation algorithm:
@@ -54,6 +61,7 @@ type HyperLogLog struct {
 	b         uint32      // number of bits to calculate register
 	alpha     float64     // bias-correction constant
 	hash      hash.Hash32 // hash function
+	seed      uint64      // hash seed
 }
 
 // NewHyperLogLog creates a new HyperLogLog with m registers. Returns an error
@@ -97,6 +105,23 @@ func (h *HyperLogLog) Add(data []byte) *HyperLogLog {
 	return h
 }
 
+// AddWithHashes adds the element with the given base hashes to the set,
+// skipping hashing. The 32-bit hash is derived by mixing the base hashes with
+// the seed, so it's unrelated to the hash used by Add: the same element added
+// with both methods is counted twice.
+func (h *HyperLogLog) AddWithHashes(h1, h2 uint64) {
+	var (
+		hash = uint32(mix64(h1 ^ h2<<32 ^ h.seed))
+		k    = 32 - h.b
+		r    = calculateRho(hash<<h.b, k)
+		j    = hash >> uint(k)
+	)
+
+	if r > h.registers[j] {
+		h.registers[j] = r
+	}
+}
+
 // Count returns the approximated cardinality of the set.
 func (h *HyperLogLog) Count() uint64 {
 	sum := 0.0
@@ -123,13 +148,20 @@ func (h *HyperLogLog) Count() uint64 {
 	return uint64(estimate)
 }
 
-// Merge combines this HyperLogLog with another. Returns an error if the number
-// of registers in the two HyperLogLogs are not equal.
+// Merge combines this HyperLogLog with another. Both must use the same hash
+// function and seed, since registers are only comparable if every element is
+// assigned to the same register with the same value. Merging HyperLogLogs with
+// different hash functions yields a meaningless count. Returns an error if the
+// number of registers or the seeds in the two HyperLogLogs are not equal.
 func (h *HyperLogLog) Merge(other *HyperLogLog) error {
 	if h.m != other.m {
 		return errors.New("number of registers must match")
 	}
 
+	if h.seed != other.seed {
+		return errors.New("seed must match")
+	}
+
 	for j, r := range other.registers {
 		if r > h.registers[j] {
 			h.registers[j] = r
@@ -148,6 +180,11 @@ func (h *HyperLogLog) Reset() *HyperLogLog {
 
 // calculateHash calculates the 32-bit hash value for the provided data.
 func (h *HyperLogLog) calculateHash(data []byte) uint32 {
+	if h.seed != 0 {
+		var seed [8]byte
+		binary.BigEndian.PutUint64(seed[:], h.seed)
+		h.hash.Write(seed[:])
+	}
 	h.hash.Write(data)
 	sum := h.hash.Sum32()
 	h.hash.Reset()
@@ -159,6 +196,21 @@ func (h *HyperLogLog) SetHash(ha hash.Hash32) {
 	h.hash = ha
 }
 
+// SetSeed sets the hash seed, which is hashed ahead of every element so that
+// the register assignment differs from an unseeded HyperLogLog. HyperLogLogs
+// can only be merged if they use the same seed. The seed is included in the
+// binary representation written by WriteDataTo, so a decoded HyperLogLog can
+// be merged with the one it was written from. A seed of zero disables seeding,
+// which is the default. The HyperLogLog should be empty when the seed is set.
+func (h *HyperLogLog) SetSeed(seed uint64) {
+	h.seed = seed
+}
+
+// Seed returns the hash seed.
+func (h *HyperLogLog) Seed() uint64 {
+	return h.seed
+}
+
 // calculateAlpha calculates the bias-correction constant alpha based on the
 // number of registers, m.
 func calculateAlpha(m uint) (result float64) {
@@ -189,6 +241,9 @@ func calculateRho(val, max uint32) uint8 {
 // an io stream. It returns the number of bytes written and error
 func (h *HyperLogLog) WriteDataTo(stream io.Writer) (n int, err error) {
 	buf := new(bytes.Buffer)
+	buf.Write(formatMagic[:])
+	buf.WriteByte(hllFormatVersion)
+
 	// write register number first
 	err = binary.Write(buf, binary.LittleEndian, uint64(h.m))
 	if err != nil {
@@ -205,6 +260,11 @@ func (h *HyperLogLog) WriteDataTo(stream io.Writer) (n int, err error) {
 		return
 	}
 
+	err = binary.Write(buf, binary.LittleEndian, h.seed)
+	if err != nil {
+		return
+	}
+
 	err = binary.Write(buf, binary.LittleEndian, h.registers)
 	if err != nil {
 		return
@@ -216,10 +276,23 @@ func (h *HyperLogLog) WriteDataTo(stream io.Writer) (n int, err error) {
 
 // ReadDataFrom reads a binary representation of the Hll data written
 // by WriteDataTo() from io stream. It returns the number of bytes read
-// and error.
+// and error. Data written before the seed was serialized is read with a
+// seed of zero.
 // If serialized Hll configuration is different it returns error with expected params
 func (h *HyperLogLog) ReadDataFrom(stream io.Reader) (int, error) {
-	var m uint64
+	var header [headerSize]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return 0, err
+	}
+
+	versioned := bytes.Equal(header[:len(formatMagic)], formatMagic[:])
+	if !versioned {
+		stream = io.MultiReader(bytes.NewReader(header[:]), stream)
+	} else if version := header[len(formatMagic)]; version != hllFormatVersion {
+		return 0, fmt.Errorf("unsupported hll format version %d", version)
+	}
+
+	var m, seed uint64
 	// read register number first
 	err := binary.Read(stream, binary.LittleEndian, &m)
 	if err != nil {
@@ -241,13 +314,25 @@ func (h *HyperLogLog) ReadDataFrom(stream io.Reader) (int, error) {
 		return 0, err
 	}
 
+	if versioned {
+		err = binary.Read(stream, binary.LittleEndian, &seed)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	err = binary.Read(stream, binary.LittleEndian, h.registers)
 	if err != nil {
 		return 0, err
 	}
+	h.seed = seed
 
 	// count size of data in registers + m, b, alpha
 	size := int(h.m)*binary.Size(uint8(0)) + binary.Size(uint64(0)) + binary.Size(uint32(0)) + binary.Size(float64(0))
+	if versioned {
+		// and the header and seed
+		size += headerSize + binary.Size(seed)
+	}
 
 	return size, err
 }
@@ -19,10 +19,12 @@ package boom
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -109,6 +111,55 @@ func TestNewDefaultHyperLogLog(t *testing.T) {
 	}
 }
 
+// Ensures that Merge gives the union count when the seeds match and returns an
+// error when they don't, since register assignment depends on the seed.
+func TestHyperLogLogMergeSeeds(t *testing.T) {
+	var (
+		h1, _    = NewHyperLogLog(1024)
+		h2, _    = NewHyperLogLog(1024)
+		other, _ = NewHyperLogLog(1024)
+	)
+	h1.SetSeed(42)
+	h2.SetSeed(42)
+	other.SetSeed(43)
+
+	if seed := h1.Seed(); seed != 42 {
+		t.Errorf("expected 42, got %d", seed)
+	}
+
+	words := dictionary(0)
+	for i := 0; i < 5000; i++ {
+		h1.Add([]byte(words[i]))
+		h2.Add([]byte(words[i+2500]))
+		other.Add([]byte(words[i+2500]))
+	}
+
+	// Registers of differently seeded HyperLogLogs don't line up, so combining
+	// them anyway counts the overlap twice.
+	combined, _ := NewHyperLogLog(1024)
+	for j := range combined.registers {
+		combined.registers[j] = h1.registers[j]
+		if other.registers[j] > h1.registers[j] {
+			combined.registers[j] = other.registers[j]
+		}
+	}
+	if count := combined.Count(); count < 9000 {
+		t.Errorf("expected more than 9000, got %d", count)
+	}
+
+	if err := h1.Merge(other); err == nil {
+		t.Error("expected error")
+	}
+
+	if err := h1.Merge(h2); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := math.Abs(geterror(7500, h1.Count())); e > 3*1.04/math.Sqrt(1024) {
+		t.Errorf("expected about 7500, got %d", h1.Count())
+	}
+}
+
 func TestHyperLogLogSerialization(t *testing.T) {
 	hll, err := NewDefaultHyperLogLog(0.1)
 	if err != nil {
@@ -163,6 +214,71 @@ func TestHyperLogLogSerialization(t *testing.T) {
 
 }
 
+// Ensures that the seed survives a WriteDataTo and ReadDataFrom round trip, so
+// that the decoded HyperLogLog can be merged with the original, and that data
+// written without a seed is read with a seed of zero.
+func TestHyperLogLogSerializationSeed(t *testing.T) {
+	hll, _ := NewHyperLogLog(1024)
+	hll.SetSeed(42)
+	for i := 0; i < 100; i++ {
+		hll.Add([]byte(strconv.Itoa(i)))
+	}
+
+	buf := new(bytes.Buffer)
+	wn, err := hll.WriteDataTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, _ := NewHyperLogLog(1024)
+	rn, err := decoded.ReadDataFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rn != wn {
+		t.Errorf("expected %d bytes read, got %d", wn, rn)
+	}
+
+	if seed := decoded.Seed(); seed != 42 {
+		t.Errorf("expected 42, got %d", seed)
+	}
+
+	if count := decoded.Count(); count != hll.Count() {
+		t.Errorf("expected %d, got %d", hll.Count(), count)
+	}
+
+	if err := decoded.Merge(hll); err != nil {
+		t.Error(err)
+	}
+
+	// Data written before the seed was serialized has no header.
+	unseeded, _ := NewHyperLogLog(1024)
+	unseeded.Add([]byte(`a`))
+	buf.Reset()
+	binary.Write(buf, binary.LittleEndian, uint64(unseeded.m))
+	binary.Write(buf, binary.LittleEndian, unseeded.b)
+	binary.Write(buf, binary.LittleEndian, unseeded.alpha)
+	binary.Write(buf, binary.LittleEndian, unseeded.registers)
+	legacy := buf.Len()
+
+	if rn, err := decoded.ReadDataFrom(buf); err != nil || rn != legacy {
+		t.Fatalf("expected %d bytes read, got %d (%v)", legacy, rn, err)
+	}
+
+	if seed := decoded.Seed(); seed != 0 {
+		t.Errorf("expected 0, got %d", seed)
+	}
+
+	if count := decoded.Count(); count != 1 {
+		t.Errorf("expected 1, got %d", count)
+	}
+
+	if err := decoded.Merge(hll); err == nil {
+		t.Error("expected error")
+	}
+}
+
 func BenchmarkHllWriteDataTo(b *testing.B) {
 	b.StopTimer()
 	hll, err := NewDefaultHyperLogLog(0.1)
@@ -0,0 +1,115 @@
+package boom
+
+import (
+	"errors"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// HyperLogLogArray maintains several independent HyperLogLogs with different
+// seeds and combines their estimates. The median of the copies' estimates
+// has lower variance than any single copy and is robust against an outlier,
+// and the copies provide a confidence interval. Each element is hashed once,
+// and the hash is mixed with each copy's seed, so the copies' estimates are
+// independent. This costs one HyperLogLog's memory per copy.
+type HyperLogLogArray struct {
+	copies []*HyperLogLog // independently seeded HyperLogLogs
+	hash   hash.Hash64    // hash function shared by the copies
+}
+
+// NewHyperLogLogArray creates a new HyperLogLogArray of the given number of
+// copies, each with 2^precision registers. Returns an error if precision
+// isn't between 4 and 16 or copies is 0.
+func NewHyperLogLogArray(precision, copies uint) (*HyperLogLogArray, error) {
+	if precision < 4 || precision > 16 {
+		return nil, errors.New("precision must be between 4 and 16")
+	}
+
+	if copies == 0 {
+		return nil, errors.New("copies must be positive")
+	}
+
+	a := &HyperLogLogArray{
+		copies: make([]*HyperLogLog, copies),
+		hash:   fnv.New64(),
+	}
+	for i := range a.copies {
+		h, err := NewHyperLogLog(1 << precision)
+		if err != nil {
+			return nil, err
+		}
+		h.SetSeed(generationSeed(i + 1))
+		a.copies[i] = h
+	}
+	return a, nil
+}
+
+// Add will add the data to every copy. Returns the HyperLogLogArray to allow
+// for chaining.
+func (a *HyperLogLogArray) Add(data []byte) *HyperLogLogArray {
+	lower, upper := hashKernel(data, a.hash)
+	for _, h := range a.copies {
+		h.AddWithHashes(uint64(lower), uint64(upper))
+	}
+	return a
+}
+
+// Count returns the median of the copies' approximated cardinalities.
+func (a *HyperLogLogArray) Count() uint64 {
+	estimate, _ := a.CountWithError()
+	return estimate
+}
+
+// CountWithError returns the median of the copies' approximated cardinalities
+// and its standard error, so the true cardinality is within the estimate plus
+// or minus two standard errors about 95% of the time. The standard error of a
+// single HyperLogLog is 1.04/sqrt(m) relative to the cardinality, and that of
+// the median of c copies is about 1.25/sqrt(c) times as much.
+func (a *HyperLogLogArray) CountWithError() (estimate uint64, stderr float64) {
+	counts := make([]uint64, len(a.copies))
+	for i, h := range a.copies {
+		counts[i] = h.Count()
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+
+	if n := len(counts); n%2 == 1 {
+		estimate = counts[n/2]
+	} else {
+		estimate = counts[n/2-1]/2 + counts[n/2]/2 + (counts[n/2-1]%2+counts[n/2]%2)/2
+	}
+
+	var (
+		m        = float64(a.copies[0].m)
+		relative = 1.04 / math.Sqrt(m)
+	)
+	if len(counts) > 1 {
+		relative *= math.Sqrt(math.Pi/2) / math.Sqrt(float64(len(counts)))
+	}
+	return estimate, relative * float64(estimate)
+}
+
+// Merge combines this HyperLogLogArray with another, copy by copy. Returns an
+// error if the number of copies or the number of registers don't match.
+func (a *HyperLogLogArray) Merge(other *HyperLogLogArray) error {
+	if len(a.copies) != len(other.copies) {
+		return errors.New("number of copies must match")
+	}
+
+	for i, h := range a.copies {
+		if err := h.Merge(other.copies[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset restores the HyperLogLogArray to its original state. It returns itself
+// to allow for chaining.
+func (a *HyperLogLogArray) Reset() *HyperLogLogArray {
+	for _, h := range a.copies {
+		h.Reset()
+	}
+	return a
+}
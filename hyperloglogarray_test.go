@@ -0,0 +1,124 @@
+package boom
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// Ensures that NewHyperLogLogArray returns an error for an invalid precision
+// or number of copies.
+func TestNewHyperLogLogArrayErrors(t *testing.T) {
+	if _, err := NewHyperLogLogArray(3, 5); err == nil {
+		t.Error("Expected error for precision 3")
+	}
+
+	if _, err := NewHyperLogLogArray(17, 5); err == nil {
+		t.Error("Expected error for precision 17")
+	}
+
+	if _, err := NewHyperLogLogArray(10, 0); err == nil {
+		t.Error("Expected error for 0 copies")
+	}
+}
+
+// Ensures that the standard error reported by CountWithError brackets the
+// true cardinality most of the time.
+func TestHyperLogLogArrayCountWithError(t *testing.T) {
+	var (
+		trials = 50
+		n      = 10000
+		within = 0
+	)
+	for trial := 0; trial < trials; trial++ {
+		a, err := NewHyperLogLogArray(10, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			a.Add([]byte(strconv.Itoa(trial) + "-" + strconv.Itoa(i)))
+		}
+
+		estimate, stderr := a.CountWithError()
+		if estimate != a.Count() {
+			t.Errorf("Expected %d, got %d", estimate, a.Count())
+		}
+		if math.Abs(float64(estimate)-float64(n)) <= 2*stderr {
+			within++
+		}
+	}
+
+	// About 95% of the estimates are within two standard errors.
+	if within < trials*4/5 {
+		t.Errorf("Expected at least %d estimates within two standard errors, got %d", trials*4/5, within)
+	}
+}
+
+// Ensures that the median of several copies has a smaller standard error than
+// a single copy.
+func TestHyperLogLogArrayCopies(t *testing.T) {
+	single, err := NewHyperLogLogArray(10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multiple, err := NewHyperLogLogArray(10, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i++ {
+		single.Add([]byte(strconv.Itoa(i)))
+		multiple.Add([]byte(strconv.Itoa(i)))
+	}
+
+	_, singleErr := single.CountWithError()
+	_, multipleErr := multiple.CountWithError()
+	if multipleErr >= singleErr {
+		t.Errorf("Expected stderr below %f, got %f", singleErr, multipleErr)
+	}
+
+	// The copies are seeded differently, so their estimates differ.
+	distinct := map[uint64]bool{}
+	for _, h := range multiple.copies {
+		distinct[h.Count()] = true
+	}
+	if len(distinct) < 2 {
+		t.Error("Expected the copies' estimates to differ")
+	}
+}
+
+// Ensures that Merge combines HyperLogLogArrays with the same number of copies
+// and that Reset empties them.
+func TestHyperLogLogArrayMerge(t *testing.T) {
+	a, _ := NewHyperLogLogArray(10, 3)
+	b, _ := NewHyperLogLogArray(10, 3)
+	for i := 0; i < 1000; i++ {
+		a.Add([]byte(strconv.Itoa(i)))
+		b.Add([]byte(strconv.Itoa(i + 1000)))
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := a.Count(); math.Abs(geterror(2000, count)) > 0.1 {
+		t.Errorf("Expected about 2000, got %d", count)
+	}
+
+	c, _ := NewHyperLogLogArray(10, 4)
+	if err := a.Merge(c); err == nil {
+		t.Error("Expected error for a different number of copies")
+	}
+
+	d, _ := NewHyperLogLogArray(11, 3)
+	if err := a.Merge(d); err == nil {
+		t.Error("Expected error for a different precision")
+	}
+
+	if a.Reset() != a {
+		t.Error("Returned HyperLogLogArray should be the same instance")
+	}
+
+	if count := a.Count(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+}
@@ -35,9 +35,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"hash"
 	"hash/fnv"
 	"io"
+	"math"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -73,6 +75,50 @@ func NewInverseBloomFilter(capacity uint) *InverseBloomFilter {
 	}
 }
 
+// NewInverseBloomFilterForFalseNegativeRate creates and returns a new
+// InverseBloomFilter whose capacity is chosen with
+// OptimalInverseCapacity so that, after n distinct items are added, the
+// expected fraction of them reported as not seen is at most fnRate.
+func NewInverseBloomFilterForFalseNegativeRate(n uint, fnRate float64) *InverseBloomFilter {
+	return NewInverseBloomFilter(OptimalInverseCapacity(n, fnRate))
+}
+
+// OptimalInverseCapacity calculates the smallest InverseBloomFilter capacity
+// for which, after n distinct items are added, the expected fraction of them
+// which have been overwritten, and are therefore false negatives, is at most
+// fnRate. An item followed by t other items survives with probability
+// (1 - 1/c)^t for capacity c, so the expected rate over all n items is
+// 1 - c(1 - (1 - 1/c)^n) / n, which is about n / 2c. The rate must be between
+// 0 and 1 exclusive, and a capacity of 1 is returned for any other rate,
+// including NaN.
+func OptimalInverseCapacity(n uint, fnRate float64) uint {
+	if n <= 1 || !(fnRate > 0 && fnRate < 1) {
+		return 1
+	}
+
+	rate := func(c uint) float64 {
+		survivors := -float64(c) * math.Expm1(float64(n)*math.Log1p(-1/float64(c)))
+		return 1 - survivors/float64(n)
+	}
+
+	// The rate decreases with the capacity, so binary search for the
+	// smallest capacity which meets it, bounded from above by twice the
+	// approximation, or by the largest capacity for tiny rates.
+	lo, hi := uint(1), ^uint(0)
+	if bound := math.Ceil(float64(n) / fnRate); bound < float64(hi) {
+		hi = uint(bound) + 1
+	}
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if rate(mid) <= fnRate {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
 // Test will test for membership of the data and returns true if it is a
 // member, false if not. This is a probabilistic test, meaning there is a
 // non-zero probability of false negatives but a zero probability of false
@@ -88,6 +134,22 @@ func (i *InverseBloomFilter) Test(data []byte) bool {
 	return bytes.Equal(*val, data)
 }
 
+// DefinitelyContains is equivalent to Test, named for its guarantee, which is
+// the inverse of a Bloom filter's: there are no false positives, so true
+// means the data was definitely added. A Bloom filter's MayContain has no
+// counterpart here, since a positive is never uncertain.
+func (i *InverseBloomFilter) DefinitelyContains(data []byte) bool {
+	return i.Test(data)
+}
+
+// PossiblyAbsent is the negation of Test. Since there are false negatives,
+// true only means the data may not have been added: it may also have been
+// added and then evicted by data which maps to the same slot. Unlike a Bloom
+// filter's DefinitelyNotContains, a negative is never certain.
+func (i *InverseBloomFilter) PossiblyAbsent(data []byte) bool {
+	return !i.Test(data)
+}
+
 // Add will add the data to the filter. It returns the filter to allow for
 // chaining.
 func (i *InverseBloomFilter) Add(data []byte) Filter {
@@ -108,6 +170,24 @@ func (i *InverseBloomFilter) Capacity() uint {
 	return i.capacity
 }
 
+// Values returns copies of the data currently stored in the filter's slots, in
+// slot order. Since a slot is overwritten by any other data hashing to it,
+// this isn't every item added, but approximates the set of recently added
+// distinct items, which is useful for debugging. It's safe to call
+// concurrently with Add.
+func (i *InverseBloomFilter) Values() [][]byte {
+	var values [][]byte
+	for index := range i.array {
+		indexPtr := (*unsafe.Pointer)(unsafe.Pointer(&i.array[index]))
+		val := (*[]byte)(atomic.LoadPointer(indexPtr))
+		if val == nil {
+			continue
+		}
+		values = append(values, append([]byte{}, *val...))
+	}
+	return values
+}
+
 // getAndSet returns the data that was in the slice at the given index after
 // putting the new data in the slice at that index, atomically.
 func (i *InverseBloomFilter) getAndSet(index uint32, data []byte) []byte {
@@ -239,13 +319,30 @@ func (i *InverseBloomFilter) decodeToArray(stream io.Reader) ([][]byte, uint64,
 		return nil, 0, 0, err
 	}
 
+	if capacity == 0 {
+		return nil, 0, 0, errors.New("capacity must be positive")
+	}
+
+	// Every element takes at least one byte of the encoded slice.
+	if capacity > size {
+		return nil, 0, 0, errors.New("capacity exceeds encoded size")
+	}
+	if err := checkDecodeSize(capacity, 3*ptrSize); err != nil {
+		return nil, 0, 0, err
+	}
+
 	// Read the encoded slice and decode into [][]byte
-	encoded := make([]byte, size)
-	stream.Read(encoded)
+	encoded, err := readBytes(stream, size)
+	if err != nil {
+		return nil, 0, 0, err
+	}
 	buf := bytes.NewBuffer(encoded)
 	dec := gob.NewDecoder(buf)
 	decoded := make([][]byte, capacity)
 	dec.Decode(&decoded)
+	if uint64(len(decoded)) != capacity {
+		return nil, 0, 0, errors.New("number of elements must match capacity")
+	}
 
 	return decoded, capacity, size, nil
 }
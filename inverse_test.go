@@ -3,6 +3,8 @@ package boom
 import (
 	"bytes"
 	"encoding/gob"
+	"math"
+	"math/rand"
 	"os"
 	"strconv"
 	"testing"
@@ -72,6 +74,147 @@ func TestInverseTestAndAdd(t *testing.T) {
 	}
 }
 
+// Ensures that the capacity chosen for a false-negative rate meets it
+// empirically and that smaller capacities don't.
+func TestInverseFalseNegativeRate(t *testing.T) {
+	var (
+		n      = uint(10000)
+		fnRate = 0.05
+		f      = NewInverseBloomFilterForFalseNegativeRate(n, fnRate)
+		rng    = rand.New(rand.NewSource(1))
+		keys   = make([][]byte, n)
+	)
+
+	if capacity := f.Capacity(); capacity != OptimalInverseCapacity(n, fnRate) {
+		t.Errorf("Expected %d, got %d", OptimalInverseCapacity(n, fnRate), capacity)
+	}
+
+	// The expected rate is about n / 2c.
+	if capacity := f.Capacity(); capacity < 95000 || capacity > 105000 {
+		t.Errorf("Expected about 100000, got %d", capacity)
+	}
+
+	for i := range keys {
+		keys[i] = make([]byte, 16)
+		rng.Read(keys[i])
+		f.Add(keys[i])
+	}
+
+	negatives := 0
+	for _, key := range keys {
+		if !f.Test(key) {
+			negatives++
+		}
+	}
+
+	if rate := float64(negatives) / float64(n); rate > fnRate*1.2 {
+		t.Errorf("Expected false-negative rate at most %f, got %f", fnRate, rate)
+	}
+
+	if capacity := OptimalInverseCapacity(n, fnRate/10); capacity <= f.Capacity() {
+		t.Errorf("Expected more than %d, got %d", f.Capacity(), capacity)
+	}
+
+	if capacity := OptimalInverseCapacity(1, fnRate); capacity != 1 {
+		t.Errorf("Expected 1, got %d", capacity)
+	}
+
+	// Rates out of range are handled like a rate of 1.
+	for _, rate := range []float64{1, 0, -0.1, math.NaN()} {
+		if capacity := OptimalInverseCapacity(n, rate); capacity != 1 {
+			t.Errorf("Expected 1 for %v, got %d", rate, capacity)
+		}
+	}
+
+	if capacity := OptimalInverseCapacity(n, 1e-300); capacity < OptimalInverseCapacity(n, fnRate/10) {
+		t.Errorf("Expected a large capacity, got %d", capacity)
+	}
+}
+
+// Ensures that DefinitelyContains and PossiblyAbsent follow the guarantee of
+// the inverse filter, which has false negatives but no false positives: only
+// added data is definitely contained, and added data can be possibly absent.
+func TestInverseDefinitelyContains(t *testing.T) {
+	f := NewInverseBloomFilter(10)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	absent := 0
+	for i := 0; i < 100; i++ {
+		data := []byte(strconv.Itoa(i))
+		if f.DefinitelyContains(data) == f.PossiblyAbsent(data) {
+			t.Errorf("Expected PossiblyAbsent to negate DefinitelyContains for %d", i)
+		}
+		if f.DefinitelyContains(data) != f.Test(data) {
+			t.Errorf("Expected DefinitelyContains to match Test for %d", i)
+		}
+		if f.PossiblyAbsent(data) {
+			absent++
+		}
+	}
+
+	// Most of the added data was evicted, so it's a false negative.
+	if absent < 90 {
+		t.Errorf("Expected at least 90 possibly absent elements, got %d", absent)
+	}
+
+	for i := 100; i < 10000; i++ {
+		if f.DefinitelyContains([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d not to be definitely contained", i)
+		}
+	}
+}
+
+// Ensures that Values returns copies of the data stored in the slots, which
+// excludes overwritten items.
+func TestInverseValues(t *testing.T) {
+	f := NewInverseBloomFilter(100)
+	if values := f.Values(); len(values) != 0 {
+		t.Errorf("Expected no values, got %d", len(values))
+	}
+
+	data := []byte(`a`)
+	f.Add(data)
+	f.Add([]byte(`b`))
+	f.Add([]byte(`b`))
+
+	values := f.Values()
+	if len(values) != 2 {
+		t.Fatalf("Expected 2 values, got %d", len(values))
+	}
+
+	seen := map[string]bool{}
+	for _, value := range values {
+		seen[string(value)] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("Expected `a` and `b`, got %q", values)
+	}
+
+	// The returned values are copies.
+	for _, value := range values {
+		value[0] = 'x'
+	}
+	if !f.Test([]byte(`a`)) || !f.Test([]byte(`b`)) {
+		t.Error("Expected the stored values to be unchanged")
+	}
+
+	// With more items than slots, some are overwritten.
+	f = NewInverseBloomFilter(10)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	if values := f.Values(); len(values) > 10 {
+		t.Errorf("Expected at most 10 values, got %d", len(values))
+	}
+	for _, value := range f.Values() {
+		if !f.Test(value) {
+			t.Errorf("Expected %s to be a member", value)
+		}
+	}
+}
+
 // Ensures an InverseBloomFilter can read and write successfully
 func TestInverseBloomFilter_ReadFrom(t *testing.T) {
 	d, err := os.Create("TestInverseBloomFilter_ReadFrom.dat")
@@ -83,7 +226,8 @@ func TestInverseBloomFilter_ReadFrom(t *testing.T) {
 		f.Add([]byte(strconv.Itoa(i)))
 	}
 
-	if _, err := f.WriteTo(d); err != nil {
+	written, err := f.WriteTo(d)
+	if err != nil {
 		t.Error(err)
 	}
 	d.Close()
@@ -97,8 +241,10 @@ func TestInverseBloomFilter_ReadFrom(t *testing.T) {
 	}
 	d.Close()
 
-	if read != 12814 {
-		t.Errorf("Expected to read 12814 bytes, read %v", read)
+	// The size depends on the gob type IDs assigned so far in the process,
+	// so it's compared to the number of bytes written.
+	if read != written {
+		t.Errorf("Expected to read %d bytes, read %v", written, read)
 	}
 
 	if f.capacity != f2.capacity {
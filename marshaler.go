@@ -0,0 +1,55 @@
+package boom
+
+import "encoding"
+
+// MarshalerFilter wraps a Filter so that values implementing
+// encoding.BinaryMarshaler can be tested and added directly. Each value is
+// marshaled and its binary representation is fed to the underlying filter, so
+// values are members if their binary representations are equal.
+type MarshalerFilter struct {
+	filter Filter // underlying filter
+}
+
+// NewMarshalerFilter creates a new MarshalerFilter which tests and adds
+// marshaled values to the given filter.
+func NewMarshalerFilter(f Filter) *MarshalerFilter {
+	return &MarshalerFilter{filter: f}
+}
+
+// Filter returns the underlying filter.
+func (m *MarshalerFilter) Filter() Filter {
+	return m.filter
+}
+
+// TestMarshaler will test for membership of the marshaled value and returns
+// true if it is a member, false if not. It returns an error if the value can't
+// be marshaled.
+func (m *MarshalerFilter) TestMarshaler(v encoding.BinaryMarshaler) (bool, error) {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	return m.filter.Test(data), nil
+}
+
+// AddMarshaler will add the marshaled value to the filter. It returns an error
+// if the value can't be marshaled, in which case nothing is added.
+func (m *MarshalerFilter) AddMarshaler(v encoding.BinaryMarshaler) error {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	m.filter.Add(data)
+	return nil
+}
+
+// TestAndAddMarshaler is equivalent to calling TestMarshaler followed by
+// AddMarshaler. It returns true if the marshaled value is a member, false if
+// not, and an error if the value can't be marshaled.
+func (m *MarshalerFilter) TestAndAddMarshaler(v encoding.BinaryMarshaler) (bool, error) {
+	data, err := v.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	return m.filter.TestAndAdd(data), nil
+}
@@ -0,0 +1,66 @@
+package boom
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingMarshaler is an encoding.BinaryMarshaler which always fails.
+type failingMarshaler struct{}
+
+func (failingMarshaler) MarshalBinary() ([]byte, error) {
+	return nil, errors.New("marshal failed")
+}
+
+// Ensures that marshaled values are tested and added to the underlying filter.
+func TestMarshalerFilter(t *testing.T) {
+	var (
+		f    = NewMarshalerFilter(NewBloomFilter(100, 0.01))
+		a    = time.Unix(1, 0).UTC()
+		b    = time.Unix(2, 0).UTC()
+		data []byte
+	)
+
+	if member, err := f.TestMarshaler(a); err != nil || member {
+		t.Errorf("Expected false and no error, got %v and %v", member, err)
+	}
+
+	if err := f.AddMarshaler(a); err != nil {
+		t.Error(err)
+	}
+
+	if member, err := f.TestMarshaler(a); err != nil || !member {
+		t.Errorf("Expected true and no error, got %v and %v", member, err)
+	}
+
+	data, _ = a.MarshalBinary()
+	if !f.Filter().Test(data) {
+		t.Error("Expected the marshaled value to be a member of the underlying filter")
+	}
+
+	if member, err := f.TestAndAddMarshaler(b); err != nil || member {
+		t.Errorf("Expected false and no error, got %v and %v", member, err)
+	}
+
+	if member, err := f.TestMarshaler(b); err != nil || !member {
+		t.Errorf("Expected true and no error, got %v and %v", member, err)
+	}
+}
+
+// Ensures that marshal errors are returned.
+func TestMarshalerFilterError(t *testing.T) {
+	f := NewMarshalerFilter(NewBloomFilter(100, 0.01))
+
+	if err := f.AddMarshaler(failingMarshaler{}); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := f.TestMarshaler(failingMarshaler{}); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := f.TestAndAddMarshaler(failingMarshaler{}); err == nil {
+		t.Error("Expected error")
+	}
+}
@@ -18,10 +18,13 @@ package boom
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"hash"
 	"hash/fnv"
 	"io"
 	"math"
+	"math/bits"
+	"sync/atomic"
 )
 
 // PartitionedBloomFilter implements a variation of a classic Bloom filter as
@@ -35,24 +38,71 @@ import (
 // respective slice. Thus, each element is described by exactly k bits, meaning
 // the distribution of false positives is uniform across all elements.
 type PartitionedBloomFilter struct {
-	partitions []*Buckets  // partitioned filter data
-	hash       hash.Hash64 // hash function (kernel for all k functions)
-	m          uint        // filter size (divided into k partitions)
-	k          uint        // number of hash functions (and partitions)
-	s          uint        // partition size (m / k)
-	count      uint        // number of items added
+	partitions []*Buckets                    // partitioned filter data
+	hash       hash.Hash64                   // hash function (kernel for all k functions)
+	hashFunc   func([]byte) (uint64, uint64) // base hash function (overrides hash)
+	m          uint                          // filter size (divided into k partitions)
+	k          uint                          // number of hash functions (and partitions)
+	s          uint                          // partition size (m / k)
+	count      uint                          // number of items added
+	seed       uint64                        // seed mixed into the base hashes
+	shared     *int32                        // number of forks sharing the partitions, nil if unshared
+	mapping    byte                          // mapping of base hashes to partition indices
 }
 
 // NewPartitionedBloomFilter creates a new partitioned Bloom filter optimized
-// to store n items with a specified target false-positive rate.
+// to store n items with a specified target false-positive rate. The partition
+// size is rounded up to a multiple of 64 bits, so the capacity, m, is the
+// total size of the partitions and may be slightly larger than OptimalM.
 func NewPartitionedBloomFilter(n uint, fpRate float64) *PartitionedBloomFilter {
 	var (
-		m          = OptimalM(n, fpRate)
-		k          = OptimalK(fpRate)
-		partitions = make([]*Buckets, k)
-		s          = uint(math.Ceil(float64(m) / float64(k)))
+		m = OptimalM(n, fpRate)
+		k = OptimalK(fpRate)
+		s = partitionSize(m, k)
 	)
+	return newPartitionedBloomFilter(k*s, k, s)
+}
+
+// partitionSize returns the size of each of k partitions holding m bits,
+// rounded up to a multiple of 64 bits. Every partition is then a whole number
+// of 64-bit words with no ragged tail, which lets word-at-a-time operations
+// such as FillRatio skip the trailing bytes.
+func partitionSize(m, k uint) uint {
+	s := uint(math.Ceil(float64(m) / float64(k)))
+	if s > ^uint(0)-63 {
+		return s
+	}
+	return (s + 63) / 64 * 64
+}
+
+// NewPartitionedBloomFilterFixedMemory creates a new partitioned Bloom filter
+// with k hash functions which uses at most the given number of bits, for when
+// memory rather than the false-positive rate is the constraint. Each partition
+// has bits/k bits, rounded down to a multiple of 64 bits if it has at least
+// 64, so the capacity may be somewhat less than bits. Use ExpectedFPAt to
+// determine the resulting false-positive rate. k is at least 1 and at most
+// bits, and bits is at least 1.
+func NewPartitionedBloomFilterFixedMemory(bits, k uint) *PartitionedBloomFilter {
+	if bits == 0 {
+		bits = 1
+	}
+	if k == 0 {
+		k = 1
+	}
+	if k > bits {
+		k = bits
+	}
+	s := bits / k
+	if s >= 64 {
+		s = s / 64 * 64
+	}
+	return newPartitionedBloomFilter(k*s, k, s)
+}
 
+// newPartitionedBloomFilter creates a new partitioned Bloom filter of size m
+// with k partitions of s bits.
+func newPartitionedBloomFilter(m, k, s uint) *PartitionedBloomFilter {
+	partitions := make([]*Buckets, k)
 	for i := uint(0); i < k; i++ {
 		partitions[i] = NewBuckets(s, 1)
 	}
@@ -63,9 +113,18 @@ func NewPartitionedBloomFilter(n uint, fpRate float64) *PartitionedBloomFilter {
 		m:          m,
 		k:          k,
 		s:          s,
+		mapping:    fastRangeIndex,
 	}
 }
 
+// Aligned returns true if the partition size is a multiple of 64 bits. This is
+// the case for filters created with NewPartitionedBloomFilter, but not for
+// filters decoded from data written before partitions were aligned, which
+// keep their original size.
+func (p *PartitionedBloomFilter) Aligned() bool {
+	return p.s%64 == 0
+}
+
 // Capacity returns the Bloom filter capacity, m.
 func (p *PartitionedBloomFilter) Capacity() uint {
 	return p.m
@@ -86,60 +145,277 @@ func (p *PartitionedBloomFilter) EstimatedFillRatio() float64 {
 	return 1 - math.Exp(-float64(p.count)/float64(p.s))
 }
 
+// SetBits returns the number of set bits across all partitions.
+func (p *PartitionedBloomFilter) SetBits() uint {
+	bits := uint(0)
+	for i := uint(0); i < p.k; i++ {
+		bits += p.partitions[i].popCount()
+	}
+	return bits
+}
+
+// distinctCount estimates the number of distinct items added to the filter
+// from the number of set bits in each partition, averaged over the partitions.
+// Items added more than once, such as the same item from both filters of a
+// union, only count once. The estimate is capped at the count, which it also
+// falls back to if a partition is full.
+func (p *PartitionedBloomFilter) distinctCount() uint {
+	t := float64(0)
+	for i := uint(0); i < p.k; i++ {
+		set := p.partitions[i].popCount()
+		if set >= p.s {
+			return p.count
+		}
+		t += -float64(p.s) * math.Log1p(-float64(set)/float64(p.s))
+	}
+
+	if estimate := uint(math.Round(t / float64(p.k))); estimate < p.count {
+		return estimate
+	}
+	return p.count
+}
+
+// TotalBits returns the number of bits across all partitions, which is k
+// times the partition size. This may be slightly more than the capacity, m,
+// since the partition size is rounded up.
+func (p *PartitionedBloomFilter) TotalBits() uint {
+	return p.k * p.s
+}
+
 // FillRatio returns the average ratio of set bits across all partitions.
 func (p *PartitionedBloomFilter) FillRatio() float64 {
 	t := float64(0)
 	for i := uint(0); i < p.k; i++ {
-		sum := uint32(0)
-		for j := uint(0); j < p.partitions[i].Count(); j++ {
-			sum += p.partitions[i].Get(j)
-		}
-		t += (float64(sum) / float64(p.s))
+		t += (float64(p.partitions[i].popCount()) / float64(p.s))
 	}
 	return t / float64(p.k)
 }
 
+// ReadOnly returns a view of the Bloom filter which can't be used to modify
+// it.
+func (p *PartitionedBloomFilter) ReadOnly() ReadOnlyFilter {
+	return &ReadOnlyView{filter: p}
+}
+
+// ContentHash returns a 64-bit hash of the filter's contents, which only
+// depends on the set bits and the parameters which determine the bits an
+// element maps to: the number and size of the partitions, the seed and the
+// index mapping. Filters holding the same elements hash the same regardless of
+// the order or number of times the elements were added, and the hash is stable
+// across serialization, so it can key a cache of results computed from the
+// filter. Filters are assumed to use the same hash function. It isn't a
+// cryptographic hash.
+func (p *PartitionedBloomFilter) ContentHash() uint64 {
+	h := fnv.New64a()
+	p.encodeContent(newEncoder(h))
+	return h.Sum64()
+}
+
+// encodeContent writes the state of the filter which ContentHash depends on.
+func (p *PartitionedBloomFilter) encodeContent(e *encoder) {
+	e.uvarint(uint64(p.k))
+	e.uvarint(uint64(p.s))
+	e.uint64(p.seed)
+	e.byte(p.mapping)
+	for _, partition := range p.partitions {
+		e.write(partition.data)
+	}
+}
+
+// HashUniformity hashes the given number of distinct synthetic keys, without
+// adding them, and returns a chi-square uniformity score of the bit positions
+// they map to, which detects a badly distributed hash function before it
+// raises the false-positive rate. The positions in each partition are grouped
+// into equal ranges which each expect about 10 keys, and the score is the
+// chi-square statistic over every range of every partition divided by its
+// degrees of freedom. A uniform hash scores around 1, or somewhat less since
+// consecutive keys can spread more evenly than random ones, and the score
+// grows with the skew, so a score well above 1 indicates a bad hash. The keys
+// are consecutive little-endian integers, which resemble real keys such as
+// IDs more than random bytes do. It returns 0 if samples isn't positive.
+func (p *PartitionedBloomFilter) HashUniformity(samples int) float64 {
+	if samples <= 0 {
+		return 0
+	}
+
+	ranges := uint64(samples) / 10
+	if ranges > uint64(p.s) {
+		ranges = uint64(p.s)
+	}
+	if ranges < 2 {
+		ranges = 2
+	}
+
+	var (
+		s        = uint64(p.s)
+		observed = make([]uint64, uint64(p.k)*ranges)
+		key      = make([]byte, 8)
+	)
+	for i := 0; i < samples; i++ {
+		binary.LittleEndian.PutUint64(key, uint64(i))
+		lower, upper := p.seedHashes(p.baseHashes(key))
+		for j := uint(0); j < p.k; j++ {
+			// The range of index x is floor(x * ranges / s).
+			hi, lo := bits.Mul64(uint64(p.index(lower, upper, j)), ranges)
+			r, _ := bits.Div64(hi, lo, s)
+			observed[uint64(j)*ranges+r]++
+		}
+	}
+
+	// start returns the first index in range r, ceil(r * s / ranges).
+	start := func(r uint64) uint64 {
+		hi, lo := bits.Mul64(r, s)
+		lo, carry := bits.Add64(lo, ranges-1, 0)
+		q, _ := bits.Div64(hi+carry, lo, ranges)
+		return q
+	}
+
+	chiSquare := float64(0)
+	for r := uint64(0); r < ranges; r++ {
+		expected := float64(samples) * float64(start(r+1)-start(r)) / float64(s)
+		if expected == 0 {
+			continue
+		}
+		for j := uint64(0); j < uint64(p.k); j++ {
+			d := float64(observed[j*ranges+r]) - expected
+			chiSquare += d * d / expected
+		}
+	}
+
+	return chiSquare / float64(uint64(p.k)*(ranges-1))
+}
+
+// ExpectedFPAt returns the expected false-positive rate once n distinct items
+// have been added, which is (1 - (1 - 1/s)^n)^k for k partitions of s bits.
+func (p *PartitionedBloomFilter) ExpectedFPAt(n uint) float64 {
+	fill := -math.Expm1(float64(n) * math.Log1p(-1/float64(p.s)))
+	return math.Pow(fill, float64(p.k))
+}
+
+// EstimatedFalsePositiveRate returns the current false-positive rate implied
+// by the ratio of set bits, which is the product of the fill ratios of the
+// partitions since an element tests positive only if its bit in every
+// partition is set.
+func (p *PartitionedBloomFilter) EstimatedFalsePositiveRate() float64 {
+	rate := float64(1)
+	for i := uint(0); i < p.k; i++ {
+		rate *= float64(p.partitions[i].popCount()) / float64(p.s)
+	}
+	return rate
+}
+
+// SymmetricDifferenceCount returns the approximate number of distinct items
+// which were added to exactly one of this filter and the other. The union
+// count is estimated from the fill ratio of the OR of the partitions. Because
+// the AND of the partitions overestimates the intersection, the intersection
+// count is instead derived from the union and the individual estimates.
+// Returns an error if the filters don't have matching parameters.
+func (p *PartitionedBloomFilter) SymmetricDifferenceCount(other *PartitionedBloomFilter) (uint, error) {
+	if err := p.checkCompatible(other); err != nil {
+		return 0, err
+	}
+
+	var a, b, union float64
+	for i := uint(0); i < p.k; i++ {
+		a += estimateCount(p.partitions[i].popCount(), p.s)
+		b += estimateCount(other.partitions[i].popCount(), p.s)
+		union += estimateCount(p.partitions[i].unionPopCount(other.partitions[i]), p.s)
+	}
+	a /= float64(p.k)
+	b /= float64(p.k)
+	union /= float64(p.k)
+
+	intersection := math.Max(0, a+b-union)
+	return uint(math.Max(0, math.Floor(union-intersection+0.5))), nil
+}
+
+// DiffFilters returns the number of bits set in a but not in b, and in b but
+// not in a. Identical filters have no differing bits, so this helps to
+// localize why two filters which should be identical, such as a filter and its
+// deserialized copy, disagree on membership. Returns an error if the filters
+// don't have matching parameters.
+func DiffFilters(a, b *PartitionedBloomFilter) (onlyA, onlyB uint, err error) {
+	if err := a.checkCompatible(b); err != nil {
+		return 0, 0, err
+	}
+
+	for i := range a.partitions {
+		onlyA += a.partitions[i].differencePopCount(b.partitions[i])
+		onlyB += b.partitions[i].differencePopCount(a.partitions[i])
+	}
+	return onlyA, onlyB, nil
+}
+
+// union sets every bit which is set in the other filter, which must be
+// compatible. The count becomes the sum of both counts, which overestimates
+// the count if the filters share elements.
+func (p *PartitionedBloomFilter) union(other *PartitionedBloomFilter) {
+	for i := range p.partitions {
+		p.partitions[i].union(other.partitions[i])
+	}
+	p.count += other.count
+}
+
+// checkCompatible returns an error if the other filter's bits can't be
+// compared with this filter's bits.
+func (p *PartitionedBloomFilter) checkCompatible(other *PartitionedBloomFilter) error {
+	if p.k != other.k {
+		return errors.New("number of hash functions must match")
+	}
+
+	if p.s != other.s {
+		return errors.New("partition size must match")
+	}
+
+	if p.seed != other.seed {
+		return errors.New("seed must match")
+	}
+
+	if p.mapping != other.mapping {
+		return errors.New("index mapping must match")
+	}
+
+	return nil
+}
+
 // Test will test for membership of the data and returns true if it is a
 // member, false if not. This is a probabilistic test, meaning there is a
 // non-zero probability of false positives but a zero probability of false
 // negatives. Due to the way the filter is partitioned, the probability of
 // false positives is uniformly distributed across all elements.
 func (p *PartitionedBloomFilter) Test(data []byte) bool {
-	lower, upper := hashKernel(data, p.hash)
+	return p.testHashes(p.baseHashes(data))
+}
 
-	// If any of the K partition bits are not set, then it's not a member.
-	for i := uint(0); i < p.k; i++ {
-		if p.partitions[i].Get((uint(lower)+uint(upper)*i)%p.s) == 0 {
-			return false
-		}
-	}
+// MayContain is equivalent to Test, named for its guarantee: true means the
+// data may have been added, while it may also be a false positive.
+func (p *PartitionedBloomFilter) MayContain(data []byte) bool {
+	return p.Test(data)
+}
 
-	return true
+// DefinitelyNotContains is the negation of Test. A partitioned Bloom filter
+// has no false negatives, so true means the data was never added.
+func (p *PartitionedBloomFilter) DefinitelyNotContains(data []byte) bool {
+	return !p.Test(data)
 }
 
 // Add will add the data to the Bloom filter. It returns the filter to allow
 // for chaining.
 func (p *PartitionedBloomFilter) Add(data []byte) Filter {
-	lower, upper := hashKernel(data, p.hash)
-
-	// Set the K partition bits.
-	for i := uint(0); i < p.k; i++ {
-		p.partitions[i].Set((uint(lower)+uint(upper)*i)%p.s, 1)
-	}
-
-	p.count++
+	p.addHashes(p.baseHashes(data))
 	return p
 }
 
 // TestAndAdd is equivalent to calling Test followed by Add. It returns true if
 // the data is a member, false if not.
 func (p *PartitionedBloomFilter) TestAndAdd(data []byte) bool {
-	lower, upper := hashKernel(data, p.hash)
+	lower, upper := p.seedHashes(p.baseHashes(data))
 	member := true
+	p.unshare()
 
 	// If any of the K partition bits are not set, then it's not a member.
 	for i := uint(0); i < p.k; i++ {
-		idx := (uint(lower) + uint(upper)*i) % p.s
+		idx := p.index(lower, upper, i)
 		if p.partitions[i].Get(idx) == 0 {
 			member = false
 		}
@@ -150,9 +426,70 @@ func (p *PartitionedBloomFilter) TestAndAdd(data []byte) bool {
 	return member
 }
 
+// TestWithHashes tests for membership of the element with the given base
+// hashes, skipping hashing. This avoids hashing data again which was already
+// hashed by a prior pipeline stage. For the result to be consistent with Test
+// and Add, the hashes must be the same base hashes the filter would produce
+// for the data: the values returned by the function set with SetHashFunc, or
+// otherwise the lower and upper 32-bit halves of the hash.Hash64 sum.
+func (p *PartitionedBloomFilter) TestWithHashes(h1, h2 uint64) bool {
+	return p.testHashes(h1, h2)
+}
+
+// AddWithHashes adds the element with the given base hashes to the filter,
+// skipping hashing. The same contract as TestWithHashes applies to the hashes.
+func (p *PartitionedBloomFilter) AddWithHashes(h1, h2 uint64) {
+	p.addHashes(h1, h2)
+}
+
+// Prehash hashes the data for AddPrehashed and TestPrehashed, so hashing can
+// be done separately from adding and testing. The result can be used with any
+// PartitionedBloomFilter or ScalableBloomFilter which hashes the same way as
+// this filter.
+func (p *PartitionedBloomFilter) Prehash(data []byte) Prehashed {
+	return newPrehashed(p.baseHashes(data))
+}
+
+// AddPrehashed adds the element hashed by Prehash to the filter, with the same
+// result as adding the data. It panics if the Prehashed wasn't created by
+// Prehash.
+func (p *PartitionedBloomFilter) AddPrehashed(h Prehashed) {
+	p.addHashes(h.hashes())
+}
+
+// TestPrehashed tests for membership of the element hashed by Prehash, with
+// the same result as testing the data. It panics if the Prehashed wasn't
+// created by Prehash.
+func (p *PartitionedBloomFilter) TestPrehashed(h Prehashed) bool {
+	return p.testHashes(h.hashes())
+}
+
+// AddHashesSorted adds the elements with the given 64-bit hash.Hash64 sums to
+// the filter, skipping hashing, with the same result as adding the elements.
+// It's meant for loading hashes precomputed and sorted offline. The bits are
+// set one partition at a time rather than one element at a time, so only one
+// partition needs to be in cache at once, which makes loading a filter much
+// larger than the cache faster. The hashes don't have to be sorted for the
+// result to be correct. They're only consistent with Add if no function was
+// set with SetHashFunc.
+func (p *PartitionedBloomFilter) AddHashesSorted(hashes []uint64) {
+	p.unshare()
+
+	for i := uint(0); i < p.k; i++ {
+		partition := p.partitions[i]
+		for _, h := range hashes {
+			lower, upper := p.seedHashes(uint64(uint32(h)), h>>32)
+			partition.Set(p.index(lower, upper, i), 1)
+		}
+	}
+
+	p.count += uint(len(hashes))
+}
+
 // Reset restores the Bloom filter to its original state. It returns the filter
 // to allow for chaining.
 func (p *PartitionedBloomFilter) Reset() *PartitionedBloomFilter {
+	p.unshare()
 	for _, partition := range p.partitions {
 		partition.Reset()
 	}
@@ -165,44 +502,312 @@ func (p *PartitionedBloomFilter) SetHash(h hash.Hash64) {
 	p.hash = h
 }
 
+// SetHashFunc sets a function which produces the two base hashes used to
+// derive the k partition indices through double hashing. This allows using a
+// single-pass 128-bit hash split into two 64-bit halves rather than hashing
+// the data twice. When set, it overrides any hash.Hash64 set with SetHash.
+// Passing nil restores hashing with the hash.Hash64.
+func (p *PartitionedBloomFilter) SetHashFunc(fn func(data []byte) (uint64, uint64)) {
+	p.hashFunc = fn
+}
+
+// SetHash128 sets a hash function of at least 128 bits whose sum is split into
+// the two 64-bit base hashes, as described by Hash128. It's equivalent to
+// calling SetHashFunc with Hash128(h).
+func (p *PartitionedBloomFilter) SetHash128(h hash.Hash) {
+	p.SetHashFunc(Hash128(h))
+}
+
+// estimateCount returns the estimated number of distinct items which set x of
+// the s bits in a partition.
+func estimateCount(x, s uint) float64 {
+	if s == 0 {
+		return 0
+	}
+	if x >= s {
+		// The partition is saturated, so the estimate is unbounded. Clamp it
+		// to what one fewer set bit would imply.
+		x = s - 1
+	}
+	return -float64(s) * math.Log(1-float64(x)/float64(s))
+}
+
+// baseHashes returns the two base hash values from which the k partition
+// indices are derived.
+func (p *PartitionedBloomFilter) baseHashes(data []byte) (uint64, uint64) {
+	if p.hashFunc != nil {
+		return p.hashFunc(data)
+	}
+	lower, upper := hashKernel(data, p.hash)
+	return uint64(lower), uint64(upper)
+}
+
+// TestInto is like Test but hashes the data with the scratch's hash function
+// and buffer, so it doesn't allocate. The scratch is unused if a function was
+// set with SetHashFunc.
+func (p *PartitionedBloomFilter) TestInto(data []byte, scratch *HashScratch) bool {
+	return p.testHashes(p.baseHashesInto(data, scratch))
+}
+
+// baseHashesInto is like baseHashes but hashes the data with the scratch.
+func (p *PartitionedBloomFilter) baseHashesInto(data []byte, scratch *HashScratch) (uint64, uint64) {
+	if p.hashFunc != nil {
+		return p.hashFunc(data)
+	}
+	lower, upper := scratch.hashKernel(data)
+	return uint64(lower), uint64(upper)
+}
+
+// testHashes tests for membership of the element with the given base hashes.
+func (p *PartitionedBloomFilter) testHashes(lower, upper uint64) bool {
+	lower, upper = p.seedHashes(lower, upper)
+
+	// If any of the K partition bits are not set, then it's not a member.
+	for i := uint(0); i < p.k; i++ {
+		if p.partitions[i].Get(p.index(lower, upper, i)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addHashes adds the element with the given base hashes to the filter.
+func (p *PartitionedBloomFilter) addHashes(lower, upper uint64) {
+	lower, upper = p.seedHashes(lower, upper)
+	p.unshare()
+
+	// Set the K partition bits.
+	for i := uint(0); i < p.k; i++ {
+		p.partitions[i].Set(p.index(lower, upper, i), 1)
+	}
+
+	p.count++
+}
+
+// testHashesAtomic is like testHashes but reads the partitions atomically, so
+// it's safe to call concurrently with addHashesAtomic. The partitions must
+// have been aligned with alignData.
+func (p *PartitionedBloomFilter) testHashesAtomic(lower, upper uint64) bool {
+	lower, upper = p.seedHashes(lower, upper)
+
+	for i := uint(0); i < p.k; i++ {
+		if !p.partitions[i].getBitAtomic(p.index(lower, upper, i)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addHashesAtomic is like addHashes but sets the partition bits atomically.
+// Concurrent calls must still be serialized since the count isn't updated
+// atomically.
+func (p *PartitionedBloomFilter) addHashesAtomic(lower, upper uint64) {
+	lower, upper = p.seedHashes(lower, upper)
+	p.unshare()
+
+	for i := uint(0); i < p.k; i++ {
+		p.partitions[i].setBitAtomic(p.index(lower, upper, i))
+	}
+
+	p.count++
+}
+
+// clone returns a copy of the filter which shares its hash function.
+func (p *PartitionedBloomFilter) clone() *PartitionedBloomFilter {
+	clone := *p
+	clone.shared = nil
+	clone.partitions = make([]*Buckets, len(p.partitions))
+	for i, partition := range p.partitions {
+		clone.partitions[i] = partition.clone()
+	}
+	return &clone
+}
+
+// fork returns a copy of the filter which shares its partitions and hash
+// function until either of them writes to the partitions, at which point the
+// writer copies them.
+func (p *PartitionedBloomFilter) fork() *PartitionedBloomFilter {
+	if p.shared == nil {
+		p.shared = new(int32)
+		*p.shared = 1
+	}
+	atomic.AddInt32(p.shared, 1)
+	fork := *p
+	return &fork
+}
+
+// unshare copies the partitions if they're shared with a fork, so that they
+// can be written to. A filter which is the last to hold shared partitions
+// takes ownership of them without copying.
+func (p *PartitionedBloomFilter) unshare() {
+	if p.shared == nil {
+		return
+	}
+	if atomic.LoadInt32(p.shared) > 1 {
+		partitions := make([]*Buckets, len(p.partitions))
+		for i, partition := range p.partitions {
+			partitions[i] = partition.clone()
+		}
+		p.partitions = partitions
+		atomic.AddInt32(p.shared, -1)
+	}
+	p.shared = nil
+}
+
+// alignData aligns the partitions for atomic access.
+func (p *PartitionedBloomFilter) alignData() {
+	p.unshare()
+	for _, partition := range p.partitions {
+		partition.alignData()
+	}
+}
+
+// seedHashes mixes the filter's seed into the base hashes so that filters with
+// different seeds map the same element to uncorrelated indices. A zero seed
+// leaves the base hashes unchanged, unless they're mapped to indices with fast
+// range reduction, which needs them to be mixed over all 64 bits.
+func (p *PartitionedBloomFilter) seedHashes(lower, upper uint64) (uint64, uint64) {
+	if p.seed == 0 && p.mapping == moduloIndex {
+		return lower, upper
+	}
+	return mix64(lower ^ p.seed), mix64(upper ^ p.seed)
+}
+
+// index returns the bit index within partition i for the given base hashes.
+// New filters use Lemire's fast range reduction, which maps the combined hash
+// to the high 64 bits of its product with the partition size. Unlike taking it
+// modulo a partition size which isn't a power of two, this doesn't favor lower
+// indices and avoids a division. Filters decoded from older formats keep using
+// the modulo so that their bits stay valid.
+func (p *PartitionedBloomFilter) index(lower, upper uint64, i uint) uint {
+	if p.mapping == moduloIndex {
+		return uint((lower + upper*uint64(i)) % uint64(p.s))
+	}
+	hi, _ := bits.Mul64(lower+upper*uint64(i), uint64(p.s))
+	return uint(hi)
+}
+
 // WriteTo writes a binary representation of the PartitionedBloomFilter to an i/o stream.
 // It returns the number of bytes written.
 func (p *PartitionedBloomFilter) WriteTo(stream io.Writer) (int64, error) {
-	err := binary.Write(stream, binary.BigEndian, uint64(p.m))
-	if err != nil {
-		return 0, err
+	e := newEncoder(stream)
+	e.header()
+	p.encode(e)
+	return e.n, e.err
+}
+
+// encode writes the PartitionedBloomFilter without a format header.
+func (p *PartitionedBloomFilter) encode(e *encoder) {
+	e.uvarint(uint64(p.m))
+	e.uvarint(uint64(p.k))
+	e.uvarint(uint64(p.s))
+	e.uvarint(uint64(p.count))
+	e.uint64(p.seed)
+	e.byte(p.mapping)
+	e.uvarint(uint64(len(p.partitions)))
+	for _, partition := range p.partitions {
+		partition.encode(e)
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(p.k))
+}
+
+// ReadFrom reads a binary representation of PartitionedBloomFilter (such as might
+// have been written by WriteTo()) from an i/o stream. It returns the number
+// of bytes read. Both the compact format and the fixed-width format written by
+// earlier versions of this package, which is also the upstream format, can be
+// read.
+func (p *PartitionedBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	d, legacy, err := readHeader(stream)
 	if err != nil {
 		return 0, err
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(p.s))
-	if err != nil {
-		return 0, err
+	if d == nil {
+		return p.readFrom(legacy)
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(p.count))
-	if err != nil {
-		return 0, err
+
+	p.decode(d)
+	return d.n, d.err
+}
+
+// decode reads a PartitionedBloomFilter written by encode. The filter is only
+// modified if decoding succeeds.
+func (p *PartitionedBloomFilter) decode(d *decoder) {
+	var (
+		m       = d.uvarint()
+		k       = d.uvarint()
+		s       = d.uvarint()
+		count   = d.uvarint()
+		seed    = d.uint64()
+		mapping = d.indexMapping()
+		n       = d.length(ptrSize)
+	)
+	if d.err == nil && n != k {
+		d.err = errors.New("number of partitions must match number of hash functions")
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(len(p.partitions)))
-	if err != nil {
-		return 0, err
+	if d.err != nil {
+		return
 	}
-	var numBytes int64
-	for _, partition := range p.partitions {
-		num, err := partition.WriteTo(stream)
-		if err != nil {
-			return 0, err
+
+	partitions := make([]*Buckets, n)
+	for i := range partitions {
+		partitions[i] = &Buckets{}
+		partitions[i].decode(d)
+		if d.err != nil {
+			return
 		}
-		numBytes += num
 	}
-	return numBytes + int64(5*binary.Size(uint64(0))), err
+	if d.err = checkPartitions(partitions, k, s); d.err != nil {
+		return
+	}
+
+	p.m = uint(m)
+	p.k = uint(k)
+	p.s = uint(s)
+	p.count = uint(count)
+	p.seed = seed
+	p.mapping = mapping
+	p.partitions = partitions
+	p.shared = nil
 }
 
-// ReadFrom reads a binary representation of PartitionedBloomFilter (such as might
-// have been written by WriteTo()) from an i/o stream. It returns the number
-// of bytes read.
-func (p *PartitionedBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+// checkPartitions returns an error if a binary representation of
+// PartitionedBloomFilter declares no hash functions or empty partitions, more
+// bits than fit in a uint, or if any of the decoded partitions doesn't consist
+// of s single-bit buckets, since indexing such partitions would panic.
+func checkPartitions(partitions []*Buckets, k, s uint64) error {
+	if k == 0 || s == 0 {
+		return errors.New("number of hash functions and partition size must be positive")
+	}
+	if s > uint64(^uint(0))/k {
+		return errors.New("number of bits overflows uint")
+	}
+	for _, partition := range partitions {
+		if partition.bucketSize != 1 || uint64(partition.Count()) != s {
+			return errors.New("partitions must have one single-bit bucket per partition bit")
+		}
+	}
+	return nil
+}
+
+// ReadFromUpstream reads a binary representation of PartitionedBloomFilter
+// written by the upstream github.com/tylertreat/BoomFilters package, which
+// doesn't include a hash seed, from an i/o stream. ReadFrom reads this format
+// too, so this is only needed to reject the compact format. It returns the
+// number of bytes read.
+func (p *PartitionedBloomFilter) ReadFromUpstream(stream io.Reader) (int64, error) {
+	legacy, err := readUpstream(stream)
+	if err != nil {
+		return 0, err
+	}
+	return p.readFrom(legacy)
+}
+
+// readFrom reads the fixed-width binary representation of
+// PartitionedBloomFilter written by earlier versions of this package and by
+// upstream, which is unseeded, from an i/o stream. It returns the number of
+// bytes read.
+func (p *PartitionedBloomFilter) readFrom(stream io.Reader) (int64, error) {
 	var m, k, s, count, len uint64
 	err := binary.Read(stream, binary.BigEndian, &m)
 	if err != nil {
@@ -224,22 +829,34 @@ func (p *PartitionedBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if len != k {
+		return 0, errors.New("number of partitions must match number of hash functions")
+	}
+	if err := checkDecodeSize(len, ptrSize); err != nil {
+		return 0, err
+	}
 	var numBytes int64
 	partitions := make([]*Buckets, len)
 	for i := range partitions {
 		buckets := &Buckets{}
-		num, err := buckets.ReadFrom(stream)
+		num, err := buckets.readLegacy(stream)
 		if err != nil {
 			return 0, err
 		}
 		numBytes += num
 		partitions[i] = buckets
 	}
+	if err := checkPartitions(partitions, k, s); err != nil {
+		return 0, err
+	}
 	p.m = uint(m)
 	p.k = uint(k)
 	p.s = uint(s)
 	p.count = uint(count)
+	p.seed = 0
+	p.mapping = moduloIndex
 	p.partitions = partitions
+	p.shared = nil
 	return numBytes + int64(5*binary.Size(uint64(0))), nil
 }
 
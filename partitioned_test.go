@@ -2,7 +2,14 @@ package boom
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"hash"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
 	"strconv"
 	"testing"
 
@@ -13,8 +20,8 @@ import (
 func TestPartitionedBloomCapacity(t *testing.T) {
 	f := NewPartitionedBloomFilter(100, 0.1)
 
-	if capacity := f.Capacity(); capacity != 480 {
-		t.Errorf("Expected 480, got %d", capacity)
+	if capacity := f.Capacity(); capacity != 512 {
+		t.Errorf("Expected 512, got %d", capacity)
 	}
 }
 
@@ -58,8 +65,332 @@ func TestPartitionedFillRatio(t *testing.T) {
 	f.Add([]byte(`b`))
 	f.Add([]byte(`c`))
 
-	if ratio := f.FillRatio(); ratio != 0.025 {
-		t.Errorf("Expected 0.025, got %f", ratio)
+	if ratio := f.FillRatio(); ratio != 0.0234375 {
+		t.Errorf("Expected 0.0234375, got %f", ratio)
+	}
+}
+
+// skewedHash is a hash.Hash64 whose sum only depends on the first byte of the
+// data.
+type skewedHash struct {
+	first []byte
+}
+
+func (h *skewedHash) Write(p []byte) (int, error) {
+	if len(h.first) == 0 && len(p) > 0 {
+		h.first = []byte{p[0]}
+	}
+	return len(p), nil
+}
+
+func (h *skewedHash) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+func (h *skewedHash) Sum64() uint64 {
+	if len(h.first) == 0 {
+		return 0
+	}
+	return uint64(h.first[0])<<32 | uint64(h.first[0])
+}
+
+func (h *skewedHash) Reset()         { h.first = nil }
+func (h *skewedHash) Size() int      { return 8 }
+func (h *skewedHash) BlockSize() int { return 1 }
+
+// Ensures that HashUniformity scores a good hash around 1 and a skewed hash
+// far higher.
+func TestPartitionedBloomHashUniformity(t *testing.T) {
+	f := NewPartitionedBloomFilter(10000, 0.01)
+	if score := f.HashUniformity(0); score != 0 {
+		t.Errorf("Expected 0, got %f", score)
+	}
+
+	for _, h := range []hash.Hash64{fnv.New64(), fnv.New64a()} {
+		f.SetHash(h)
+		if score := f.HashUniformity(100000); score > 1.5 {
+			t.Errorf("Expected at most 1.5, got %f", score)
+		}
+	}
+
+	f.SetHash(&skewedHash{})
+	if score := f.HashUniformity(100000); score < 10 {
+		t.Errorf("Expected at least 10, got %f", score)
+	}
+
+	// Nothing is added.
+	if count := f.Count(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+
+	s := NewScalableBloomFilter(10000, 0.01, 0.8)
+	if score := s.HashUniformity(100000); score != s.Filters()[0].HashUniformity(100000) {
+		t.Errorf("Expected %f, got %f", s.Filters()[0].HashUniformity(100000), score)
+	}
+}
+
+// Ensures that NewPartitionedBloomFilterFixedMemory stays within the bit
+// budget and that ExpectedFPAt matches the observed false-positive rate.
+func TestPartitionedBloomFixedMemory(t *testing.T) {
+	for _, k := range []uint{1, 2, 4, 8} {
+		f := NewPartitionedBloomFilterFixedMemory(20000, k)
+		if f.K() != k {
+			t.Errorf("Expected %d, got %d", k, f.K())
+		}
+
+		if bits := f.TotalBits(); bits > 20000 || bits <= 20000-64*k {
+			t.Errorf("Expected at most 20000 bits, got %d", bits)
+		}
+
+		for i := 0; i < 2000; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+
+		var (
+			trials    = 100000
+			positives = 0
+		)
+		for i := 2000; i < 2000+trials; i++ {
+			if f.Test([]byte(strconv.Itoa(i))) {
+				positives++
+			}
+		}
+
+		var (
+			expected = f.ExpectedFPAt(2000)
+			observed = float64(positives) / float64(trials)
+		)
+		// FNV-1 doesn't spread consecutive keys quite randomly, so allow for
+		// more than sampling error.
+		if math.Abs(observed-expected) > 0.2*expected {
+			t.Errorf("k=%d: Expected false-positive rate %f, got %f", k, expected, observed)
+		}
+	}
+
+	if fp := NewPartitionedBloomFilterFixedMemory(20000, 4).ExpectedFPAt(0); fp != 0 {
+		t.Errorf("Expected 0, got %f", fp)
+	}
+
+	f := NewPartitionedBloomFilterFixedMemory(3, 5)
+	if f.K() != 3 || f.TotalBits() != 3 {
+		t.Errorf("Expected 3 partitions of 1 bit, got %d of %d", f.K(), f.s)
+	}
+}
+
+// Ensures that NewPartitionedBloomFilter sizes partitions to a whole number
+// of 64-bit words and that Add never sets the unused trailing bits of
+// unaligned partitions, as kept by filters decoded from older data.
+func TestPartitionedBloomAligned(t *testing.T) {
+	aligned := NewPartitionedBloomFilter(100, 0.01)
+	var (
+		m = OptimalM(100, 0.01)
+		k = OptimalK(0.01)
+		s = uint(math.Ceil(float64(m) / float64(k)))
+	)
+	unaligned := newPartitionedBloomFilter(m, k, s)
+
+	if !aligned.Aligned() || unaligned.Aligned() {
+		t.Fatalf("Expected partition sizes %d and %d to be aligned and unaligned", aligned.s, unaligned.s)
+	}
+
+	if aligned.s < unaligned.s || aligned.s-unaligned.s >= 64 {
+		t.Errorf("Expected %d rounded up to a multiple of 64, got %d", unaligned.s, aligned.s)
+	}
+
+	if capacity := aligned.Capacity(); capacity != aligned.k*aligned.s {
+		t.Errorf("Expected %d, got %d", aligned.k*aligned.s, capacity)
+	}
+
+	for _, partition := range aligned.partitions {
+		if len(partition.data)%8 != 0 || uint(len(partition.data))*8 != aligned.s {
+			t.Errorf("Expected %d bytes, got %d", aligned.s/8, len(partition.data))
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		aligned.Add([]byte(strconv.Itoa(i)))
+		unaligned.Add([]byte(strconv.Itoa(i)))
+	}
+
+	// The unused high bits of the last byte are never set.
+	for _, partition := range unaligned.partitions {
+		last := partition.data[len(partition.data)-1]
+		if used := unaligned.s % 8; used != 0 && last>>used != 0 {
+			t.Errorf("Expected unused bits to be unset, got %08b", last)
+		}
+	}
+
+	for _, f := range []*PartitionedBloomFilter{aligned, unaligned} {
+		if ratio := float64(f.SetBits()) / float64(f.TotalBits()); ratio != f.FillRatio() {
+			t.Errorf("Expected %f, got %f", ratio, f.FillRatio())
+		}
+
+		for i := 0; i < 1000; i++ {
+			if !f.Test([]byte(strconv.Itoa(i))) {
+				t.Errorf("Expected %d to be a member", i)
+			}
+		}
+	}
+}
+
+// Ensures that SetBits and TotalBits return the numerator and denominator of
+// the fill ratio.
+func TestPartitionedBloomSetBits(t *testing.T) {
+	f := NewPartitionedBloomFilter(100, 0.1)
+	f.Add([]byte(`a`))
+	f.Add([]byte(`b`))
+	f.Add([]byte(`c`))
+
+	if bits := f.SetBits(); bits != 12 {
+		t.Errorf("Expected 12, got %d", bits)
+	}
+
+	if bits := f.TotalBits(); bits != 512 {
+		t.Errorf("Expected 512, got %d", bits)
+	}
+
+	if ratio := float64(f.SetBits()) / float64(f.TotalBits()); ratio != f.FillRatio() {
+		t.Errorf("Expected %f, got %f", f.FillRatio(), ratio)
+	}
+}
+
+// Ensures that SymmetricDifferenceCount approximates the number of items in
+// exactly one of the filters and rejects filters with different parameters.
+func TestPartitionedBloomSymmetricDifferenceCount(t *testing.T) {
+	f := NewPartitionedBloomFilter(5000, 0.01)
+	f2 := NewPartitionedBloomFilter(5000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 500; i < 2000; i++ {
+		f2.Add([]byte(strconv.Itoa(i)))
+	}
+
+	count, err := f.SymmetricDifferenceCount(f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count < 1350 || count > 1650 {
+		t.Errorf("Expected about 1500, got %d", count)
+	}
+
+	count, err = f.SymmetricDifferenceCount(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count > 15 {
+		t.Errorf("Expected about 0, got %d", count)
+	}
+
+	if _, err := f.SymmetricDifferenceCount(NewPartitionedBloomFilter(100, 0.01)); err == nil {
+		t.Error("Expected error for mismatched partition size")
+	}
+
+	if _, err := f.SymmetricDifferenceCount(NewPartitionedBloomFilter(5000, 0.1)); err == nil {
+		t.Error("Expected error for mismatched number of hash functions")
+	}
+}
+
+// Ensures that DiffFilters counts the bits set in only one of the filters and
+// rejects filters with different parameters.
+func TestDiffFilters(t *testing.T) {
+	f := NewPartitionedBloomFilter(1000, 0.01)
+	f2 := NewPartitionedBloomFilter(1000, 0.01)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		f2.Add([]byte(strconv.Itoa(i)))
+	}
+
+	onlyA, onlyB, err := DiffFilters(f, f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if onlyA != 0 || onlyB != 0 {
+		t.Errorf("Expected no differing bits, got %d and %d", onlyA, onlyB)
+	}
+
+	f2.Add([]byte(`a`))
+	onlyA, onlyB, err = DiffFilters(f, f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if onlyA != 0 {
+		t.Errorf("Expected 0, got %d", onlyA)
+	}
+
+	if onlyB == 0 || onlyB > f2.K() {
+		t.Errorf("Expected between 1 and %d, got %d", f2.K(), onlyB)
+	}
+
+	if a, b, _ := DiffFilters(f2, f); a != onlyB || b != 0 {
+		t.Errorf("Expected %d and 0, got %d and %d", onlyB, a, b)
+	}
+
+	if _, _, err := DiffFilters(f, NewPartitionedBloomFilter(100, 0.01)); err == nil {
+		t.Error("Expected error for mismatched partition size")
+	}
+}
+
+// Ensures that a 128-bit hash spreads indices over partitions larger than
+// 2^32 bits, which the 32-bit halves of a 64-bit hash can't.
+func TestPartitionedBloomHash128Distribution(t *testing.T) {
+	g := NewPartitionedBloomFilter(1000, 0.01)
+	g.SetHash128(fnv.New128a())
+	for i := 0; i < 1000; i++ {
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		if !g.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if bits.UintSize != 64 {
+		t.Skip("partitions larger than 2^32 bits require a 64-bit uint")
+	}
+
+	const bins = 64
+	chiSquare := func(f *PartitionedBloomFilter) float64 {
+		var counts [bins]float64
+		n := 0
+		for i := 0; i < 100000; i++ {
+			lower, upper := f.seedHashes(f.baseHashes([]byte(strconv.Itoa(i))))
+			for j := uint(0); j < f.k; j++ {
+				counts[f.index(lower, upper, j)*bins/f.s]++
+				n++
+			}
+		}
+		expected := float64(n) / bins
+		x := 0.0
+		for _, c := range counts {
+			x += (c - expected) * (c - expected) / expected
+		}
+		return x
+	}
+
+	// The partitions are never allocated, since only indices are computed.
+	// The size is shifted at run time so that this compiles where uint is
+	// 32 bits.
+	shift := 36
+	f := &PartitionedBloomFilter{hash: fnv.New64(), k: 4, s: 1<<shift - 5}
+	biased := chiSquare(f)
+
+	f.SetHash128(fnv.New128())
+	uniform := chiSquare(f)
+
+	// For 63 degrees of freedom, the 99.9th percentile is about 104.
+	if uniform > 104 {
+		t.Errorf("Expected a uniform distribution, got chi-square %f", uniform)
+	}
+
+	if biased < 10*uniform {
+		t.Errorf("Expected a biased distribution, got chi-square %f", biased)
 	}
 }
 
@@ -136,6 +467,75 @@ func TestPartitionedBloomReset(t *testing.T) {
 	}
 }
 
+// Ensures that SetHashFunc replaces the hash used to derive partition indices.
+func TestPartitionedBloomSetHashFunc(t *testing.T) {
+	f := NewPartitionedBloomFilter(100, 0.01)
+	calls := 0
+	f.SetHashFunc(func(data []byte) (uint64, uint64) {
+		calls++
+		return 42, 7
+	})
+
+	f.Add([]byte(`a`))
+
+	// Every element has the same base hashes, so every element is a member.
+	if !f.Test([]byte(`b`)) {
+		t.Error("`b` should be a member")
+	}
+
+	if !f.TestAndAdd([]byte(`c`)) {
+		t.Error("`c` should be a member")
+	}
+
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+
+	f.SetHashFunc(nil)
+	f.Reset()
+	f.Add([]byte(`a`))
+
+	if f.Test([]byte(`b`)) {
+		t.Error("`b` should not be a member")
+	}
+}
+
+// Ensures that TestWithHashes and AddWithHashes are consistent with Test and
+// Add when given the filter's own base hashes.
+func TestPartitionedBloomWithHashes(t *testing.T) {
+	f := NewPartitionedBloomFilter(100, 0.01)
+	f.SetHashFunc(func(data []byte) (uint64, uint64) {
+		return uint64(len(data)), uint64(data[0])
+	})
+
+	f.AddWithHashes(1, 'a')
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	f.Add([]byte(`bb`))
+	if !f.TestWithHashes(2, 'b') {
+		t.Error("`bb` should be a member")
+	}
+
+	if f.TestWithHashes(3, 'c') {
+		t.Error("`ccc` should not be a member")
+	}
+
+	if count := f.Count(); count != 2 {
+		t.Errorf("Expected 2, got %d", count)
+	}
+
+	// Without a hash function, the base hashes are the two halves of the
+	// hash.Hash64 sum.
+	f = NewPartitionedBloomFilter(100, 0.01)
+	lower, upper := hashKernel([]byte(`a`), fnv.New64())
+	f.AddWithHashes(uint64(lower), uint64(upper))
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+}
+
 // Ensures that PartitionedBloomFilter can be serialized and deserialized without errors.
 func TestPartitionedBloomGob(t *testing.T) {
 	f := NewPartitionedBloomFilter(100, 0.1)
@@ -158,6 +558,203 @@ func TestPartitionedBloomGob(t *testing.T) {
 	}
 }
 
+// Ensures that ReadFromUpstream decodes a filter written by the upstream
+// BoomFilters package and rejects the compact format.
+func TestPartitionedBloomReadFromUpstream(t *testing.T) {
+	data, err := os.ReadFile("testdata/upstream_partitioned.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewPartitionedBloomFilter(100, 0.1)
+	n, err := f.ReadFromUpstream(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(data)) {
+		t.Errorf("Expected %d bytes read, got %d", len(data), n)
+	}
+
+	if count := f.Count(); count != 20 {
+		t.Errorf("Expected 20, got %d", count)
+	}
+
+	for i := 0; i < 20; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPartitionedBloomFilter(100, 0.1).ReadFromUpstream(&buf); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that ReadFrom rejects filters whose partitions are inconsistent with
+// the declared partition size instead of panicking when they're used.
+func TestPartitionedBloomReadFromInconsistent(t *testing.T) {
+	partitioned := func(k, s uint64, bucketSize, max uint8, count, size uint64) []byte {
+		var buf bytes.Buffer
+		for _, x := range []uint64{k * s, k, s, 0, k} {
+			binary.Write(&buf, binary.BigEndian, x)
+		}
+		for i := uint64(0); i < k; i++ {
+			buf.Write([]byte{bucketSize, max})
+			binary.Write(&buf, binary.BigEndian, count)
+			binary.Write(&buf, binary.BigEndian, size)
+			buf.Write(make([]byte, size))
+		}
+		return buf.Bytes()
+	}
+
+	f := NewPartitionedBloomFilter(100, 0.1)
+	if _, err := f.ReadFrom(bytes.NewReader(partitioned(2, 100, 1, 1, 100, 13))); err != nil {
+		t.Fatal(err)
+	}
+	f.Add([]byte("a"))
+	if !f.Test([]byte("a")) {
+		t.Error("Expected a to be a member")
+	}
+
+	for _, data := range [][]byte{
+		partitioned(2, 100, 1, 1, 8, 1),
+		partitioned(2, 100, 2, 3, 100, 25),
+		partitioned(2, 100, 1, 1, 100, 1),
+		partitioned(2, 100, 1, 3, 100, 13),
+		partitioned(0, 100, 1, 1, 100, 13),
+		partitioned(2, 0, 1, 1, 0, 0),
+	} {
+		if _, err := NewPartitionedBloomFilter(100, 0.1).ReadFrom(bytes.NewReader(data)); err == nil {
+			t.Error("Expected error")
+		}
+	}
+}
+
+// Ensures that fast range reduction maps uniform base hashes to uniform
+// indices for a partition size which isn't a power of two, while the modulo
+// mapping favors lower indices.
+func TestPartitionedBloomIndexBias(t *testing.T) {
+	const samples = 100000
+	lowerHalf := func(mapping byte) float64 {
+		// 32-bit hashes modulo 3*2^30 hit the first 2^30 indices twice as
+		// often as the rest.
+		p := &PartitionedBloomFilter{k: 2, s: 3 << 30, mapping: mapping}
+		n := 0
+		for i := uint64(0); i < samples; i++ {
+			lower, upper := p.seedHashes(uint64(uint32(mix64(2*i+1))), uint64(uint32(mix64(2*i+2))))
+			if p.index(lower, upper, 0) < p.s/2 {
+				n++
+			}
+		}
+		return float64(n) / samples
+	}
+
+	if frac := lowerHalf(moduloIndex); math.Abs(frac-0.625) > 0.01 {
+		t.Errorf("Expected 0.625 of the modulo indices in the lower half, got %f", frac)
+	}
+
+	if frac := lowerHalf(fastRangeIndex); math.Abs(frac-0.5) > 0.01 {
+		t.Errorf("Expected 0.5 of the fast range indices in the lower half, got %f", frac)
+	}
+
+	if mapping := NewPartitionedBloomFilter(100, 0.1).mapping; mapping != fastRangeIndex {
+		t.Errorf("Expected fast range reduction, got %d", mapping)
+	}
+}
+
+// Ensures that a filter written in version 1 of the compact format, before
+// the index mapping was written, is decoded with the modulo mapping.
+func TestPartitionedBloomReadFromVersion1(t *testing.T) {
+	f := NewPartitionedBloomFilter(100, 0.1)
+	f.mapping = moduloIndex
+	for i := 0; i < 20; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the index mapping, which follows the sizes, count and seed.
+	data := buf.Bytes()
+	offset := headerSize + 8
+	for _, x := range []uint{f.m, f.k, f.s, f.count} {
+		offset += uvarintSize(uint64(x))
+	}
+	data[len(formatMagic)] = 1
+	data = append(data[:offset], data[offset+1:]...)
+
+	g := NewPartitionedBloomFilter(100, 0.1)
+	n, err := g.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(data)) {
+		t.Errorf("Expected %d bytes read, got %d", len(data), n)
+	}
+
+	if g.mapping != moduloIndex {
+		t.Errorf("Expected the modulo mapping, got %d", g.mapping)
+	}
+
+	for i := 0; i < 20; i++ {
+		if !g.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// Filters with different mappings can't be merged.
+	if err := NewPartitionedBloomFilter(100, 0.1).checkCompatible(g); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that AddHashesSorted yields the same filter as adding the elements
+// whose hashes are given.
+func TestPartitionedBloomAddHashesSorted(t *testing.T) {
+	for _, seed := range []uint64{0, 42} {
+		var (
+			f      = NewPartitionedBloomFilter(1000, 0.01)
+			g      = NewPartitionedBloomFilter(1000, 0.01)
+			hashes = make([]uint64, 1000)
+		)
+		f.seed = seed
+		g.seed = seed
+		for i := range hashes {
+			data := []byte(strconv.Itoa(i))
+			h := fnv.New64()
+			h.Write(data)
+			hashes[i] = h.Sum64()
+			f.Add(data)
+		}
+		sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+		g.AddHashesSorted(hashes)
+
+		if g.Count() != f.Count() {
+			t.Errorf("Expected %d, got %d", f.Count(), g.Count())
+		}
+
+		for i := range f.partitions {
+			if !bytes.Equal(g.partitions[i].data, f.partitions[i].data) {
+				t.Errorf("Expected partition %d to match", i)
+			}
+		}
+
+		for i := 0; i < 1000; i++ {
+			if !g.Test([]byte(strconv.Itoa(i))) {
+				t.Errorf("Expected %d to be a member", i)
+			}
+		}
+	}
+}
+
 func BenchmarkPartitionedBloomAdd(b *testing.B) {
 	b.StopTimer()
 	f := NewPartitionedBloomFilter(100000, 0.1)
@@ -199,3 +796,107 @@ func BenchmarkPartitionedBloomTestAndAdd(b *testing.B) {
 		f.TestAndAdd(data[n])
 	}
 }
+
+func BenchmarkPartitionedBloomFillRatio(b *testing.B) {
+	b.StopTimer()
+	f := NewPartitionedBloomFilter(4000000, 0.01)
+	for i := 0; i < 100000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.FillRatio()
+	}
+}
+
+func BenchmarkPartitionedBloomAddHash128(b *testing.B) {
+	b.StopTimer()
+	f := NewPartitionedBloomFilter(100000, 0.1)
+	f.SetHash128(fnv.New128())
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.Add(data[n])
+	}
+}
+
+func BenchmarkPartitionedBloomAddHashesSorted(b *testing.B) {
+	b.StopTimer()
+	f := NewPartitionedBloomFilter(10000000, 0.01)
+	hashes := benchmarkHashes(b.N)
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	b.StartTimer()
+
+	f.AddHashesSorted(hashes)
+}
+
+func BenchmarkPartitionedBloomAddWithHashes(b *testing.B) {
+	b.StopTimer()
+	f := NewPartitionedBloomFilter(10000000, 0.01)
+	hashes := benchmarkHashes(b.N)
+	b.StartTimer()
+
+	for _, h := range hashes {
+		f.AddWithHashes(uint64(uint32(h)), h>>32)
+	}
+}
+
+// benchmarkHashes returns the FNV-1 64-bit hashes of the first n integers.
+func benchmarkHashes(n int) []uint64 {
+	var (
+		hashes = make([]uint64, n)
+		h      = fnv.New64()
+	)
+	for i := range hashes {
+		h.Write([]byte(strconv.Itoa(i)))
+		hashes[i] = h.Sum64()
+		h.Reset()
+	}
+	return hashes
+}
+
+// Ensures that ContentHash only depends on the filter's contents and is stable
+// across serialization.
+func TestPartitionedBloomContentHash(t *testing.T) {
+	var (
+		f = NewPartitionedBloomFilter(100, 0.01)
+		g = NewPartitionedBloomFilter(100, 0.01)
+	)
+	for i := 0; i < 50; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		g.Add([]byte(strconv.Itoa(49 - i)))
+		g.Add([]byte(strconv.Itoa(49 - i)))
+	}
+
+	if f.ContentHash() != g.ContentHash() {
+		t.Error("Expected filters with the same elements to hash the same")
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewPartitionedBloomFilter(10, 0.1)
+	if _, err := decoded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ContentHash() != f.ContentHash() {
+		t.Error("Expected the hash to be stable across serialization")
+	}
+
+	hash := f.ContentHash()
+	f.Add([]byte(`a`))
+	if f.ContentHash() == hash {
+		t.Error("Expected a new element to change the hash")
+	}
+
+	g.seed = 42
+	if g.ContentHash() == hash {
+		t.Error("Expected the seed to change the hash")
+	}
+}
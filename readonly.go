@@ -0,0 +1,57 @@
+package boom
+
+import "io"
+
+// ReadOnlyFilter is a filter which can be queried and serialized but not
+// modified.
+type ReadOnlyFilter interface {
+	Countable
+	Serializable
+
+	// Test will test for membership of the data and returns true if it is a
+	// member, false if not.
+	Test([]byte) bool
+
+	// Capacity returns the filter capacity.
+	Capacity() uint
+
+	// FillRatio returns the ratio of set bits.
+	FillRatio() float64
+}
+
+// ReadOnlyView is a ReadOnlyFilter which wraps a filter, for sharing a filter
+// with components which shouldn't modify it. Since the filter is hidden, it
+// can't be recovered with a type assertion. Changes made through the filter
+// itself are visible through the view. The view doesn't make the filter safe
+// for concurrent use: Test uses the filter's hash function, so concurrent
+// calls must still be serialized.
+type ReadOnlyView struct {
+	filter ReadOnlyFilter // underlying filter
+}
+
+// Test will test for membership of the data and returns true if it is a
+// member, false if not.
+func (r *ReadOnlyView) Test(data []byte) bool {
+	return r.filter.Test(data)
+}
+
+// Count returns the number of items added to the filter.
+func (r *ReadOnlyView) Count() uint {
+	return r.filter.Count()
+}
+
+// Capacity returns the filter capacity.
+func (r *ReadOnlyView) Capacity() uint {
+	return r.filter.Capacity()
+}
+
+// FillRatio returns the ratio of set bits.
+func (r *ReadOnlyView) FillRatio() float64 {
+	return r.filter.FillRatio()
+}
+
+// WriteTo writes a binary representation of the filter to an i/o stream. It
+// returns the number of bytes written.
+func (r *ReadOnlyView) WriteTo(stream io.Writer) (int64, error) {
+	return r.filter.WriteTo(stream)
+}
@@ -0,0 +1,75 @@
+package boom
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// Ensures that ReadOnly returns a view which reflects the filter but doesn't
+// expose its mutating methods.
+func TestReadOnlyView(t *testing.T) {
+	var (
+		bloom       = NewBloomFilter(100, 0.01)
+		partitioned = NewPartitionedBloomFilter(100, 0.01)
+		scalable    = NewScalableBloomFilter(10, 0.01, 0.8)
+	)
+
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		view   ReadOnlyFilter
+	}{
+		{"bloom", bloom, bloom.ReadOnly()},
+		{"partitioned", partitioned, partitioned.ReadOnly()},
+		{"scalable", scalable, scalable.ReadOnly()},
+	} {
+		if _, ok := tc.view.(Filter); ok {
+			t.Errorf("%s: Expected the view not to be a Filter", tc.name)
+		}
+
+		if tc.view.Test([]byte(`a`)) {
+			t.Errorf("%s: `a` should not be a member", tc.name)
+		}
+
+		for i := 0; i < 50; i++ {
+			tc.filter.Add([]byte(strconv.Itoa(i)))
+		}
+		tc.filter.Add([]byte(`a`))
+
+		// Changes to the filter are visible through the view.
+		if !tc.view.Test([]byte(`a`)) {
+			t.Errorf("%s: `a` should be a member", tc.name)
+		}
+
+		source := tc.filter.(ReadOnlyFilter)
+		if count := tc.view.Count(); count != source.Count() {
+			t.Errorf("%s: Expected %d, got %d", tc.name, source.Count(), count)
+		}
+
+		if capacity := tc.view.Capacity(); capacity != source.Capacity() {
+			t.Errorf("%s: Expected %d, got %d", tc.name, source.Capacity(), capacity)
+		}
+
+		if ratio := tc.view.FillRatio(); ratio != source.FillRatio() {
+			t.Errorf("%s: Expected %f, got %f", tc.name, source.FillRatio(), ratio)
+		}
+
+		var expected, actual bytes.Buffer
+		if _, err := source.WriteTo(&expected); err != nil {
+			t.Fatal(err)
+		}
+		n, err := tc.view.WriteTo(&actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(actual.Len()) {
+			t.Errorf("%s: Expected %d, got %d", tc.name, actual.Len(), n)
+		}
+
+		if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+			t.Errorf("%s: Expected the view to serialize the filter", tc.name)
+		}
+	}
+}
@@ -18,9 +18,14 @@ package boom
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash"
+	"hash/fnv"
 	"io"
 	"math"
+	"math/rand"
+	"reflect"
 )
 
 // ScalableBloomFilter implements a Scalable Bloom Filter as described by
@@ -39,25 +44,92 @@ import (
 // isn't known a priori and memory constraints aren't of particular concern.
 // For situations where memory is bounded, consider using Inverse or Stable
 // Bloom Filters.
+//
+// The zero value is ready to use, for example after embedding the filter in a
+// struct. It's initialized on first use with a 1% target false-positive rate
+// and the other parameters of NewDefaultScalableBloomFilter.
 type ScalableBloomFilter struct {
-	filters []*PartitionedBloomFilter // filters with geometrically decreasing error rates
-	r       float64                   // tightening ratio
-	fp      float64                   // target false-positive rate
-	p       float64                   // partition fill ratio
-	hint    uint                      // filter size hint
+	filters  []*PartitionedBloomFilter // filters with geometrically decreasing error rates
+	r        float64                   // tightening ratio
+	fp       float64                   // target false-positive rate
+	p        float64                   // partition fill ratio
+	hint     uint                      // filter size hint
+	growth   uint                      // filter size growth factor
+	retained map[string]struct{}       // added elements, if retention is enabled
+	newest   bool                      // test the newest filter first
+	exact    bool                      // track the exact distinct-insert count
+	distinct uint64                    // distinct-insert count, if exact counting is enabled
+	budget   uint                      // memory budget in bytes, 0 if unlimited
+	degraded bool                      // a filter wasn't added because of the budget
+	band     float64                   // fill ratio hysteresis band
+	holding  *PartitionedBloomFilter   // filter kept active within the band, if any
+	reserve  int                       // reservoir size, 0 if sampling is disabled
+	samples  [][]byte                  // reservoir sample of added elements
+	sampled  uint64                    // number of elements offered to the reservoir
+	rng      *rand.Rand                // random source for the reservoir
+	estimate fillEstimator             // fill ratio estimator, nil for the default
+	merged   bool                      // generations may hold overlapping elements
 }
 
+// fillEstimator estimates the fill ratio of a filter from its number of set
+// bits and total number of bits.
+type fillEstimator func(setBits, totalBits uint) float64
+
+const (
+	// defaultHint is the filter size hint used by
+	// NewDefaultScalableBloomFilter.
+	defaultHint = 10000
+
+	// defaultRatio is the tightening ratio of filters created without one,
+	// such as by NewDefaultScalableBloomFilter and
+	// NewScalableBloomFilterFromSet.
+	defaultRatio = 0.8
+
+	// maxGrowth is the largest growth factor. A few generations of a larger
+	// one would exceed any filter which can be allocated.
+	maxGrowth = 1 << 10
+
+	// maxGenerationHint is the largest size hint of a generation, which keeps
+	// its number of bits within a uint for any practical false-positive rate.
+	maxGenerationHint = ^uint(0) / 128
+
+	// defaultFPRate is the target false-positive rate a zero-value Scalable
+	// Bloom Filter is initialized with.
+	defaultFPRate = 0.01
+)
+
 // NewScalableBloomFilter creates a new Scalable Bloom Filter with the
 // specified target false-positive rate and tightening ratio. Use
 // NewDefaultScalableBloomFilter if you don't want to calculate these
 // parameters.
 func NewScalableBloomFilter(hint uint, fpRate, r float64) *ScalableBloomFilter {
+	return NewScalableBloomFilterWithGrowth(hint, fpRate, r, 1)
+}
+
+// NewScalableBloomFilterWithGrowth creates a new Scalable Bloom Filter with
+// the specified target false-positive rate and tightening ratio where each
+// successive filter is sized for growth times as many items as the previous
+// one, i.e. the filter at index i is sized for hint * growth^i items. Growth
+// factors of 2 or 4 reduce the number of filters required for large data
+// sets, which makes Test cheaper. A growth factor of 1 sizes every filter the
+// same. The growth factor is limited to between 1 and 1024, and once a
+// generation's size hint would overflow, later generations stay at the largest
+// size.
+func NewScalableBloomFilterWithGrowth(hint uint, fpRate, r float64, growth uint) *ScalableBloomFilter {
+	if growth < 1 {
+		growth = 1
+	}
+	if growth > maxGrowth {
+		growth = maxGrowth
+	}
+
 	s := &ScalableBloomFilter{
 		filters: make([]*PartitionedBloomFilter, 0, 1),
 		r:       r,
 		fp:      fpRate,
 		p:       fillRatio,
 		hint:    hint,
+		growth:  growth,
 	}
 
 	s.addFilter()
@@ -67,7 +139,135 @@ func NewScalableBloomFilter(hint uint, fpRate, r float64) *ScalableBloomFilter {
 // NewDefaultScalableBloomFilter creates a new Scalable Bloom Filter with the
 // specified target false-positive rate and an optimal tightening ratio.
 func NewDefaultScalableBloomFilter(fpRate float64) *ScalableBloomFilter {
-	return NewScalableBloomFilter(10000, fpRate, 0.8)
+	return NewScalableBloomFilter(defaultHint, fpRate, defaultRatio)
+}
+
+// OptimalTighteningRatio returns a tightening ratio suited to a Scalable Bloom
+// Filter whose filters grow in size by the given factor, following section
+// 5 of the Scalable Bloom Filters paper, which recommends r = 0.8 to 0.9 for
+// slow growth of s = 2 and r = 0.9 for faster growth of s = 4: the faster the
+// filters grow, the fewer are added, so each can tighten its false-positive
+// rate less. The ratio is 0.8 for growth factors up to 2, 0.9 for growth
+// factors of 4 or more, and in between is interpolated linearly in log2 s.
+func OptimalTighteningRatio(expectedGrowthFactor float64) float64 {
+	const (
+		slow = 0.8 // ratio for growth factors up to 2
+		fast = 0.9 // ratio for growth factors of 4 or more
+	)
+	switch {
+	case expectedGrowthFactor >= 4:
+		return fast
+	case !(expectedGrowthFactor > 2):
+		return slow
+	}
+	return slow + (fast-slow)*(math.Log2(expectedGrowthFactor)-1)
+}
+
+// lazyInit initializes a zero-value Scalable Bloom Filter, such as one
+// embedded in a struct, on first use. A zero value gets the parameters of
+// NewDefaultScalableBloomFilter with a false-positive rate of 1%, except for
+// those set beforehand, and its initial filter is added.
+func (s *ScalableBloomFilter) lazyInit() {
+	if len(s.filters) > 0 {
+		return
+	}
+
+	// A filter can't be created with a zero false-positive rate, so only a
+	// zero value has one.
+	if s.fp == 0 {
+		s.fp = defaultFPRate
+		if s.r == 0 {
+			s.r = defaultRatio
+		}
+		if s.p == 0 {
+			s.p = fillRatio
+		}
+		if s.hint == 0 {
+			s.hint = defaultHint
+		}
+		if s.growth == 0 {
+			s.growth = 1
+		}
+	}
+	s.addFilter()
+}
+
+// NewScalableBloomFilterFromSet creates a new Scalable Bloom Filter with the
+// specified target false-positive rate containing the given elements. The
+// distinct elements are counted first so that the initial filter is sized to
+// hold all of them, which avoids growing additional filters and produces a
+// smaller filter than adding the elements to one with a small hint. Further
+// elements can be added, in which case the filter grows as usual.
+func NewScalableBloomFilterFromSet(elements [][]byte, fpRate float64) *ScalableBloomFilter {
+	var (
+		seen     = make(map[string]struct{}, len(elements))
+		distinct = make([][]byte, 0, len(elements))
+	)
+	for _, data := range elements {
+		if _, ok := seen[string(data)]; !ok {
+			seen[string(data)] = struct{}{}
+			distinct = append(distinct, data)
+		}
+	}
+
+	// Duplicates are skipped since they would count towards the fill ratio.
+	return NewScalableBloomFilter(setHint(uint(len(distinct)), fpRate), fpRate, defaultRatio).AddBatch(distinct)
+}
+
+// NewScalableBloomFilterFromFilter creates a new Scalable Bloom Filter with
+// the specified target false-positive rate and tightening ratio whose initial
+// filter is the given one, such as a large filter which was loaded or bulk
+// built, so that it doesn't have to be rebuilt. The filter is used rather
+// than copied, and later filters share its hash function. The size hint is
+// derived from the filter's size, so later filters grow from it as if the
+// Scalable Bloom Filter had been created with NewScalableBloomFilter. It
+// returns an error if the rates aren't between 0 and 1 exclusive, or if the
+// filter's number of hash functions or size don't fit the false-positive rate
+// of the initial filter.
+func NewScalableBloomFilterFromFilter(first *PartitionedBloomFilter, fpRate, r float64) (*ScalableBloomFilter, error) {
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, errors.New("false-positive rate must be between 0 and 1")
+	}
+
+	if r <= 0 || r >= 1 {
+		return nil, errors.New("tightening ratio must be between 0 and 1")
+	}
+
+	if k := OptimalK(fpRate); first.k != k {
+		return nil, fmt.Errorf("filter has %d hash functions, expected %d for the false-positive rate", first.k, k)
+	}
+
+	hint := CountForBits(first.m, fpRate)
+	if hint == 0 {
+		return nil, errors.New("filter is too small for the false-positive rate")
+	}
+
+	return &ScalableBloomFilter{
+		filters: []*PartitionedBloomFilter{first},
+		r:       r,
+		fp:      fpRate,
+		p:       fillRatio,
+		hint:    hint,
+		growth:  1,
+	}, nil
+}
+
+// setHint returns the smallest size hint, up to rounding, for which the
+// initial filter holds n distinct items before reaching its fill ratio. This
+// is generally more than n since the number of partitions is rounded up.
+func setHint(n uint, fpRate float64) uint {
+	hint := n
+	if hint == 0 {
+		hint = 1
+	}
+
+	for {
+		c := planScalable(n, hint, 1, fpRate, 1).Capacities[0]
+		if c >= n {
+			return hint
+		}
+		hint += (hint*(n-c))/c + 1
+	}
 }
 
 // Capacity returns the current Scalable Bloom Filter capacity, which is the
@@ -80,14 +280,185 @@ func (s *ScalableBloomFilter) Capacity() uint {
 	return capacity
 }
 
-// K returns the number of hash functions used in each Bloom filter.
+// Count returns the number of items added to the Scalable Bloom Filter, which
+// is the sum of the counts for the contained series of Bloom filters. If exact
+// counting is enabled, it instead returns the number of distinct items added.
+func (s *ScalableBloomFilter) Count() uint {
+	if s.exact {
+		return uint(s.distinct)
+	}
+
+	count := uint(0)
+	for _, bf := range s.filters {
+		count += bf.Count()
+	}
+	return count
+}
+
+// CountConsideringOverlap returns the estimated number of distinct items in
+// the Scalable Bloom Filter. Count sums the counts of the contained filters,
+// which is right as long as each item is added to a single filter. Once
+// filters have been combined with Merge or UnionScalable, an item added to
+// several of them is counted once for each, so Count overestimates. For such
+// filters, this instead estimates the number of items in each generation from
+// its set bits, which only counts an item once per generation, and sums the
+// estimates. Use Count for filters which were never merged, where this
+// returns the same, and this for merged ones. Whether a filter was merged
+// isn't serialized, so a merged filter which is decoded counts like one that
+// never was.
+func (s *ScalableBloomFilter) CountConsideringOverlap() uint {
+	if !s.merged {
+		return s.Count()
+	}
+
+	count := uint(0)
+	for _, bf := range s.filters {
+		count += bf.distinctCount()
+	}
+	return count
+}
+
+// Load returns how full the Scalable Bloom Filter is as a single number: the
+// estimated number of items added, as returned by Count, divided by the number
+// of items the contained series of filters is designed to hold before each
+// reaches its fill ratio. Unlike FillRatio, which is the ratio of set bits,
+// this relates directly to the number of items. It drops when a new filter is
+// added, and it's greater than 1 once the filter is degraded.
+func (s *ScalableBloomFilter) Load() float64 {
+	s.lazyInit()
+	capacity := uint(0)
+	for _, bf := range s.filters {
+		capacity += filterCapacity(bf.s, s.p)
+	}
+	return float64(s.Count()) / float64(capacity)
+}
+
+// IsEmpty returns true if nothing has been added to the Scalable Bloom Filter
+// since it was created or reset, so that Test would return false for any data.
+// Every addition is counted by the filter it's added to, so this only checks
+// the counts rather than scanning the bits.
+func (s *ScalableBloomFilter) IsEmpty() bool {
+	for _, bf := range s.filters {
+		if bf.count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetBits returns the number of set bits across the contained series of Bloom
+// filters.
+func (s *ScalableBloomFilter) SetBits() uint {
+	bits := uint(0)
+	for _, bf := range s.filters {
+		bits += bf.SetBits()
+	}
+	return bits
+}
+
+// TotalBits returns the number of bits across the contained series of Bloom
+// filters.
+func (s *ScalableBloomFilter) TotalBits() uint {
+	bits := uint(0)
+	for _, bf := range s.filters {
+		bits += bf.TotalBits()
+	}
+	return bits
+}
+
+// RemainingCapacity returns the estimated number of items which can be added
+// before the newest filter reaches its fill ratio and a new filter is added,
+// based on the newest filter's count and partition size. Once the filter is
+// degraded, no more filters are added, so this returns 0.
+func (s *ScalableBloomFilter) RemainingCapacity() uint {
+	s.lazyInit()
+	if s.degraded {
+		return 0
+	}
+
+	return s.remaining(s.filters[len(s.filters)-1])
+}
+
+// FiltersNeededFor returns the number of filters which would be added to hold
+// a total of totalCount distinct items, given the items already added and the
+// remaining capacity of the active filter. Each new filter is sized the way
+// addFilter would add it, so this projects the growth of the series for a
+// known upcoming load. The memory budget isn't taken into account.
+func (s *ScalableBloomFilter) FiltersNeededFor(totalCount uint) int {
+	s.lazyInit()
+	held := uint(0)
+	for _, bf := range s.filters {
+		held += bf.count
+	}
+	held += s.remaining(s.filters[len(s.filters)-1])
+
+	needed := 0
+	for index := len(s.filters); held < totalCount; index++ {
+		_, size := s.generationSize(index)
+		needed++
+		if capacity := filterCapacity(size, s.p); capacity < totalCount-held {
+			held += capacity
+		} else {
+			held = totalCount
+		}
+	}
+	return needed
+}
+
+// remaining returns the number of items which can be added to the filter
+// before it reaches the fill ratio.
+func (s *ScalableBloomFilter) remaining(bf *PartitionedBloomFilter) uint {
+	capacity := filterCapacity(bf.s, s.p)
+	if bf.count >= capacity {
+		return 0
+	}
+	return capacity - bf.count
+}
+
+// K returns the number of hash functions used in the initial Bloom filter.
+// Each filter is created with the optimal number of hash functions for its own
+// false-positive rate, so later filters use more. Use GenerationK to get the
+// number for a specific filter.
 func (s *ScalableBloomFilter) K() uint {
-	// K is the same across every filter.
+	s.lazyInit()
 	return s.filters[0].K()
 }
 
+// GenerationK returns the number of hash functions used in the Bloom filter
+// at the given index, where 0 is the initial filter. It panics if the index is
+// out of range.
+func (s *ScalableBloomFilter) GenerationK(index int) uint {
+	s.lazyInit()
+	return s.filters[index].K()
+}
+
+// Filters returns the series of Bloom filters backing the Scalable Bloom
+// Filter, oldest first. The returned slice is a copy, but the filters are not,
+// so mutating them mutates the Scalable Bloom Filter. This is intended for
+// custom analytics, such as per-generation fill ratios.
+func (s *ScalableBloomFilter) Filters() []*PartitionedBloomFilter {
+	filters := make([]*PartitionedBloomFilter, len(s.filters))
+	copy(filters, s.filters)
+	return filters
+}
+
+// ForEach calls fn with the index and Bloom filter of each filter in the
+// series, oldest first, until fn returns false. Like Filters, it passes the
+// filters themselves rather than copies, so mutating one through the pointer
+// mutates the Scalable Bloom Filter, but without copying the slice. fn must
+// not add to the Scalable Bloom Filter, since that may change the series.
+func (s *ScalableBloomFilter) ForEach(fn func(index int, pbf *PartitionedBloomFilter) bool) {
+	s.lazyInit()
+	for i, bf := range s.filters {
+		if !fn(i, bf) {
+			return
+		}
+	}
+}
+
 // FillRatio returns the average ratio of set bits across every filter.
 func (s *ScalableBloomFilter) FillRatio() float64 {
+	s.lazyInit()
 	sum := 0.0
 	for _, filter := range s.filters {
 		sum += filter.FillRatio()
@@ -95,109 +466,1175 @@ func (s *ScalableBloomFilter) FillRatio() float64 {
 	return sum / float64(len(s.filters))
 }
 
+// ReadOnly returns a view of the Scalable Bloom Filter which can't be used to
+// modify it.
+func (s *ScalableBloomFilter) ReadOnly() ReadOnlyFilter {
+	return &ReadOnlyView{filter: s}
+}
+
+// ContentHash returns a 64-bit hash of the filter's contents, which only
+// depends on the contents of each filter in the series, as described by
+// PartitionedBloomFilter.ContentHash. Empty filters at the end of the series
+// are ignored since they don't hold any elements. Options, counts and the
+// parameters for filters yet to be added are ignored too, so the hash is
+// stable across serialization and can key a cache of results computed from
+// the filter.
+func (s *ScalableBloomFilter) ContentHash() uint64 {
+	n := len(s.filters)
+	for n > 0 && s.filters[n-1].count == 0 {
+		n--
+	}
+
+	var (
+		h = fnv.New64a()
+		e = newEncoder(h)
+	)
+	e.uvarint(uint64(n))
+	for _, bf := range s.filters[:n] {
+		bf.encodeContent(e)
+	}
+	return h.Sum64()
+}
+
+// EstimatedFalsePositiveRate returns the current false-positive rate implied
+// by the ratio of set bits in every filter. An element tests positive if any
+// filter reports it, so this is the compounded rate over the whole series.
+func (s *ScalableBloomFilter) EstimatedFalsePositiveRate() float64 {
+	negative := float64(1)
+	for _, filter := range s.filters {
+		negative *= 1 - filter.EstimatedFalsePositiveRate()
+	}
+	return 1 - negative
+}
+
 // Test will test for membership of the data and returns true if it is a
 // member, false if not. This is a probabilistic test, meaning there is a
 // non-zero probability of false positives but a zero probability of false
 // negatives.
 func (s *ScalableBloomFilter) Test(data []byte) bool {
-	// Querying is made by testing for the presence in each filter.
-	for _, bf := range s.filters {
-		if bf.Test(data) {
-			return true
-		}
+	return s.testHashes(s.baseHashes(data))
+}
+
+// TestBatchWithIndex tests each element for membership like Test, and returns
+// for each one the index of the first filter which contains it, or -1 if it
+// isn't a member. Since elements are added to the newest filter, the index
+// hints at when an element was added, which is useful for analytics about
+// data recency. Filters are probed oldest first, so an element added to
+// several filters is reported in the oldest one, unless TestNewestFirst is
+// enabled, in which case it's reported in the newest one. Probing stops at the
+// first match, as with Test.
+func (s *ScalableBloomFilter) TestBatchWithIndex(data [][]byte) []int {
+	indexes := make([]int, len(data))
+	for i, element := range data {
+		indexes[i] = s.matchHashes(s.baseHashes(element))
 	}
+	return indexes
+}
+
+// MayContain is equivalent to Test, named for its guarantee: true means the
+// data may have been added to any of the filters, or it's a false positive.
+func (s *ScalableBloomFilter) MayContain(data []byte) bool {
+	return s.Test(data)
+}
 
-	return false
+// DefinitelyNotContains is the negation of Test. None of the filters in the
+// series has false negatives, so true means the data was never added.
+func (s *ScalableBloomFilter) DefinitelyNotContains(data []byte) bool {
+	return !s.Test(data)
+}
+
+// TestInto is like Test but hashes the data with the scratch's hash function
+// and buffer, so it doesn't allocate. See HashScratch for the rules of reuse.
+func (s *ScalableBloomFilter) TestInto(data []byte, scratch *HashScratch) bool {
+	s.lazyInit()
+	return s.testHashes(s.filters[0].baseHashesInto(data, scratch))
 }
 
 // Add will add the data to the Bloom filter. It returns the filter to allow
 // for chaining.
 func (s *ScalableBloomFilter) Add(data []byte) Filter {
-	idx := len(s.filters) - 1
-
-	// If the last filter has reached its fill ratio, add a new one.
-	if s.filters[idx].EstimatedFillRatio() >= s.p {
-		s.addFilter()
-		idx++
+	if s.exact {
+		s.TestAndAdd(data)
+		return s
 	}
 
-	s.filters[idx].Add(data)
+	lower, upper := s.baseHashes(data)
+	s.activeFilter().addHashes(lower, upper)
+	s.retain(data)
 	return s
 }
 
+// ErrDegraded is returned by ScalableBloomFilter.AddE when the filter is
+// degraded because a filter wasn't added to stay within the memory budget.
+var ErrDegraded = errors.New("filter is degraded: memory budget exceeded")
+
+// AddE is like Add but returns an error if the filter can't be relied on,
+// for callers which want to detect a loss of accuracy rather than chaining:
+//
+//   - ErrDegraded if the filter is degraded, as reported by Degraded, either
+//     before or because of this addition. The data is still added to the last
+//     filter, but the false-positive rate is no longer bounded by the target.
+//   - An error describing the problem if the target false-positive rate,
+//     tightening ratio, fill ratio, size hint or growth factor is out of range,
+//     in which case the data isn't added.
+func (s *ScalableBloomFilter) AddE(data []byte) error {
+	s.lazyInit()
+	switch {
+	case !(s.fp > 0 && s.fp < 1):
+		return fmt.Errorf("false-positive rate %v is not between 0 and 1", s.fp)
+	case !(s.r > 0 && s.r < 1):
+		return fmt.Errorf("tightening ratio %v is not between 0 and 1", s.r)
+	case !(s.p > 0 && s.p <= 1):
+		return fmt.Errorf("fill ratio %v is not between 0 and 1", s.p)
+	case s.hint == 0:
+		return errors.New("size hint must be positive")
+	case s.growth == 0:
+		return errors.New("growth factor must be positive")
+	}
+
+	s.Add(data)
+	if s.degraded {
+		return ErrDegraded
+	}
+	return nil
+}
+
 // TestAndAdd is equivalent to calling Test followed by Add. It returns true if
-// the data is a member, false if not.
+// the data is a member, false if not. The data is only hashed once.
 func (s *ScalableBloomFilter) TestAndAdd(data []byte) bool {
-	member := s.Test(data)
-	s.Add(data)
+	lower, upper := s.baseHashes(data)
+	member := s.testHashes(lower, upper)
+	s.activeFilter().addHashes(lower, upper)
+	s.retain(data)
+	if s.exact && !member {
+		s.distinct++
+	}
 	return member
 }
 
+// AddReportGrowth is equivalent to TestAndAdd but also returns true as grew if
+// adding the data added a new filter to the series, which happens on the
+// first insert after the active filter reached the fill ratio. This is useful
+// for counting growth in metrics.
+func (s *ScalableBloomFilter) AddReportGrowth(data []byte) (member bool, grew bool) {
+	s.lazyInit()
+	n := len(s.filters)
+	member = s.TestAndAdd(data)
+	return member, len(s.filters) != n
+}
+
+// AddWithHashes adds the element with the given base hashes to the filter,
+// skipping hashing. For the result to be consistent with Test and Add, the
+// hashes must be the base hashes the filter would produce for the data, as
+// described by PartitionedBloomFilter.TestWithHashes. Since the data isn't
+// available, it isn't retained for TryShrink.
+func (s *ScalableBloomFilter) AddWithHashes(h1, h2 uint64) {
+	if s.exact && !s.testHashes(h1, h2) {
+		s.distinct++
+	}
+	s.activeFilter().addHashes(h1, h2)
+}
+
+// Prehash hashes the data for AddPrehashed and TestPrehashed, so hashing can
+// be done in a separate stage from adding and testing, or done once for
+// several filters which hash the same way as this one.
+func (s *ScalableBloomFilter) Prehash(data []byte) Prehashed {
+	return newPrehashed(s.baseHashes(data))
+}
+
+// AddPrehashed adds the element hashed by Prehash to the filter, with the same
+// result as Add except that, as with AddWithHashes, the element isn't retained
+// since its data isn't available. It panics if the Prehashed wasn't created by
+// Prehash.
+func (s *ScalableBloomFilter) AddPrehashed(h Prehashed) {
+	s.AddWithHashes(h.hashes())
+}
+
+// TestPrehashed tests for membership of the element hashed by Prehash, with
+// the same result as Test. It panics if the Prehashed wasn't created by
+// Prehash.
+func (s *ScalableBloomFilter) TestPrehashed(h Prehashed) bool {
+	lower, upper := h.hashes()
+	s.lazyInit()
+	return s.testHashes(lower, upper)
+}
+
+// baseHashes returns the base hash values of the data. Every filter shares the
+// same hash function, so the data only needs to be hashed once no matter how
+// many filters there are.
+func (s *ScalableBloomFilter) baseHashes(data []byte) (uint64, uint64) {
+	s.lazyInit()
+	return s.filters[0].baseHashes(data)
+}
+
+// MeasureFalsePositiveRate estimates the false-positive rate empirically by
+// testing the given number of random keys, which are practically certain to be
+// absent, and returning the fraction reported as members. Nothing is added to
+// the filter. The keys are generated from the given seed, so the result is
+// reproducible for a given filter state.
+func (s *ScalableBloomFilter) MeasureFalsePositiveRate(trials int, seed int64) float64 {
+	if trials <= 0 {
+		return 0
+	}
+
+	var (
+		rng       = rand.New(rand.NewSource(seed))
+		key       = make([]byte, 16)
+		positives = 0
+	)
+	for i := 0; i < trials; i++ {
+		binary.LittleEndian.PutUint64(key, rng.Uint64())
+		binary.LittleEndian.PutUint64(key[8:], rng.Uint64())
+		if s.Test(key) {
+			positives++
+		}
+	}
+	return float64(positives) / float64(trials)
+}
+
+// HashUniformity returns a chi-square uniformity score of the bit positions of
+// the given number of distinct synthetic keys, as described by
+// PartitionedBloomFilter.HashUniformity, for the initial filter. Every filter
+// shares the same hash function, so this diagnoses the hash for all of them.
+func (s *ScalableBloomFilter) HashUniformity(samples int) float64 {
+	s.lazyInit()
+	return s.filters[0].HashUniformity(samples)
+}
+
+// testHashes tests for membership of the element with the given base hashes
+// in any of the filters.
+func (s *ScalableBloomFilter) testHashes(lower, upper uint64) bool {
+	return s.matchHashes(lower, upper) >= 0
+}
+
+// matchHashes returns the index of the first filter, in probe order, which
+// contains the element with the given base hashes, or -1 if none does.
+func (s *ScalableBloomFilter) matchHashes(lower, upper uint64) int {
+	// Querying is made by testing for the presence in each filter.
+	if s.newest {
+		for i := len(s.filters) - 1; i >= 0; i-- {
+			if s.filters[i].testHashes(lower, upper) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for i, bf := range s.filters {
+		if bf.testHashes(lower, upper) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// TestNewestFirst sets the order in which Test probes the filters. When
+// enabled, the most recently added filter is probed first, which reduces the
+// average number of probes for workloads that mostly test recently added
+// elements. Otherwise filters are probed oldest first, which suits workloads
+// that mostly test long-lived elements. The order doesn't affect the result,
+// only how quickly a member is found. It returns the filter to allow for
+// chaining.
+func (s *ScalableBloomFilter) TestNewestFirst(enabled bool) *ScalableBloomFilter {
+	s.newest = enabled
+	return s
+}
+
+// activeFilter returns the filter new elements are added to. If the last
+// filter has reached its fill ratio, a new one is added first, unless it would
+// exceed the memory budget, in which case the filter is degraded and the last
+// filter keeps being used. With a hysteresis band, the filter that reached the
+// fill ratio stays active until its fill is at least the fill ratio plus the
+// band, and only then is the new filter used.
+func (s *ScalableBloomFilter) activeFilter() *PartitionedBloomFilter {
+	s.lazyInit()
+	n := len(s.filters)
+	if s.holding != nil {
+		if n > 1 && s.filters[n-2] == s.holding && s.fillRatio(s.holding) < s.holdFill() {
+			return s.holding
+		}
+		s.holding = nil
+	}
+
+	last := s.filters[n-1]
+	fill := s.fillRatio(last)
+	if !s.degraded && fill >= s.p {
+		if s.budget > 0 && s.memory()+s.nextFilterBytes() > s.budget {
+			s.degraded = true
+		} else {
+			s.addFilter()
+			if fill < s.holdFill() {
+				s.holding = last
+				return last
+			}
+		}
+	}
+	return s.filters[len(s.filters)-1]
+}
+
+// holdFill returns the fill ratio a filter is kept active until once a new
+// filter has been added after it.
+func (s *ScalableBloomFilter) holdFill() float64 {
+	return s.p + math.Min(s.band, s.p/2)
+}
+
+// fillRatio returns the fill ratio used to decide whether to grow past the
+// filter, as estimated by the injected estimator if there is one.
+func (s *ScalableBloomFilter) fillRatio(bf *PartitionedBloomFilter) float64 {
+	if s.estimate == nil {
+		return bf.EstimatedFillRatio()
+	}
+	return s.estimate(bf.SetBits(), bf.TotalBits())
+}
+
+// memory returns the number of bytes of bit data held by the filters.
+func (s *ScalableBloomFilter) memory() uint {
+	bytes := uint(0)
+	for _, bf := range s.filters {
+		bytes += bf.k * ((bf.s + 7) / 8)
+	}
+	return bytes
+}
+
+// nextFilterBytes returns the number of bytes of bit data the next filter
+// added by addFilter would hold.
+func (s *ScalableBloomFilter) nextFilterBytes() uint {
+	k, size := s.generationSize(len(s.filters))
+	return k * ((size + 7) / 8)
+}
+
+// generationSize returns the number of partitions and the partition size of
+// the filter addFilter would add at the given index.
+func (s *ScalableBloomFilter) generationSize(index int) (k, size uint) {
+	var (
+		fpRate = s.fp * math.Pow(s.r, float64(index))
+		m      = OptimalM(generationHint(s.hint, s.growth, index), fpRate)
+	)
+	k = OptimalK(fpRate)
+	return k, partitionSize(m, k)
+}
+
+// retain records the data if element retention is enabled and offers it to
+// the reservoir if sampling is enabled.
+func (s *ScalableBloomFilter) retain(data []byte) {
+	if s.retained != nil {
+		s.retained[string(data)] = struct{}{}
+	}
+	if s.reserve > 0 {
+		s.sample(data)
+	}
+}
+
+// sample adds the data to the reservoir with Algorithm R: the first reserve
+// elements fill it, and the nth element after that replaces a random sample
+// with probability reserve/n, so every element added is equally likely to be
+// in it.
+func (s *ScalableBloomFilter) sample(data []byte) {
+	s.sampled++
+	if len(s.samples) < s.reserve {
+		s.samples = append(s.samples, append([]byte{}, data...))
+		return
+	}
+	if j := s.rng.Int63n(int64(s.sampled)); j < int64(s.reserve) {
+		s.samples[j] = append(s.samples[j][:0], data...)
+	}
+}
+
+// AddBatch adds every element to the filter. Rather than checking the fill
+// ratio after every element, it computes how many elements the active filter
+// can take before reaching the fill ratio and adds that many before checking
+// again, so filters are added at exactly the same points as with Add. With
+// exact counting or a fill estimator set, every element is checked as with
+// Add. It returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) AddBatch(elements [][]byte) *ScalableBloomFilter {
+	if s.exact || s.estimate != nil || s.band > 0 {
+		// Exact counting tests every element anyway, and an injected fill
+		// estimator can't be predicted from the count, so it's consulted
+		// for every element. A filter kept active within the hysteresis
+		// band has no remaining capacity to batch up to either.
+		for _, data := range elements {
+			s.Add(data)
+		}
+		return s
+	}
+
+	for len(elements) > 0 {
+		var (
+			bf   = s.activeFilter()
+			step = len(elements)
+		)
+		// If the filter is full, it's degraded or the budget is exhausted,
+		// so it keeps being used.
+		if r := s.remaining(bf); r > 0 && r < uint(step) {
+			step = int(r)
+		}
+
+		for _, data := range elements[:step] {
+			bf.addHashes(s.baseHashes(data))
+			s.retain(data)
+		}
+		elements = elements[step:]
+	}
+	return s
+}
+
 // Reset restores the Bloom filter to its original state. It returns the filter
 // to allow for chaining.
 func (s *ScalableBloomFilter) Reset() *ScalableBloomFilter {
-	s.filters = make([]*PartitionedBloomFilter, 0, 1)
+	s.filters = make([]*PartitionedBloomFilter, 0, cap(s.filters))
+	s.lazyInit()
+	s.clearState()
+	return s
+}
+
+// clearState clears the state which isn't part of the filters themselves,
+// such as retained elements and the exact count, while keeping the options
+// which enable it.
+func (s *ScalableBloomFilter) clearState() {
+	if s.retained != nil {
+		s.retained = make(map[string]struct{})
+	}
+	s.distinct = 0
+	s.degraded = false
+	s.holding = nil
+	s.merged = false
+	s.clearSamples()
+}
+
+// Reconfigure resets the Scalable Bloom Filter, dropping its data, and
+// rebuilds it with the given target false-positive rate and tightening ratio.
+// The size hint, growth factor, hash function and options are kept, and the
+// filter slice is reused. Both parameters must be between 0 and 1 exclusive.
+// It returns the filter to allow for chaining, or an error if they aren't, in
+// which case the filter is unchanged.
+func (s *ScalableBloomFilter) Reconfigure(fpRate, r float64) (*ScalableBloomFilter, error) {
+	if fpRate <= 0 || fpRate >= 1 {
+		return s, errors.New("false-positive rate must be between 0 and 1")
+	}
+
+	if r <= 0 || r >= 1 {
+		return s, errors.New("tightening ratio must be between 0 and 1")
+	}
+
+	s.lazyInit()
+	var (
+		h  = s.filters[0].hash
+		fn = s.filters[0].hashFunc
+	)
+	for i := range s.filters {
+		s.filters[i] = nil
+	}
+
+	s.filters = s.filters[:0]
+	s.fp = fpRate
+	s.r = r
 	s.addFilter()
+	s.filters[0].SetHash(h)
+	s.filters[0].SetHashFunc(fn)
+	s.clearState()
+	return s, nil
+}
+
+// Fork returns a copy of the Scalable Bloom Filter which initially shares the
+// bit arrays of the contained filters with the original, which makes it much
+// cheaper than a full copy for speculative processing: the fork can be
+// modified and then kept or discarded. The first write to a contained filter
+// by either the fork or the original copies that filter's bit array, so a
+// fork which only adds a few elements only copies the active filter. Retained
+// elements are copied up front.
+//
+// Since the bit arrays are copied before they're written, the fork and the
+// original behave like independent filters, but they share the hash function,
+// which is stateful. To use them from different goroutines, call SetHash on
+// the fork with a new hash function first. Neither is safe for concurrent use
+// on its own.
+func (s *ScalableBloomFilter) Fork() *ScalableBloomFilter {
+	fork := *s
+	fork.filters = make([]*PartitionedBloomFilter, len(s.filters), cap(s.filters))
+	for i, bf := range s.filters {
+		fork.filters[i] = bf.fork()
+	}
+	if s.retained != nil {
+		fork.retained = make(map[string]struct{}, len(s.retained))
+		for element := range s.retained {
+			fork.retained[element] = struct{}{}
+		}
+	}
+	if s.reserve > 0 {
+		fork.samples = s.Samples()
+		fork.rng = rand.New(rand.NewSource(s.rng.Int63()))
+	}
+	return &fork
+}
+
+// WithElementRetention enables retaining a copy of every element added from
+// this point on, in addition to setting its bits. Retention is opt-in because
+// it costs memory proportional to the total size of the distinct elements
+// added, which defeats the purpose of a Bloom filter for most workloads. It
+// enables operations which need the elements themselves, such as MergeRehash.
+// Retained elements are not included in the binary representation. It returns
+// the filter to allow for chaining.
+func (s *ScalableBloomFilter) WithElementRetention() *ScalableBloomFilter {
+	if s.retained == nil {
+		s.retained = make(map[string]struct{})
+	}
+	return s
+}
+
+// TryShrink rebuilds the Scalable Bloom Filter from its retained elements if
+// they fit in fewer filters than are currently allocated, which reclaims
+// memory after a burst of traffic has subsided. This is only possible with
+// element retention enabled, and elements added before retention was enabled
+// are not carried over. It returns the number of filters dropped, which is
+// zero if the filter could not be shrunk, or an error if element retention is
+// not enabled.
+func (s *ScalableBloomFilter) TryShrink() (int, error) {
+	if s.retained == nil {
+		return 0, errors.New("element retention must be enabled")
+	}
+
+	s.lazyInit()
+	before := len(s.filters)
+	fill := math.Max(s.p-s.band, s.p/2)
+	needed := planScalableFill(uint(len(s.retained)), s.hint, s.growth, s.fp, s.r, fill).Filters
+	if needed >= before {
+		return 0, nil
+	}
+
+	var (
+		retained = s.retained
+		h        = s.filters[0].hash
+		fn       = s.filters[0].hashFunc
+	)
+	s.Reset()
+	s.filters[0].SetHash(h)
+	s.filters[0].SetHashFunc(fn)
+	for element := range retained {
+		s.Add([]byte(element))
+	}
+	return before - len(s.filters), nil
+}
+
+// RebuildWithFPRate returns a new Scalable Bloom Filter with the given target
+// false-positive rate containing the retained elements, since the rate of an
+// existing filter can't be tightened without its elements. The new filter's
+// initial filter is sized to hold every retained element, so the rebuild
+// doesn't grow a series of filters, and it keeps this filter's tightening
+// ratio, growth factor, hash function and options, including retention. This
+// requires element retention, and elements added before retention was enabled
+// are not carried over. It returns an error if element retention is not
+// enabled or the rate isn't between 0 and 1 exclusive.
+func (s *ScalableBloomFilter) RebuildWithFPRate(newFP float64) (*ScalableBloomFilter, error) {
+	if s.retained == nil {
+		return nil, errors.New("element retention must be enabled to rebuild the filter")
+	}
+
+	if newFP <= 0 || newFP >= 1 {
+		return nil, errors.New("false-positive rate must be between 0 and 1")
+	}
+
+	s.lazyInit()
+	hint := setHint(uint(len(s.retained)), newFP)
+	if hint < s.hint {
+		hint = s.hint
+	}
+
+	rebuilt := NewScalableBloomFilterWithGrowth(hint, newFP, s.r, s.growth)
+	rebuilt.p = s.p
+	rebuilt.filters[0].SetHash(s.filters[0].hash)
+	rebuilt.filters[0].SetHashFunc(s.filters[0].hashFunc)
+	rebuilt.newest = s.newest
+	rebuilt.exact = s.exact
+	rebuilt.budget = s.budget
+	rebuilt.band = s.band
+	rebuilt.estimate = s.estimate
+	rebuilt.WithElementRetention()
+	if s.reserve > 0 {
+		rebuilt.WithSampleSize(s.reserve)
+	}
+
+	for element := range s.retained {
+		rebuilt.Add([]byte(element))
+	}
+	return rebuilt, nil
+}
+
+// TrimEmpty removes the empty filters at the end of the series, which nothing
+// has been added to, for example after a bulk load which failed after growing
+// the filter. At least one filter is kept, and filters before the last
+// non-empty one are kept even if they're empty. Filters added afterwards
+// continue the series from the new end. It returns the number of filters
+// removed.
+func (s *ScalableBloomFilter) TrimEmpty() int {
+	n := len(s.filters)
+	for n > 1 && s.filters[n-1].count == 0 {
+		s.filters[n-1] = nil
+		n--
+	}
+
+	removed := len(s.filters) - n
+	s.filters = s.filters[:n]
+	return removed
+}
+
+// SetSizeHint sets the size hint used for filters added from now on, for
+// example to make later generations larger once items turn out to arrive
+// faster than expected. Existing filters are unchanged. The filter at index i
+// is sized for hint * growth^i items, and the hint is included in the binary
+// representation. Since merging requires matching filter sizes, filters whose
+// hints changed at different points can't be merged. A hint of 0 is ignored,
+// since no filter can be sized for it. It returns the filter to allow for
+// chaining.
+func (s *ScalableBloomFilter) SetSizeHint(hint uint) *ScalableBloomFilter {
+	if hint > 0 {
+		s.hint = hint
+	}
+	return s
+}
+
+// SetGrowthHysteresis sets a band around the fill ratio which keeps a filter
+// whose fill hovers at the threshold from adding a burst of new filters. A new
+// filter is still added as soon as the active one reaches the fill ratio, but
+// elements keep going to the old filter until its fill is clearly above the
+// threshold, at the fill ratio plus the band, so a fill estimate that dips
+// back under and over the threshold doesn't add another filter each time. The
+// old filter's false-positive rate ends up slightly above its bound in return.
+// Likewise, TryShrink only drops filters if the retained elements fit in fewer
+// filters filled to the fill ratio minus the band, so elements re-added
+// between periodic calls to TryShrink don't shrink and regrow the filter over
+// and over. A negative band is treated as 0, and the band is at most half the
+// fill ratio. It returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) SetGrowthHysteresis(band float64) *ScalableBloomFilter {
+	s.band = math.Max(0, band)
+	return s
+}
+
+// SetFillEstimator overrides how the fill ratio of the active filter is
+// estimated when deciding whether to add a new filter. The estimator is given
+// the number of set bits and the total number of bits of the active filter and
+// returns its fill ratio, which allows experimenting with alternative
+// estimators. By default, the fill ratio is estimated from the number of
+// elements added to the active filter, as with EstimatedFillRatio. The set bits
+// are counted on every addition while an estimator is set. Passing nil
+// restores the default. It returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) SetFillEstimator(fn func(setBits, totalBits uint) float64) *ScalableBloomFilter {
+	s.estimate = fn
+	return s
+}
+
+// WithExpectedGenerations preallocates room for n filters in the series, so
+// that a filter which is known to grow to many generations doesn't reallocate
+// its slice of filters as it grows. The capacity is kept by Reset. It's only a
+// hint: the filter still grows past n filters if needed. It returns the filter
+// to allow for chaining.
+func (s *ScalableBloomFilter) WithExpectedGenerations(n int) *ScalableBloomFilter {
+	if n > cap(s.filters) {
+		filters := make([]*PartitionedBloomFilter, len(s.filters), n)
+		copy(filters, s.filters)
+		s.filters = filters
+	}
 	return s
 }
 
+// WithSampleSize enables keeping a reservoir sample of up to k of the elements
+// added from this point on, which can be inspected with Samples, for example
+// to see what kind of keys were inserted when debugging false positives. The
+// sample is uniform over the elements added with Add, TestAndAdd and AddBatch,
+// and costs memory for k elements. It doesn't affect membership tests and
+// isn't included in the binary representation. A k of 0 or less disables
+// sampling. Changing k discards the current sample. It returns the filter to
+// allow for chaining.
+func (s *ScalableBloomFilter) WithSampleSize(k int) *ScalableBloomFilter {
+	if k < 0 {
+		k = 0
+	}
+	s.reserve = k
+	if s.rng == nil && k > 0 {
+		s.rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+	s.clearSamples()
+	return s
+}
+
+// Samples returns copies of the elements in the reservoir sample, or nil if
+// sampling isn't enabled.
+func (s *ScalableBloomFilter) Samples() [][]byte {
+	if s.samples == nil {
+		return nil
+	}
+	samples := make([][]byte, len(s.samples))
+	for i, data := range s.samples {
+		samples[i] = append([]byte{}, data...)
+	}
+	return samples
+}
+
+// clearSamples empties the reservoir sample.
+func (s *ScalableBloomFilter) clearSamples() {
+	s.samples = nil
+	if s.reserve > 0 {
+		s.samples = make([][]byte, 0, s.reserve)
+	}
+	s.sampled = 0
+}
+
+// WithExactCount enables counting the distinct items added from this point on,
+// which Count then returns instead of the sum of the filters' counts. An item
+// is counted when the filter judges it not to be a member already, so false
+// positives cause a slight undercount. This costs a membership test on every
+// Add. The distinct count is not included in the binary representation. It
+// returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) WithExactCount() *ScalableBloomFilter {
+	s.exact = true
+	return s
+}
+
+// WithMemoryBudget limits the bit data held by the filters to the given number
+// of bytes, which protects memory-constrained processes from running out of
+// memory as the filter grows. Once adding a filter would exceed the budget,
+// new elements are added to the last filter instead, whose false-positive rate
+// then rises above the target, and Degraded returns true. A budget of 0 means
+// unlimited. The budget is not included in the binary representation. It
+// returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) WithMemoryBudget(bytes uint) *ScalableBloomFilter {
+	s.budget = bytes
+	return s
+}
+
+// Degraded returns true if a filter wasn't added because it would have
+// exceeded the memory budget, meaning the false-positive rate is no longer
+// bounded by the target. This is cleared by Reset.
+func (s *ScalableBloomFilter) Degraded() bool {
+	return s.degraded
+}
+
+// MergeRehash adds every element retained by the other filter to this filter.
+// Unlike a bitwise merge, this works regardless of differences in the filters'
+// parameters, but the other filter must have element retention enabled. It
+// returns the filter to allow for chaining, or an error if the other filter
+// doesn't retain elements.
+func (s *ScalableBloomFilter) MergeRehash(other *ScalableBloomFilter) (*ScalableBloomFilter, error) {
+	if other.retained == nil {
+		return s, errors.New("other filter must have element retention enabled")
+	}
+
+	for element := range other.retained {
+		s.Add([]byte(element))
+	}
+	return s, nil
+}
+
+// Merge adds every element of the other filter to this filter by ORing their
+// corresponding generations, which preserves the series of filters and the
+// false-positive rate bound of each generation rather than collapsing them
+// into one filter. If the other filter has more generations, copies of the
+// extra ones are appended. The filters must be compatible as described by
+// MergeCompatibility. Exact counts can't be merged, and if this filter retains
+// elements, the other one must too, so that its retained elements carry over.
+// Returns an error if the filters can't be merged, in which case this filter
+// is unchanged.
+func (s *ScalableBloomFilter) Merge(other *ScalableBloomFilter) error {
+	s.lazyInit()
+	if ok, reason := MergeCompatibility(s, other); !ok {
+		return errors.New(reason)
+	}
+
+	if s.exact || other.exact {
+		return errors.New("exact counts can't be merged")
+	}
+
+	if s.retained != nil && other.retained == nil {
+		return errors.New("other filter must have element retention enabled")
+	}
+
+	for i, bf := range other.filters {
+		if i >= len(s.filters) {
+			extra := bf.clone()
+			extra.SetHash(s.filters[0].hash)
+			extra.SetHashFunc(s.filters[0].hashFunc)
+			s.filters = append(s.filters, extra)
+			continue
+		}
+		s.filters[i].unshare()
+		s.filters[i].union(bf)
+	}
+
+	if s.retained != nil {
+		for element := range other.retained {
+			s.retained[element] = struct{}{}
+		}
+	}
+	s.degraded = s.degraded || other.degraded
+	s.merged = true
+	return nil
+}
+
+// CanMerge returns true if the Scalable Bloom Filters can be merged with
+// UnionScalable. See MergeCompatibility for the reason if they can't.
+func CanMerge(a, b *ScalableBloomFilter) bool {
+	ok, _ := MergeCompatibility(a, b)
+	return ok
+}
+
+// MergeCompatibility returns true if the Scalable Bloom Filters can be merged
+// with UnionScalable, or false and the reason why not: their tightening
+// ratios, false-positive rates, fill ratios, size hints, growth factors or
+// hash functions differ, or a generation present in both differs in its
+// layout or seed. Hash functions are compared by type, so two differently
+// configured instances of the same type are considered the same, and base hash
+// functions set with SetHashFunc or SetHash128 are compared by their code.
+// Zero-value filters are initialized first, as on their first use.
+func MergeCompatibility(a, b *ScalableBloomFilter) (ok bool, reason string) {
+	a.lazyInit()
+	b.lazyInit()
+	switch {
+	case a.r != b.r:
+		return false, "tightening ratio must match"
+	case a.fp != b.fp:
+		return false, "false-positive rate must match"
+	case a.p != b.p:
+		return false, "fill ratio must match"
+	case a.hint != b.hint:
+		return false, "size hint must match"
+	case a.growth != b.growth:
+		return false, "growth factor must match"
+	case !sameHash(a.filters[0], b.filters[0]):
+		return false, "hash function must match"
+	}
+
+	for i := 0; i < len(a.filters) && i < len(b.filters); i++ {
+		if err := a.filters[i].checkCompatible(b.filters[i]); err != nil {
+			return false, fmt.Sprintf("filter %d: %v", i, err)
+		}
+	}
+	return true, ""
+}
+
+// sameHash returns true if the Bloom filters use the same type of hash
+// function and the same base hash function, if any.
+func sameHash(a, b *PartitionedBloomFilter) bool {
+	if reflect.TypeOf(a.hash) != reflect.TypeOf(b.hash) {
+		return false
+	}
+	if a.hashFunc == nil || b.hashFunc == nil {
+		return a.hashFunc == nil && b.hashFunc == nil
+	}
+	return reflect.ValueOf(a.hashFunc).Pointer() == reflect.ValueOf(b.hashFunc).Pointer()
+}
+
+// UnionScalable returns a new Scalable Bloom Filter containing every element
+// of the given filters, which must have been created with the same
+// parameters and hash function. Each generation of the result is computed in a
+// single pass over the inputs rather than through repeated pairwise merges.
+// Since each generation of the result holds that generation's elements from
+// every input, the false-positive rate of the result grows with the number of
+// inputs. Neither retained elements nor exact counts carry over to the
+// result. Returns an error if no filters are given or their parameters differ.
+func UnionScalable(filters ...*ScalableBloomFilter) (*ScalableBloomFilter, error) {
+	if len(filters) == 0 {
+		return nil, errors.New("at least one filter is required")
+	}
+
+	first := filters[0]
+	generations := 0
+	for _, f := range filters {
+		if ok, reason := MergeCompatibility(first, f); !ok {
+			return nil, errors.New(reason)
+		}
+		if len(f.filters) > generations {
+			generations = len(f.filters)
+		}
+	}
+
+	union := NewScalableBloomFilterWithGrowth(first.hint, first.fp, first.r, first.growth)
+	union.p = first.p
+	union.filters[0].SetHash(first.filters[0].hash)
+	union.filters[0].SetHashFunc(first.filters[0].hashFunc)
+	for len(union.filters) < generations {
+		union.addFilter()
+	}
+
+	for i, bf := range union.filters {
+		// Filters decoded from the upstream format are unseeded, and filters
+		// decoded from older formats use the modulo index mapping and
+		// partitions which aren't aligned, so take the layout, seed and
+		// mapping from the inputs rather than assuming them.
+		for _, f := range filters {
+			if i < len(f.filters) {
+				src := f.filters[i]
+				bf = newPartitionedBloomFilter(src.m, src.k, src.s)
+				bf.seed = src.seed
+				bf.mapping = src.mapping
+				bf.SetHash(first.filters[0].hash)
+				bf.SetHashFunc(first.filters[0].hashFunc)
+				union.filters[i] = bf
+				break
+			}
+		}
+		for _, f := range filters {
+			if i >= len(f.filters) {
+				continue
+			}
+			if err := bf.checkCompatible(f.filters[i]); err != nil {
+				return nil, err
+			}
+			bf.union(f.filters[i])
+		}
+	}
+
+	union.merged = len(filters) > 1
+	return union, nil
+}
+
 // addFilter adds a new Bloom filter with a restricted false-positive rate to
-// the Scalable Bloom Filter
+// the Scalable Bloom Filter. Each filter is seeded by its index so that an
+// element maps to uncorrelated positions across generations.
 func (s *ScalableBloomFilter) addFilter() {
 	fpRate := s.fp * math.Pow(s.r, float64(len(s.filters)))
-	p := NewPartitionedBloomFilter(s.hint, fpRate)
+	p := NewPartitionedBloomFilter(generationHint(s.hint, s.growth, len(s.filters)), fpRate)
+	p.seed = generationSeed(len(s.filters))
 	if len(s.filters) > 0 {
 		p.SetHash(s.filters[0].hash)
+		p.SetHashFunc(s.filters[0].hashFunc)
 	}
 	s.filters = append(s.filters, p)
 }
 
+// generationHint returns the size hint for the filter at the given index,
+// which is at most maxGenerationHint.
+func generationHint(hint, growth uint, index int) uint {
+	if hint > maxGenerationHint {
+		return maxGenerationHint
+	}
+	for i := 0; i < index && growth > 1; i++ {
+		if hint > maxGenerationHint/growth {
+			return maxGenerationHint
+		}
+		hint *= growth
+	}
+	return hint
+}
+
+// generationSeed returns the hash seed for the filter at the given index. The
+// initial filter is unseeded so it hashes exactly like a standalone
+// PartitionedBloomFilter.
+func generationSeed(index int) uint64 {
+	return uint64(index) * 0x9e3779b97f4a7c15
+}
+
+// ScalablePlan describes the Bloom filters a Scalable Bloom Filter allocates to
+// hold a given number of items.
+type ScalablePlan struct {
+	Filters    int    // number of Bloom filters
+	Capacities []uint // number of items each filter holds before the next is added
+	Bits       uint   // total number of bits allocated
+	Bytes      uint   // total number of bytes allocated for filter data
+}
+
+// PlanScalable returns the Bloom filters a Scalable Bloom Filter created by
+// NewDefaultScalableBloomFilter with the given tightening ratio would allocate
+// to hold expectedCount distinct items, without building anything. The
+// capacities of the filters sum to at least expectedCount.
+func PlanScalable(expectedCount uint, fpRate, r float64) ScalablePlan {
+	return planScalable(expectedCount, defaultHint, 1, fpRate, r)
+}
+
+// planScalable returns the Bloom filters a Scalable Bloom Filter with the
+// given parameters would allocate to hold expectedCount distinct items.
+func planScalable(expectedCount, hint, growth uint, fpRate, r float64) ScalablePlan {
+	return planScalableFill(expectedCount, hint, growth, fpRate, r, fillRatio)
+}
+
+// planScalableFill is like planScalable but for filters which are filled to
+// the given fill ratio.
+func planScalableFill(expectedCount, hint, growth uint, fpRate, r, p float64) ScalablePlan {
+	var (
+		plan  ScalablePlan
+		total uint
+	)
+
+	for i := 0; i == 0 || total < expectedCount; i++ {
+		var (
+			fp = fpRate * math.Pow(r, float64(i))
+			m  = OptimalM(generationHint(hint, growth, i), fp)
+			k  = OptimalK(fp)
+			s  = partitionSize(m, k)
+			c  = filterCapacity(s, p)
+		)
+		plan.Filters++
+		plan.Capacities = append(plan.Capacities, c)
+		plan.Bits += k * s
+		plan.Bytes += k * ((s + 7) / 8)
+		if c < ^uint(0)-total {
+			total += c
+		} else {
+			total = ^uint(0)
+		}
+	}
+
+	return plan
+}
+
+// filterCapacity returns the number of items which can be added to a
+// partitioned Bloom filter with partition size s before its estimated fill
+// ratio reaches p, at which point a Scalable Bloom Filter adds a new filter.
+func filterCapacity(s uint, p float64) uint {
+	fill := func(n uint) float64 {
+		return 1 - math.Exp(-float64(n)/float64(s))
+	}
+
+	c := uint(math.Ceil(-float64(s) * math.Log(1-p)))
+	for c > 0 && fill(c-1) >= p {
+		c--
+	}
+	for fill(c) < p {
+		c++
+	}
+	return c
+}
+
 // SetHash sets the hashing function used in the filter.
 // For the effect on false positive rates see: https://github.com/tylertreat/BoomFilters/pull/1
-func (s *ScalableBloomFilter) SetHash(h hash.Hash64) {
+// It returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) SetHash(h hash.Hash64) *ScalableBloomFilter {
+	s.lazyInit()
 	for _, bf := range s.filters {
 		bf.SetHash(h)
 	}
+	return s
+}
+
+// SetHash128 sets a hash function of at least 128 bits whose sum is split into
+// the two 64-bit base hashes of every filter, as described by Hash128. It
+// returns the filter to allow for chaining.
+func (s *ScalableBloomFilter) SetHash128(h hash.Hash) *ScalableBloomFilter {
+	s.lazyInit()
+	fn := Hash128(h)
+	for _, bf := range s.filters {
+		bf.SetHashFunc(fn)
+	}
+	return s
 }
 
 // WriteTo writes a binary representation of the ScalableBloomFilter to an i/o stream.
 // It returns the number of bytes written.
 func (s *ScalableBloomFilter) WriteTo(stream io.Writer) (int64, error) {
-	err := binary.Write(stream, binary.BigEndian, s.r)
-	if err != nil {
-		return 0, err
+	e := newEncoder(stream)
+	e.header()
+	e.float64(s.r)
+	e.float64(s.fp)
+	e.float64(s.p)
+	e.uvarint(uint64(s.hint))
+	e.uvarint(uint64(s.growth))
+	e.uvarint(uint64(len(s.filters)))
+	for _, filter := range s.filters {
+		filter.encode(e)
 	}
-	err = binary.Write(stream, binary.BigEndian, s.fp)
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of ScalableBloomFilter (such as might
+// have been written by WriteTo()) from an i/o stream. It returns the number
+// of bytes read. Both the compact format and the fixed-width format written by
+// earlier versions of this package, which is also the upstream format, can be
+// read. The fixed-width format doesn't include a growth factor or hash seeds,
+// so filters decoded from it are unseeded and have a growth factor of 1. As
+// with Reset, retained elements, samples and the exact count are cleared,
+// since they aren't part of the binary representation, while the options
+// enabling them are kept.
+func (s *ScalableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	d, legacy, err := readHeader(stream)
 	if err != nil {
 		return 0, err
 	}
-	err = binary.Write(stream, binary.BigEndian, s.p)
-	if err != nil {
-		return 0, err
+	if d == nil {
+		return s.readFrom(legacy)
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(s.hint))
-	if err != nil {
-		return 0, err
+
+	var (
+		r      = d.float64()
+		fp     = d.float64()
+		p      = d.float64()
+		hint   = d.uvarint()
+		growth = d.uvarint()
+		n      = d.length(ptrSize)
+	)
+	if d.err == nil && n == 0 {
+		d.err = errors.New("must contain at least one filter")
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(len(s.filters)))
-	if err != nil {
-		return 0, err
+	if d.err == nil {
+		d.err = checkScalable(r, fp, p, hint, growth, n)
 	}
-	var numBytes int64
-	for _, filter := range s.filters {
-		num, err := filter.WriteTo(stream)
-		if err != nil {
-			return 0, err
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	filters := make([]*PartitionedBloomFilter, n)
+	for i := range filters {
+		filters[i] = &PartitionedBloomFilter{hash: fnv.New64()}
+		filters[i].decode(d)
+		if d.err != nil {
+			return 0, d.err
 		}
-		numBytes += num
 	}
-	return numBytes + int64(5*binary.Size(uint64(0))), err
+
+	s.r = r
+	s.fp = fp
+	s.p = p
+	s.hint = uint(hint)
+	s.growth = uint(growth)
+	s.filters = filters
+	s.clearState()
+	return d.n, nil
 }
 
-// ReadFrom reads a binary representation of ScalableBloomFilter (such as might
-// have been written by WriteTo()) from an i/o stream. It returns the number
-// of bytes read.
-func (s *ScalableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+// checkScalable returns an error if the parameters of a binary representation
+// of ScalableBloomFilter with n filters are out of range, since filters added
+// after decoding are sized from them. Like decoded data, the next filter added
+// is limited to MaxDecodeSize.
+func checkScalable(r, fp, p float64, hint, growth, n uint64) error {
+	var (
+		fpRate = fp * math.Pow(r, float64(n))
+		bits   = float64(hint) * math.Pow(float64(growth), float64(n)) *
+			math.Abs(math.Log(fpRate)) / (math.Log(fillRatio) * math.Log(1-fillRatio))
+	)
+	switch {
+	case !(fp > 0 && fp < 1):
+		return fmt.Errorf("false-positive rate %v is not between 0 and 1", fp)
+	case !(r > 0 && r < 1):
+		return fmt.Errorf("tightening ratio %v is not between 0 and 1", r)
+	case !(p > 0 && p <= 1):
+		return fmt.Errorf("fill ratio %v is not between 0 and 1", p)
+	case hint == 0 || hint > uint64(^uint(0)):
+		return fmt.Errorf("size hint %d is out of range", hint)
+	case growth == 0 || growth > uint64(^uint(0)):
+		return fmt.Errorf("growth factor %d is out of range", growth)
+	case !(fpRate > 0) || math.IsInf(1/fpRate, 1) || !(bits/8 <= float64(MaxDecodeSize)):
+		return errors.New("next filter exceeds MaxDecodeSize")
+	}
+	return nil
+}
+
+// ReadFromUpstream reads a binary representation of ScalableBloomFilter
+// written by the upstream github.com/tylertreat/BoomFilters package from an
+// i/o stream. The upstream format doesn't include a growth factor or hash
+// seeds, so the decoded filters are unseeded and a growth factor of 1 is used.
+// Filters added after decoding are seeded as usual. ReadFrom reads this format
+// too, so this is only needed to reject the compact format. It returns the
+// number of bytes read.
+func (s *ScalableBloomFilter) ReadFromUpstream(stream io.Reader) (int64, error) {
+	legacy, err := readUpstream(stream)
+	if err != nil {
+		return 0, err
+	}
+	return s.readFrom(legacy)
+}
+
+// readFrom reads the fixed-width binary representation of ScalableBloomFilter
+// written by earlier versions of this package and by upstream from an i/o
+// stream. It returns the number of bytes read.
+func (s *ScalableBloomFilter) readFrom(stream io.Reader) (int64, error) {
 	var r, fp, p float64
 	var hint, len uint64
 	err := binary.Read(stream, binary.BigEndian, &r)
@@ -220,11 +1657,20 @@ func (s *ScalableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if len == 0 {
+		return 0, errors.New("must contain at least one filter")
+	}
+	if err := checkScalable(r, fp, p, hint, 1, len); err != nil {
+		return 0, err
+	}
+	if err := checkDecodeSize(len, ptrSize); err != nil {
+		return 0, err
+	}
 	var numBytes int64
 	filters := make([]*PartitionedBloomFilter, len)
 	for i := range filters {
-		filter := NewPartitionedBloomFilter(0, fp)
-		num, err := filter.ReadFrom(stream)
+		filter := &PartitionedBloomFilter{hash: fnv.New64()}
+		num, err := filter.readFrom(stream)
 		if err != nil {
 			return 0, err
 		}
@@ -235,7 +1681,9 @@ func (s *ScalableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
 	s.fp = fp
 	s.p = p
 	s.hint = uint(hint)
+	s.growth = 1
 	s.filters = filters
+	s.clearState()
 	return numBytes + int64(5*binary.Size(uint64(0))), nil
 }
 
@@ -0,0 +1,21 @@
+//go:build go1.23
+
+package boom
+
+import "iter"
+
+// Generations returns an iterator over the index and Bloom filter of each
+// filter in the series, oldest first, for use with a range loop:
+//
+//	for i, pbf := range f.Generations() {
+//		...
+//	}
+//
+// It's the range-over-func equivalent of ForEach, and likewise yields the
+// filters themselves, so mutating one mutates the Scalable Bloom Filter. The
+// loop body must not add to the Scalable Bloom Filter.
+func (s *ScalableBloomFilter) Generations() iter.Seq2[int, *PartitionedBloomFilter] {
+	return func(yield func(int, *PartitionedBloomFilter) bool) {
+		s.ForEach(yield)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build go1.23
+
+package boom
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// Ensures that Generations yields each filter in order and stops when the
+// loop breaks.
+func TestScalableBloomGenerations(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	visited := 0
+	for i, pbf := range f.Generations() {
+		if i != visited {
+			t.Errorf("Expected index %d, got %d", visited, i)
+		}
+		if pbf != f.filters[i] {
+			t.Errorf("Expected filter %d to be the same instance", i)
+		}
+		visited++
+	}
+	if visited != len(f.filters) {
+		t.Errorf("Expected %d filters, got %d", len(f.filters), visited)
+	}
+
+	visited = 0
+	for range f.Generations() {
+		visited++
+		break
+	}
+	if visited != 1 {
+		t.Errorf("Expected 1 filter, got %d", visited)
+	}
+}
+
+func ExampleScalableBloomFilter_Generations() {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 300; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	for i, pbf := range f.Generations() {
+		fmt.Printf("filter %d: k=%d, capacity=%d\n", i, pbf.K(), pbf.Capacity())
+	}
+	// Output:
+	// filter 0: k=7, capacity=1344
+	// filter 1: k=7, capacity=1344
+	// filter 2: k=8, capacity=1536
+}
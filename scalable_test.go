@@ -2,7 +2,12 @@ package boom
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"hash"
+	"hash/fnv"
+	"math"
+	"os"
 	"strconv"
 	"testing"
 
@@ -34,8 +39,8 @@ func TestScalableBloomCapacity(t *testing.T) {
 	f.addFilter()
 	f.addFilter()
 
-	if capacity := f.Capacity(); capacity != 15 {
-		t.Errorf("Expected 15, got %d", capacity)
+	if capacity := f.Capacity(); capacity != 768 {
+		t.Errorf("Expected 768, got %d", capacity)
 	}
 }
 
@@ -49,6 +54,42 @@ func TestScalableBloomK(t *testing.T) {
 	}
 }
 
+// Ensures that each filter uses the optimal number of hash functions for its
+// own false-positive rate and that the measured false-positive rate of each
+// filter meets its target.
+func TestScalableBloomGenerationK(t *testing.T) {
+	f := NewScalableBloomFilter(1000, 0.01, 0.5)
+	for i := 0; i < 4000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if len(f.filters) < 4 {
+		t.Fatalf("Expected at least 4 filters, got %d", len(f.filters))
+	}
+
+	for i := range f.filters[:3] {
+		fpRate := 0.01 * math.Pow(0.5, float64(i))
+		if k := f.GenerationK(i); k != OptimalK(fpRate) {
+			t.Errorf("Expected k %d for filter %d, got %d", OptimalK(fpRate), i, k)
+		}
+
+		fps := 0
+		for j := 0; j < 100000; j++ {
+			if f.filters[i].Test([]byte(strconv.Itoa(-j - 1))) {
+				fps++
+			}
+		}
+
+		if rate := float64(fps) / 100000; rate > fpRate*1.5 {
+			t.Errorf("Expected false-positive rate of at most %f for filter %d, got %f", fpRate*1.5, i, rate)
+		}
+	}
+
+	if f.GenerationK(0) != f.K() {
+		t.Errorf("Expected %d, got %d", f.K(), f.GenerationK(0))
+	}
+}
+
 // Ensures that FillRatio returns the average fill ratio of the contained
 // filters.
 func TestScalableFillRatio(t *testing.T) {
@@ -62,6 +103,101 @@ func TestScalableFillRatio(t *testing.T) {
 	}
 }
 
+// Ensures that SetBits and TotalBits are summed across the contained filters.
+func TestScalableBloomSetBits(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.1, 0.8)
+	for i := 0; i < 200; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var set, total uint
+	for _, bf := range f.Filters() {
+		set += bf.SetBits()
+		total += bf.TotalBits()
+	}
+
+	if len(f.Filters()) < 2 {
+		t.Errorf("Expected more than 1 filter, got %d", len(f.Filters()))
+	}
+
+	if bits := f.SetBits(); bits != set || bits == 0 {
+		t.Errorf("Expected %d, got %d", set, bits)
+	}
+
+	if bits := f.TotalBits(); bits != total {
+		t.Errorf("Expected %d, got %d", total, bits)
+	}
+}
+
+// Ensures that AddBatch adds filters at the same points as Add.
+func TestScalableBloomAddBatchGrowth(t *testing.T) {
+	elements := make([][]byte, 5000)
+	for i := range elements {
+		elements[i] = []byte(strconv.Itoa(i))
+	}
+
+	var (
+		batch = NewScalableBloomFilter(100, 0.01, 0.8)
+		added = NewScalableBloomFilter(100, 0.01, 0.8)
+	)
+	batch.AddBatch(elements[:1234]).AddBatch(elements[1234:])
+	for _, data := range elements {
+		added.Add(data)
+	}
+
+	if len(batch.filters) != len(added.filters) || len(added.filters) < 5 {
+		t.Fatalf("Expected %d filters, got %d", len(added.filters), len(batch.filters))
+	}
+
+	for i := range added.filters {
+		if batch.filters[i].Count() != added.filters[i].Count() {
+			t.Errorf("Expected filter %d to have %d items, got %d", i, added.filters[i].Count(), batch.filters[i].Count())
+		}
+		for j, partition := range added.filters[i].partitions {
+			if !bytes.Equal(batch.filters[i].partitions[j].data, partition.data) {
+				t.Errorf("Expected filter %d to have the same bits", i)
+			}
+		}
+	}
+
+	for _, data := range elements {
+		if !batch.Test(data) {
+			t.Errorf("Expected %s to be a member", data)
+		}
+	}
+}
+
+// Ensures that RemainingCapacity is the number of items which can be added
+// before a new filter is added.
+func TestScalableBloomRemainingCapacity(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	remaining := f.RemainingCapacity()
+	if remaining == 0 {
+		t.Fatal("Expected remaining capacity")
+	}
+
+	for i := uint(0); i < remaining; i++ {
+		f.Add([]byte(strconv.Itoa(int(i))))
+	}
+
+	if len(f.filters) != 1 {
+		t.Errorf("Expected 1 filter, got %d", len(f.filters))
+	}
+
+	if r := f.RemainingCapacity(); r != 0 {
+		t.Errorf("Expected 0, got %d", r)
+	}
+
+	f.Add([]byte(`a`))
+	if len(f.filters) != 2 {
+		t.Errorf("Expected 2 filters, got %d", len(f.filters))
+	}
+
+	if r := f.RemainingCapacity(); r != filterCapacity(f.filters[1].s, f.p)-1 {
+		t.Errorf("Expected %d, got %d", filterCapacity(f.filters[1].s, f.p)-1, r)
+	}
+}
+
 // Ensures that Test, Add, and TestAndAdd behave correctly.
 func TestScalableBloomTestAndAdd(t *testing.T) {
 	f := NewScalableBloomFilter(1000, 0.01, 0.8)
@@ -115,6 +251,176 @@ func TestScalableBloomTestAndAdd(t *testing.T) {
 	}
 }
 
+// countingHash is a hash.Hash64 which counts the number of hashed elements.
+type countingHash struct {
+	hash.Hash64
+	sums int
+}
+
+func (c *countingHash) Sum(b []byte) []byte {
+	c.sums++
+	return c.Hash64.Sum(b)
+}
+
+// Ensures that TestAndAdd only hashes the data once regardless of the number
+// of filters.
+func TestScalableBloomTestAndAddHashesOnce(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.1, 0.8)
+	h := &countingHash{Hash64: fnv.New64()}
+	f.SetHash(h)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if len(f.filters) < 2 {
+		t.Fatalf("Expected more than 1 filter, got %d", len(f.filters))
+	}
+
+	// Find an element which isn't a false positive.
+	absent := 1000
+	for f.Test([]byte(strconv.Itoa(absent))) {
+		absent++
+	}
+
+	h.sums = 0
+	for i := 0; i < 1000; i++ {
+		if !f.TestAndAdd([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if f.TestAndAdd([]byte(strconv.Itoa(absent))) {
+		t.Errorf("%d should not be a member", absent)
+	}
+
+	if !f.Test([]byte(strconv.Itoa(absent))) {
+		t.Errorf("%d should be a member", absent)
+	}
+
+	if h.sums != 1002 {
+		t.Errorf("Expected 1002 hashes, got %d", h.sums)
+	}
+}
+
+// Ensures that IsEmpty returns true until something is added and again after
+// Reset.
+func TestScalableBloomIsEmpty(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.01, 0.8)
+	if !f.IsEmpty() {
+		t.Error("Expected an empty filter")
+	}
+
+	f.AddWithHashes(1, 2)
+	if f.IsEmpty() {
+		t.Error("Expected a non-empty filter")
+	}
+
+	f.Reset()
+	if !f.IsEmpty() {
+		t.Error("Expected an empty filter")
+	}
+
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	if f.IsEmpty() || f.FillRatio() == 0 {
+		t.Error("Expected a non-empty filter")
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	f.Reset()
+	if _, err := f.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if f.IsEmpty() {
+		t.Error("Expected a non-empty filter")
+	}
+}
+
+// Ensures that AddReportGrowth reports growth exactly on the insert which adds
+// a filter after the active filter reached the fill ratio.
+func TestScalableBloomAddReportGrowth(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.01, 0.8)
+	grows := 0
+	for i := 0; i < 1000; i++ {
+		full := f.filters[len(f.filters)-1].EstimatedFillRatio() >= f.p
+		_, grew := f.AddReportGrowth([]byte(strconv.Itoa(i)))
+		if grew != full {
+			t.Errorf("Expected grew to be %t on insert %d", full, i)
+		}
+		if grew {
+			grows++
+		}
+	}
+
+	if grows == 0 || len(f.filters) != grows+1 {
+		t.Errorf("Expected %d filters, got %d", grows+1, len(f.filters))
+	}
+
+	if member, grew := f.AddReportGrowth([]byte(`0`)); !member || grew {
+		t.Errorf("Expected member without growth, got %t and %t", member, grew)
+	}
+}
+
+// Ensures that a fork shares bit arrays until it writes to them and that the
+// fork and the original don't see each other's additions.
+func TestScalableBloomFork(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 500; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	fork := f.Fork()
+	if len(fork.filters) != len(f.filters) || len(f.filters) < 2 {
+		t.Fatalf("Expected %d filters, got %d", len(f.filters), len(fork.filters))
+	}
+
+	for i := range f.filters {
+		if fork.filters[i].partitions[0] != f.filters[i].partitions[0] {
+			t.Errorf("Expected filter %d to be shared", i)
+		}
+	}
+
+	fork.Add([]byte(`a`))
+
+	// Only the active filter was copied.
+	last := len(f.filters) - 1
+	for i := range f.filters {
+		shared := fork.filters[i].partitions[0] == f.filters[i].partitions[0]
+		if shared == (i == last) {
+			t.Errorf("Expected filter %d to be shared: %v", i, i != last)
+		}
+	}
+
+	if !fork.Test([]byte(`a`)) {
+		t.Error("`a` should be a member of the fork")
+	}
+
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member of the original")
+	}
+
+	f.Add([]byte(`b`))
+	if fork.Test([]byte(`b`)) {
+		t.Error("`b` should not be a member of the fork")
+	}
+
+	for i := 0; i < 500; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) || !fork.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member of both", i)
+		}
+	}
+
+	// Resetting the fork leaves the original intact.
+	fork.Filters()[0].Reset()
+	if !f.Test([]byte(`0`)) {
+		t.Error("`0` should be a member of the original")
+	}
+}
+
 // Ensures that Reset removes all Bloom filters and resets the initial one.
 func TestScalableBloomReset(t *testing.T) {
 	f := NewScalableBloomFilter(10, 0.1, 0.8)
@@ -143,66 +449,2084 @@ func TestScalableBloomReset(t *testing.T) {
 	}
 }
 
-// Ensures that ScalableBloomFilter can be serialized and deserialized without errors.
-func TestScalableBloomGob(t *testing.T) {
+// Ensures that NewScalableBloomFilterFromSet sizes a single filter for the
+// distinct elements and that it's smaller than an incrementally grown filter.
+func TestNewScalableBloomFilterFromSet(t *testing.T) {
+	elements := make([][]byte, 0, 20000)
+	for i := 0; i < 10000; i++ {
+		// Every element appears twice.
+		elements = append(elements, []byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
+	}
+
+	f := NewScalableBloomFilterFromSet(elements, 0.01)
+	if len(f.filters) != 1 {
+		t.Errorf("Expected 1 filter, got %d", len(f.filters))
+	}
+
+	for i := 0; i < 10000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	grown := NewScalableBloomFilter(100, 0.01, 0.8).AddBatch(elements)
+	if f.Capacity() >= grown.Capacity() {
+		t.Errorf("Expected capacity less than %d, got %d", grown.Capacity(), f.Capacity())
+	}
+
+	empty := NewScalableBloomFilterFromSet(nil, 0.01)
+	if empty.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+}
+
+// Ensures that EstimatedFalsePositiveRate is zero for an empty filter and
+// close to the measured rate for a filled one.
+func TestScalableBloomEstimatedFalsePositiveRate(t *testing.T) {
+	f := NewScalableBloomFilter(1000, 0.01, 0.8)
+	if rate := f.EstimatedFalsePositiveRate(); rate != 0 {
+		t.Errorf("Expected 0, got %f", rate)
+	}
+
+	for i := 0; i < 5000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var (
+		estimated = f.EstimatedFalsePositiveRate()
+		measured  = f.MeasureFalsePositiveRate(100000, 1)
+	)
+	if estimated <= 0 || estimated >= 1 {
+		t.Errorf("Expected rate in (0, 1), got %f", estimated)
+	}
+
+	if math.Abs(estimated-measured) > estimated/2 {
+		t.Errorf("Expected about %f, got %f", measured, estimated)
+	}
+}
+
+// Ensures that TestInto agrees with Test and doesn't allocate.
+func TestScalableBloomTestInto(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	scratch := NewHashScratch(fnv.New64())
+	for i := 0; i < 2000; i++ {
+		data := []byte(strconv.Itoa(i))
+		if f.TestInto(data, scratch) != f.Test(data) {
+			t.Errorf("Expected TestInto(%d) to match Test", i)
+		}
+	}
+
+	data := []byte(`a`)
+	if allocs := testing.AllocsPerRun(100, func() { f.TestInto(data, scratch) }); allocs != 0 {
+		t.Errorf("Expected 0 allocations, got %f", allocs)
+	}
+}
+
+// Ensures that mutators return the filter so they can be chained.
+func TestScalableBloomChaining(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.1, 0.8)
+	keys := [][]byte{[]byte(`a`), []byte(`b`), []byte(`c`)}
+
+	if f.SetHash(fnv.New64a()).AddBatch(keys) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	for _, key := range keys {
+		if !f.Test(key) {
+			t.Errorf("Expected %s to be a member", key)
+		}
+	}
+
+	if count := f.Count(); count != 3 {
+		t.Errorf("Expected 3, got %d", count)
+	}
+
+	if f.AddBatch(keys).Reset().Count() != 0 {
+		t.Error("Expected an empty filter")
+	}
+
+	g, err := f.Reconfigure(0.01, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	other := NewScalableBloomFilter(10, 0.1, 0.8).WithElementRetention().AddBatch(keys)
+	if g, err := f.MergeRehash(other); err != nil || g != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+}
+
+// Ensures that each Bloom filter is seeded by its index and that seeds survive
+// serialization.
+func TestScalableBloomSeeds(t *testing.T) {
 	f := NewScalableBloomFilter(10, 0.1, 0.8)
 	for i := 0; i < 1000; i++ {
 		f.Add([]byte(strconv.Itoa(i)))
 	}
 
+	if len(f.filters) < 2 {
+		t.Fatalf("Expected more than 1 filter, got %d", len(f.filters))
+	}
+
+	for i, filter := range f.filters {
+		if filter.seed != generationSeed(i) {
+			t.Errorf("Expected seed %d for filter %d, got %d", generationSeed(i), i, filter.seed)
+		}
+	}
+
+	if f.filters[0].seed != 0 || f.filters[1].seed == 0 {
+		t.Error("Expected only the initial filter to be unseeded")
+	}
+
 	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
-		t.Error(err)
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
 	}
 
 	f2 := NewScalableBloomFilter(10, 0.1, 0.8)
-	if err := gob.NewDecoder(&buf).Decode(f2); err != nil {
-		t.Error(err)
+	if _, err := f2.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
 	}
 
-	if diff, equal := messagediff.PrettyDiff(f, f2); !equal {
-		t.Errorf("ScalableBoomFilter Gob Encode and Decode = %+v; not %+v\n%s", f2, f, diff)
+	for i, filter := range f2.filters {
+		if filter.seed != generationSeed(i) {
+			t.Errorf("Expected seed %d for filter %d, got %d", generationSeed(i), i, filter.seed)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !f2.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
 	}
 }
 
-func BenchmarkScalableBloomAdd(b *testing.B) {
-	b.StopTimer()
-	f := NewScalableBloomFilter(100000, 0.1, 0.8)
-	data := make([][]byte, b.N)
-	for i := 0; i < b.N; i++ {
-		data[i] = []byte(strconv.Itoa(i))
+// Ensures that PlanScalable matches the filters allocated by an actually grown
+// Scalable Bloom Filter.
+func TestPlanScalable(t *testing.T) {
+	plan := PlanScalable(50000, 0.01, 0.8)
+	f := NewDefaultScalableBloomFilter(0.01)
+	for i := 0; i < 50000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
 	}
-	b.StartTimer()
 
-	for n := 0; n < b.N; n++ {
-		f.Add(data[n])
+	if plan.Filters != len(f.filters) {
+		t.Fatalf("Expected %d filters, got %d", len(f.filters), plan.Filters)
 	}
-}
 
-func BenchmarkScalableBloomTest(b *testing.B) {
-	b.StopTimer()
-	f := NewScalableBloomFilter(100000, 0.1, 0.8)
-	data := make([][]byte, b.N)
-	for i := 0; i < b.N; i++ {
-		data[i] = []byte(strconv.Itoa(i))
+	total, bits, bytes := uint(0), uint(0), uint(0)
+	for i, filter := range f.filters {
+		total += plan.Capacities[i]
+		bits += filter.k * filter.s
+		for _, partition := range filter.partitions {
+			bytes += uint(len(partition.data))
+		}
+
+		// Every filter but the last is filled to its capacity.
+		if i < len(f.filters)-1 && filter.Count() != plan.Capacities[i] {
+			t.Errorf("Expected capacity %d for filter %d, got %d",
+				filter.Count(), i, plan.Capacities[i])
+		}
 	}
-	b.StartTimer()
 
-	for n := 0; n < b.N; n++ {
-		f.Test(data[n])
+	if total < 50000 {
+		t.Errorf("Expected capacities to sum to at least 50000, got %d", total)
+	}
+
+	if plan.Bits != bits {
+		t.Errorf("Expected %d bits, got %d", bits, plan.Bits)
+	}
+
+	if plan.Bytes != bytes {
+		t.Errorf("Expected %d bytes, got %d", bytes, plan.Bytes)
+	}
+
+	if plan := PlanScalable(0, 0.01, 0.8); plan.Filters != 1 {
+		t.Errorf("Expected 1 filter, got %d", plan.Filters)
 	}
 }
 
-func BenchmarkScalableBloomTestAndAdd(b *testing.B) {
-	b.StopTimer()
-	f := NewScalableBloomFilter(100000, 0.1, 0.8)
-	data := make([][]byte, b.N)
-	for i := 0; i < b.N; i++ {
-		data[i] = []byte(strconv.Itoa(i))
+// Ensures that each successive filter is sized for growth times as many items
+// as the previous one and that the growth factor survives serialization.
+func TestScalableBloomGrowth(t *testing.T) {
+	f := NewScalableBloomFilterWithGrowth(100, 0.01, 0.8, 2)
+	for i := 0; i < 5000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
 	}
-	b.StartTimer()
 
-	for n := 0; n < b.N; n++ {
-		f.TestAndAdd(data[n])
+	if len(f.filters) < 3 {
+		t.Fatalf("Expected at least 3 filters, got %d", len(f.filters))
+	}
+
+	hint := uint(100)
+	for i, filter := range f.filters {
+		fp := 0.01 * math.Pow(0.8, float64(i))
+		if m := OptimalK(fp) * partitionSize(OptimalM(hint, fp), OptimalK(fp)); filter.m != m {
+			t.Errorf("Expected m %d for filter %d, got %d", m, i, filter.m)
+		}
+		hint *= 2
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := NewScalableBloomFilter(10, 0.1, 0.8)
+	if _, err := f2.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if f2.growth != 2 {
+		t.Errorf("Expected growth 2, got %d", f2.growth)
+	}
+
+	if f := NewScalableBloomFilterWithGrowth(100, 0.01, 0.8, 0); f.growth != 1 {
+		t.Errorf("Expected growth 1, got %d", f.growth)
+	}
+
+	if f := NewScalableBloomFilterWithGrowth(100, 0.01, 0.8, 1<<20); f.growth != maxGrowth {
+		t.Errorf("Expected growth %d, got %d", maxGrowth, f.growth)
+	}
+}
+
+// Ensures that generation size hints saturate instead of overflowing for large
+// growth factors and many generations.
+func TestScalableBloomGenerationHintOverflow(t *testing.T) {
+	if hint := generationHint(10, 1<<20, 4); hint != maxGenerationHint {
+		t.Errorf("Expected %d, got %d", maxGenerationHint, hint)
+	}
+
+	for _, growth := range []uint{2, maxGrowth, 1 << 20} {
+		prev := uint(0)
+		for i := 0; i < 200; i++ {
+			hint := generationHint(10, growth, i)
+			if hint < prev {
+				t.Fatalf("Expected hint %d for generation %d to be at least %d", hint, i, prev)
+			}
+			prev = hint
+		}
+	}
+
+	f := NewScalableBloomFilterWithGrowth(10, 0.01, 0.8, maxGrowth)
+	for i := 0; len(f.filters) < 2; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	if needed := f.FiltersNeededFor(^uint(0)); needed <= 0 {
+		t.Errorf("Expected filters to be needed, got %d", needed)
+	}
+	if plan := planScalable(^uint(0), 10, maxGrowth, 0.01, 0.8); plan.Filters <= 1 {
+		t.Errorf("Expected several filters, got %d", plan.Filters)
+	}
+	for i := 1; i < 8; i++ {
+		if _, size := f.generationSize(i); size == 0 {
+			t.Errorf("Expected a non-empty partition for generation %d", i)
+		}
+	}
+}
+
+// Ensures that MergeRehash adds the other filter's retained elements
+// regardless of the filters' parameters.
+func TestScalableBloomMergeRehash(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.1, 0.8)
+	other := NewScalableBloomFilter(1000, 0.01, 0.9)
+
+	if _, err := f.MergeRehash(other); err == nil {
+		t.Error("Expected error without element retention")
+	}
+
+	if other.WithElementRetention() != other {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	for i := 0; i < 500; i++ {
+		other.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if _, err := f.MergeRehash(other); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if len(other.retained) != 500 {
+		t.Errorf("Expected 500 retained elements, got %d", len(other.retained))
+	}
+
+	other.Reset()
+	if other.retained == nil || len(other.retained) != 0 {
+		t.Error("Expected Reset to clear retained elements but keep retention enabled")
+	}
+}
+
+// Ensures that ScalableBloomFilter can be serialized and deserialized without errors.
+func TestScalableBloomGob(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.1, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+		t.Error(err)
+	}
+
+	f2 := NewScalableBloomFilter(10, 0.1, 0.8)
+	if err := gob.NewDecoder(&buf).Decode(f2); err != nil {
+		t.Error(err)
+	}
+
+	if diff, equal := messagediff.PrettyDiff(f, f2); !equal {
+		t.Errorf("ScalableBoomFilter Gob Encode and Decode = %+v; not %+v\n%s", f2, f, diff)
+	}
+}
+
+// Ensures that ReadFromUpstream decodes a filter written by the upstream
+// BoomFilters package, that the filter keeps working after it grows and that
+// the compact format is rejected.
+func TestScalableBloomReadFromUpstream(t *testing.T) {
+	data, err := os.ReadFile("testdata/upstream_scalable.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewScalableBloomFilter(100, 0.1, 0.8)
+	n, err := f.ReadFromUpstream(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(data)) {
+		t.Errorf("Expected %d bytes read, got %d", len(data), n)
+	}
+
+	if f.hint != 10 {
+		t.Errorf("Expected hint 10, got %d", f.hint)
+	}
+
+	if f.growth != 1 {
+		t.Errorf("Expected growth 1, got %d", f.growth)
+	}
+
+	for i := 0; i < 50; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// The decoded filter can be merged with another decoded one.
+	g := NewScalableBloomFilter(100, 0.1, 0.8)
+	if _, err := g.ReadFromUpstream(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	union, err := UnionScalable(f, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 50; i < 200; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	for i := 0; i < 200; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		if !union.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member of the union", i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewScalableBloomFilter(100, 0.1, 0.8).ReadFromUpstream(&buf); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that UnionScalable returns a filter containing the elements of every
+// input and returns an error if the parameters differ.
+func TestUnionScalable(t *testing.T) {
+	var (
+		f1 = NewScalableBloomFilter(100, 0.01, 0.8)
+		f2 = NewScalableBloomFilter(100, 0.01, 0.8)
+		f3 = NewScalableBloomFilter(100, 0.01, 0.8)
+	)
+	for i := 0; i < 100; i++ {
+		f1.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 100; i < 1000; i++ {
+		f2.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 1000; i < 1500; i++ {
+		f3.Add([]byte(strconv.Itoa(i)))
+	}
+
+	union, err := UnionScalable(f1, f2, f3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(union.filters) != len(f2.filters) {
+		t.Errorf("Expected %d filters, got %d", len(f2.filters), len(union.filters))
+	}
+
+	for i := 0; i < 1500; i++ {
+		if !union.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// Anything an input reports as a member must be reported by the union.
+	for i := 1500; i < 2500; i++ {
+		data := []byte(strconv.Itoa(i))
+		if !union.Test(data) && (f1.Test(data) || f2.Test(data) || f3.Test(data)) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if count := union.Count(); count != 1500 {
+		t.Errorf("Expected 1500, got %d", count)
+	}
+
+	if _, err := UnionScalable(); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := UnionScalable(f1, NewScalableBloomFilter(100, 0.1, 0.8)); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := UnionScalable(f1, NewScalableBloomFilterWithGrowth(100, 0.01, 0.8, 2)); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that MergeCompatibility explains each parameter mismatch and that
+// CanMerge agrees with it.
+func TestScalableBloomMergeCompatibility(t *testing.T) {
+	base := func() *ScalableBloomFilter {
+		return NewScalableBloomFilter(100, 0.01, 0.8)
+	}
+
+	if ok, reason := MergeCompatibility(base(), base()); !ok || reason != "" {
+		t.Errorf("Expected compatible filters, got %q", reason)
+	}
+
+	fillRatio := base()
+	fillRatio.p = 0.6
+
+	seed := base()
+	seed.filters[0].seed = 42
+
+	layout := base()
+	layout.filters[0] = NewPartitionedBloomFilter(200, 0.01)
+
+	for _, tc := range []struct {
+		other  *ScalableBloomFilter
+		reason string
+	}{
+		{NewScalableBloomFilter(100, 0.01, 0.9), "tightening ratio must match"},
+		{NewScalableBloomFilter(100, 0.1, 0.8), "false-positive rate must match"},
+		{fillRatio, "fill ratio must match"},
+		{NewScalableBloomFilter(200, 0.01, 0.8), "size hint must match"},
+		{NewScalableBloomFilterWithGrowth(100, 0.01, 0.8, 4), "growth factor must match"},
+		{base().SetHash(fnv.New64a()), "hash function must match"},
+		{base().SetHash128(fnv.New128()), "hash function must match"},
+		{seed, "filter 0: seed must match"},
+		{layout, "filter 0: partition size must match"},
+	} {
+		ok, reason := MergeCompatibility(base(), tc.other)
+		if ok {
+			t.Errorf("Expected %q, got compatible", tc.reason)
+		}
+		if reason != tc.reason {
+			t.Errorf("Expected %q, got %q", tc.reason, reason)
+		}
+
+		if CanMerge(base(), tc.other) {
+			t.Errorf("Expected CanMerge to be false for %q", tc.reason)
+		}
+
+		if _, err := UnionScalable(base(), tc.other); err == nil || err.Error() != tc.reason {
+			t.Errorf("Expected error %q, got %v", tc.reason, err)
+		}
+	}
+
+	// Filters with the same base hash function can be merged.
+	if !CanMerge(base().SetHash128(fnv.New128()), base().SetHash128(fnv.New128())) {
+		t.Error("Expected filters using Hash128 to be compatible")
+	}
+}
+
+// Ensures that the reservoir sample stays bounded, holds copies of added
+// elements and is roughly uniform.
+func TestScalableBloomSamples(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	if f.Samples() != nil {
+		t.Error("Expected no samples without sampling")
+	}
+
+	if f.WithSampleSize(10) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	data := []byte(`a`)
+	f.Add(data)
+	data[0] = 'b'
+	if samples := f.Samples(); len(samples) != 1 || string(samples[0]) != "a" {
+		t.Errorf("Expected a copy of `a`, got %q", samples)
+	}
+
+	added := map[string]bool{"a": true}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		added[key] = true
+		f.Add([]byte(key))
+		if l := len(f.Samples()); l > 10 {
+			t.Fatalf("Expected at most 10 samples, got %d", l)
+		}
+	}
+
+	samples := f.Samples()
+	if len(samples) != 10 {
+		t.Errorf("Expected 10 samples, got %d", len(samples))
+	}
+	for _, sample := range samples {
+		if !added[string(sample)] {
+			t.Errorf("Expected %q to have been added", sample)
+		}
+		sample[0] = 'x'
+	}
+	for _, sample := range f.Samples() {
+		if sample[0] == 'x' {
+			t.Error("Expected Samples to return copies")
+		}
+	}
+
+	// Every element is equally likely to be sampled, so about a tenth of the
+	// samples come from the first tenth of the elements.
+	early := 0
+	for trial := 0; trial < 200; trial++ {
+		f.Reset()
+		for i := 0; i < 100; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+		for _, sample := range f.Samples() {
+			if i, _ := strconv.Atoi(string(sample)); i < 10 {
+				early++
+			}
+		}
+	}
+	if early < 100 || early > 300 {
+		t.Errorf("Expected about 200 early samples, got %d", early)
+	}
+
+	f.Reset()
+	if l := len(f.Samples()); l != 0 {
+		t.Errorf("Expected 0 samples, got %d", l)
+	}
+
+	f.Add([]byte(`a`))
+	if f.WithSampleSize(0).Samples() != nil {
+		t.Error("Expected no samples after disabling sampling")
+	}
+}
+
+// Ensures that FiltersNeededFor matches the number of filters added by
+// inserting that many distinct elements.
+func TestScalableBloomFiltersNeededFor(t *testing.T) {
+	for _, growth := range []uint{1, 2} {
+		for _, total := range []uint{0, 50, 100, 1000, 5000} {
+			f := NewScalableBloomFilterWithGrowth(100, 0.01, 0.8, growth)
+			for i := 0; i < 50; i++ {
+				f.Add([]byte(strconv.Itoa(i)))
+			}
+
+			var (
+				needed = f.FiltersNeededFor(total)
+				before = len(f.filters)
+			)
+			for i := f.Count(); i < total; i++ {
+				f.Add([]byte(strconv.Itoa(int(i))))
+			}
+
+			if added := len(f.filters) - before; added != needed {
+				t.Errorf("growth %d, total %d: Expected %d filters, got %d", growth, total, added, needed)
+			}
+		}
+	}
+}
+
+// Ensures that SetSizeHint only changes the size of filters added afterwards
+// and that the hint is serialized.
+func TestScalableBloomSetSizeHint(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; len(f.filters) < 2; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	capacities := []uint{f.filters[0].Capacity(), f.filters[1].Capacity()}
+
+	if f.SetSizeHint(1000) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	for i := 0; len(f.filters) < 3; i++ {
+		f.Add([]byte(strconv.Itoa(i + 1000000)))
+	}
+
+	for i, capacity := range capacities {
+		if f.filters[i].Capacity() != capacity {
+			t.Errorf("Expected %d, got %d", capacity, f.filters[i].Capacity())
+		}
+	}
+
+	expected := NewPartitionedBloomFilter(1000, 0.01*math.Pow(0.8, 2)).Capacity()
+	if capacity := f.filters[2].Capacity(); capacity != expected || capacity <= capacities[1] {
+		t.Errorf("Expected %d, got %d", expected, capacity)
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	g := NewScalableBloomFilter(10, 0.01, 0.8)
+	if _, err := g.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if g.hint != 1000 {
+		t.Errorf("Expected 1000, got %d", g.hint)
+	}
+
+	// A hint of 0 keeps the previous one, so filters can still be added.
+	g.SetSizeHint(0)
+	if g.hint != 1000 {
+		t.Errorf("Expected 1000, got %d", g.hint)
+	}
+	for i := 0; len(g.filters) < 4; i++ {
+		g.Add([]byte(strconv.Itoa(i + 2000000)))
+	}
+	buf.Reset()
+	if _, err := g.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewScalableBloomFilter(10, 0.01, 0.8).ReadFrom(&buf); err != nil {
+		t.Error(err)
+	}
+}
+
+// Ensures that with a hysteresis band, a filter hovering at the fill threshold
+// isn't repeatedly shrunk and regrown.
+func TestScalableBloomGrowthHysteresis(t *testing.T) {
+	hover := func(f *ScalableBloomFilter) int {
+		f.WithElementRetention()
+		capacity := filterCapacity(f.filters[0].s, f.p)
+		for i := uint(0); i < capacity-5; i++ {
+			f.Add([]byte(strconv.Itoa(int(i))))
+		}
+
+		// Re-adding elements pushes the fill over the threshold, while the
+		// distinct elements still fit in one filter.
+		grows := 0
+		for cycle := 0; cycle < 50; cycle++ {
+			for i := 0; i < 10; i++ {
+				if _, grew := f.AddReportGrowth([]byte(strconv.Itoa(i))); grew {
+					grows++
+				}
+			}
+			if _, err := f.TryShrink(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return grows
+	}
+
+	if grows := hover(NewScalableBloomFilter(100, 0.01, 0.8)); grows < 50 {
+		t.Errorf("Expected a new filter every cycle without hysteresis, got %d", grows)
+	}
+
+	// With hysteresis, the filter keeps its second filter and only grows as
+	// the re-added elements fill further filters.
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	if f.SetGrowthHysteresis(0.1) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+	if grows := hover(f); grows > 10 {
+		t.Errorf("Expected at most 10 new filters with hysteresis, got %d", grows)
+	}
+
+	// Filters are still dropped when the retained elements clearly fit.
+	f = NewScalableBloomFilter(10, 0.01, 0.8).WithElementRetention().SetGrowthHysteresis(1)
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i % 5)))
+	}
+	if dropped, err := f.TryShrink(); err != nil || dropped == 0 || len(f.filters) != 1 {
+		t.Errorf("Expected filters to be dropped, got %d (%v)", dropped, err)
+	}
+}
+
+// Ensures that with a hysteresis band, a fill estimate hovering at the
+// threshold adds one new filter rather than a burst of them, and that the old
+// filter stays active until it's clearly above the threshold.
+func TestScalableBloomGrowthHysteresisActivation(t *testing.T) {
+	hover := func(f *ScalableBloomFilter) int {
+		// Every filter's fill estimate alternates just above and below the
+		// fill ratio.
+		calls := 0
+		f.SetFillEstimator(func(setBits, totalBits uint) float64 {
+			calls++
+			if calls%2 == 0 {
+				return f.p + 0.01
+			}
+			return f.p - 0.01
+		})
+		for i := 0; i < 100; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+		return len(f.filters)
+	}
+
+	if filters := hover(NewScalableBloomFilter(100, 0.01, 0.8)); filters < 10 {
+		t.Errorf("Expected a burst of filters without hysteresis, got %d", filters)
+	}
+
+	f := NewScalableBloomFilter(100, 0.01, 0.8).SetGrowthHysteresis(0.1)
+	if filters := hover(f); filters != 2 {
+		t.Errorf("Expected 2 filters with hysteresis, got %d", filters)
+	}
+	if count := f.filters[1].Count(); count != 0 {
+		t.Errorf("Expected the new filter to be unused, got %d", count)
+	}
+	for i := 0; i < 100; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	// Once the old filter is clearly above the threshold, the new one is
+	// used.
+	f.SetFillEstimator(func(setBits, totalBits uint) float64 {
+		if setBits > 0 {
+			return f.p + 0.2
+		}
+		return 0
+	})
+	f.Add([]byte("a"))
+	if count := f.filters[1].Count(); count != 1 {
+		t.Errorf("Expected the new filter to be used, got %d", count)
+	}
+	if len(f.filters) != 2 {
+		t.Errorf("Expected 2 filters, got %d", len(f.filters))
+	}
+}
+
+// Ensures that TryShrink drops filters which are no longer needed to hold the
+// retained elements and returns an error if retention is not enabled.
+func TestScalableBloomTryShrink(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	if _, err := f.TryShrink(); err == nil {
+		t.Error("Expected error")
+	}
+
+	f.SetHash128(fnv.New128a())
+
+	f.WithElementRetention()
+	for i := 0; i < 1000; i++ {
+		f.Add(append([]byte(`burst`), strconv.Itoa(i)...))
+	}
+	before := len(f.filters)
+
+	// Simulate the traffic subsiding by keeping only a few elements.
+	for element := range f.retained {
+		if len(f.retained) <= 50 {
+			break
+		}
+		delete(f.retained, element)
+	}
+
+	dropped, err := f.TryShrink()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dropped != before-1 {
+		t.Errorf("Expected %d filters dropped, got %d", before-1, dropped)
+	}
+
+	if len(f.filters) != 1 {
+		t.Errorf("Expected 1 filter, got %d", len(f.filters))
+	}
+
+	if f.filters[0].hashFunc == nil {
+		t.Error("Expected the hash function to be kept")
+	}
+
+	for element := range f.retained {
+		if !f.Test([]byte(element)) {
+			t.Errorf("Expected %s to be a member", element)
+		}
+	}
+
+	if dropped, err := f.TryShrink(); err != nil || dropped != 0 {
+		t.Errorf("Expected 0 filters dropped, got %d (%v)", dropped, err)
+	}
+}
+
+// Ensures that Count returns the sum of the filters' counts, or the number of
+// distinct items added when exact counting is enabled.
+func TestScalableBloomCount(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i % 500)))
+	}
+
+	if count := f.Count(); count != 1000 {
+		t.Errorf("Expected 1000, got %d", count)
+	}
+
+	f = NewScalableBloomFilter(1000, 0.001, 0.8)
+	if f.WithExactCount() != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i % 500)))
+	}
+	for i := 500; i < 1000; i++ {
+		f.TestAndAdd([]byte(strconv.Itoa(i)))
+	}
+
+	// False positives can only undercount.
+	if count := f.Count(); count > 1000 || count < 990 {
+		t.Errorf("Expected about 1000, got %d", count)
+	}
+
+	f.Reset()
+	if count := f.Count(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+}
+
+// Ensures that filters aren't added beyond the memory budget and that the
+// filter is flagged as degraded instead.
+func TestScalableBloomMemoryBudget(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	budget := f.memory() + f.nextFilterBytes()
+	if f.WithMemoryBudget(budget) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if len(f.filters) != 2 {
+		t.Errorf("Expected 2 filters, got %d", len(f.filters))
+	}
+
+	if !f.Degraded() {
+		t.Error("Expected filter to be degraded")
+	}
+
+	if f.memory() > budget {
+		t.Errorf("Expected at most %d bytes, got %d", budget, f.memory())
+	}
+
+	// Elements are still added to the last filter.
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	f.Reset()
+	if f.Degraded() {
+		t.Error("Expected filter not to be degraded after Reset")
+	}
+
+	unlimited := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		unlimited.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if unlimited.Degraded() {
+		t.Error("Expected filter not to be degraded")
+	}
+}
+
+// Ensures that decoding into a filter which already holds data clears the
+// state which isn't part of the binary representation, as Reset does, while
+// keeping the options enabling it.
+func TestScalableBloomReadFromClearsState(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewScalableBloomFilter(100, 0.01, 0.8).Add([]byte(`x`)).(*ScalableBloomFilter).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := os.ReadFile("testdata/upstream_scalable.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{buf.Bytes(), upstream} {
+		f := NewScalableBloomFilter(10, 0.1, 0.8).
+			WithElementRetention().
+			WithSampleSize(5).
+			WithMemoryBudget(1)
+		if err := f.Merge(NewScalableBloomFilter(10, 0.1, 0.8).WithElementRetention()); err != nil {
+			t.Fatal(err)
+		}
+		f.WithExactCount()
+		for i := 0; i < 100; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+		if !f.Degraded() || !f.merged || f.distinct == 0 || len(f.retained) == 0 || len(f.Samples()) == 0 {
+			t.Fatal("Expected the filter to hold state before decoding")
+		}
+
+		if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Degraded() {
+			t.Error("Expected filter not to be degraded")
+		}
+		if f.merged {
+			t.Error("Expected filter not to be merged")
+		}
+		if count := f.Count(); count != 0 {
+			t.Errorf("Expected exact count 0, got %d", count)
+		}
+		if f.retained == nil || len(f.retained) != 0 {
+			t.Errorf("Expected retention enabled with no elements, got %d", len(f.retained))
+		}
+		if samples := f.Samples(); len(samples) != 0 {
+			t.Errorf("Expected no samples, got %d", len(samples))
+		}
+
+		// The options still apply to elements added after decoding.
+		y := "y"
+		for f.Test([]byte(y)) {
+			y += "y"
+		}
+		f.Add([]byte(y))
+		if count := f.Count(); count != 1 {
+			t.Errorf("Expected exact count 1, got %d", count)
+		}
+		if _, ok := f.retained[y]; !ok {
+			t.Errorf("Expected %s to be retained", y)
+		}
+		if samples := f.Samples(); len(samples) != 1 {
+			t.Errorf("Expected 1 sample, got %d", len(samples))
+		}
+	}
+}
+
+// Ensures that ReadFrom rejects filters whose parameters are out of range
+// instead of misbehaving when filters are added after decoding.
+func TestScalableBloomReadFromInvalid(t *testing.T) {
+	for _, invalidate := range []func(*ScalableBloomFilter){
+		func(f *ScalableBloomFilter) { f.growth = 0 },
+		func(f *ScalableBloomFilter) { f.growth = 1 << 30 },
+		func(f *ScalableBloomFilter) { f.hint = 0 },
+		func(f *ScalableBloomFilter) { f.fp = 0 },
+		func(f *ScalableBloomFilter) { f.fp = math.NaN() },
+		func(f *ScalableBloomFilter) { f.r = 1 },
+		func(f *ScalableBloomFilter) { f.p = 0 },
+		func(f *ScalableBloomFilter) { f.p = 1.5 },
+	} {
+		f := NewScalableBloomFilter(100, 0.01, 0.8)
+		invalidate(f)
+		var buf bytes.Buffer
+		if _, err := f.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewScalableBloomFilter(10, 0.1, 0.8).ReadFrom(&buf); err == nil {
+			t.Error("Expected error")
+		}
+	}
+
+	for _, params := range [][3]float64{{0.8, 0.01, 0}, {0, 0.01, 0.5}, {0.8, 1, 0.5}} {
+		var buf bytes.Buffer
+		for _, x := range params {
+			binary.Write(&buf, binary.BigEndian, x)
+		}
+		binary.Write(&buf, binary.BigEndian, []uint64{10, 1})
+		if _, err := NewScalableBloomFilter(10, 0.1, 0.8).ReadFrom(&buf); err == nil {
+			t.Error("Expected error")
+		}
+	}
+}
+
+// Ensures that AddE returns ErrDegraded once the memory budget is exceeded
+// and an error for invalid parameters.
+func TestScalableBloomAddE(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	f.WithMemoryBudget(f.memory() + f.nextFilterBytes())
+
+	degradedAt := -1
+	for i := 0; i < 1000; i++ {
+		err := f.AddE([]byte(strconv.Itoa(i)))
+		if err != nil && err != ErrDegraded {
+			t.Fatalf("Expected ErrDegraded, got %v", err)
+		}
+		if err == nil && degradedAt >= 0 {
+			t.Fatalf("Expected ErrDegraded for %d after degrading at %d", i, degradedAt)
+		}
+		if err == ErrDegraded && degradedAt < 0 {
+			degradedAt = i
+		}
+		if (err == ErrDegraded) != f.Degraded() {
+			t.Fatalf("Expected the error to match Degraded for %d", i)
+		}
+	}
+
+	if degradedAt <= 0 {
+		t.Errorf("Expected the filter to degrade after some additions, got %d", degradedAt)
+	}
+
+	// Elements are added even when degraded.
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	f.Reset()
+	if err := f.AddE([]byte(`a`)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	var zero ScalableBloomFilter
+	if err := zero.AddE([]byte(`a`)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	for _, invalidate := range []func(*ScalableBloomFilter){
+		func(f *ScalableBloomFilter) { f.r = 1 },
+		func(f *ScalableBloomFilter) { f.hint = 0 },
+		func(f *ScalableBloomFilter) { f.growth = 0 },
+	} {
+		invalid := NewScalableBloomFilter(100, 0.01, 0.8)
+		invalidate(invalid)
+		if err := invalid.AddE([]byte(`a`)); err == nil {
+			t.Error("Expected error")
+		}
+		if invalid.Test([]byte(`a`)) {
+			t.Error("`a` should not be a member")
+		}
+	}
+}
+
+// Ensures that Reconfigure resets the filter with the new parameters and
+// returns an error for invalid parameters.
+func TestScalableBloomReconfigure(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.1, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if _, err := f.Reconfigure(0.01, 0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.filters) != 1 {
+		t.Errorf("Expected 1 filter, got %d", len(f.filters))
+	}
+
+	if f.fp != 0.01 {
+		t.Errorf("Expected 0.01, got %f", f.fp)
+	}
+
+	if f.r != 0.5 {
+		t.Errorf("Expected 0.5, got %f", f.r)
+	}
+
+	if k := f.K(); k != OptimalK(0.01) {
+		t.Errorf("Expected %d, got %d", OptimalK(0.01), k)
+	}
+
+	if f.Test([]byte(`1`)) {
+		t.Error("`1` should not be a member")
+	}
+
+	f.Add([]byte(`a`))
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	for _, params := range [][2]float64{{0, 0.5}, {1, 0.5}, {0.01, 0}, {0.01, 1.5}} {
+		if _, err := f.Reconfigure(params[0], params[1]); err == nil {
+			t.Errorf("Expected error for %v", params)
+		}
+	}
+
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+}
+
+// Ensures that MeasureFalsePositiveRate is reproducible and close to the
+// target false-positive rate.
+func TestScalableBloomMeasureFalsePositiveRate(t *testing.T) {
+	f := NewScalableBloomFilter(10000, 0.01, 0.8)
+	for i := 0; i < 10000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	rate := f.MeasureFalsePositiveRate(100000, 42)
+	if rate <= 0 || rate > 0.02 {
+		t.Errorf("Expected about 0.01, got %f", rate)
+	}
+
+	if r := f.MeasureFalsePositiveRate(100000, 42); r != rate {
+		t.Errorf("Expected %f, got %f", rate, r)
+	}
+
+	if count := f.Count(); count != 10000 {
+		t.Errorf("Expected 10000, got %d", count)
+	}
+
+	if r := f.MeasureFalsePositiveRate(0, 42); r != 0 {
+		t.Errorf("Expected 0, got %f", r)
+	}
+}
+
+// Ensures that Filters returns a copy of the series of Bloom filters.
+func TestScalableBloomFilters(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	filters := f.Filters()
+	if len(filters) != len(f.filters) {
+		t.Fatalf("Expected %d filters, got %d", len(f.filters), len(filters))
+	}
+
+	for i, filter := range filters {
+		if filter != f.filters[i] {
+			t.Errorf("Expected filter %d to be the same instance", i)
+		}
+	}
+
+	filters[0] = nil
+	if f.filters[0] == nil {
+		t.Error("Expected returned slice to be a copy")
+	}
+}
+
+// Ensures that TestBatchWithIndex returns the index of the filter each member
+// was added to and -1 for absent elements.
+func TestScalableBloomTestBatchWithIndex(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	var (
+		data  [][]byte
+		added []int
+	)
+	for i := 0; i < 1000; i++ {
+		element := []byte(strconv.Itoa(i))
+		if f.Test(element) {
+			continue
+		}
+		f.Add(element)
+		data = append(data, element)
+		added = append(added, len(f.filters)-1)
+	}
+	if len(f.filters) < 2 {
+		t.Fatalf("Expected more than 1 filter, got %d", len(f.filters))
+	}
+
+	// A member may be a false positive in an older filter than the one it
+	// was added to, but never in a newer one.
+	indexes := f.TestBatchWithIndex(data)
+	for i, index := range indexes {
+		if index < 0 || index > added[i] {
+			t.Errorf("Expected %s in filter %d or an older one, got %d", data[i], added[i], index)
+		}
+	}
+
+	exact := 0
+	for i, index := range indexes {
+		if index == added[i] {
+			exact++
+		}
+	}
+	if exact < len(data)*95/100 {
+		t.Errorf("Expected at least %d elements in the filter they were added to, got %d", len(data)*95/100, exact)
+	}
+
+	var absent [][]byte
+	for i := 1000; i < 2000; i++ {
+		if element := []byte(strconv.Itoa(i)); !f.Test(element) {
+			absent = append(absent, element)
+		}
+	}
+	if len(absent) < 900 {
+		t.Fatalf("Expected at least 900 absent elements, got %d", len(absent))
+	}
+	for i, index := range f.TestBatchWithIndex(absent) {
+		if index != -1 {
+			t.Errorf("Expected -1 for %s, got %d", absent[i], index)
+		}
+	}
+
+	if indexes := f.TestBatchWithIndex(nil); len(indexes) != 0 {
+		t.Errorf("Expected 0 indexes, got %d", len(indexes))
+	}
+}
+
+// Ensures that WithExpectedGenerations preallocates the slice of filters
+// without changing them, and that Reset keeps the capacity.
+func TestScalableBloomWithExpectedGenerations(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	f.Add([]byte(`a`))
+	first := f.filters[0]
+
+	if f.WithExpectedGenerations(32) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	if c := cap(f.filters); c != 32 {
+		t.Errorf("Expected capacity 32, got %d", c)
+	}
+
+	if len(f.filters) != 1 || f.filters[0] != first {
+		t.Error("Expected the filters to be kept")
+	}
+
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	// A smaller hint doesn't shrink the slice.
+	f.WithExpectedGenerations(2)
+	if c := cap(f.filters); c != 32 {
+		t.Errorf("Expected capacity 32, got %d", c)
+	}
+
+	f.Reset()
+	if c := cap(f.filters); c != 32 {
+		t.Errorf("Expected capacity 32, got %d", c)
+	}
+}
+
+// Ensures that ForEach visits each filter in order and stops when the function
+// returns false.
+func TestScalableBloomForEach(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	visited := 0
+	f.ForEach(func(index int, pbf *PartitionedBloomFilter) bool {
+		if index != visited {
+			t.Errorf("Expected index %d, got %d", visited, index)
+		}
+		if pbf != f.filters[index] {
+			t.Errorf("Expected filter %d to be the same instance", index)
+		}
+		visited++
+		return true
+	})
+	if visited != len(f.filters) {
+		t.Errorf("Expected %d filters, got %d", len(f.filters), visited)
+	}
+
+	// Find the first filter which isn't full.
+	first := -1
+	visited = 0
+	f.ForEach(func(index int, pbf *PartitionedBloomFilter) bool {
+		visited++
+		if pbf.EstimatedFillRatio() < f.p {
+			first = index
+			return false
+		}
+		return true
+	})
+	if first != len(f.filters)-1 {
+		t.Errorf("Expected %d, got %d", len(f.filters)-1, first)
+	}
+	if visited != first+1 {
+		t.Errorf("Expected %d filters, got %d", first+1, visited)
+	}
+
+	visited = 0
+	f.ForEach(func(int, *PartitionedBloomFilter) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("Expected 1 filter, got %d", visited)
+	}
+}
+
+// Ensures that Test returns the same results regardless of the order filters
+// are probed in.
+func TestScalableBloomTestNewestFirst(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.01, 0.8)
+	for i := 0; i < 2000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if f.TestNewestFirst(true) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+
+	for i := 0; i < 4000; i++ {
+		data := []byte(strconv.Itoa(i))
+		newest := f.TestNewestFirst(true).Test(data)
+		oldest := f.TestNewestFirst(false).Test(data)
+		if newest != oldest {
+			t.Errorf("Expected %v for %d, got %v", oldest, i, newest)
+		}
+	}
+}
+
+func BenchmarkScalableBloomAdd(b *testing.B) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(100000, 0.1, 0.8)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.Add(data[n])
+	}
+}
+
+func BenchmarkScalableBloomAddBatch(b *testing.B) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(100000, 0.1, 0.8)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	f.AddBatch(data)
+}
+
+func BenchmarkScalableBloomTest(b *testing.B) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(100000, 0.1, 0.8)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.Test(data[n])
+	}
+}
+
+func BenchmarkScalableBloomTestAndAdd(b *testing.B) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(100000, 0.1, 0.8)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.TestAndAdd(data[n])
+	}
+}
+
+func BenchmarkScalableBloomTestAndAddManyFilters(b *testing.B) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(1000, 0.1, 0.8)
+	for i := 0; i < 20000; i++ {
+		f.Add([]byte(strconv.Itoa(-i)))
+	}
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.TestAndAdd(data[n])
+	}
+}
+
+func BenchmarkScalableBloomGrowth(b *testing.B) {
+	benchmarkScalableBloomGrowth(b, 0)
+}
+
+func BenchmarkScalableBloomGrowthExpectedGenerations(b *testing.B) {
+	benchmarkScalableBloomGrowth(b, 64)
+}
+
+func benchmarkScalableBloomGrowth(b *testing.B, generations int) {
+	b.StopTimer()
+	data := make([][]byte, 5000)
+	for i := range data {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f := NewScalableBloomFilter(100, 0.1, 0.8).WithExpectedGenerations(generations)
+		for _, element := range data {
+			f.Add(element)
+		}
+	}
+}
+
+func BenchmarkScalableBloomTestRecentOldestFirst(b *testing.B) {
+	benchmarkScalableBloomTestRecent(b, false)
+}
+
+func BenchmarkScalableBloomTestRecentNewestFirst(b *testing.B) {
+	benchmarkScalableBloomTestRecent(b, true)
+}
+
+func benchmarkScalableBloomTestRecent(b *testing.B, newest bool) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(1000, 0.1, 0.8).TestNewestFirst(newest)
+	for i := 0; i < 20000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	// Skew tests towards the most recently added elements.
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(19999 - i%1000))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.Test(data[n])
+	}
+}
+
+func BenchmarkScalableBloomTestInto(b *testing.B) {
+	b.StopTimer()
+	f := NewScalableBloomFilter(100000, 0.1, 0.8)
+	scratch := NewHashScratch(fnv.New64())
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.TestInto(data[n], scratch)
+	}
+}
+
+// Ensures that an injected fill estimator drives growth and that a sampling
+// estimator grows near the same point as the default.
+func TestScalableBloomSetFillEstimator(t *testing.T) {
+	firstGrowth := func(f *ScalableBloomFilter) int {
+		for i := 0; i < 100000; i++ {
+			if _, grew := f.AddReportGrowth([]byte(strconv.Itoa(i))); grew {
+				return i
+			}
+		}
+		return -1
+	}
+
+	def := firstGrowth(NewScalableBloomFilter(1000, 0.01, 0.8))
+	if def < 0 {
+		t.Fatal("Expected the default filter to grow")
+	}
+
+	// Only counts every 16th set bit, as if sampling the bit array.
+	calls := 0
+	sampling := func(setBits, totalBits uint) float64 {
+		calls++
+		return float64(setBits/16*16) / float64(totalBits)
+	}
+	f := NewScalableBloomFilter(1000, 0.01, 0.8)
+	if f.SetFillEstimator(sampling) != f {
+		t.Error("Returned ScalableBloomFilter should be the same instance")
+	}
+	grew := firstGrowth(f)
+	if calls == 0 {
+		t.Error("Expected the estimator to be used")
+	}
+	if grew < def*9/10 || grew > def*11/10 {
+		t.Errorf("Expected growth near %d, got %d", def, grew)
+	}
+
+	// An estimator reporting a full filter grows on every addition.
+	full := NewScalableBloomFilter(1000, 0.01, 0.8).SetFillEstimator(func(uint, uint) float64 { return 1 })
+	for i := 0; i < 10; i++ {
+		full.Add([]byte(strconv.Itoa(i)))
+	}
+	if l := len(full.filters); l != 11 {
+		t.Errorf("Expected 11 filters, got %d", l)
+	}
+
+	// AddBatch consults the estimator for every element as well.
+	batch := NewScalableBloomFilter(1000, 0.01, 0.8).SetFillEstimator(func(uint, uint) float64 { return 1 })
+	elements := make([][]byte, 10)
+	for i := range elements {
+		elements[i] = []byte(strconv.Itoa(i))
+	}
+	batch.AddBatch(elements)
+	if l := len(batch.filters); l != 11 {
+		t.Errorf("Expected 11 filters, got %d", l)
+	}
+
+	// nil restores the default.
+	if grew := firstGrowth(NewScalableBloomFilter(1000, 0.01, 0.8).SetFillEstimator(sampling).SetFillEstimator(nil)); grew != def {
+		t.Errorf("Expected growth at %d, got %d", def, grew)
+	}
+}
+
+// Ensures that the zero value of ScalableBloomFilter is initialized with the
+// default parameters on first use through each entry point.
+func TestScalableBloomZeroValue(t *testing.T) {
+	def := NewDefaultScalableBloomFilter(defaultFPRate)
+
+	var f ScalableBloomFilter
+	if f.Test([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+	if k := f.K(); k != def.K() {
+		t.Errorf("Expected %d, got %d", def.K(), k)
+	}
+	if c := f.Capacity(); c != def.Capacity() {
+		t.Errorf("Expected %d, got %d", def.Capacity(), c)
+	}
+	if f.r != def.r || f.fp != def.fp || f.p != def.p || f.hint != def.hint || f.growth != def.growth {
+		t.Errorf("Expected the default parameters, got %+v", f)
+	}
+
+	entryPoints := map[string]func(f *ScalableBloomFilter){
+		"Add":               func(f *ScalableBloomFilter) { f.Add([]byte(`a`)) },
+		"TestAndAdd":        func(f *ScalableBloomFilter) { f.TestAndAdd([]byte(`a`)) },
+		"AddReportGrowth":   func(f *ScalableBloomFilter) { f.AddReportGrowth([]byte(`a`)) },
+		"AddBatch":          func(f *ScalableBloomFilter) { f.AddBatch([][]byte{[]byte(`a`)}) },
+		"AddWithHashes":     func(f *ScalableBloomFilter) { f.AddWithHashes(def.baseHashes([]byte(`a`))) },
+		"Reset":             func(f *ScalableBloomFilter) { f.Reset().Add([]byte(`a`)) },
+		"SetHash":           func(f *ScalableBloomFilter) { f.SetHash(fnv.New64()).Add([]byte(`a`)) },
+		"FillRatio":         func(f *ScalableBloomFilter) { f.FillRatio(); f.Add([]byte(`a`)) },
+		"RemainingCapacity": func(f *ScalableBloomFilter) { f.RemainingCapacity(); f.Add([]byte(`a`)) },
+		"TestInto": func(f *ScalableBloomFilter) {
+			f.TestInto([]byte(`b`), NewHashScratch(fnv.New64()))
+			f.Add([]byte(`a`))
+		},
+		"Reconfigure": func(f *ScalableBloomFilter) {
+			if _, err := f.Reconfigure(defaultFPRate, defaultRatio); err != nil {
+				t.Fatal(err)
+			}
+			f.Add([]byte(`a`))
+		},
+		"CanMerge": func(f *ScalableBloomFilter) {
+			if !CanMerge(f, &ScalableBloomFilter{}) {
+				t.Error("Expected zero values to be compatible")
+			}
+			f.Add([]byte(`a`))
+		},
+		"Merge": func(f *ScalableBloomFilter) {
+			var other ScalableBloomFilter
+			other.Add([]byte(`a`))
+			if err := f.Merge(&other); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"UnionScalable": func(f *ScalableBloomFilter) {
+			var other ScalableBloomFilter
+			union, err := UnionScalable(f, &other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if union.Test([]byte(`a`)) {
+				t.Error("`a` should not be a member")
+			}
+			f.Add([]byte(`a`))
+		},
+	}
+	for name, fn := range entryPoints {
+		var f ScalableBloomFilter
+		fn(&f)
+		if l := len(f.filters); l != 1 {
+			t.Errorf("%s: Expected 1 filter, got %d", name, l)
+		}
+		if !f.Test([]byte(`a`)) {
+			t.Errorf("%s: `a` should be a member", name)
+		}
+		if f.fp != defaultFPRate {
+			t.Errorf("%s: Expected %f, got %f", name, defaultFPRate, f.fp)
+		}
+	}
+
+	// Options set on the zero value are kept.
+	var g ScalableBloomFilter
+	g.SetSizeHint(100).WithElementRetention().Add([]byte(`a`))
+	if g.hint != 100 {
+		t.Errorf("Expected 100, got %d", g.hint)
+	}
+	if len(g.retained) != 1 {
+		t.Errorf("Expected 1 retained element, got %d", len(g.retained))
+	}
+
+	// The zero value grows like any other filter.
+	var h ScalableBloomFilter
+	for i := 0; i < 100000; i++ {
+		h.Add([]byte(strconv.Itoa(i)))
+	}
+	if len(h.filters) < 2 {
+		t.Errorf("Expected more than 1 filter, got %d", len(h.filters))
+	}
+}
+
+// Ensures that TrimEmpty removes the empty filters at the end of the series
+// and that the series continues correctly afterwards.
+func TestScalableBloomTrimEmpty(t *testing.T) {
+	f := NewScalableBloomFilter(10, 0.01, 0.8)
+	if removed := f.TrimEmpty(); removed != 0 {
+		t.Errorf("Expected 0, got %d", removed)
+	}
+
+	for i := 0; i < 30; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	filters := len(f.filters)
+	f.addFilter()
+	f.addFilter()
+
+	if removed := f.TrimEmpty(); removed != 2 {
+		t.Errorf("Expected 2, got %d", removed)
+	}
+	if l := len(f.filters); l != filters {
+		t.Errorf("Expected %d filters, got %d", filters, l)
+	}
+
+	// The series continues the same way as without trimming.
+	g := NewScalableBloomFilter(10, 0.01, 0.8)
+	for i := 0; i < 30; i++ {
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+	var fBuf, gBuf bytes.Buffer
+	if _, err := f.WriteTo(&fBuf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.WriteTo(&gBuf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fBuf.Bytes(), gBuf.Bytes()) {
+		t.Error("Expected the same filters as without trimming")
+	}
+
+	// At least one filter is kept.
+	f.Reset()
+	f.addFilter()
+	if removed := f.TrimEmpty(); removed != 1 {
+		t.Errorf("Expected 1, got %d", removed)
+	}
+	if l := len(f.filters); l != 1 {
+		t.Errorf("Expected 1 filter, got %d", l)
+	}
+}
+
+// Ensures that Merge ORs corresponding generations, appends the extra
+// generations of the other filter and returns an error if the filters can't
+// be merged.
+func TestScalableBloomMerge(t *testing.T) {
+	var (
+		f = NewScalableBloomFilter(10, 0.01, 0.8)
+		g = NewScalableBloomFilter(10, 0.01, 0.8)
+	)
+	for i := 0; i < 20; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+	for i := 100; i < 200; i++ {
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+	fGenerations, gGenerations := len(f.filters), len(g.filters)
+	if fGenerations >= gGenerations {
+		t.Fatalf("Expected fewer than %d generations, got %d", gGenerations, fGenerations)
+	}
+	firstBits := f.filters[0].SetBits()
+	union, err := UnionScalable(f, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Merge(g); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(f.filters); l != gGenerations {
+		t.Errorf("Expected %d generations, got %d", gGenerations, l)
+	}
+
+	for i := range f.filters {
+		if f.filters[i].K() != g.filters[i].K() {
+			t.Errorf("Expected generation %d to keep %d hash functions, got %d", i, g.filters[i].K(), f.filters[i].K())
+		}
+		if diff, equal := messagediff.PrettyDiff(union.filters[i].partitions, f.filters[i].partitions); !equal {
+			t.Errorf("Expected generation %d to be the union\n%s", i, diff)
+		}
+	}
+
+	if f.filters[0].SetBits() <= firstBits {
+		t.Error("Expected the first generation to gain bits")
+	}
+
+	for i := 0; i < 200; i++ {
+		if (i < 20 || i >= 100) && !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if count := f.Count(); count != 120 {
+		t.Errorf("Expected 120, got %d", count)
+	}
+
+	// The appended generations are copies.
+	last := f.filters[len(f.filters)-1]
+	bits := last.SetBits()
+	for i := 0; i < 10; i++ {
+		g.filters[len(g.filters)-1].Add([]byte(strconv.Itoa(1000 + i)))
+	}
+	if last.SetBits() != bits {
+		t.Error("Expected the appended generation to be a copy")
+	}
+
+	if err := f.Merge(NewScalableBloomFilter(10, 0.1, 0.8)); err == nil {
+		t.Error("Expected error")
+	}
+
+	if err := f.Merge(NewScalableBloomFilter(10, 0.01, 0.8).WithExactCount()); err == nil {
+		t.Error("Expected error")
+	}
+
+	if err := NewScalableBloomFilter(10, 0.01, 0.8).WithElementRetention().Merge(f); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that ContentHash only depends on the contents of the series of
+// filters and is stable across serialization.
+func TestScalableBloomContentHash(t *testing.T) {
+	var (
+		f = NewScalableBloomFilter(10, 0.01, 0.8)
+		g = NewScalableBloomFilter(10, 0.01, 0.8).WithElementRetention()
+	)
+	for i := 0; i < 30; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if f.ContentHash() != g.ContentHash() {
+		t.Error("Expected filters with the same elements to hash the same")
+	}
+
+	// Empty filters at the end of the series don't hold elements.
+	hash := f.ContentHash()
+	g.addFilter()
+	if g.ContentHash() != hash {
+		t.Error("Expected an empty filter not to change the hash")
+	}
+
+	data, err := f.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewScalableBloomFilter(100, 0.1, 0.9)
+	if err := decoded.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ContentHash() != hash {
+		t.Error("Expected the hash to be stable across serialization")
+	}
+
+	f.Add([]byte(`a`))
+	if f.ContentHash() == hash {
+		t.Error("Expected a new element to change the hash")
+	}
+
+	if NewScalableBloomFilter(10, 0.01, 0.8).ContentHash() == hash {
+		t.Error("Expected an empty filter to hash differently")
+	}
+}
+
+// Ensures that Load relates the number of items added to the designed
+// capacity of the series of filters.
+func TestScalableBloomLoad(t *testing.T) {
+	f := NewScalableBloomFilter(1000, 0.01, 0.8)
+	if load := f.Load(); load != 0 {
+		t.Errorf("Expected 0, got %f", load)
+	}
+
+	capacity := filterCapacity(f.filters[0].s, f.p)
+	for i := uint(0); i < capacity/4; i++ {
+		f.Add([]byte(strconv.Itoa(int(i))))
+	}
+	if load, expected := f.Load(), float64(capacity/4)/float64(capacity); load != expected {
+		t.Errorf("Expected %f, got %f", expected, load)
+	}
+
+	// Filling the first filter and growing adds the second filter's
+	// capacity.
+	for i := capacity / 4; i <= capacity; i++ {
+		f.Add([]byte(strconv.Itoa(int(i))))
+	}
+	if l := len(f.filters); l != 2 {
+		t.Fatalf("Expected 2 filters, got %d", l)
+	}
+	total := capacity + filterCapacity(f.filters[1].s, f.p)
+	if load, expected := f.Load(), float64(capacity+1)/float64(total); load != expected {
+		t.Errorf("Expected %f, got %f", expected, load)
+	}
+
+	// A degraded filter can be loaded beyond its capacity.
+	g := NewScalableBloomFilter(100, 0.01, 0.8).WithMemoryBudget(1)
+	for i := 0; i < 1000; i++ {
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+	if load := g.Load(); load <= 1 {
+		t.Errorf("Expected more than 1, got %f", load)
+	}
+}
+
+// Ensures that NewScalableBloomFilterFromFilter uses the given initial filter,
+// grows like a filter created with NewScalableBloomFilter and validates the
+// initial filter's parameters.
+func TestNewScalableBloomFilterFromFilter(t *testing.T) {
+	first := NewPartitionedBloomFilter(1000, 0.01)
+	for i := 0; i < 500; i++ {
+		first.Add([]byte(strconv.Itoa(i)))
+	}
+
+	f, err := NewScalableBloomFilterFromFilter(first, 0.01, 0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.filters[0] != first {
+		t.Error("Expected the initial filter to be used")
+	}
+
+	if _, s := f.generationSize(0); f.hint < 1000 || s != first.s {
+		t.Errorf("Expected a hint of at least 1000 sized like the filter, got %d", f.hint)
+	}
+
+	for i := 0; i < 500; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	g := NewScalableBloomFilter(f.hint, 0.01, 0.8)
+	for i := 0; i < 3000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+	if len(f.filters) < 2 {
+		t.Fatalf("Expected more than 1 filter, got %d", len(f.filters))
+	}
+	for i := 1; i < len(f.filters) && i < len(g.filters); i++ {
+		if f.filters[i].k != g.filters[i].k || f.filters[i].s != g.filters[i].s {
+			t.Errorf("Expected filter %d to have %d partitions of %d bits, got %d of %d",
+				i, g.filters[i].k, g.filters[i].s, f.filters[i].k, f.filters[i].s)
+		}
+	}
+
+	if _, err := NewScalableBloomFilterFromFilter(first, 0.1, 0.8); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := NewScalableBloomFilterFromFilter(first, 0.01, 1); err == nil {
+		t.Error("Expected error")
+	}
+
+	if _, err := NewScalableBloomFilterFromFilter(NewPartitionedBloomFilterFixedMemory(7, 7), 0.01, 0.8); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that CountConsideringOverlap matches Count for a filter which was
+// never merged and doesn't count elements in both merged filters twice.
+func TestScalableBloomCountConsideringOverlap(t *testing.T) {
+	f := NewScalableBloomFilter(1000, 0.01, 0.8)
+	g := NewScalableBloomFilter(1000, 0.01, 0.8)
+	for i := 0; i < 3000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+		g.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if count := f.CountConsideringOverlap(); count != f.Count() {
+		t.Errorf("Expected %d, got %d", f.Count(), count)
+	}
+
+	union, err := UnionScalable(f, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Merge(g); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := f.Count(); count != 6000 {
+		t.Errorf("Expected 6000, got %d", count)
+	}
+
+	for _, merged := range []*ScalableBloomFilter{f, union} {
+		if count := merged.CountConsideringOverlap(); count < 2850 || count > 3150 {
+			t.Errorf("Expected about 3000, got %d", count)
+		}
+	}
+
+	f.Reset()
+	f.Add([]byte(`a`))
+	if count := f.CountConsideringOverlap(); count != 1 {
+		t.Errorf("Expected 1, got %d", count)
+	}
+}
+
+// Ensures that OptimalTighteningRatio returns the paper's recommended ratios,
+// grows with the growth factor and stays between 0 and 1.
+func TestOptimalTighteningRatio(t *testing.T) {
+	if r := OptimalTighteningRatio(2); r != 0.8 {
+		t.Errorf("Expected 0.8, got %f", r)
+	}
+
+	if r := OptimalTighteningRatio(4); r != 0.9 {
+		t.Errorf("Expected 0.9, got %f", r)
+	}
+
+	prev := 0.0
+	for _, growth := range []float64{math.NaN(), -1, 0, 1, 1.5, 2, 2.5, 3, 3.5, 4, 8, 1e9, math.Inf(1)} {
+		r := OptimalTighteningRatio(growth)
+		if r <= 0 || r >= 1 {
+			t.Errorf("Expected a ratio between 0 and 1 for %f, got %f", growth, r)
+		}
+		if r < prev {
+			t.Errorf("Expected the ratio for %f to be at least %f, got %f", growth, prev, r)
+		}
+		prev = r
+	}
+}
+
+// Ensures that adding and testing prehashed elements matches adding and
+// testing the data, including with a partitioned filter which hashes the same
+// way, and that a Prehashed which wasn't created by Prehash is rejected.
+func TestScalableBloomPrehashed(t *testing.T) {
+	var (
+		f           = NewScalableBloomFilter(100, 0.01, 0.8)
+		g           = NewScalableBloomFilter(100, 0.01, 0.8)
+		partitioned = NewPartitionedBloomFilter(1000, 0.01)
+	)
+	for i := 0; i < 1000; i++ {
+		data := []byte(strconv.Itoa(i))
+		f.Add(data)
+		h := g.Prehash(data)
+		g.AddPrehashed(h)
+		partitioned.AddPrehashed(h)
+	}
+
+	if len(f.filters) != len(g.filters) {
+		t.Fatalf("Expected %d filters, got %d", len(f.filters), len(g.filters))
+	}
+	for i := range f.filters {
+		if f.filters[i].ContentHash() != g.filters[i].ContentHash() {
+			t.Errorf("Expected filter %d to match", i)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		data := []byte(strconv.Itoa(i))
+		h := f.Prehash(data)
+		if f.TestPrehashed(h) != f.Test(data) {
+			t.Errorf("Expected TestPrehashed to match Test for %d", i)
+		}
+		if partitioned.TestPrehashed(h) != partitioned.Test(data) {
+			t.Errorf("Expected TestPrehashed to match Test for %d on the partitioned filter", i)
+		}
+		if partitioned.Prehash(data) != h {
+			t.Errorf("Expected the same hashes for %d", i)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic")
+		}
+	}()
+	f.TestPrehashed(Prehashed{})
+}
+
+// Ensures that RebuildWithFPRate rebuilds the filter from its retained
+// elements with a measured false-positive rate within the new target, and that
+// it requires element retention.
+func TestScalableBloomRebuildWithFPRate(t *testing.T) {
+	f := NewScalableBloomFilter(100, 0.1, 0.8)
+	if _, err := f.RebuildWithFPRate(0.001); err == nil {
+		t.Error("Expected error")
+	}
+
+	f.WithElementRetention()
+	for i := 0; i < 5000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if _, err := f.RebuildWithFPRate(0); err == nil {
+		t.Error("Expected error")
+	}
+
+	rebuilt, err := f.RebuildWithFPRate(0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rebuilt.filters) != 1 {
+		t.Errorf("Expected 1 filter, got %d", len(rebuilt.filters))
+	}
+
+	if count := rebuilt.Count(); count != 5000 {
+		t.Errorf("Expected 5000, got %d", count)
+	}
+
+	for i := 0; i < 5000; i++ {
+		if !rebuilt.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if rate := f.MeasureFalsePositiveRate(100000, 1); rate < 0.01 {
+		t.Errorf("Expected the original rate to be at least 0.01, got %f", rate)
+	}
+
+	if rate := rebuilt.MeasureFalsePositiveRate(1000000, 1); rate > 0.001 {
+		t.Errorf("Expected a rate of at most 0.001, got %f", rate)
+	}
+
+	// Retention carries over, so the rebuilt filter can be rebuilt again.
+	if len(rebuilt.retained) != 5000 {
+		t.Errorf("Expected 5000 retained elements, got %d", len(rebuilt.retained))
 	}
 }
@@ -0,0 +1,243 @@
+package boom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// semiSortedEntries is the number of entries per bucket semi-sorting supports.
+const semiSortedEntries = 4
+
+var (
+	// nibbleCodes maps the index of a sorted combination of four 4-bit values
+	// to the combination, packed into 16 bits.
+	nibbleCodes []uint16
+
+	// nibbleIndices is the inverse of nibbleCodes.
+	nibbleIndices map[uint16]uint16
+
+	nibbleOnce sync.Once
+)
+
+// initNibbleCodes enumerates the 3876 sorted combinations of four 4-bit
+// values, which is what allows a semi-sorted bucket to store the high 4 bits
+// of its fingerprints in 12 bits rather than 16.
+func initNibbleCodes() {
+	nibbleIndices = make(map[uint16]uint16)
+	for a := uint16(0); a < 16; a++ {
+		for b := a; b < 16; b++ {
+			for c := b; c < 16; c++ {
+				for d := c; d < 16; d++ {
+					code := a<<12 | b<<8 | c<<4 | d
+					nibbleIndices[code] = uint16(len(nibbleCodes))
+					nibbleCodes = append(nibbleCodes, code)
+				}
+			}
+		}
+	}
+}
+
+// NewSemiSortedCuckooFilter creates a new Cuckoo Bloom filter optimized to
+// store n items with a specified target false-positive rate which uses the
+// semi-sorting buckets described in the Cuckoo Filter paper. The fingerprints
+// in each bucket are kept sorted, so the high 4 bits of the four fingerprints
+// can be encoded as one of 3876 sorted combinations in 12 bits instead of 16.
+// The bit saved per fingerprint is used to lengthen the fingerprints, which
+// roughly halves the false-positive rate at the same memory. In exchange,
+// every insert and removal decodes and re-encodes the bucket.
+func NewSemiSortedCuckooFilter(n uint, fpRate float64) *CuckooFilter {
+	nibbleOnce.Do(initNibbleCodes)
+
+	var (
+		b = uint(semiSortedEntries)
+		f = calculateF(b, fpRate)
+		m = power2(n / f * 8)
+	)
+
+	// Fingerprints are taken from a 32-bit hash.
+	fpBits := 8*f + 1
+	if fpBits > 32 {
+		fpBits = 32
+	}
+
+	return &CuckooFilter{
+		hash:       fnv.New32(),
+		m:          m,
+		b:          b,
+		f:          f,
+		n:          n,
+		semiSorted: true,
+		fpBits:     fpBits,
+		packed:     NewBuckets(m*uint(semiSortedBucketBits(f)), 1),
+	}
+}
+
+// semiSortedBucketBits returns the number of bits per semi-sorted bucket for
+// fingerprints of f bytes, which is the same as four unsorted fingerprints.
+func semiSortedBucketBits(f uint) uint32 {
+	return uint32(semiSortedEntries * 8 * f)
+}
+
+// SemiSorted returns true if the filter uses semi-sorting buckets.
+func (c *CuckooFilter) SemiSorted() bool {
+	return c.semiSorted
+}
+
+// semiSortedComponents returns the two hash values used to index into the
+// buckets and the fingerprint for the given element. A fingerprint of zero
+// marks an empty entry, so it's never returned.
+func (c *CuckooFilter) semiSortedComponents(data []byte) (uint, uint, uint32) {
+	var (
+		hash = binary.BigEndian.Uint32(c.computeHash(data))
+		f    = hash >> (32 - c.fpBits)
+		i1   = uint(hash)
+	)
+
+	if f == 0 {
+		f = 1
+	}
+
+	return i1, c.altIndex(i1, f), f
+}
+
+// altIndex returns the alternate bucket index for a fingerprint in the bucket
+// at index i.
+func (c *CuckooFilter) altIndex(i uint, f uint32) uint {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], f)
+	return i ^ uint(binary.BigEndian.Uint32(c.computeHash(buf[:])))
+}
+
+// readBucket decodes the fingerprints in the semi-sorted bucket at index i.
+func (c *CuckooFilter) readBucket(i uint) [semiSortedEntries]uint32 {
+	var (
+		fps        [semiSortedEntries]uint32
+		suffixBits = uint(c.fpBits - 4)
+		offset     = uint(i%c.m) * uint(semiSortedBucketBits(c.f))
+		code       = nibbleCodes[c.packed.getBits(offset, 12)]
+	)
+
+	offset += 12
+	for j := range fps {
+		nibble := uint32(code>>(12-4*uint(j))) & 0xf
+		fps[j] = nibble<<suffixBits | c.packed.getBits(offset, suffixBits)
+		offset += suffixBits
+	}
+	return fps
+}
+
+// writeBucket sorts and encodes the fingerprints into the semi-sorted bucket
+// at index i.
+func (c *CuckooFilter) writeBucket(i uint, fps [semiSortedEntries]uint32) {
+	sort.Slice(fps[:], func(a, b int) bool { return fps[a] < fps[b] })
+
+	var (
+		suffixBits = c.fpBits - 4
+		offset     = uint32(i%c.m) * semiSortedBucketBits(c.f)
+		code       uint16
+	)
+
+	for _, f := range fps {
+		code = code<<4 | uint16(f>>suffixBits)
+	}
+	c.packed.setBits(offset, 12, uint32(nibbleIndices[code]))
+
+	offset += 12
+	for _, f := range fps {
+		c.packed.setBits(offset, uint32(suffixBits), f&(1<<suffixBits-1))
+		offset += uint32(suffixBits)
+	}
+}
+
+// bucketContains indicates if the semi-sorted bucket at index i contains the
+// fingerprint.
+func (c *CuckooFilter) bucketContains(i uint, f uint32) bool {
+	for _, fp := range c.readBucket(i) {
+		if fp == f {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketInsert inserts the fingerprint into an empty entry of the semi-sorted
+// bucket at index i. It returns false if the bucket is full.
+func (c *CuckooFilter) bucketInsert(i uint, f uint32) bool {
+	fps := c.readBucket(i)
+	for j, fp := range fps {
+		if fp == 0 {
+			fps[j] = f
+			c.writeBucket(i, fps)
+			return true
+		}
+	}
+	return false
+}
+
+// bucketRemove removes the fingerprint from the semi-sorted bucket at index i.
+// It returns false if the bucket doesn't contain it.
+func (c *CuckooFilter) bucketRemove(i uint, f uint32) bool {
+	fps := c.readBucket(i)
+	for j, fp := range fps {
+		if fp == f {
+			fps[j] = 0
+			c.writeBucket(i, fps)
+			return true
+		}
+	}
+	return false
+}
+
+// testSemiSorted is Test for semi-sorted filters.
+func (c *CuckooFilter) testSemiSorted(data []byte) bool {
+	i1, i2, f := c.semiSortedComponents(data)
+	return c.bucketContains(i1, f) || c.bucketContains(i2, f)
+}
+
+// testAndAddSemiSorted is TestAndAdd for semi-sorted filters.
+func (c *CuckooFilter) testAndAddSemiSorted(data []byte) (bool, error) {
+	i1, i2, f := c.semiSortedComponents(data)
+	if c.bucketContains(i1, f) || c.bucketContains(i2, f) {
+		return true, nil
+	}
+	return false, c.addSemiSorted(i1, i2, f)
+}
+
+// testAndRemoveSemiSorted is TestAndRemove for semi-sorted filters.
+func (c *CuckooFilter) testAndRemoveSemiSorted(data []byte) bool {
+	i1, i2, f := c.semiSortedComponents(data)
+	if c.bucketRemove(i1, f) || c.bucketRemove(i2, f) {
+		c.count--
+		return true
+	}
+	return false
+}
+
+// addSemiSorted will insert the fingerprint into the semi-sorted filter
+// returning an error if the filter is full.
+func (c *CuckooFilter) addSemiSorted(i1, i2 uint, f uint32) error {
+	if c.bucketInsert(i1, f) || c.bucketInsert(i2, f) {
+		c.count++
+		return nil
+	}
+
+	// Must relocate existing items.
+	i := i1
+	for n := 0; n < maxNumKicks; n++ {
+		fps := c.readBucket(i)
+		entryIdx := rand.Intn(int(c.b))
+		f, fps[entryIdx] = fps[entryIdx], f
+		c.writeBucket(i, fps)
+		i = c.altIndex(i, f)
+		if c.bucketInsert(i, f) {
+			c.count++
+			return nil
+		}
+	}
+
+	return errors.New("full")
+}
@@ -0,0 +1,142 @@
+package boom
+
+import (
+	"errors"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// SignedCountMinSketch implements a Count-Min Sketch with signed counters,
+// which supports the turnstile stream model where item frequencies can be
+// decremented as well as incremented. This is useful for windowed counting,
+// where items leaving the window are subtracted from the sketch.
+//
+// With negative updates, the minimum of an item's counters is no longer an
+// upper bound on its frequency, so the frequency is instead estimated by
+// taking the median of the item's respective counter values as described by
+// Cormode and Muthukrishnan in An Improved Data Stream Summary: The Count-Min
+// Sketch and its Applications:
+//
+// http://dimacs.rutgers.edu/~graham/pubs/papers/cm-full.pdf
+type SignedCountMinSketch struct {
+	matrix  [][]int64   // count matrix
+	width   uint        // matrix width
+	depth   uint        // matrix depth
+	count   int64       // net sum of all updates
+	epsilon float64     // relative-accuracy factor
+	delta   float64     // relative-accuracy probability
+	hash    hash.Hash64 // hash function (kernel for all depth functions)
+	row     []int64     // buffer used to compute the median
+}
+
+// NewSignedCountMinSketch creates a new signed Count-Min Sketch whose relative
+// accuracy is within a factor of epsilon with probability delta. Both of these
+// parameters affect the space and time complexity.
+func NewSignedCountMinSketch(epsilon, delta float64) *SignedCountMinSketch {
+	var (
+		width  = uint(math.Ceil(math.E / epsilon))
+		depth  = uint(math.Ceil(math.Log(1 / delta)))
+		matrix = make([][]int64, depth)
+	)
+
+	for i := uint(0); i < depth; i++ {
+		matrix[i] = make([]int64, width)
+	}
+
+	return &SignedCountMinSketch{
+		matrix:  matrix,
+		width:   width,
+		depth:   depth,
+		epsilon: epsilon,
+		delta:   delta,
+		hash:    fnv.New64(),
+		row:     make([]int64, depth),
+	}
+}
+
+// Epsilon returns the relative-accuracy factor, epsilon.
+func (c *SignedCountMinSketch) Epsilon() float64 {
+	return c.epsilon
+}
+
+// Delta returns the relative-accuracy probability, delta.
+func (c *SignedCountMinSketch) Delta() float64 {
+	return c.delta
+}
+
+// TotalCount returns the net sum of all updates applied to the sketch.
+func (c *SignedCountMinSketch) TotalCount() int64 {
+	return c.count
+}
+
+// Add will add n to the frequency of the data. A negative n decrements the
+// frequency. Returns the SignedCountMinSketch to allow for chaining.
+func (c *SignedCountMinSketch) Add(data []byte, n int64) *SignedCountMinSketch {
+	lower, upper := hashKernel(data, c.hash)
+
+	// Update count in each row.
+	for i := uint(0); i < c.depth; i++ {
+		c.matrix[i][(uint(lower)+uint(upper)*i)%c.width] += n
+	}
+
+	c.count += n
+	return c
+}
+
+// Count returns the approximate frequency of the specified item, taken as the
+// median of its counters across all rows.
+func (c *SignedCountMinSketch) Count(data []byte) int64 {
+	lower, upper := hashKernel(data, c.hash)
+
+	for i := uint(0); i < c.depth; i++ {
+		c.row[i] = c.matrix[i][(uint(lower)+uint(upper)*i)%c.width]
+	}
+	sort.Slice(c.row, func(i, j int) bool { return c.row[i] < c.row[j] })
+
+	mid := c.depth / 2
+	if c.depth%2 == 1 {
+		return c.row[mid]
+	}
+	return (c.row[mid-1] + c.row[mid]) / 2
+}
+
+// Merge combines this SignedCountMinSketch with another. Returns an error if
+// the matrix width and depth are not equal.
+func (c *SignedCountMinSketch) Merge(other *SignedCountMinSketch) error {
+	if c.depth != other.depth {
+		return errors.New("matrix depth must match")
+	}
+
+	if c.width != other.width {
+		return errors.New("matrix width must match")
+	}
+
+	for i := uint(0); i < c.depth; i++ {
+		for j := uint(0); j < c.width; j++ {
+			c.matrix[i][j] += other.matrix[i][j]
+		}
+	}
+
+	c.count += other.count
+	return nil
+}
+
+// Reset restores the SignedCountMinSketch to its original state. It returns
+// itself to allow for chaining.
+func (c *SignedCountMinSketch) Reset() *SignedCountMinSketch {
+	matrix := make([][]int64, c.depth)
+	for i := uint(0); i < c.depth; i++ {
+		matrix[i] = make([]int64, c.width)
+	}
+
+	c.matrix = matrix
+	c.count = 0
+	return c
+}
+
+// SetHash sets the hashing function used.
+func (c *SignedCountMinSketch) SetHash(h hash.Hash64) {
+	c.hash = h
+}
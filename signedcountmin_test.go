@@ -0,0 +1,166 @@
+package boom
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Ensures that TotalCount returns the net sum of all updates.
+func TestSignedCMSTotalCount(t *testing.T) {
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+
+	for i := 0; i < 100; i++ {
+		cms.Add([]byte(strconv.Itoa(i)), 2)
+	}
+	cms.Add([]byte(`a`), -50)
+
+	if count := cms.TotalCount(); count != 150 {
+		t.Errorf("expected 150, got %d", count)
+	}
+}
+
+// Ensures that Add increments and decrements frequencies and Count returns
+// the correct approximation.
+func TestSignedCMSAddAndCount(t *testing.T) {
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+
+	if cms.Add([]byte(`a`), 3) != cms {
+		t.Error("Returned SignedCountMinSketch should be the same instance")
+	}
+
+	cms.Add([]byte(`b`), 2)
+	cms.Add([]byte(`a`), -1)
+	cms.Add([]byte(`c`), -4)
+
+	if count := cms.Count([]byte(`a`)); count != 2 {
+		t.Errorf("expected 2, got %d", count)
+	}
+
+	if count := cms.Count([]byte(`b`)); count != 2 {
+		t.Errorf("expected 2, got %d", count)
+	}
+
+	if count := cms.Count([]byte(`c`)); count != -4 {
+		t.Errorf("expected -4, got %d", count)
+	}
+
+	if count := cms.Count([]byte(`x`)); count != 0 {
+		t.Errorf("expected 0, got %d", count)
+	}
+}
+
+// Ensures that Count tracks the final frequency of an item under mixed add
+// and remove traffic.
+func TestSignedCMSTurnstile(t *testing.T) {
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+
+	for i := 0; i < 100; i++ {
+		cms.Add([]byte(`a`), 1)
+		for j := 0; j < 50; j++ {
+			cms.Add([]byte(strconv.Itoa(i*50+j)), 3)
+		}
+		if i%5 < 2 {
+			cms.Add([]byte(`a`), -1)
+		}
+	}
+
+	// Remove everything except `a` and a residue of one per key.
+	for i := 0; i < 5000; i++ {
+		cms.Add([]byte(strconv.Itoa(i)), -2)
+	}
+
+	if count := cms.Count([]byte(`a`)); count < 60 || count > 65 {
+		t.Errorf("expected about 60, got %d", count)
+	}
+
+	for i := 0; i < 5000; i++ {
+		cms.Add([]byte(strconv.Itoa(i)), -1)
+	}
+
+	if count := cms.Count([]byte(`a`)); count != 60 {
+		t.Errorf("expected 60, got %d", count)
+	}
+
+	if count := cms.TotalCount(); count != 60 {
+		t.Errorf("expected 60, got %d", count)
+	}
+}
+
+// Ensures that Merge combines the two sketches.
+func TestSignedCMSMerge(t *testing.T) {
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+	cms.Add([]byte(`a`), 5)
+	cms.Add([]byte(`b`), 1)
+
+	other := NewSignedCountMinSketch(0.001, 0.01)
+	other.Add([]byte(`a`), -2)
+	other.Add([]byte(`c`), 1)
+
+	if err := cms.Merge(other); err != nil {
+		t.Error(err)
+	}
+
+	if count := cms.Count([]byte(`a`)); count != 3 {
+		t.Errorf("expected 3, got %d", count)
+	}
+
+	if count := cms.Count([]byte(`c`)); count != 1 {
+		t.Errorf("expected 1, got %d", count)
+	}
+
+	if err := cms.Merge(NewSignedCountMinSketch(0.01, 0.01)); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// Ensures that Reset restores the sketch to its original state.
+func TestSignedCMSReset(t *testing.T) {
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+	cms.Add([]byte(`a`), 5)
+	cms.Add([]byte(`b`), -1)
+
+	if cms.Reset() != cms {
+		t.Error("Returned SignedCountMinSketch should be the same instance")
+	}
+
+	for i := uint(0); i < cms.depth; i++ {
+		for j := uint(0); j < cms.width; j++ {
+			if x := cms.matrix[i][j]; x != 0 {
+				t.Errorf("expected matrix to be completely empty, got %d", x)
+			}
+		}
+	}
+
+	if count := cms.TotalCount(); count != 0 {
+		t.Errorf("expected 0, got %d", count)
+	}
+}
+
+func BenchmarkSignedCMSAdd(b *testing.B) {
+	b.StopTimer()
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		cms.Add(data[n], 1)
+	}
+}
+
+func BenchmarkSignedCMSCount(b *testing.B) {
+	b.StopTimer()
+	cms := NewSignedCountMinSketch(0.001, 0.01)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+		cms.Add([]byte(strconv.Itoa(i)), 1)
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		cms.Count(data[n])
+	}
+}
@@ -0,0 +1,343 @@
+package boom
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// SparsePartitionedBloomFilter is a PartitionedBloomFilter which stores the
+// indices of its set bits in a sorted slice rather than allocating the bit
+// array up front. Once the indices would take more memory than the bit array,
+// the filter converts itself to the dense representation. New indices are
+// collected in a set and merged into the slice in batches, so that an addition
+// doesn't shift the slice. Test and Add behave exactly like a
+// PartitionedBloomFilter's, so the filter reports the same memberships in
+// either representation.
+//
+// Sparse filters are useful when allocating many filters of which most stay
+// nearly empty, since an empty sparse filter takes almost no memory.
+type SparsePartitionedBloomFilter struct {
+	filter    *PartitionedBloomFilter // parameters, and data once dense
+	bits      []uint64                // sorted indices of set bits while sparse
+	pending   map[uint64]struct{}     // indices of set bits not yet in bits
+	threshold int                     // bytes of indices which trigger conversion
+}
+
+// pendingIndexBytes approximates the memory taken by an index in the set of
+// pending indices, which is several times the 8 bytes of an index in the
+// sorted slice once the hash table's metadata and free slots are included.
+const pendingIndexBytes = 24
+
+// NewSparsePartitionedBloomFilter creates a new sparse partitioned Bloom
+// filter optimized to store n items with a specified target false-positive
+// rate.
+func NewSparsePartitionedBloomFilter(n uint, fpRate float64) *SparsePartitionedBloomFilter {
+	var (
+		m = OptimalM(n, fpRate)
+		k = OptimalK(fpRate)
+		s = partitionSize(m, k)
+	)
+
+	return &SparsePartitionedBloomFilter{
+		filter: &PartitionedBloomFilter{
+			hash:    fnv.New64(),
+			m:       k * s,
+			k:       k,
+			s:       s,
+			mapping: fastRangeIndex,
+		},
+		// Conversion happens once the indices take more memory than the k
+		// partitions of s bits.
+		threshold: int(k * ((s + 7) / 8)),
+	}
+}
+
+// Capacity returns the Bloom filter capacity, m.
+func (p *SparsePartitionedBloomFilter) Capacity() uint {
+	return p.filter.Capacity()
+}
+
+// K returns the number of hash functions.
+func (p *SparsePartitionedBloomFilter) K() uint {
+	return p.filter.K()
+}
+
+// Count returns the number of items added to the filter.
+func (p *SparsePartitionedBloomFilter) Count() uint {
+	return p.filter.Count()
+}
+
+// Sparse returns true if the filter still uses the sparse representation.
+func (p *SparsePartitionedBloomFilter) Sparse() bool {
+	return p.filter.partitions == nil
+}
+
+// Test will test for membership of the data and returns true if it is a
+// member, false if not. This is a probabilistic test, meaning there is a
+// non-zero probability of false positives but a zero probability of false
+// negatives.
+func (p *SparsePartitionedBloomFilter) Test(data []byte) bool {
+	return p.testHashes(p.filter.baseHashes(data))
+}
+
+// Add will add the data to the Bloom filter. It returns the filter to allow
+// for chaining.
+func (p *SparsePartitionedBloomFilter) Add(data []byte) Filter {
+	p.addHashes(p.filter.baseHashes(data))
+	return p
+}
+
+// TestAndAdd is equivalent to calling Test followed by Add. It returns true if
+// the data is a member, false if not.
+func (p *SparsePartitionedBloomFilter) TestAndAdd(data []byte) bool {
+	lower, upper := p.filter.baseHashes(data)
+	member := p.testHashes(lower, upper)
+	p.addHashes(lower, upper)
+	return member
+}
+
+// testHashes tests for membership of the element with the given base hashes.
+func (p *SparsePartitionedBloomFilter) testHashes(lower, upper uint64) bool {
+	if !p.Sparse() {
+		return p.filter.testHashes(lower, upper)
+	}
+
+	lower, upper = p.filter.seedHashes(lower, upper)
+	for i := uint(0); i < p.filter.k; i++ {
+		if !p.has(p.bit(lower, upper, i)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// has returns true if the bit with the given index is set while sparse.
+func (p *SparsePartitionedBloomFilter) has(bit uint64) bool {
+	if _, ok := p.pending[bit]; ok {
+		return true
+	}
+	j := sort.Search(len(p.bits), func(j int) bool { return p.bits[j] >= bit })
+	return j < len(p.bits) && p.bits[j] == bit
+}
+
+// addHashes adds the element with the given base hashes to the filter,
+// converting it to the dense representation if it has become too full.
+func (p *SparsePartitionedBloomFilter) addHashes(lower, upper uint64) {
+	if !p.Sparse() {
+		p.filter.addHashes(lower, upper)
+		return
+	}
+
+	lower, upper = p.filter.seedHashes(lower, upper)
+	for i := uint(0); i < p.filter.k; i++ {
+		bit := p.bit(lower, upper, i)
+		if p.has(bit) {
+			continue
+		}
+		if p.pending == nil {
+			p.pending = make(map[uint64]struct{})
+		}
+		p.pending[bit] = struct{}{}
+	}
+	p.filter.count++
+
+	switch {
+	case p.indexBytes() > p.threshold:
+		p.densify()
+	case len(p.pending) > 8+len(p.bits)/8:
+		// Merging in batches of a fraction of the slice keeps the amortized
+		// cost of an addition logarithmic.
+		p.merge()
+	}
+}
+
+// indexBytes returns the approximate memory taken by the indices of the set
+// bits while sparse.
+func (p *SparsePartitionedBloomFilter) indexBytes() int {
+	return 8*len(p.bits) + pendingIndexBytes*len(p.pending)
+}
+
+// merge moves the pending indices into the sorted slice.
+func (p *SparsePartitionedBloomFilter) merge() {
+	if len(p.pending) == 0 {
+		return
+	}
+	for bit := range p.pending {
+		p.bits = append(p.bits, bit)
+	}
+	sort.Slice(p.bits, func(i, j int) bool { return p.bits[i] < p.bits[j] })
+	p.pending = nil
+}
+
+// bit returns the index of the bit in partition i across all partitions.
+func (p *SparsePartitionedBloomFilter) bit(lower, upper uint64, i uint) uint64 {
+	return uint64(i)*uint64(p.filter.s) + uint64(p.filter.index(lower, upper, i))
+}
+
+// densify converts the filter to the dense representation.
+func (p *SparsePartitionedBloomFilter) densify() {
+	p.merge()
+	partitions := make([]*Buckets, p.filter.k)
+	for i := range partitions {
+		partitions[i] = NewBuckets(p.filter.s, 1)
+	}
+	for _, bit := range p.bits {
+		partitions[bit/uint64(p.filter.s)].Set(uint(bit%uint64(p.filter.s)), 1)
+	}
+	p.filter.partitions = partitions
+	p.bits = nil
+}
+
+// Reset restores the Bloom filter to its original, sparse state. It returns
+// the filter to allow for chaining.
+func (p *SparsePartitionedBloomFilter) Reset() *SparsePartitionedBloomFilter {
+	p.filter.partitions = nil
+	p.filter.count = 0
+	p.bits = nil
+	p.pending = nil
+	return p
+}
+
+// SetHash sets the hashing function used in the filter.
+// For the effect on false positive rates see: https://github.com/tylertreat/BoomFilters/pull/1
+func (p *SparsePartitionedBloomFilter) SetHash(h hash.Hash64) {
+	p.filter.SetHash(h)
+}
+
+// WriteTo writes a binary representation of the SparsePartitionedBloomFilter
+// to an i/o stream, keeping its current representation. While sparse, the
+// indices of the set bits are written as gaps from the previous index. It
+// returns the number of bytes written.
+func (p *SparsePartitionedBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	e := newEncoder(stream)
+	e.header()
+	e.uvarint(uint64(p.filter.m))
+	e.uvarint(uint64(p.filter.k))
+	e.uvarint(uint64(p.filter.s))
+	e.uvarint(uint64(p.filter.count))
+	e.uint64(p.filter.seed)
+	e.byte(p.filter.mapping)
+	if p.Sparse() {
+		p.merge()
+		e.byte(sparseBuckets)
+		e.uvarint(uint64(len(p.bits)))
+		prev := uint64(0)
+		for _, bit := range p.bits {
+			e.uvarint(bit - prev)
+			prev = bit
+		}
+	} else {
+		e.byte(denseBuckets)
+		for _, partition := range p.filter.partitions {
+			partition.encode(e)
+		}
+	}
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of SparsePartitionedBloomFilter
+// (such as might have been written by WriteTo()) from an i/o stream. It
+// returns the number of bytes read.
+func (p *SparsePartitionedBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	d, _, err := readHeader(stream)
+	if err != nil {
+		return 0, err
+	}
+	if d == nil {
+		return 0, errors.New("invalid format header")
+	}
+
+	var (
+		m          = d.uvarint()
+		k          = d.length(ptrSize)
+		s          = d.uvarint()
+		count      = d.uvarint()
+		seed       = d.uint64()
+		mapping    = d.indexMapping()
+		encoding   = d.byte()
+		bits       []uint64
+		partitions []*Buckets
+	)
+	if d.err == nil {
+		d.err = checkPartitions(nil, k, s)
+	}
+
+	switch {
+	case d.err != nil:
+	case encoding == sparseBuckets:
+		n := d.length(8)
+		c := n
+		if c > decodeChunkSize/8 {
+			c = decodeChunkSize / 8
+		}
+		bits = make([]uint64, 0, c)
+		bit := uint64(0)
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			gap := d.uvarint()
+			if i > 0 && gap == 0 {
+				d.err = errors.New("bit indices must be increasing")
+			}
+			bit += gap
+			if bit >= k*s {
+				d.err = errors.New("bit index out of range")
+			}
+			bits = append(bits, bit)
+		}
+	case encoding == denseBuckets:
+		partitions = make([]*Buckets, k)
+		for i := range partitions {
+			partitions[i] = &Buckets{}
+			partitions[i].decode(d)
+			if d.err != nil {
+				break
+			}
+		}
+		if d.err == nil {
+			d.err = checkPartitions(partitions, k, s)
+		}
+	default:
+		d.err = errors.New("invalid encoding")
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if p.filter == nil {
+		p.filter = &PartitionedBloomFilter{hash: fnv.New64()}
+	}
+	p.filter.m = uint(m)
+	p.filter.k = uint(k)
+	p.filter.s = uint(s)
+	p.filter.count = uint(count)
+	p.filter.seed = seed
+	p.filter.mapping = mapping
+	p.filter.partitions = partitions
+	p.bits = bits
+	p.pending = nil
+	p.threshold = int(p.filter.k * ((p.filter.s + 7) / 8))
+	return d.n, nil
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (p *SparsePartitionedBloomFilter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := p.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder interface.
+func (p *SparsePartitionedBloomFilter) GobDecode(data []byte) error {
+	buf := bytes.NewBuffer(data)
+	_, err := p.ReadFrom(buf)
+
+	return err
+}
@@ -0,0 +1,234 @@
+package boom
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+	"testing"
+)
+
+// Ensures that TestAndAdd behaves correctly.
+func TestSparsePartitionedBloomTestAndAdd(t *testing.T) {
+	f := NewSparsePartitionedBloomFilter(1000, 0.01)
+
+	// `a` isn't in the filter.
+	if f.TestAndAdd([]byte(`a`)) {
+		t.Error("`a` should not be a member")
+	}
+
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	// `a` is now in the filter.
+	if !f.TestAndAdd([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+
+	// `b` isn't in the filter.
+	if f.TestAndAdd([]byte(`b`)) {
+		t.Error("`b` should not be a member")
+	}
+
+	if f.Add([]byte(`x`)) != f {
+		t.Error("Returned SparsePartitionedBloomFilter should be the same instance")
+	}
+
+	if count := f.Count(); count != 4 {
+		t.Errorf("Expected 4, got %d", count)
+	}
+
+	if !f.Sparse() {
+		t.Error("Expected filter to be sparse")
+	}
+}
+
+// Ensures that the filter converts to the dense representation once sparse
+// storage would exceed the bit array, with the same bits as an equivalent
+// PartitionedBloomFilter before and after conversion.
+func TestSparsePartitionedBloomConversion(t *testing.T) {
+	var (
+		f     = NewSparsePartitionedBloomFilter(1000, 0.01)
+		dense = NewPartitionedBloomFilter(1000, 0.01)
+	)
+
+	converted := -1
+	for i := 0; i < 1000; i++ {
+		data := []byte(strconv.Itoa(i))
+		f.Add(data)
+		dense.Add(data)
+		if converted < 0 && !f.Sparse() {
+			converted = i
+		}
+		if f.Sparse() && f.indexBytes() > int(f.filter.k*((f.filter.s+7)/8)) {
+			t.Fatalf("Expected conversion once %d bytes of indices exceed the bit array", f.indexBytes())
+		}
+	}
+
+	if converted < 0 {
+		t.Fatal("Expected filter to become dense")
+	}
+
+	if len(f.filter.partitions) != len(dense.partitions) {
+		t.Fatalf("Expected %d partitions, got %d", len(dense.partitions), len(f.filter.partitions))
+	}
+
+	for i, partition := range f.filter.partitions {
+		if !bytes.Equal(partition.data, dense.partitions[i].data) {
+			t.Errorf("Expected partition %d to match", i)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		data := []byte(strconv.Itoa(i))
+		if f.Test(data) != dense.Test(data) {
+			t.Errorf("Expected Test(%d) to match the dense filter", i)
+		}
+	}
+
+	if f.Reset() != f {
+		t.Error("Returned SparsePartitionedBloomFilter should be the same instance")
+	}
+
+	if !f.Sparse() || f.Count() != 0 || f.Test([]byte(`0`)) {
+		t.Error("Expected an empty sparse filter")
+	}
+}
+
+// Ensures that indices pending a merge into the sorted slice are tested and
+// encoded like merged ones.
+func TestSparsePartitionedBloomPending(t *testing.T) {
+	var (
+		f     = NewSparsePartitionedBloomFilter(100000, 0.01)
+		dense = NewPartitionedBloomFilter(100000, 0.01)
+	)
+
+	for i := 0; i < 1000; i++ {
+		data := []byte(strconv.Itoa(i))
+		f.Add(data)
+		dense.Add(data)
+	}
+
+	if !f.Sparse() {
+		t.Fatal("Expected filter to be sparse")
+	}
+
+	if len(f.pending) == 0 {
+		t.Fatal("Expected pending indices")
+	}
+
+	for i := 0; i < 2000; i++ {
+		data := []byte(strconv.Itoa(i))
+		if f.Test(data) != dense.Test(data) {
+			t.Errorf("Expected Test(%d) to match the dense filter", i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	g := NewSparsePartitionedBloomFilter(10, 0.1)
+	if _, err := g.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(g.bits); i++ {
+		if g.bits[i] <= g.bits[i-1] {
+			t.Fatalf("Expected increasing indices, got %d after %d", g.bits[i], g.bits[i-1])
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		data := []byte(strconv.Itoa(i))
+		if g.Test(data) != dense.Test(data) {
+			t.Errorf("Expected Test(%d) to match the dense filter", i)
+		}
+	}
+}
+
+// Ensures that a sparse filter with few items uses much less memory than a
+// dense filter.
+func TestSparsePartitionedBloomMemory(t *testing.T) {
+	var (
+		f     = NewSparsePartitionedBloomFilter(100000, 0.01)
+		dense = NewPartitionedBloomFilter(100000, 0.01)
+	)
+
+	for i := 0; i < 100; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	denseBytes := 0
+	for _, partition := range dense.partitions {
+		denseBytes += cap(partition.data)
+	}
+	sparseBytes := 8 * (cap(f.bits) + len(f.pending))
+
+	if !f.Sparse() {
+		t.Fatal("Expected filter to be sparse")
+	}
+
+	if sparseBytes*10 > denseBytes {
+		t.Errorf("Expected at most %d bytes, got %d", denseBytes/10, sparseBytes)
+	}
+
+	for i := 0; i < 100; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+}
+
+// Ensures that SparsePartitionedBloomFilter can be serialized and
+// deserialized in either representation without losing members.
+func TestSparsePartitionedBloomGob(t *testing.T) {
+	for _, n := range []int{10, 1000} {
+		f := NewSparsePartitionedBloomFilter(1000, 0.01)
+		for i := 0; i < n; i++ {
+			f.Add([]byte(strconv.Itoa(i)))
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(f); err != nil {
+			t.Fatal(err)
+		}
+
+		f2 := &SparsePartitionedBloomFilter{}
+		if err := gob.NewDecoder(&buf).Decode(f2); err != nil {
+			t.Fatal(err)
+		}
+
+		if f2.Sparse() != f.Sparse() {
+			t.Errorf("Expected sparse to be %v", f.Sparse())
+		}
+
+		if f2.Count() != f.Count() || f2.K() != f.K() {
+			t.Errorf("Expected %d and %d, got %d and %d", f.Count(), f.K(), f2.Count(), f2.K())
+		}
+
+		for i := 0; i < n; i++ {
+			if !f2.Test([]byte(strconv.Itoa(i))) {
+				t.Errorf("Expected %d to be a member", i)
+			}
+		}
+
+		if f2.Test([]byte(`a`)) != f.Test([]byte(`a`)) {
+			t.Error("Expected `a` to have the same membership")
+		}
+	}
+}
+
+func BenchmarkSparsePartitionedBloomAdd(b *testing.B) {
+	b.StopTimer()
+	f := NewSparsePartitionedBloomFilter(100000, 0.1)
+	data := make([][]byte, b.N)
+	for i := 0; i < b.N; i++ {
+		data[i] = []byte(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		f.Add(data[n])
+	}
+}
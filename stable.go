@@ -3,6 +3,7 @@ package boom
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"hash"
 	"hash/fnv"
 	"io"
@@ -41,8 +42,13 @@ type StableBloomFilter struct {
 	k           uint        // number of hash functions
 	max         uint8       // cell max value
 	indexBuffer []uint      // buffer used to cache indices
+	paused      bool        // whether decay is paused
 }
 
+// MaxCellValue is the largest value a Stable Bloom Filter cell can hold, which
+// is reached with 8 bits allocated per cell.
+const MaxCellValue = math.MaxUint8
+
 // NewStableBloomFilter creates a new Stable Bloom Filter with m cells and d
 // bits allocated per cell optimized for the target false-positive rate. Use
 // NewDefaultStableFilter if you don't want to calculate d.
@@ -111,6 +117,71 @@ func (s *StableBloomFilter) P() uint {
 	return s.p
 }
 
+// CellHistogram returns the number of cells holding each value, indexed by
+// value. Values above the filter's cell max value are always zero. This shows
+// the decay distribution, which helps tune the number of bits per cell and the
+// false-positive rate.
+func (s *StableBloomFilter) CellHistogram() [MaxCellValue + 1]uint {
+	var histogram [MaxCellValue + 1]uint
+	for i := uint(0); i < s.m; i++ {
+		histogram[s.cells.Get(i)]++
+	}
+	return histogram
+}
+
+// MinCell returns the smallest cell value in the Stable Bloom Filter. A
+// minimum near the cell max value means the filter is saturated, i.e. decay
+// can't keep up with additions and the decay rate should be increased.
+func (s *StableBloomFilter) MinCell() uint8 {
+	min := s.max
+	for i := uint(0); i < s.m && min > 0; i++ {
+		if value := uint8(s.cells.Get(i)); value < min {
+			min = value
+		}
+	}
+	return min
+}
+
+// MaxCell returns the largest cell value in the Stable Bloom Filter.
+func (s *StableBloomFilter) MaxCell() uint8 {
+	max := uint8(0)
+	for i := uint(0); i < s.m && max < s.max; i++ {
+		if value := uint8(s.cells.Get(i)); value > max {
+			max = value
+		}
+	}
+	return max
+}
+
+// AvgCell returns the average cell value in the Stable Bloom Filter. An
+// average approaching the cell max value indicates the filter is saturating.
+func (s *StableBloomFilter) AvgCell() float64 {
+	sum := uint(0)
+	for i := uint(0); i < s.m; i++ {
+		sum += uint(s.cells.Get(i))
+	}
+	return float64(sum) / float64(s.m)
+}
+
+// WindowedDistinctCount returns the estimated number of distinct elements
+// currently alive in the Stable Bloom Filter, i.e. those whose cells haven't
+// decayed to zero. Since decay evicts elements which haven't been added
+// recently, this approximates the number of distinct elements in a sliding
+// window of recent additions, such as the number of active users. It applies
+// the fill-ratio estimator to the non-zero cells. An element which has
+// partially decayed still contributes its remaining live cells, so the
+// estimate is between the number of fully alive elements and the number with
+// any live cells.
+func (s *StableBloomFilter) WindowedDistinctCount() uint {
+	live := uint(0)
+	for i := uint(0); i < s.m; i++ {
+		if s.cells.Get(i) != 0 {
+			live++
+		}
+	}
+	return uint(math.Round(estimateCount(live, s.m) / float64(s.k)))
+}
+
 // StablePoint returns the limit of the expected fraction of zeros in the
 // Stable Bloom Filter when the number of iterations goes to infinity. When
 // this limit is reached, the Stable Bloom Filter is considered stable.
@@ -194,13 +265,45 @@ func (s *StableBloomFilter) Reset() *StableBloomFilter {
 	return s
 }
 
+// PauseDecay stops Add and TestAndAdd from decrementing cells, so a baseline
+// set can be loaded at full fidelity without evicting earlier inserts. While
+// paused, the filter behaves like a classic Bloom filter and fills up. The
+// stable point and false-positive bound only hold once decay is resumed and
+// the filter has had time to stabilize again. It returns the filter to allow
+// for chaining.
+func (s *StableBloomFilter) PauseDecay() *StableBloomFilter {
+	s.paused = true
+	return s
+}
+
+// ResumeDecay restores the streaming semantics stopped by PauseDecay. It
+// returns the filter to allow for chaining.
+func (s *StableBloomFilter) ResumeDecay() *StableBloomFilter {
+	s.paused = false
+	return s
+}
+
 // decrement will decrement a random cell and (p-1) adjacent cells by 1. This
 // is faster than generating p random numbers. Although the processes of
 // picking the p cells are not independent, each cell has a probability of p/m
 // for being picked at each iteration, which means the properties still hold.
+// If p is at least m, every cell is decremented p/m times at once rather than
+// wrapping around, which has the same effect since cells stop at zero.
 func (s *StableBloomFilter) decrement() {
+	if s.paused {
+		return
+	}
 	r := rand.Intn(int(s.m))
-	for i := uint(0); i < s.p; i++ {
+	if rounds := s.p / s.m; rounds > 0 {
+		// No cell holds more than 255.
+		if rounds > 256 {
+			rounds = 256
+		}
+		for i := uint(0); i < s.m; i++ {
+			s.cells.Increment(i, -int32(rounds))
+		}
+	}
+	for i := uint(0); i < s.p%s.m; i++ {
 		idx := (r + int(i)) % int(s.m)
 		s.cells.Increment(uint(idx), -1)
 	}
@@ -215,44 +318,84 @@ func (s *StableBloomFilter) SetHash(h hash.Hash64) {
 // WriteTo writes a binary representation of the StableBloomFilter to an i/o stream.
 // It returns the number of bytes written.
 func (s *StableBloomFilter) WriteTo(stream io.Writer) (int64, error) {
-	err := binary.Write(stream, binary.BigEndian, uint64(s.m))
-	if err != nil {
-		return 0, err
+	e := newEncoder(stream)
+	e.header()
+	e.uvarint(uint64(s.m))
+	e.uvarint(uint64(s.p))
+	e.uvarint(uint64(s.k))
+	e.byte(s.max)
+	e.uvarint(uint64(len(s.indexBuffer)))
+	for _, index := range s.indexBuffer {
+		e.uvarint(uint64(index))
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(s.p))
+	s.cells.encode(e)
+	return e.n, e.err
+}
+
+// ReadFrom reads a binary representation of StableBloomFilter (such as might
+// have been written by WriteTo()) from an i/o stream. It returns the number
+// of bytes read. Both the compact format and the original fixed-width format
+// can be read.
+func (s *StableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	d, legacy, err := readHeader(stream)
 	if err != nil {
 		return 0, err
 	}
-	err = binary.Write(stream, binary.BigEndian, uint64(s.k))
-	if err != nil {
-		return 0, err
+	if d == nil {
+		return s.readLegacy(legacy)
 	}
-	err = binary.Write(stream, binary.BigEndian, s.max)
-	if err != nil {
-		return 0, err
+
+	var (
+		m         = d.uvarint()
+		p         = d.uvarint()
+		k         = d.uvarint()
+		max       = d.byte()
+		bufferLen = d.length(uint64(binary.Size(uint64(0))))
+	)
+	if d.err != nil {
+		return 0, d.err
 	}
-	err = binary.Write(stream, binary.BigEndian, int64(len(s.indexBuffer)))
-	if err != nil {
-		return 0, err
+	indexBuffer := make([]uint, bufferLen)
+	for i := range indexBuffer {
+		indexBuffer[i] = uint(d.uvarint())
 	}
-	for _, index := range s.indexBuffer {
-		err = binary.Write(stream, binary.BigEndian, uint64(index))
-		if err != nil {
-			return 0, err
-		}
+	var cells Buckets
+	cells.decode(d)
+	if d.err == nil {
+		d.err = checkStable(&cells, m, k, max, bufferLen)
 	}
-	n, err := s.cells.WriteTo(stream)
-	if err != nil {
-		return 0, err
+	if d.err != nil {
+		return 0, d.err
 	}
-	return int64((3+len(s.indexBuffer))*binary.Size(uint64(0))) +
-		int64(1*binary.Size(uint8(0))) + int64(1*binary.Size(int64(0))) + n, err
+
+	s.m = uint(m)
+	s.p = uint(p)
+	s.k = uint(k)
+	s.max = max
+	s.indexBuffer = indexBuffer
+	s.cells = &cells
+	return d.n, nil
 }
 
-// ReadFrom reads a binary representation of StableBloomFilter (such as might
-// have been written by WriteTo()) from an i/o stream. It returns the number
-// of bytes read.
-func (s *StableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+// checkStable returns an error if the decoded cells of a StableBloomFilter
+// don't match its declared number of cells m and maximum cell value or its
+// index buffer doesn't hold one index per hash function.
+func checkStable(cells *Buckets, m, k uint64, max uint8, bufferLen uint64) error {
+	if m == 0 || uint64(cells.Count()) != m {
+		return errors.New("number of cells must match filter size")
+	}
+	if max != cells.MaxBucketValue() {
+		return errors.New("maximum cell value must match cell size")
+	}
+	if bufferLen != k {
+		return errors.New("index buffer must hold one index per hash function")
+	}
+	return nil
+}
+
+// readLegacy reads the original fixed-width binary representation of
+// StableBloomFilter from an i/o stream. It returns the number of bytes read.
+func (s *StableBloomFilter) readLegacy(stream io.Reader) (int64, error) {
 	var m, p, k, bufferLen uint64
 	var max uint8
 	err := binary.Read(stream, binary.BigEndian, &m)
@@ -275,6 +418,9 @@ func (s *StableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if err := checkDecodeSize(bufferLen, uint64(binary.Size(uint64(0)))); err != nil {
+		return 0, err
+	}
 	indexBuffer := make([]uint, bufferLen)
 	var index uint64
 	for i := range indexBuffer {
@@ -284,16 +430,21 @@ func (s *StableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
 		}
 		indexBuffer[i] = uint(index)
 	}
+	var cells Buckets
+	n, err := cells.readLegacy(stream)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkStable(&cells, m, k, max, bufferLen); err != nil {
+		return 0, err
+	}
+
 	s.m = uint(m)
 	s.p = uint(p)
 	s.k = uint(k)
 	s.max = max
 	s.indexBuffer = indexBuffer
-
-	n, err := s.cells.ReadFrom(stream)
-	if err != nil {
-		return 0, err
-	}
+	s.cells = &cells
 	return int64((3+len(s.indexBuffer))*binary.Size(uint64(0))) +
 		int64(1*binary.Size(uint8(0))) + int64(1*binary.Size(int64(0))) + n, nil
 }
@@ -106,6 +106,156 @@ func TestTestAndAdd(t *testing.T) {
 	}
 }
 
+// Ensures that decrementing more cells than the filter has decrements every
+// cell repeatedly, without looping p times.
+func TestStableDecrementWraps(t *testing.T) {
+	f := NewStableBloomFilter(10, 3, 0.01)
+	for i := 0; i < 10; i++ {
+		f.cells.Set(uint(i), uint8(i%8))
+	}
+	f.p = 25
+	f.decrement()
+	decremented := 0
+	for i := 0; i < 10; i++ {
+		v := f.cells.Get(uint(i))
+		switch {
+		case i%8 <= 2 && v == 0:
+		case v == uint32(i%8-2):
+		case v == uint32(i%8-3):
+			decremented++
+		default:
+			t.Errorf("Unexpected value %d of cell %d", v, i)
+		}
+	}
+	if decremented > 5 {
+		t.Errorf("Expected at most 5 cells decremented three times, got %d", decremented)
+	}
+
+	f.p = ^uint(0)
+	f.Add([]byte(`a`))
+	if !f.Test([]byte(`a`)) {
+		t.Error("`a` should be a member")
+	}
+	if set := 10 - f.CellHistogram()[0]; set > f.k {
+		t.Errorf("Expected at most %d cells set, got %d", f.k, set)
+	}
+}
+
+// Ensures that PauseDecay prevents Add from evicting elements and that
+// ResumeDecay restores eviction.
+func TestStablePauseDecay(t *testing.T) {
+	f := NewDefaultStableBloomFilter(10000, 0.01)
+	if f.PauseDecay() != f {
+		t.Error("Returned StableBloomFilter should be the same instance")
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if f.ResumeDecay() != f {
+		t.Error("Returned StableBloomFilter should be the same instance")
+	}
+
+	for i := 1000; i < 1000000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	evicted := 0
+	for i := 0; i < 1000; i++ {
+		if !f.Test([]byte(strconv.Itoa(i))) {
+			evicted++
+		}
+	}
+
+	if evicted < 900 {
+		t.Errorf("Expected most elements to be evicted, got %d", evicted)
+	}
+}
+
+// Ensures that CellHistogram returns the number of cells holding each value.
+func TestStableCellHistogram(t *testing.T) {
+	f := NewStableBloomFilter(1000, 3, 0.01).PauseDecay()
+
+	histogram := f.CellHistogram()
+	if histogram[0] != 1000 {
+		t.Errorf("Expected 1000, got %d", histogram[0])
+	}
+
+	for i := 0; i < 20; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	histogram = f.CellHistogram()
+	total := uint(0)
+	for _, n := range histogram {
+		total += n
+	}
+
+	if total != 1000 {
+		t.Errorf("Expected 1000, got %d", total)
+	}
+
+	if histogram[7] == 0 {
+		t.Error("Expected cells at max value")
+	}
+
+	for value := 8; value <= MaxCellValue; value++ {
+		if histogram[value] != 0 {
+			t.Errorf("Expected 0 cells with value %d, got %d", value, histogram[value])
+		}
+	}
+}
+
+// Ensures that MinCell, MaxCell and AvgCell aggregate the cell values and
+// detect a saturated filter.
+func TestStableCellAggregates(t *testing.T) {
+	f := NewStableBloomFilter(1000, 3, 0.01).PauseDecay()
+
+	if min := f.MinCell(); min != 0 {
+		t.Errorf("Expected 0, got %d", min)
+	}
+	if max := f.MaxCell(); max != 0 {
+		t.Errorf("Expected 0, got %d", max)
+	}
+	if avg := f.AvgCell(); avg != 0 {
+		t.Errorf("Expected 0, got %f", avg)
+	}
+
+	f.cells.Set(0, 2)
+	f.cells.Set(1, 6)
+	if min := f.MinCell(); min != 0 {
+		t.Errorf("Expected 0, got %d", min)
+	}
+	if max := f.MaxCell(); max != 6 {
+		t.Errorf("Expected 6, got %d", max)
+	}
+	if avg := f.AvgCell(); avg != 0.008 {
+		t.Errorf("Expected 0.008, got %f", avg)
+	}
+
+	// Saturate the filter, with all but one cell at the max value.
+	for i := uint(0); i < f.Cells(); i++ {
+		f.cells.Set(i, 7)
+	}
+	f.cells.Set(500, 5)
+	if min := f.MinCell(); min != 5 {
+		t.Errorf("Expected 5, got %d", min)
+	}
+	if max := f.MaxCell(); max != 7 {
+		t.Errorf("Expected 7, got %d", max)
+	}
+	if avg := f.AvgCell(); avg != 6.998 {
+		t.Errorf("Expected 6.998, got %f", avg)
+	}
+}
+
 // Ensures that StablePoint returns the expected fraction of zeros for large
 // iterations.
 func TestStablePoint(t *testing.T) {
@@ -153,6 +303,44 @@ func TestFalsePositiveRate(t *testing.T) {
 	}
 }
 
+// Ensures that WindowedDistinctCount estimates the number of distinct elements
+// without decay and tracks the distinct elements recently added with decay.
+func TestStableWindowedDistinctCount(t *testing.T) {
+	f := NewUnstableBloomFilter(100000, 0.01)
+	if count := f.WindowedDistinctCount(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(strconv.Itoa(i)))
+	}
+
+	if count := f.WindowedDistinctCount(); count < 950 || count > 1050 {
+		t.Errorf("Expected about 1000, got %d", count)
+	}
+
+	f = NewDefaultStableBloomFilter(10000, 0.01)
+
+	// 200 distinct elements are repeatedly added, keeping them alive.
+	for i := 0; i < 100000; i++ {
+		f.Add([]byte(strconv.Itoa(i % 200)))
+	}
+
+	if count := f.WindowedDistinctCount(); count < 150 || count > 220 {
+		t.Errorf("Expected about 200, got %d", count)
+	}
+
+	// Afterwards, only 50 other distinct elements are added, so the first 200
+	// decay out of the window.
+	for i := 0; i < 100000; i++ {
+		f.Add([]byte("b" + strconv.Itoa(i%50)))
+	}
+
+	if count := f.WindowedDistinctCount(); count < 35 || count > 60 {
+		t.Errorf("Expected about 50, got %d", count)
+	}
+}
+
 // Ensures that Reset sets every cell to zero.
 func TestReset(t *testing.T) {
 	f := NewDefaultStableBloomFilter(1000, 0.01)
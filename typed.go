@@ -0,0 +1,78 @@
+package boom
+
+import "encoding/binary"
+
+// TypedScalableBloomFilter is a ScalableBloomFilter of values of type T. Each
+// value is converted to bytes with the encoder given to the constructor, so
+// that callers don't need to encode values themselves. Two values are
+// considered the same element if their encodings are equal.
+type TypedScalableBloomFilter[T any] struct {
+	filter *ScalableBloomFilter // underlying filter
+	encode func(T) []byte       // converts values to elements
+}
+
+// NewTypedScalableBloomFilter creates a new Scalable Bloom Filter of values of
+// type T with the specified target false-positive rate and tightening ratio,
+// which encodes values with the given function. EncodeString and EncodeUint64
+// are provided for common types.
+func NewTypedScalableBloomFilter[T any](hint uint, fpRate, r float64, encode func(T) []byte) *TypedScalableBloomFilter[T] {
+	return &TypedScalableBloomFilter[T]{
+		filter: NewScalableBloomFilter(hint, fpRate, r),
+		encode: encode,
+	}
+}
+
+// Filter returns the underlying ScalableBloomFilter, e.g. for serialization.
+func (t *TypedScalableBloomFilter[T]) Filter() *ScalableBloomFilter {
+	return t.filter
+}
+
+// Capacity returns the current Scalable Bloom Filter capacity.
+func (t *TypedScalableBloomFilter[T]) Capacity() uint {
+	return t.filter.Capacity()
+}
+
+// Count returns the number of items added to the Scalable Bloom Filter.
+func (t *TypedScalableBloomFilter[T]) Count() uint {
+	return t.filter.Count()
+}
+
+// Test will test for membership of the value and returns true if it is a
+// member, false if not. This is a probabilistic test, meaning there is a
+// non-zero probability of false positives but a zero probability of false
+// negatives.
+func (t *TypedScalableBloomFilter[T]) Test(value T) bool {
+	return t.filter.Test(t.encode(value))
+}
+
+// Add will add the value to the Bloom filter. It returns the filter to allow
+// for chaining.
+func (t *TypedScalableBloomFilter[T]) Add(value T) *TypedScalableBloomFilter[T] {
+	t.filter.Add(t.encode(value))
+	return t
+}
+
+// TestAndAdd is equivalent to calling Test followed by Add. It returns true if
+// the value is a member, false if not.
+func (t *TypedScalableBloomFilter[T]) TestAndAdd(value T) bool {
+	return t.filter.TestAndAdd(t.encode(value))
+}
+
+// Reset restores the Bloom filter to its original state. It returns the filter
+// to allow for chaining.
+func (t *TypedScalableBloomFilter[T]) Reset() *TypedScalableBloomFilter[T] {
+	t.filter.Reset()
+	return t
+}
+
+// EncodeString encodes a string as its bytes.
+func EncodeString(s string) []byte {
+	return []byte(s)
+}
+
+// EncodeUint64 encodes an unsigned integer as 8 big-endian bytes.
+func EncodeUint64(x uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, x)
+	return data
+}
@@ -0,0 +1,70 @@
+package boom
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Ensures that TestAndAdd behaves correctly for string values.
+func TestTypedScalableBloomString(t *testing.T) {
+	f := NewTypedScalableBloomFilter(10, 0.01, 0.8, EncodeString)
+
+	// `a` isn't in the filter.
+	if f.TestAndAdd("a") {
+		t.Error("`a` should not be a member")
+	}
+
+	if !f.Test("a") {
+		t.Error("`a` should be a member")
+	}
+
+	if !f.Filter().Test([]byte(`a`)) {
+		t.Error("`a` should be a member of the underlying filter")
+	}
+
+	if f.Add("b") != f {
+		t.Error("Returned TypedScalableBloomFilter should be the same instance")
+	}
+
+	if f.Test("c") {
+		t.Error("`c` should not be a member")
+	}
+
+	if count := f.Count(); count != 2 {
+		t.Errorf("Expected 2, got %d", count)
+	}
+
+	if f.Reset() != f {
+		t.Error("Returned TypedScalableBloomFilter should be the same instance")
+	}
+
+	if f.Test("a") {
+		t.Error("`a` should not be a member")
+	}
+}
+
+// Ensures that values are encoded with the given encoder.
+func TestTypedScalableBloomEncoder(t *testing.T) {
+	f := NewTypedScalableBloomFilter(100, 0.01, 0.8, EncodeUint64)
+	for i := uint64(0); i < 1000; i++ {
+		f.Add(i)
+	}
+
+	for i := uint64(0); i < 1000; i++ {
+		if !f.Test(i) {
+			t.Errorf("Expected %d to be a member", i)
+		}
+	}
+
+	if f.Capacity() != f.Filter().Capacity() {
+		t.Errorf("Expected %d, got %d", f.Filter().Capacity(), f.Capacity())
+	}
+
+	g := NewTypedScalableBloomFilter(100, 0.01, 0.8, func(x int) []byte {
+		return []byte(strconv.Itoa(x))
+	})
+	g.Add(42)
+	if !g.Filter().Test([]byte(`42`)) {
+		t.Error("`42` should be a member of the underlying filter")
+	}
+}
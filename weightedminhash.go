@@ -0,0 +1,117 @@
+package boom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// WeightedMinHash estimates the weighted Jaccard similarity of weighted sets,
+// such as documents represented by their term frequencies, using the improved
+// consistent weighted sampling scheme described by Ioffe in Improved
+// Consistent Sampling, Weighted Minhash and L1 Sketching:
+//
+// https://static.googleusercontent.com/media/research.google.com/en//pubs/archive/36928.pdf
+//
+// The weighted Jaccard similarity of two sets is the sum of the smaller
+// weights of each element over the sum of the larger ones, so unlike MinHash
+// it accounts for how often each element occurs rather than only whether it
+// does. Each set is reduced to a fixed-size signature, and the fraction of
+// samples two signatures agree on estimates their similarity. Signatures are
+// only comparable if they were computed with the same number of samples and
+// seed.
+type WeightedMinHash struct {
+	k    int    // number of samples in a signature
+	seed uint64 // seed the sampling is derived from
+}
+
+// WeightedSignature is the signature of a weighted set computed by
+// WeightedMinHash.
+type WeightedSignature []weightedSample
+
+// weightedSample is the element selected by one sample of a signature and the
+// quantized weight it was selected at.
+type weightedSample struct {
+	element uint64 // hash of the selected element
+	t       int64  // quantized weight of the selected element
+}
+
+// NewWeightedMinHash creates a new WeightedMinHash which computes signatures
+// of k samples derived from the given seed. The standard error of the
+// similarity estimate is about 1/sqrt(k).
+func NewWeightedMinHash(k int, seed uint64) *WeightedMinHash {
+	return &WeightedMinHash{k: k, seed: seed}
+}
+
+// Signature returns the signature of the weighted set, which maps each element
+// to its weight. Elements whose weight isn't positive are ignored. It returns
+// nil if no element has a positive weight.
+func (w *WeightedMinHash) Signature(weights map[string]float64) WeightedSignature {
+	signature := make(WeightedSignature, w.k)
+	best := make([]float64, w.k)
+	for i := range best {
+		best[i] = math.Inf(1)
+	}
+
+	empty := true
+	for element, weight := range weights {
+		if !(weight > 0) || math.IsInf(weight, 1) {
+			continue
+		}
+		empty = false
+
+		h := fnv.New64a()
+		h.Write([]byte(element))
+		var (
+			sum  = h.Sum64()
+			logW = math.Log(weight)
+			base = mix64(sum ^ w.seed)
+		)
+		for i := 0; i < w.k; i++ {
+			var (
+				rng  = cwsRand(base + generationSeed(i+1))
+				r    = -math.Log(rng.next() * rng.next())
+				c    = -math.Log(rng.next() * rng.next())
+				beta = rng.next()
+				t    = math.Floor(logW/r + beta)
+				logA = math.Log(c) - r*(t-beta) - r
+			)
+			if logA < best[i] {
+				best[i] = logA
+				signature[i] = weightedSample{element: sum, t: int64(t)}
+			}
+		}
+	}
+
+	if empty {
+		return nil
+	}
+	return signature
+}
+
+// Similarity returns the estimated weighted Jaccard similarity of the sets
+// the signatures were computed from, between 0 and 1. It returns 0 if either
+// signature is empty or they have different numbers of samples.
+func (s WeightedSignature) Similarity(other WeightedSignature) float64 {
+	if len(s) == 0 || len(s) != len(other) {
+		return 0
+	}
+
+	matches := 0
+	for i := range s {
+		if s[i] == other[i] {
+			matches++
+		}
+	}
+	return float64(matches) / float64(len(s))
+}
+
+// cwsRand is a SplitMix64 generator of the random variables consistent
+// weighted sampling draws for an element and sample. They depend only on
+// the state it's created with, so every set draws the same ones.
+type cwsRand uint64
+
+// next returns a uniformly distributed number in (0, 1).
+func (r *cwsRand) next() float64 {
+	*r += 0x9e3779b97f4a7c15
+	return (float64(mix64(uint64(*r))>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,93 @@
+package boom
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// weightedJaccard returns the exact weighted Jaccard similarity of the sets.
+func weightedJaccard(a, b map[string]float64) float64 {
+	var intersection, union float64
+	for element, weight := range a {
+		intersection += math.Min(weight, b[element])
+		union += math.Max(weight, b[element])
+	}
+	for element, weight := range b {
+		if _, ok := a[element]; !ok {
+			union += weight
+		}
+	}
+	return intersection / union
+}
+
+// Ensures that WeightedMinHash estimates the weighted Jaccard similarity
+// within tolerance.
+func TestWeightedMinHash(t *testing.T) {
+	w := NewWeightedMinHash(2048, 1)
+	a := map[string]float64{"a": 1, "b": 2, "c": 3}
+	b := map[string]float64{"a": 2, "b": 2, "d": 1}
+
+	if s := w.Signature(a).Similarity(w.Signature(a)); s != 1 {
+		t.Errorf("Expected 1, got %f", s)
+	}
+
+	// The exact similarity is 3/8.
+	if s := w.Signature(a).Similarity(w.Signature(b)); math.Abs(s-0.375) > 0.05 {
+		t.Errorf("Expected about 0.375, got %f", s)
+	}
+
+	// Scaling every weight by 2 halves the similarity with the original.
+	scaled := map[string]float64{}
+	for element, weight := range a {
+		scaled[element] = weight * 2
+	}
+	if s := w.Signature(a).Similarity(w.Signature(scaled)); math.Abs(s-0.5) > 0.05 {
+		t.Errorf("Expected about 0.5, got %f", s)
+	}
+
+	// Documents with overlapping terms of varying frequency.
+	doc1, doc2 := map[string]float64{}, map[string]float64{}
+	for i := 0; i < 300; i++ {
+		doc1[strconv.Itoa(i)] = float64(i%7 + 1)
+	}
+	for i := 100; i < 400; i++ {
+		doc2[strconv.Itoa(i)] = float64(i%5 + 1)
+	}
+	expected := weightedJaccard(doc1, doc2)
+	if s := w.Signature(doc1).Similarity(w.Signature(doc2)); math.Abs(s-expected) > 0.05 {
+		t.Errorf("Expected about %f, got %f", expected, s)
+	}
+
+	disjoint := map[string]float64{"x": 1, "y": 5}
+	if s := w.Signature(a).Similarity(w.Signature(disjoint)); s != 0 {
+		t.Errorf("Expected 0, got %f", s)
+	}
+
+	// Non-positive weights are ignored.
+	if sig := w.Signature(map[string]float64{"a": 0, "b": -1}); sig != nil {
+		t.Errorf("Expected nil signature, got %d samples", len(sig))
+	}
+	if s := w.Signature(a).Similarity(nil); s != 0 {
+		t.Errorf("Expected 0, got %f", s)
+	}
+
+	// Signatures with different parameters aren't comparable.
+	if s := w.Signature(a).Similarity(NewWeightedMinHash(16, 1).Signature(a)); s != 0 {
+		t.Errorf("Expected 0, got %f", s)
+	}
+}
+
+func BenchmarkWeightedMinHashSignature(b *testing.B) {
+	b.StopTimer()
+	w := NewWeightedMinHash(128, 1)
+	doc := map[string]float64{}
+	for i := 0; i < 500; i++ {
+		doc[strconv.Itoa(i)] = float64(i%7 + 1)
+	}
+	b.StartTimer()
+
+	for n := 0; n < b.N; n++ {
+		w.Signature(doc)
+	}
+}